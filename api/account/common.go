@@ -21,6 +21,8 @@ import (
 	"regexp"
 	"runtime"
 
+	"github.com/bwmarrin/discordgo"
+	"github.com/pagefaultgames/rogueserver/config"
 	"golang.org/x/crypto/argon2"
 )
 
@@ -29,9 +31,6 @@ type GenericAuthResponse struct {
 }
 
 const (
-	ArgonTime     = 1
-	ArgonMemory   = 256 * 1024
-	ArgonThreads  = 4
 	ArgonKeySize  = 32
 	ArgonSaltSize = 16
 
@@ -40,18 +39,52 @@ const (
 )
 
 var (
-	ArgonMaxInstances = runtime.NumCPU()
+	argonTime    uint32 = 1
+	argonMemory  uint32 = 256 * 1024
+	argonThreads uint8  = 4
 
 	isValidUsername = regexp.MustCompile(`^\w{1,16}$`).MatchString
-	semaphore       = make(chan bool, ArgonMaxInstances)
+	semaphore       = make(chan bool, runtime.NumCPU())
 
 	GameURL          string
 	OAuthCallbackURL string
 )
 
+// Init applies the OAuth, Discord and password hashing settings.
+func Init(cfg config.API) error {
+	GameURL = cfg.GameURL
+
+	DiscordClientID = cfg.Discord.ClientID
+	DiscordClientSecret = cfg.Discord.ClientSecret
+	DiscordCallbackURL = cfg.CallbackURL + "/auth/discord/callback"
+	DiscordGuildID = cfg.Discord.GuildID
+
+	GoogleClientID = cfg.Google.ClientID
+	GoogleClientSecret = cfg.Google.ClientSecret
+	GoogleCallbackURL = cfg.CallbackURL + "/auth/google/callback"
+
+	var err error
+	DiscordSession, err = discordgo.New("Bot " + cfg.Discord.BotToken)
+	if err != nil {
+		return err
+	}
+
+	argonTime = uint32(cfg.Argon2.Time)
+	argonMemory = uint32(cfg.Argon2.Memory)
+	argonThreads = uint8(cfg.Argon2.Threads)
+
+	instances := cfg.Argon2.MaxInstances
+	if instances == 0 {
+		instances = runtime.NumCPU()
+	}
+	semaphore = make(chan bool, instances)
+
+	return nil
+}
+
 func deriveArgon2IDKey(password, salt []byte) []byte {
 	semaphore <- true
 	defer func() { <-semaphore }()
 
-	return argon2.IDKey(password, salt, ArgonTime, ArgonMemory, ArgonThreads, ArgonKeySize)
+	return argon2.IDKey(password, salt, argonTime, argonMemory, argonThreads, ArgonKeySize)
 }
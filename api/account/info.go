@@ -18,6 +18,7 @@
 package account
 
 import (
+	"context"
 	"github.com/pagefaultgames/rogueserver/db"
 )
 
@@ -30,8 +31,8 @@ type InfoResponse struct {
 }
 
 // /account/info - get account info
-func Info(username string, discordId string, googleId string, uuid []byte, hasAdminRole bool) (InfoResponse, error) {
-	slot, _ := db.GetLatestSessionSaveDataSlot(uuid)
+func Info(ctx context.Context, username string, discordId string, googleId string, uuid []byte, hasAdminRole bool) (InfoResponse, error) {
+	slot, _ := db.GetLatestSessionSaveDataSlot(ctx, uuid)
 	response := InfoResponse{
 		Username:        username,
 		LastSessionSlot: slot,
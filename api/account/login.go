@@ -19,22 +19,21 @@ package account
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"log"
 
-	"github.com/pagefaultgames/rogueserver/cache"
 	"github.com/pagefaultgames/rogueserver/db"
-	"github.com/redis/go-redis/v9"
+	"github.com/pagefaultgames/rogueserver/storage"
 )
 
 type LoginResponse GenericAuthResponse
 
 // /account/login - log into account
-func Login(username, password string) (LoginResponse, error) {
+func Login(ctx context.Context, username, password string) (LoginResponse, error) {
 	var response LoginResponse
 
 	// 아이디 형식 확인
@@ -48,7 +47,7 @@ func Login(username, password string) (LoginResponse, error) {
 	}
 
 	// 비밀번호 인증을 위해 필요한 데이터 해시키, 솔트를 데이터베이스에서 가져오기
-	key, salt, err := db.FetchAccountKeySaltFromUsername(username)
+	key, salt, err := db.FetchAccountKeySaltFromUsername(ctx, username)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return response, fmt.Errorf("account doesn't exist")
@@ -63,7 +62,7 @@ func Login(username, password string) (LoginResponse, error) {
 	}
 
 	// 일치하는 경우 토큰 생성
-	response.Token, err = GenerateTokenForUsername(username)
+	response.Token, err = GenerateTokenForUsername(ctx, username)
 
 	if err != nil {
 		return response, fmt.Errorf("failed to generate token: %s", err)
@@ -73,7 +72,7 @@ func Login(username, password string) (LoginResponse, error) {
 	return response, nil
 }
 
-func GenerateTokenForUsername(username string) (string, error) {
+func GenerateTokenForUsername(ctx context.Context, username string) (string, error) {
 	token := make([]byte, TokenSize)
 	_, err := rand.Read(token)
 	if err != nil {
@@ -81,51 +80,23 @@ func GenerateTokenForUsername(username string) (string, error) {
 	}
 
 	// db에서 uuid 가져오기
-	uuid, err := db.FetchUUIDFromUsername(username)
+	uuid, err := db.FetchUUIDFromUsername(ctx, username)
 	if err != nil {
-		return "", fmt.Errorf("failed to get uuid")
+		return "", fmt.Errorf("failed to get uuid: %w", err)
 	}
 
-	// uuid와토큰으로 Cache 추가
-	// token / uuid
-	err = cache.StoreSessionToken(uuid, token)
+	// 토큰은 sessions 테이블에도 기록해서 캐시 miss 시 DB에서 검증할 수 있도록 함
+	err = storage.AddSessionToken(ctx, username, uuid, token)
 	if err != nil {
-		return "", fmt.Errorf("failed to store token")
+		return "", fmt.Errorf("failed to add account session: %w", err)
 	}
 
-	// 유저가 로그인한 것이기 때문에 Cache에 Userdata가 있는지 확인
-	err = cache.IsValidCacheData(uuid)
-
-	// 데이터가 없는 경우 넘어가기
-	if err != nil {
-		if !errors.Is(err, redis.Nil) {
-			// 데이터가 있으면 return
-			return "", fmt.Errorf("")
-		}
-	}
-
-	// cache에 해당 uuid를 가진 데이터가 없는 경우
-	// db에서 로그인 유저 정보 가져와서 cache에 저장
-	// uuid / userData
-	accountData, err := db.GetAccountFromDB(uuid)
-
+	// 유저가 로그인한 것이기 때문에 Cache에 Userdata가 없으면 DB에서 불러오기
+	// 이미 있는 경우 아직 DB에 반영되지 않은 변경이 있을 수 있으므로 덮어쓰지 않음
+	err = storage.EnsureCached(ctx, uuid)
 	if err != nil {
-		return "", fmt.Errorf("%s", err)
+		return "", fmt.Errorf("failed to load user data: %w", err)
 	}
-	// account 정보 cache로 가져오기
-	cache.CacheAccountInRedis(accountData)
-
-	// db에서 로그인 유저 통계 정보 가져와서 cache에 저장
-	accountStatsData, err := db.GetAccountStatsFromDB(uuid)
-	log.Printf("Login account StatsData : %s", accountStatsData)
-	// accountStats 정보 cache로 가져오기
-	cache.CacheAccountStatsInRedis(uuid, accountStatsData)
-
-	// 유저 아이디와 토큰값으로 세션 정보 저장 -> DB에 굳이 할 필요가 없어짐
-	// err = db.AddAccountSession(username, token)
-	// if err != nil {
-	// 	return "", fmt.Errorf("failed to add account session")
-	// }
 
 	return base64.StdEncoding.EncodeToString(token), nil
 }
@@ -18,24 +18,24 @@
 package account
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 
-	"github.com/pagefaultgames/rogueserver/cache"
+	"github.com/pagefaultgames/rogueserver/storage"
 )
 
 // /account/logout - log out of account
-func Logout(token []byte) error {
-	// err := db.RemoveSessionFromToken(token)
-	err := cache.RemoveSessionFromToken(token)
+func Logout(ctx context.Context, token []byte) error {
+	err := storage.RemoveSessionToken(ctx, token)
 	// TODO. 남아있는 데이터를 로그아웃할 때, 전부 DB에 저장할건지, Cache 정책에 따라 저장할 것인지
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return fmt.Errorf("token not found")
 		}
 
-		return fmt.Errorf("failed to remove account session")
+		return fmt.Errorf("failed to remove account session: %w", err)
 	}
 
 	return nil
@@ -18,15 +18,15 @@
 package account
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
-	"log"
 
 	"github.com/pagefaultgames/rogueserver/db"
 )
 
 // /account/register - register account
-func Register(username, password string) error {
+func Register(ctx context.Context, username, password string) error {
 	if !isValidUsername(username) {
 		return fmt.Errorf("invalid username")
 	}
@@ -35,28 +35,21 @@ func Register(username, password string) error {
 		return fmt.Errorf("invalid password")
 	}
 
-	log.Printf("name and password pass")
-
 	uuid := make([]byte, UUIDSize)
 	_, err := rand.Read(uuid)
 	if err != nil {
 		return fmt.Errorf("failed to generate uuid: %s", err)
 	}
 
-	log.Printf("make uuid")
-
 	salt := make([]byte, ArgonSaltSize)
 	_, err = rand.Read(salt)
 	if err != nil {
 		return fmt.Errorf("failed to generate salt: %s", err)
 	}
 
-	log.Printf("make salt")
-
-	err = db.AddAccountRecord(uuid, username, deriveArgon2IDKey([]byte(password), salt), salt)
+	err = db.AddAccountRecord(ctx, uuid, username, deriveArgon2IDKey([]byte(password), salt), salt)
 	if err != nil {
-		log.Printf("addaccountrecord error")
-		return fmt.Errorf("failed to add account record: %s", err)
+		return fmt.Errorf("failed to add account record: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,421 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/pagefaultgames/rogueserver/api/account"
+	"github.com/pagefaultgames/rogueserver/api/daily"
+	"github.com/pagefaultgames/rogueserver/cache"
+	"github.com/pagefaultgames/rogueserver/config"
+	"github.com/pagefaultgames/rogueserver/db"
+	"github.com/pagefaultgames/rogueserver/defs"
+	"github.com/pagefaultgames/rogueserver/storage"
+)
+
+// testServer serves the api with the memory cache backend under write-back,
+// in front of a stub database that expects the queries a test lists.
+type testServer struct {
+	t    *testing.T
+	mux  *http.ServeMux
+	mock sqlmock.Sqlmock
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	conn, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Use(conn)
+
+	cfg := config.Default()
+	cfg.Cache.Backend = "memory"
+	cfg.API.Argon2.Memory = 64
+
+	err = cache.Init(cfg.Cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = storage.Init(storage.WriteBack)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = account.Init(cfg.API)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	routes(mux)
+
+	t.Cleanup(func() {
+		err := mock.ExpectationsWereMet()
+		if err != nil {
+			t.Error(err)
+		}
+
+		cache.Close()
+		conn.Close()
+	})
+
+	return &testServer{t: t, mux: mux, mock: mock}
+}
+
+// do sends a request to the api. A url.Values body is sent as a form, any
+// other as JSON.
+func (s *testServer) do(method, target, token string, body any) *httptest.ResponseRecorder {
+	s.t.Helper()
+
+	var reader io.Reader
+	contentType := "application/json"
+	switch body := body.(type) {
+	case nil:
+	case url.Values:
+		reader = strings.NewReader(body.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	default:
+		raw, err := json.Marshal(body)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+
+		reader = bytes.NewReader(raw)
+	}
+
+	r := httptest.NewRequest(method, target, reader)
+	r.Header.Set("Content-Type", contentType)
+	if token != "" {
+		r.Header.Set("Authorization", token)
+	}
+
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, r)
+
+	return w
+}
+
+// captured is a query argument that matches anything and keeps it, like the
+// uuid and password hash of a new account.
+type captured struct {
+	value driver.Value
+}
+
+func (c *captured) Match(v driver.Value) bool {
+	c.value = v
+	return true
+}
+
+func (c *captured) bytes() []byte {
+	b, _ := c.value.([]byte)
+	return b
+}
+
+// expectLogin expects a login of username, whose account was registered with
+// uuid, hash and salt and has nothing else in the database yet.
+func (s *testServer) expectLogin(username string, uuid, hash, salt *captured) {
+	s.mock.ExpectQuery(regexp.QuoteMeta("SELECT hash, salt FROM accounts WHERE username = ?")).WithArgs(username).
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "salt"}).AddRow(hash.value, salt.value))
+	s.mock.ExpectQuery(regexp.QuoteMeta("SELECT uuid FROM accounts WHERE username = ?")).WithArgs(username).
+		WillReturnRows(sqlmock.NewRows([]string{"uuid"}).AddRow(uuid.value))
+	s.mock.ExpectExec("INSERT INTO sessions").WillReturnResult(sqlmock.NewResult(1, 1))
+	s.mock.ExpectExec("UPDATE accounts SET lastLoggedIn").WithArgs(username).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// the user document is loaded into the cache
+	s.mock.ExpectQuery("FROM accounts WHERE uuid = ?").WithArgs(uuid.value).
+		WillReturnRows(sqlmock.NewRows([]string{"uuid", "username", "hash", "salt", "registered", "lastLoggedIn", "lastActivity", "banned", "trainerId", "secretId", "discordId", "googleId"}).
+			AddRow(uuid.value, username, hash.value, salt.value, time.Now(), nil, nil, false, 0, 0, nil, nil))
+	s.mock.ExpectQuery("FROM accountStats WHERE uuid = ?").WillReturnError(sql.ErrNoRows)
+	s.mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM systemSaveData WHERE uuid = ?")).WillReturnError(sql.ErrNoRows)
+	s.mock.ExpectQuery(regexp.QuoteMeta("SELECT clientSessionId FROM activeClientSessions WHERE uuid = ?")).WillReturnError(sql.ErrNoRows)
+	for range defs.SessionSlotCount {
+		s.mock.ExpectQuery(regexp.QuoteMeta("SELECT data FROM sessionSaveData WHERE uuid = ? AND slot = ?")).WillReturnError(sql.ErrNoRows)
+	}
+}
+
+// register registers and logs in username and returns the session token.
+func (s *testServer) register(username string) string {
+	s.t.Helper()
+
+	uuid, hash, salt := &captured{}, &captured{}, &captured{}
+	s.mock.ExpectExec("INSERT INTO accounts").WithArgs(uuid, username, hash, salt).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	form := url.Values{"username": {username}, "password": {"hunter22"}}
+
+	w := s.do(http.MethodPost, "/account/register", "", form)
+	if w.Code != http.StatusOK {
+		s.t.Fatalf("register: %d %s", w.Code, w.Body)
+	}
+
+	s.expectLogin(username, uuid, hash, salt)
+
+	w = s.do(http.MethodPost, "/account/login", "", form)
+	if w.Code != http.StatusOK {
+		s.t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+
+	var login account.LoginResponse
+	err := json.NewDecoder(w.Body).Decode(&login)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	return login.Token
+}
+
+// expectNoRows expects a query the database has nothing for.
+func (s *testServer) expectNoRows(query string) {
+	s.mock.ExpectQuery(regexp.QuoteMeta(query)).WillReturnError(sql.ErrNoRows)
+}
+
+func system(revision int, playTime float64) map[string]any {
+	return map[string]any{"trainerId": 1, "secretId": 2, "gameStats": map[string]any{"playTime": playTime}, "revision": revision}
+}
+
+func session(revision, wave int) map[string]any {
+	return map[string]any{"seed": "seed", "playTime": 10, "waveIndex": wave, "revision": revision}
+}
+
+func updateAll(sessionRevision, wave, systemRevision int, playTime float64) map[string]any {
+	return map[string]any{"system": system(systemRevision, playTime), "session": session(sessionRevision, wave), "sessionSlotId": 0, "clientSessionId": "a"}
+}
+
+// step is a request to the api, the queries it is expected to make, and the
+// status and part of the body it should get.
+type step struct {
+	name   string
+	method string
+	target string
+	body   any
+	expect func(s *testServer)
+	code   int
+	want   string
+}
+
+func (s *testServer) run(token string, steps []step) {
+	s.t.Helper()
+
+	for _, step := range steps {
+		if step.expect != nil {
+			step.expect(s)
+		}
+
+		w := s.do(step.method, step.target, token, step.body)
+		if w.Code != step.code || !strings.Contains(w.Body.String(), step.want) {
+			s.t.Fatalf("%s: got %d %s, want %d with %s", step.name, w.Code, w.Body, step.code, step.want)
+		}
+	}
+}
+
+// firstSave makes the first system and session saves of a new account in
+// client session a.
+var firstSave = []step{
+	{
+		name: "system update", method: http.MethodPost, target: "/savedata/system/update?clientSessionId=a", body: system(0, 10),
+		expect: func(s *testServer) {
+			// the first request of a client session makes it the active one
+			s.expectNoRows("SELECT clientSessionId FROM activeClientSessions WHERE uuid = ?")
+			s.expectNoRows("SELECT playTime FROM accountStats WHERE uuid = ?")
+			s.expectNoRows("SELECT data FROM systemSaveData WHERE uuid = ?")
+		},
+		code: http.StatusOK, want: `{"revision":1}`,
+	},
+	{
+		name: "session update", method: http.MethodPost, target: "/savedata/session/update?slot=0&clientSessionId=a", body: session(0, 5),
+		expect: func(s *testServer) {
+			s.expectNoRows("SELECT data FROM sessionSaveData WHERE uuid = ? AND slot = ?")
+		},
+		code: http.StatusOK, want: `{"revision":1}`,
+	},
+}
+
+func TestSaveData(t *testing.T) {
+	s := newTestServer(t)
+
+	token := s.register("player")
+
+	s.run(token, firstSave)
+	s.run(token, []step{
+		{name: "system get", method: http.MethodGet, target: "/savedata/system/get?clientSessionId=a", code: http.StatusOK, want: `"revision":1}`},
+		{name: "session get", method: http.MethodGet, target: "/savedata/session/get?slot=0&clientSessionId=a", code: http.StatusOK, want: `"waveIndex":5`},
+		{name: "updateall", method: http.MethodPost, target: "/savedata/updateall", body: updateAll(1, 6, 1, 20), code: http.StatusOK, want: `{"sessionRevision":2,"systemRevision":2}`},
+		{name: "system get after updateall", method: http.MethodGet, target: "/savedata/system/get?clientSessionId=a", code: http.StatusOK, want: `"gameStats":{"playTime":20}`},
+		{name: "session get after updateall", method: http.MethodGet, target: "/savedata/session/get?slot=0&clientSessionId=a", code: http.StatusOK, want: `"waveIndex":6`},
+		{
+			name: "clear", method: http.MethodPost, target: "/savedata/session/clear?slot=0&clientSessionId=a", body: session(2, 7),
+			expect: func(s *testServer) {
+				s.mock.ExpectQuery(regexp.QuoteMeta("SELECT seed FROM dailyRuns WHERE date = UTC_DATE()")).
+					WillReturnRows(sqlmock.NewRows([]string{"seed"}).AddRow("daily"))
+				s.mock.ExpectExec("INSERT IGNORE INTO sessionHistory").WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+			code: http.StatusOK, want: `{"success":false,"error":""}`,
+		},
+		{
+			name: "session get after clear", method: http.MethodGet, target: "/savedata/session/get?slot=0&clientSessionId=a",
+			expect: func(s *testServer) {
+				s.expectNoRows("SELECT data FROM sessionSaveData WHERE uuid = ? AND slot = ?")
+			},
+			code: http.StatusNotFound,
+		},
+	})
+}
+
+func TestSaveConflicts(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		body   any
+		want   string
+	}{
+		{"system update against an old revision", "/savedata/system/update?clientSessionId=a", system(0, 20), `"part":"system","revision":1}`},
+		{"session update against an old revision", "/savedata/session/update?slot=0&clientSessionId=a", session(0, 6), `"part":"session","revision":1}`},
+		{"updateall against an old session", "/savedata/updateall", updateAll(0, 6, 1, 20), `"part":"session","revision":1}`},
+		{"updateall against an old system", "/savedata/updateall", updateAll(1, 6, 0, 20), `"part":"system","revision":1}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+
+			token := s.register("player")
+
+			s.run(token, firstSave)
+			s.run(token, []step{
+				{name: "conflicting update", method: http.MethodPost, target: tt.target, body: tt.body, code: http.StatusConflict, want: tt.want},
+				// nothing was stored
+				{name: "system get", method: http.MethodGet, target: "/savedata/system/get?clientSessionId=a", code: http.StatusOK, want: `"gameStats":{"playTime":10}`},
+				{name: "session get", method: http.MethodGet, target: "/savedata/session/get?slot=0&clientSessionId=a", code: http.StatusOK, want: `"waveIndex":5`},
+			})
+		})
+	}
+}
+
+func TestDailyRankings(t *testing.T) {
+	s := newTestServer(t)
+
+	// build the boards of today from the database
+	reached := time.Now().UTC().Truncate(time.Second)
+	entries := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"username", "score", "wave", "timestamp"}).
+			AddRow("second", 100, 10, reached).
+			AddRow("first", 200, 20, reached).
+			AddRow("third", 100, 10, reached.Add(time.Second))
+	}
+	for _, c := range daily.Categories() {
+		table := "FROM accountDailyRuns"
+		if c.Period == "" && c.Id != daily.CategoryAllTime {
+			table = "FROM accountStats"
+		}
+
+		s.mock.ExpectQuery(table).WillReturnRows(entries())
+	}
+
+	err := daily.RebuildLeaderboards(context.Background(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.run("", []step{
+		{name: "today", method: http.MethodGet, target: "/daily/rankings", code: http.StatusOK, want: `[{"rank":1,"username":"first","score":200,"wave":20},{"rank":2,"username":"second","score":100,"wave":10},{"rank":3,"username":"third","score":100,"wave":10}]`},
+		{name: "second page", method: http.MethodGet, target: "/daily/rankings?page=2", code: http.StatusOK, want: `[]`},
+		{name: "this month", method: http.MethodGet, target: "/daily/rankings?category=2", code: http.StatusOK, want: `{"rank":1,"username":"first"`},
+		{name: "battles", method: http.MethodGet, target: "/daily/rankings?category=7", code: http.StatusOK, want: `{"rank":3,"username":"third"`},
+		{
+			name: "a day no longer cached", method: http.MethodGet, target: "/daily/rankings?date=2024-06-01",
+			expect: func(s *testServer) {
+				s.mock.ExpectQuery("WITH ranked AS").WithArgs("2024-06-01", 0).
+					WillReturnRows(sqlmock.NewRows([]string{"n", "username", "score", "wave"}).AddRow(1, "past", 50, 5))
+			},
+			code: http.StatusOK, want: `[{"rank":1,"username":"past","score":50,"wave":5}]`,
+		},
+		{name: "unknown category", method: http.MethodGet, target: "/daily/rankings?category=99", code: http.StatusBadRequest},
+		{name: "page out of range", method: http.MethodGet, target: "/daily/rankings?page=0", code: http.StatusBadRequest},
+		{name: "future date", method: http.MethodGet, target: "/daily/rankings?date=2999-01-01", code: http.StatusBadRequest},
+	})
+}
+
+func TestUpdateAllValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(update map[string]any)
+		code   int
+	}{
+		{"valid", func(update map[string]any) {}, http.StatusOK},
+		{"a new run may start lower", func(update map[string]any) {
+			update["session"].(map[string]any)["seed"] = "other"
+			update["session"].(map[string]any)["waveIndex"] = 1
+		}, http.StatusOK},
+		{"missing client session", func(update map[string]any) { delete(update, "clientSessionId") }, http.StatusBadRequest},
+		{"slot out of range", func(update map[string]any) { update["sessionSlotId"] = 5 }, http.StatusBadRequest},
+		{"no trainer", func(update map[string]any) {
+			update["system"].(map[string]any)["trainerId"] = 0
+			update["system"].(map[string]any)["secretId"] = 0
+		}, http.StatusBadRequest},
+		{"no playtime", func(update map[string]any) { update["system"].(map[string]any)["gameStats"] = map[string]any{} }, http.StatusBadRequest},
+		{"another client session", func(update map[string]any) { update["clientSessionId"] = "b" }, http.StatusConflict},
+		{"another trainer", func(update map[string]any) { update["system"].(map[string]any)["secretId"] = 3 }, http.StatusConflict},
+		{"less playtime", func(update map[string]any) {
+			update["system"].(map[string]any)["gameStats"] = map[string]any{"playTime": 10}
+		}, http.StatusConflict},
+		{"an earlier wave of the same run", func(update map[string]any) { update["session"].(map[string]any)["waveIndex"] = 5 }, http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t)
+
+			token := s.register("player")
+
+			update := updateAll(2, 7, 2, 30)
+			tt.change(update)
+
+			// rejected updates store neither save
+			system, session := `"gameStats":{"playTime":20}`, `"waveIndex":6`
+			if tt.code == http.StatusOK {
+				system, session = `"gameStats":{"playTime":30}`, `"revision":3}`
+			}
+
+			s.run(token, firstSave)
+			s.run(token, []step{
+				// stores the trainer the next updates are checked against
+				{name: "first updateall", method: http.MethodPost, target: "/savedata/updateall", body: updateAll(1, 6, 1, 20), code: http.StatusOK},
+				{name: "updateall", method: http.MethodPost, target: "/savedata/updateall", body: update, code: tt.code},
+				{name: "system get", method: http.MethodGet, target: "/savedata/system/get?clientSessionId=a", code: http.StatusOK, want: system},
+				{name: "session get", method: http.MethodGet, target: "/savedata/session/get?slot=0&clientSessionId=a", code: http.StatusOK, want: session},
+			})
+		})
+	}
+}
@@ -18,28 +18,36 @@
 package api
 
 import (
+	"context"
+	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"time"
 
 	"github.com/pagefaultgames/rogueserver/api/account"
 	"github.com/pagefaultgames/rogueserver/api/daily"
+	"github.com/pagefaultgames/rogueserver/api/savedata"
 	"github.com/pagefaultgames/rogueserver/cache"
-	"github.com/redis/go-redis/v9"
-	//"github.com/pagefaultgames/rogueserver/db"
+	"github.com/pagefaultgames/rogueserver/config"
+	"github.com/pagefaultgames/rogueserver/logging"
+	"github.com/pagefaultgames/rogueserver/storage"
 )
 
-const (
-	sessionUUIDKeyFmt = "session:uuid:%s"
-	sessionTTL        = 7 * 24 * time.Hour
-)
+// errServiceUnavailable marks cache or database failures that are not the client's fault.
+var errServiceUnavailable = errors.New("service unavailable")
 
-func Init(mux *http.ServeMux) error {
-	err := scheduleStatRefresh()
+func Init(mux *http.ServeMux, cfg config.API) error {
+	err := account.Init(cfg)
+	if err != nil {
+		return err
+	}
+
+	savedata.DailyBanScore = cfg.DailyBanScore
+
+	err = scheduleStatRefresh()
 	if err != nil {
 		return err
 	}
@@ -49,6 +57,17 @@ func Init(mux *http.ServeMux) error {
 		return err
 	}
 
+	routes(mux)
+
+	return nil
+}
+
+// routes registers the handlers of the api on mux.
+func routes(mux *http.ServeMux) {
+	// health
+	mux.HandleFunc("GET /healthz", handleHealthz)
+	mux.HandleFunc("GET /readyz", handleReadyz)
+
 	// account
 	mux.HandleFunc("GET /account/info", handleAccountInfo)          //user info -> login 때문에 필요.
 	mux.HandleFunc("POST /account/register", handleAccountRegister) //register 제외. 실험 환경과 연관 없음.
@@ -67,10 +86,24 @@ func Init(mux *http.ServeMux) error {
 	// new session
 	mux.HandleFunc("POST /savedata/updateall", handleUpdateAll) //game loop 때문에 필요.
 
+	// run history
+	mux.HandleFunc("GET /savedata/runs", handleRuns)
+	mux.HandleFunc("GET /savedata/runs/pagecount", handleRunPageCount)
+	mux.HandleFunc("GET /savedata/runs/{id}", handleRun)
+
 	// daily
 	mux.HandleFunc("GET /daily/seed", handleDailySeed)                         //Jmeter 실험에서 game loop에 없음. 제외.
 	mux.HandleFunc("GET /daily/rankings", handleDailyRankings)                 //daily run은 Jmeter 실험에서 제외.
 	mux.HandleFunc("GET /daily/rankingpagecount", handleDailyRankingPageCount) //daily run은 Jmeter 실험에서 제외.
+	mux.HandleFunc("GET /daily/rankings/me", handleDailyPersonalRanking)
+	mux.HandleFunc("GET /daily/rankings/categories", handleDailyRankingCategories)
+	mux.HandleFunc("GET /daily/history", handleDailyHistory)
+	mux.HandleFunc("GET /daily/export", handleDailyExport)
+
+	// speedruns
+	mux.HandleFunc("GET /speedruns", handleSpeedruns)
+	mux.HandleFunc("GET /speedruns/pagecount", handleSpeedrunPageCount)
+	mux.HandleFunc("GET /speedruns/me", handlePersonalBests)
 
 	// auth
 	mux.HandleFunc("/auth/{provider}/callback", handleProviderCallback)
@@ -82,8 +115,24 @@ func Init(mux *http.ServeMux) error {
 	mux.HandleFunc("POST /admin/account/googleLink", handleAdminGoogleLink)
 	mux.HandleFunc("POST /admin/account/googleUnlink", handleAdminGoogleUnlink)
 	mux.HandleFunc("GET /admin/account/adminSearch", handleAdminSearch)
+	mux.HandleFunc("POST /admin/account/ban", handleAdminBan)
+	mux.HandleFunc("GET /admin/cache/consistency", handleAdminCacheConsistency)
+	mux.HandleFunc("POST /admin/cache/consistency", handleAdminCacheConsistency)
+	mux.HandleFunc("GET /admin/cache/warmup", handleAdminCacheWarmup)
+	mux.HandleFunc("POST /admin/cache/warmup", handleAdminCacheWarmup)
+	mux.HandleFunc("GET /admin/savedata/history", handleAdminSaveHistory)
+	mux.HandleFunc("GET /admin/savedata/history/diff", handleAdminSaveHistoryDiff)
+	mux.HandleFunc("POST /admin/savedata/history/restore", handleAdminSaveHistoryRestore)
+}
 
-	return nil
+// Shutdown stops the background schedulers and waits for running jobs until ctx is done.
+func Shutdown(ctx context.Context) {
+	select {
+	case <-scheduler.Stop().Done():
+	case <-ctx.Done():
+	}
+
+	daily.Shutdown(ctx)
 }
 
 func tokenFromRequest(r *http.Request) ([]byte, error) {
@@ -112,75 +161,59 @@ func uuidFromRequest(r *http.Request) ([]byte, error) {
 	return uuid, nil
 }
 
+// tokenAndUuidFromRequest resolves the session token to a uuid through the
+// caching strategy and makes sure the user document is cached before the
+// handler touches it.
 func tokenAndUuidFromRequest(r *http.Request) ([]byte, []byte, error) {
-	// 토큰은 cache에서만 확인하기
-
-	// 1) Header에서 토큰 추출
 	token, err := tokenFromRequest(r)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// 2) Redis 캐시 조회 (token→uuid)
-	log.Printf("token : %s\n", base64.StdEncoding.EncodeToString(token))
-	uuid, err := cache.FetchSessionToken(token)
+	uuid, err := storage.FetchUUIDFromToken(r.Context(), token)
 	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			return nil, nil, fmt.Errorf("redis GET error: %w", err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, fmt.Errorf("invalid token")
 		}
+
+		return nil, nil, fmt.Errorf("%w: failed to validate token: %w", errServiceUnavailable, err)
 	}
 
-	// // 3) cache miss → DB 조회
-	// uuid, err := db.FetchUUIDFromToken(token)
-	// if err != nil {
-	//     return nil, nil, fmt.Errorf("failed to validate token: %w", err)
-	// }
-	// // 4) 캐시에 SET
-	// cache.Rdb.Set(cache.Ctx, cacheKey, string(uuid), sessionTTL)
+	logging.SetUUID(r.Context(), uuid)
+
+	err = storage.EnsureCached(r.Context(), uuid)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: failed to load user data: %w", errServiceUnavailable, err)
+	}
 
 	return token, uuid, nil
 }
 
-/*
-func tokenAndUuidFromRequest(r *http.Request) ([]byte, []byte, error) {
-    token, err := tokenFromRequest(r)
-    if err != nil {
-        return nil, nil, err
-    }
-    // 1) 캐시로 UUID 조회
-    tokStr := base64.StdEncoding.EncodeToString(token)
-    if u, err := cache.Rdb.Get(cache.Ctx, fmt.Sprintf(sessionUUIDKeyFmt, tokStr)).Result(); err == nil {
-        return token, []byte(u), nil
-    } else if err != redis.Nil {
-        return nil, nil, fmt.Errorf("redis GET uuid error: %w", err)
-    }
-    // 2) 캐시 miss → DB 조회
-    uuid, err := db.FetchUUIDFromToken(token)
-    if err != nil {
-        return nil, nil, fmt.Errorf("failed to validate token: %s", err)
-    }
-    // 3) 캐시에 token→uuid 매핑 저장 (optional, TTL=1주일)
-    cache.Rdb.Set(cache.Ctx, fmt.Sprintf(sessionUUIDKeyFmt, tokStr), string(uuid), sessionTTL)
-    return token, uuid, nil
-}
-*/
+// statusClientClosedRequest is logged for requests the client gave up on, as
+// nginx does. Nobody reads the response.
+const statusClientClosedRequest = 499
 
-/*func tokenAndUuidFromRequest(r *http.Request) ([]byte, []byte, error) {
-	token, err := tokenFromRequest(r)
-	if err != nil {
-		return nil, nil, err
+// httpError logs err and answers with it. Requests that ran out of time get
+// 504 and cache or database outages 503, whatever code the handler chose.
+func httpError(w http.ResponseWriter, r *http.Request, err error, code int) {
+	switch {
+	case errors.Is(r.Context().Err(), context.Canceled):
+		code = statusClientClosedRequest
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(r.Context().Err(), context.DeadlineExceeded):
+		code = http.StatusGatewayTimeout
+		err = fmt.Errorf("request timed out: %s", err)
+	case errors.Is(err, errServiceUnavailable) || errors.Is(err, cache.ErrUnavailable):
+		code = http.StatusServiceUnavailable
 	}
 
-	uuid, err := db.FetchUUIDFromToken(token)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to validate token: %s", err)
+	level := slog.LevelWarn
+	if code == statusClientClosedRequest {
+		level = slog.LevelInfo
+	} else if code >= http.StatusInternalServerError {
+		level = slog.LevelError
 	}
 
-	return token, uuid, nil
-}*/
-
-func httpError(w http.ResponseWriter, r *http.Request, err error, code int) {
-	log.Printf("%s: %s\n", r.URL.Path, err)
+	slog.Log(r.Context(), level, "request failed", "path", r.URL.Path, "status", code, "error", err)
 	http.Error(w, err.Error(), code)
 }
 
@@ -0,0 +1,132 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package daily
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/defs"
+)
+
+// ranking categories, the ids /daily/rankings takes
+const (
+	CategoryDaily = iota
+	CategoryWeekly
+	CategoryMonthly
+	CategoryAllTime
+	CategoryEndlessWave
+	CategorySessionsWon
+	CategoryPokemonHatched
+	CategoryBattles
+)
+
+// ErrUnknownCategory is returned for a ranking category that doesn't exist.
+var ErrUnknownCategory = errors.New("unknown ranking category")
+
+var categories = []defs.RankingCategory{
+	{Id: CategoryDaily, Name: "daily", Description: "Score of the daily run", Period: defs.RankingPeriodDay},
+	{Id: CategoryWeekly, Name: "weekly", Description: "Total score of the daily runs of the week", Period: defs.RankingPeriodWeek},
+	{Id: CategoryMonthly, Name: "monthly", Description: "Total score of the daily runs of the month", Period: defs.RankingPeriodMonth},
+	{Id: CategoryAllTime, Name: "allTime", Description: "Total score of every daily run"},
+	{Id: CategoryEndlessWave, Name: "highestEndlessWave", Description: "Highest wave reached in endless mode"},
+	{Id: CategorySessionsWon, Name: "sessionsWon", Description: "Runs won"},
+	{Id: CategoryPokemonHatched, Name: "pokemonHatched", Description: "Pokémon hatched"},
+	{Id: CategoryBattles, Name: "battles", Description: "Battles fought"},
+}
+
+// /daily/rankings/categories - list the ranking categories
+func Categories() []defs.RankingCategory {
+	return categories
+}
+
+func categoryOf(id int) (defs.RankingCategory, error) {
+	if id < 0 || id >= len(categories) {
+		return defs.RankingCategory{}, fmt.Errorf("%w: %d", ErrUnknownCategory, id)
+	}
+
+	return categories[id], nil
+}
+
+// rankingStart returns the start of the period of category that date is in.
+// Weeks start on Sunday. Categories not tied to a date get the zero time.
+func rankingStart(category int, date time.Time) (time.Time, error) {
+	c, err := categoryOf(category)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	day := date.UTC().Truncate(24 * time.Hour)
+
+	switch c.Period {
+	case defs.RankingPeriodDay:
+		return day, nil
+	case defs.RankingPeriodWeek:
+		return day.AddDate(0, 0, -int(day.Weekday())), nil
+	case defs.RankingPeriodMonth:
+		return day.AddDate(0, 0, 1-day.Day()), nil
+	}
+
+	return time.Time{}, nil
+}
+
+// RankingDate returns the day asked for by the date or week parameter of a
+// ranking request, or today if neither is set. date picks the day, week or
+// month of the category containing that day, and week is the same for the
+// weekly category only. Categories not tied to a date take neither.
+func RankingDate(category int, date, week string) (time.Time, error) {
+	c, err := categoryOf(category)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	value := date
+	if week != "" {
+		if date != "" {
+			return time.Time{}, fmt.Errorf("date and week can't both be set")
+		}
+
+		if category != CategoryWeekly {
+			return time.Time{}, fmt.Errorf("week is only valid for the weekly ranking")
+		}
+
+		value = week
+	}
+
+	if value == "" {
+		return today, nil
+	}
+
+	if c.Period == "" {
+		return time.Time{}, fmt.Errorf("the %s ranking isn't tied to a date", c.Name)
+	}
+
+	day, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", value)
+	}
+
+	if day.After(today) {
+		return time.Time{}, fmt.Errorf("date %s is in the future", value)
+	}
+
+	return day, nil
+}
@@ -18,12 +18,13 @@
 package daily
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/binary"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"time"
 
@@ -61,32 +62,45 @@ func Init() error {
 		secret = newSecret
 	}
 
-	seed, err := db.TryAddDailyRun(Seed())
+	seed, err := db.TryAddDailyRun(context.Background(), Seed())
 	if err != nil {
-		log.Print(err)
+		slog.Error("failed to record daily run", "error", err)
 	}
 
-	log.Printf("Daily Run Seed: %s", seed)
+	slog.Info("daily run seed", "seed", seed)
 
 	_, err = scheduler.AddFunc("@daily", func() {
 		time.Sleep(time.Second)
 
-		seed, err = db.TryAddDailyRun(Seed())
+		seed, err = db.TryAddDailyRun(context.Background(), Seed())
 		if err != nil {
-			log.Printf("error while recording new daily: %s", err)
+			slog.Error("failed to record new daily run", "error", err)
 		} else {
-			log.Printf("Daily Run Seed: %s", seed)
+			slog.Info("daily run seed", "seed", seed)
 		}
 	})
 	if err != nil {
 		return err
 	}
 
+	_, err = scheduler.AddFunc("@every "+refreshInterval.String(), refreshLeaderboards)
+	if err != nil {
+		return err
+	}
+
 	scheduler.Start()
 
 	return nil
 }
 
+// Shutdown stops the daily seed and leaderboard scheduler and waits for a running job until ctx is done.
+func Shutdown(ctx context.Context) {
+	select {
+	case <-scheduler.Stop().Done():
+	case <-ctx.Done():
+	}
+}
+
 func Seed() string {
 	return base64.StdEncoding.EncodeToString(deriveSeed(time.Now().UTC()))
 }
@@ -0,0 +1,108 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package daily
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/db"
+	"github.com/pagefaultgames/rogueserver/defs"
+)
+
+// export formats of the full ranking of a day
+const (
+	ExportNDJSON = "ndjson"
+	ExportCSV    = "csv"
+)
+
+// ErrUnknownFormat is returned for an export format that doesn't exist.
+var ErrUnknownFormat = errors.New("unknown export format")
+
+// exportedRanking is one line of an export.
+type exportedRanking struct {
+	Rank      int       `json:"rank"`
+	Username  string    `json:"username"`
+	Score     int       `json:"score"`
+	Wave      int       `json:"wave"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ExportContentType returns the Content-Type of an export in format.
+func ExportContentType(format string) (string, error) {
+	switch format {
+	case ExportNDJSON:
+		return "application/x-ndjson", nil
+	case ExportCSV:
+		return "text/csv", nil
+	}
+
+	return "", fmt.Errorf("%w: %q", ErrUnknownFormat, format)
+}
+
+// /daily/export - write the full ranking of the daily run on date to w, one
+// run per line, straight from the database.
+func Export(ctx context.Context, date time.Time, format string, w io.Writer) error {
+	_, err := ExportContentType(format)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+
+	var write func(exportedRanking) error
+	switch format {
+	case ExportNDJSON:
+		enc := json.NewEncoder(bw)
+		write = func(run exportedRanking) error {
+			return enc.Encode(run)
+		}
+	case ExportCSV:
+		cw := csv.NewWriter(bw)
+		err = cw.Write([]string{"rank", "username", "score", "wave", "timestamp"})
+		if err != nil {
+			return err
+		}
+
+		write = func(run exportedRanking) error {
+			err := cw.Write([]string{strconv.Itoa(run.Rank), run.Username, strconv.Itoa(run.Score), strconv.Itoa(run.Wave), run.Timestamp.UTC().Format(time.RFC3339)})
+			if err != nil {
+				return err
+			}
+
+			cw.Flush()
+			return cw.Error()
+		}
+	}
+
+	err = db.StreamDailyRanking(ctx, date, func(ranking defs.DailyRanking, timestamp time.Time) error {
+		return write(exportedRanking{ranking.Rank, ranking.Username, ranking.Score, ranking.Wave, timestamp})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to export ranking of %s: %w", date.Format(time.DateOnly), err)
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,395 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package daily
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/cache"
+	"github.com/pagefaultgames/rogueserver/db"
+	"github.com/pagefaultgames/rogueserver/defs"
+)
+
+// Rankings are served from leaderboards in the cache, one per category and
+// period, like one per day of daily runs, which are built from the database
+// on first use. Boards of daily runs are kept up to date as daily runs are
+// recorded, and every board as accounts are banned or unbanned. The boards
+// of accountStats columns, which change with every save, are rebuilt every
+// refreshInterval instead, and so is the all time board to make up for
+// updates it missed. Without the cache, while it is unavailable and while a
+// board is being built, rankings are read from the database instead.
+const rankingsPerPage = 10
+
+var (
+	// how long a board is kept after its day, week or month is over
+	leaderboardRetention = 7 * 24 * time.Hour
+
+	// how often boards not tied to a date are rebuilt. They expire after
+	// refreshRetention, should their rebuilds keep failing.
+	refreshInterval  = 15 * time.Minute
+	refreshRetention = 3 * refreshInterval
+
+	// a board that failed to build or to take an update is rebuilt, retrying
+	// every rebuildInterval up to rebuildAttempts times
+	rebuildInterval = 10 * time.Second
+	rebuildAttempts = 60
+
+	rebuilding sync.Map // board name -> struct{}
+)
+
+// leaderboard is a board: the rankings of a category from start until before
+// end. Categories not tied to a date have a single board, with both zero.
+type leaderboard struct {
+	name       string
+	category   int
+	start, end time.Time
+}
+
+// leaderboardFor returns the board of category that date is in. Boards are
+// named after their category, followed by the day their period starts on.
+// ok is false for unknown categories.
+func leaderboardFor(category int, date time.Time) (b leaderboard, ok bool) {
+	c, err := categoryOf(category)
+	if err != nil {
+		return leaderboard{}, false
+	}
+
+	start, err := rankingStart(category, date)
+	if err != nil {
+		return leaderboard{}, false
+	}
+
+	b = leaderboard{name: c.Name, category: category, start: start}
+
+	switch c.Period {
+	case defs.RankingPeriodDay:
+		b.end = start.AddDate(0, 0, 1)
+	case defs.RankingPeriodWeek:
+		b.end = start.AddDate(0, 0, 7)
+	case defs.RankingPeriodMonth:
+		b.end = start.AddDate(0, 1, 0)
+	default:
+		return b, true
+	}
+
+	b.name += ":" + start.Format(time.DateOnly)
+
+	return b, true
+}
+
+// dated reports whether b is the board of a day, week or month.
+func (b leaderboard) dated() bool {
+	return !b.end.IsZero()
+}
+
+// cached reports whether b is still kept in the cache. Older boards are read
+// from the database only, so asking for them doesn't rebuild them over and over.
+func (b leaderboard) cached() bool {
+	return !b.dated() || time.Now().Before(b.end.Add(leaderboardRetention))
+}
+
+// expires returns when a build of b, started now, expires.
+func (b leaderboard) expires() time.Time {
+	if !b.dated() {
+		return time.Now().Add(refreshRetention)
+	}
+
+	return b.end.Add(leaderboardRetention)
+}
+
+// parseLeaderboard is the inverse of leaderboard.name.
+func parseLeaderboard(name string) (leaderboard, bool) {
+	kind, day, hasDay := strings.Cut(name, ":")
+
+	for _, c := range categories {
+		if c.Name != kind || (c.Period != "") != hasDay {
+			continue
+		}
+
+		var date time.Time
+		if hasDay {
+			var err error
+			date, err = time.Parse(time.DateOnly, day)
+			if err != nil {
+				return leaderboard{}, false
+			}
+		}
+
+		b, ok := leaderboardFor(c.Id, date)
+		return b, ok && b.name == name
+	}
+
+	return leaderboard{}, false
+}
+
+func (b leaderboard) entries(ctx context.Context) ([]defs.LeaderboardEntry, error) {
+	return db.FetchLeaderboard(ctx, b.category, b.start)
+}
+
+func (b leaderboard) entry(ctx context.Context, uuid []byte) (defs.LeaderboardEntry, error) {
+	return db.FetchLeaderboardEntry(ctx, b.category, b.start, uuid)
+}
+
+// build replaces the board with one built from the database. Runs recorded
+// while it is read make it into the board through the build.
+func (b leaderboard) build(ctx context.Context) error {
+	build, err := cache.BeginLeaderboardBuild(ctx, b.name)
+	if err != nil {
+		return err
+	}
+
+	entries, err := b.entries(ctx)
+	if err != nil {
+		abortErr := cache.AbortLeaderboardBuild(ctx, b.name, build)
+		if abortErr != nil {
+			slog.WarnContext(ctx, "failed to abort leaderboard build", "board", b.name, "error", abortErr)
+		}
+
+		return err
+	}
+
+	err = cache.FinishLeaderboardBuild(ctx, b.name, build, entries, b.expires())
+	if err != nil {
+		return err
+	}
+
+	slog.Info("built leaderboard", "board", b.name, "entries", len(entries))
+
+	return nil
+}
+
+// update sets the entry of uuid on the board to what the database has.
+func (b leaderboard) update(ctx context.Context, uuid []byte) error {
+	entry, err := b.entry(ctx, uuid)
+	if errors.Is(err, sql.ErrNoRows) {
+		// no runs, or banned
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	_, err = cache.SetLeaderboardEntry(ctx, b.name, entry)
+
+	return err
+}
+
+// rebuild builds the board in the background, retrying until it succeeds. A
+// board already being rebuilt is left alone.
+func (b leaderboard) rebuild() {
+	if _, running := rebuilding.LoadOrStore(b.name, struct{}{}); running {
+		return
+	}
+
+	go func() {
+		defer rebuilding.Delete(b.name)
+
+		for attempt := 1; ; attempt++ {
+			var err error
+			if cache.Available() {
+				err = b.build(context.Background())
+				if err == nil {
+					return
+				}
+			} else {
+				err = cache.ErrUnavailable
+			}
+
+			if attempt == rebuildAttempts {
+				slog.Error("failed to rebuild leaderboard, serving it from the database until it expires or is rebuilt", "board", b.name, "error", err)
+				return
+			}
+
+			time.Sleep(rebuildInterval)
+		}
+	}()
+}
+
+// dailyRunLeaderboards returns the boards a daily run on date counts for.
+func dailyRunLeaderboards(date time.Time) []leaderboard {
+	var boards []leaderboard
+	for _, category := range []int{CategoryDaily, CategoryWeekly, CategoryMonthly, CategoryAllTime} {
+		b, _ := leaderboardFor(category, date)
+		boards = append(boards, b)
+	}
+
+	return boards
+}
+
+// RebuildLeaderboards builds the boards of every category that date is in
+// from the database.
+func RebuildLeaderboards(ctx context.Context, date time.Time) error {
+	for _, c := range categories {
+		b, _ := leaderboardFor(c.Id, date)
+
+		err := b.build(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to build leaderboard %s: %w", b.name, err)
+		}
+	}
+
+	return nil
+}
+
+// refreshLeaderboards rebuilds the boards in the cache that aren't tied to a
+// date, see refreshInterval.
+func refreshLeaderboards() {
+	if !cache.Enabled() || !cache.Available() {
+		return
+	}
+
+	names, err := cache.Leaderboards(context.Background())
+	if err != nil {
+		slog.Warn("failed to list leaderboards", "error", err)
+		return
+	}
+
+	for _, name := range names {
+		b, ok := parseLeaderboard(name)
+		if ok && !b.dated() {
+			b.rebuild()
+		}
+	}
+}
+
+// RecordRun records a daily run result and updates the boards it counts for.
+func RecordRun(ctx context.Context, uuid []byte, score, wave int) error {
+	date, err := db.AddOrUpdateAccountDailyRun(ctx, uuid, score, wave)
+	if err != nil {
+		return err
+	}
+
+	if !cache.Enabled() {
+		return nil
+	}
+
+	for _, b := range dailyRunLeaderboards(date) {
+		err = b.update(context.WithoutCancel(ctx), uuid)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to update leaderboard, rebuilding it", "board", b.name, "error", err)
+			b.rebuild()
+		}
+	}
+
+	return nil
+}
+
+// SetBanned bans or unbans an account. Banned accounts are taken off every
+// board; an unbanned account gets its entries back.
+func SetBanned(ctx context.Context, uuid []byte, banned bool) error {
+	err := db.SetAccountBanned(ctx, uuid, banned)
+	if err != nil {
+		return err
+	}
+
+	if !cache.Enabled() {
+		return nil
+	}
+
+	// the ban is in the database, boards still showing the account are rebuilt
+	ctx = context.WithoutCancel(ctx)
+
+	username, err := db.FetchUsernameFromUUID(ctx, uuid)
+	if err != nil {
+		return err
+	}
+
+	names, err := cache.Leaderboards(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to list leaderboards", "error", err)
+		return nil
+	}
+
+	for _, name := range names {
+		b, ok := parseLeaderboard(name)
+		if !ok {
+			continue
+		}
+
+		if banned {
+			err = cache.RemoveLeaderboardEntry(ctx, b.name, username)
+		} else {
+			err = b.update(ctx, uuid)
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "failed to update leaderboard, rebuilding it", "board", b.name, "error", err)
+			b.rebuild()
+		}
+	}
+
+	return nil
+}
+
+// leaderboardPage returns a page of b from the cache. ok is false if the
+// database has to be asked instead.
+func leaderboardPage(ctx context.Context, b leaderboard, page int) ([]defs.DailyRanking, bool) {
+	if !b.cached() || !cache.Enabled() || !cache.Available() {
+		return nil, false
+	}
+
+	offset := (page - 1) * rankingsPerPage
+
+	entries, err := cache.LeaderboardPage(ctx, b.name, offset, rankingsPerPage)
+	if err != nil {
+		missedLeaderboard(ctx, b, err)
+		return nil, false
+	}
+
+	rankings := make([]defs.DailyRanking, len(entries))
+	for i, entry := range entries {
+		rankings[i] = defs.DailyRanking{
+			Rank:     offset + i + 1,
+			Username: entry.Username,
+			Score:    entry.Score,
+			Wave:     entry.Wave,
+		}
+	}
+
+	return rankings, true
+}
+
+// leaderboardPageCount returns the number of pages of b from the cache. ok
+// is false if the database has to be asked instead.
+func leaderboardPageCount(ctx context.Context, b leaderboard) (int, bool) {
+	if !b.cached() || !cache.Enabled() || !cache.Available() {
+		return 0, false
+	}
+
+	count, err := cache.LeaderboardCount(ctx, b.name)
+	if err != nil {
+		missedLeaderboard(ctx, b, err)
+		return 0, false
+	}
+
+	return int(math.Ceil(float64(count) / rankingsPerPage)), true
+}
+
+func missedLeaderboard(ctx context.Context, b leaderboard, err error) {
+	if errors.Is(err, cache.ErrMiss) {
+		b.rebuild()
+	} else if !cache.IsUnavailable(err) && ctx.Err() == nil {
+		slog.WarnContext(ctx, "failed to read leaderboard", "board", b.name, "error", err)
+	}
+}
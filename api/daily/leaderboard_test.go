@@ -0,0 +1,59 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package daily
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeaderboardNames(t *testing.T) {
+	date := time.Date(2024, 6, 12, 15, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		category int
+		want     string
+	}{
+		{CategoryDaily, "daily:2024-06-12"},
+		{CategoryWeekly, "weekly:2024-06-09"},
+		{CategoryMonthly, "monthly:2024-06-01"},
+		{CategoryAllTime, "allTime"},
+		{CategoryEndlessWave, "highestEndlessWave"},
+		{CategoryBattles, "battles"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			b, ok := leaderboardFor(tt.category, date)
+			if !ok || b.name != tt.want {
+				t.Fatalf("board of category %d: %q %v, want %q", tt.category, b.name, ok, tt.want)
+			}
+
+			parsed, ok := parseLeaderboard(b.name)
+			if !ok || parsed != b {
+				t.Errorf("parsed %+v %v, want %+v", parsed, ok, b)
+			}
+		})
+	}
+
+	for _, name := range []string{"daily", "daily:2024-06-32", "allTime:2024-06-01", "weekly:2024-06-12", "unknown"} {
+		if b, ok := parseLeaderboard(name); ok {
+			t.Errorf("parsed %q as %+v", name, b)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package daily
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/cache"
+	"github.com/pagefaultgames/rogueserver/db"
+	"github.com/pagefaultgames/rogueserver/defs"
+)
+
+// MaxRankingsAround caps how many players above and below are returned
+// along with a personal ranking.
+const MaxRankingsAround = 25
+
+// ErrNotRanked is returned for a player without a ranking in the category
+// and date asked for.
+var ErrNotRanked = errors.New("not ranked")
+
+// /daily/rankings/me - fetch where a player stands in the rankings
+func PersonalRanking(ctx context.Context, uuid []byte, category int, date time.Time, around int) (defs.PersonalRanking, error) {
+	start, err := rankingStart(category, date)
+	if err != nil {
+		return defs.PersonalRanking{}, err
+	}
+
+	around = min(max(around, 0), MaxRankingsAround)
+
+	var rankings []defs.DailyRanking
+	var me, players int
+
+	b, ok := leaderboardFor(category, date)
+	if ok {
+		rankings, me, players, ok = leaderboardAround(ctx, b, uuid, around)
+	}
+	if !ok {
+		rankings, me, players, err = db.FetchRankingAround(ctx, category, start, uuid, around)
+		if errors.Is(err, sql.ErrNoRows) {
+			return defs.PersonalRanking{}, ErrNotRanked
+		} else if err != nil {
+			return defs.PersonalRanking{}, err
+		}
+	} else if me < 0 {
+		return defs.PersonalRanking{}, ErrNotRanked
+	}
+
+	return defs.PersonalRanking{
+		DailyRanking: rankings[me],
+		Players:      players,
+		Percentile:   float64(players-rankings[me].Rank+1) / float64(players) * 100,
+		Above:        rankings[:me],
+		Below:        rankings[me+1:],
+	}, nil
+}
+
+// leaderboardAround is FetchRankingAround from the cache, with me -1 if the
+// player isn't on b. ok is false if the database has to be asked instead.
+func leaderboardAround(ctx context.Context, b leaderboard, uuid []byte, around int) (rankings []defs.DailyRanking, me int, players int, ok bool) {
+	if !b.cached() || !cache.Enabled() || !cache.Available() {
+		return nil, 0, 0, false
+	}
+
+	username, err := db.FetchUsernameFromUUID(ctx, uuid)
+	if err != nil {
+		return nil, 0, 0, false
+	}
+
+	rank, found, err := cache.LeaderboardRank(ctx, b.name, username)
+	if err != nil {
+		missedLeaderboard(ctx, b, err)
+		return nil, 0, 0, false
+	} else if !found {
+		return nil, -1, 0, true
+	}
+
+	players, err = cache.LeaderboardCount(ctx, b.name)
+	if err != nil {
+		missedLeaderboard(ctx, b, err)
+		return nil, 0, 0, false
+	}
+
+	offset := max(rank-around, 0)
+
+	entries, err := cache.LeaderboardPage(ctx, b.name, offset, rank-offset+around+1)
+	if err != nil {
+		missedLeaderboard(ctx, b, err)
+		return nil, 0, 0, false
+	}
+
+	me = -1
+	rankings = make([]defs.DailyRanking, len(entries))
+	for i, entry := range entries {
+		rankings[i] = defs.DailyRanking{
+			Rank:     offset + i + 1,
+			Username: entry.Username,
+			Score:    entry.Score,
+			Wave:     entry.Wave,
+		}
+
+		if entry.Username == username {
+			me = i
+		}
+	}
+
+	// the board changed between the reads
+	if me < 0 {
+		return nil, 0, 0, false
+	}
+
+	return rankings, me, players, true
+}
@@ -18,13 +18,28 @@
 package daily
 
 import (
+	"context"
+	"time"
+
 	"github.com/pagefaultgames/rogueserver/db"
 	"github.com/pagefaultgames/rogueserver/defs"
 )
 
 // /daily/rankings - fetch daily rankings
-func Rankings(category, page int) ([]defs.DailyRanking, error) {
-	rankings, err := db.FetchRankings(category, page)
+func Rankings(ctx context.Context, category int, date time.Time, page int) ([]defs.DailyRanking, error) {
+	start, err := rankingStart(category, date)
+	if err != nil {
+		return nil, err
+	}
+
+	if b, ok := leaderboardFor(category, date); ok {
+		rankings, ok := leaderboardPage(ctx, b, page)
+		if ok {
+			return rankings, nil
+		}
+	}
+
+	rankings, err := db.FetchRankings(ctx, category, start, page)
 	if err != nil {
 		return rankings, err
 	}
@@ -18,12 +18,27 @@
 package daily
 
 import (
+	"context"
+	"time"
+
 	"github.com/pagefaultgames/rogueserver/db"
 )
 
 // /daily/rankingpagecount - fetch daily ranking page count
-func RankingPageCount(category int) (int, error) {
-	pageCount, err := db.FetchRankingPageCount(category)
+func RankingPageCount(ctx context.Context, category int, date time.Time) (int, error) {
+	start, err := rankingStart(category, date)
+	if err != nil {
+		return 0, err
+	}
+
+	if b, ok := leaderboardFor(category, date); ok {
+		pageCount, ok := leaderboardPageCount(ctx, b)
+		if ok {
+			return pageCount, nil
+		}
+	}
+
+	pageCount, err := db.FetchRankingPageCount(ctx, category, start)
 	if err != nil {
 		return pageCount, err
 	}
@@ -18,12 +18,14 @@
 package api
 
 import (
+	"context"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
@@ -35,7 +37,7 @@ import (
 	"github.com/pagefaultgames/rogueserver/cache"
 	"github.com/pagefaultgames/rogueserver/db"
 	"github.com/pagefaultgames/rogueserver/defs"
-	"github.com/redis/go-redis/v9"
+	"github.com/pagefaultgames/rogueserver/storage"
 )
 
 /*
@@ -52,19 +54,19 @@ func handleAccountInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	username, err := db.FetchUsernameFromUUID(uuid)
+	username, err := db.FetchUsernameFromUUID(r.Context(), uuid)
 	if err != nil {
 		httpError(w, r, err, http.StatusInternalServerError)
 		return
 	}
-	discordId, err := db.FetchDiscordIdByUsername(username)
+	discordId, err := db.FetchDiscordIdByUsername(r.Context(), username)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			httpError(w, r, err, http.StatusInternalServerError)
 			return
 		}
 	}
-	googleId, err := db.FetchGoogleIdByUsername(username)
+	googleId, err := db.FetchGoogleIdByUsername(r.Context(), username)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			httpError(w, r, err, http.StatusInternalServerError)
@@ -77,7 +79,7 @@ func handleAccountInfo(w http.ResponseWriter, r *http.Request) {
 		hasAdminRole, _ = account.IsUserDiscordAdmin(discordId, account.DiscordGuildID)
 	}
 
-	response, err := account.Info(username, discordId, googleId, uuid, hasAdminRole)
+	response, err := account.Info(r.Context(), username, discordId, googleId, uuid, hasAdminRole)
 	if err != nil {
 		httpError(w, r, err, http.StatusInternalServerError)
 		return
@@ -92,7 +94,7 @@ func handleAccountRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = account.Register(r.Form.Get("username"), r.Form.Get("password"))
+	err = account.Register(r.Context(), r.Form.Get("username"), r.Form.Get("password"))
 	if err != nil {
 		httpError(w, r, err, http.StatusInternalServerError)
 		return
@@ -108,7 +110,7 @@ func handleAccountLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response, err := account.Login(r.Form.Get("username"), r.Form.Get("password"))
+	response, err := account.Login(r.Context(), r.Form.Get("username"), r.Form.Get("password"))
 	if err != nil {
 		httpError(w, r, err, http.StatusInternalServerError)
 		return
@@ -130,7 +132,7 @@ func handleAccountChangePW(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = account.ChangePW(uuid, r.Form.Get("password"))
+	err = account.ChangePW(r.Context(), uuid, r.Form.Get("password"))
 	if err != nil {
 		httpError(w, r, err, http.StatusInternalServerError)
 		return
@@ -146,7 +148,7 @@ func handleAccountLogout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = account.Logout(token)
+	err = account.Logout(r.Context(), token)
 	if err != nil {
 		// also possible for InternalServerError but that's unlikely unless the server blew up
 		httpError(w, r, err, http.StatusUnauthorized)
@@ -193,16 +195,15 @@ func handleSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//err = db.UpdateActiveSession(uuid, r.URL.Query().Get("clientSessionId"))
-	err = cache.UpdateActiveSession(uuid, r.URL.Query().Get("clientSessionId"))
+	err = storage.UpdateActiveSession(r.Context(), uuid, r.URL.Query().Get("clientSessionId"))
 	if err != nil {
-		httpError(w, r, fmt.Errorf("handlesession : failed to update active session: %s", err), http.StatusBadRequest)
+		httpError(w, r, fmt.Errorf("handlesession : failed to update active session: %w", err), http.StatusBadRequest)
 		return
 	}
 
 	switch r.PathValue("action") {
 	case "get":
-		save, err := savedata.GetSession(uuid, slot)
+		save, err := savedata.GetSession(r.Context(), uuid, slot)
 		if errors.Is(err, sql.ErrNoRows) {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
@@ -222,24 +223,13 @@ func handleSession(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		existingSave, err := savedata.GetSession(uuid, slot)
-		if err != nil && !errors.Is(err, sql.ErrNoRows) {
-			httpError(w, r, fmt.Errorf("failed to retrieve session save data: %s", err), http.StatusInternalServerError)
-			return
-		} else {
-			if existingSave.Seed == session.Seed && existingSave.WaveIndex > session.WaveIndex {
-				httpError(w, r, fmt.Errorf("session out of date: existing wave index is greater"), http.StatusBadRequest)
-				return
-			}
-		}
-
-		err = savedata.UpdateSession(uuid, slot, session)
+		revision, err := savedata.UpdateSession(r.Context(), uuid, slot, session)
 		if err != nil {
-			httpError(w, r, fmt.Errorf("failed to put session data: %s", err), http.StatusInternalServerError)
+			saveUpdateError(w, r, fmt.Errorf("failed to put session data: %w", err))
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		writeJSON(w, r, SaveRevisionResponse{Revision: revision})
 	case "clear":
 		var session defs.SessionSaveData
 		err = json.NewDecoder(r.Body).Decode(&session)
@@ -248,13 +238,13 @@ func handleSession(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		seed, err := db.GetDailyRunSeed()
+		seed, err := db.GetDailyRunSeed(r.Context())
 		if err != nil {
 			httpError(w, r, err, http.StatusInternalServerError)
 			return
 		}
 
-		resp, err := savedata.Clear(uuid, slot, seed, session)
+		resp, err := savedata.Clear(r.Context(), uuid, slot, seed, session)
 		if err != nil {
 			httpError(w, r, err, http.StatusInternalServerError)
 			return
@@ -262,15 +252,15 @@ func handleSession(w http.ResponseWriter, r *http.Request) {
 
 		writeJSON(w, r, resp)
 	case "newclear":
-		resp, err := savedata.NewClear(uuid, slot)
+		resp, err := savedata.NewClear(r.Context(), uuid, slot)
 		if err != nil {
-			httpError(w, r, fmt.Errorf("failed to read new clear: %s", err), http.StatusInternalServerError)
+			httpError(w, r, fmt.Errorf("failed to read new clear: %w", err), http.StatusInternalServerError)
 			return
 		}
 
 		writeJSON(w, r, resp)
 	case "delete":
-		err := savedata.DeleteSession(uuid, slot)
+		err := savedata.DeleteSession(r.Context(), uuid, slot)
 		if err != nil {
 			httpError(w, r, err, http.StatusInternalServerError)
 			return
@@ -290,7 +280,8 @@ type CombinedSaveData struct {
 	ClientSessionId string               `json:"clientSessionId"`
 }
 
-// TODO wrap this in a transaction
+// handleUpdateAll validates and stores both saves atomically per account;
+// see savedata.UpdateAll for the checks.
 func handleUpdateAll(w http.ResponseWriter, r *http.Request) {
 	uuid, err := uuidFromRequest(r)
 	if err != nil {
@@ -305,99 +296,55 @@ func handleUpdateAll(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if data.ClientSessionId == "" {
-		httpError(w, r, fmt.Errorf("missing clientSessionId"), http.StatusBadRequest)
-		return
-	}
-
-	var active bool
-	// cache로 변경
-	//active, err = db.IsActiveSession(uuid, data.ClientSessionId)
-	active, err = cache.IsActiveSession(uuid, data.ClientSessionId)
-
+	sessionRevision, systemRevision, err := savedata.UpdateAll(r.Context(), uuid, data.ClientSessionId, data.SessionSlotId, data.Session, data.System)
 	if err != nil {
-		httpError(w, r, fmt.Errorf("failed to check active session: %s", err), http.StatusBadRequest)
-		return
-	}
-
-	if !active {
-		httpError(w, r, fmt.Errorf("session out of date: not active : %s", err), http.StatusBadRequest)
+		saveUpdateError(w, r, fmt.Errorf("failed to update save data: %w", err))
 		return
 	}
 
-	//storedTrainerId, storedSecretId, err := db.FetchTrainerIds(uuid)
-	storedTrainerId, storedSecretId, err := cache.FetchTrainerIds(uuid)
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			httpError(w, r, err, http.StatusInternalServerError)
-			return
-		}
-	}
-
-	if storedTrainerId > 0 || storedSecretId > 0 {
-		if data.System.TrainerId != storedTrainerId || data.System.SecretId != storedSecretId {
-			httpError(w, r, fmt.Errorf("session out of date: stored trainer or secret ID does not match"), http.StatusBadRequest)
-			return
-		}
-	} else {
-		//err = db.UpdateTrainerIds(data.System.TrainerId, data.System.SecretId, uuid)
-		err = cache.UpdateTrainerIds(data.System.TrainerId, data.System.SecretId, uuid)
-		//if err != nil {
-		if err != nil {
-			if errors.Is(err, redis.Nil) {
-				httpError(w, r, err, http.StatusInternalServerError)
-				return
-			}
-		}
-	}
-
-	// cache로 변경
-	//existingPlaytime, err := db.RetrievePlaytime(uuid)
-	existingPlaytime, err := cache.RetrievePlaytime(uuid)
-	if err != nil && errors.Is(err, redis.Nil) {
-		httpError(w, r, fmt.Errorf("failed to retrieve playtime: %s", err), http.StatusInternalServerError)
-		return
-	} else {
-		playtime, ok := data.System.GameStats.(map[string]interface{})["playTime"].(float64)
-		if !ok {
-			httpError(w, r, fmt.Errorf("no playtime found"), http.StatusBadRequest)
-			return
-		}
+	writeJSON(w, r, UpdateAllResponse{
+		SessionRevision: sessionRevision,
+		SystemRevision:  systemRevision,
+	})
+}
 
-		if float64(existingPlaytime) > playtime {
-			httpError(w, r, fmt.Errorf("session out of date: existing playtime is greater"), http.StatusBadRequest)
-			return
-		}
-	}
+type UpdateAllResponse struct {
+	SessionRevision int `json:"sessionRevision"`
+	SystemRevision  int `json:"systemRevision"`
+}
 
-	log.Println("handleUpdateAll  ", uuid, data.SessionSlotId)
-	existingSave, err := savedata.GetSession(uuid, data.SessionSlotId)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		httpError(w, r, fmt.Errorf("failed to retrieve session save data: %s", err), http.StatusInternalServerError)
-		return
-	} else {
-		if existingSave.Seed == data.Session.Seed && existingSave.WaveIndex > data.Session.WaveIndex {
-			httpError(w, r, fmt.Errorf("session out of date: existing wave index is greater"), http.StatusBadRequest)
-			return
-		}
-	}
+type SaveRevisionResponse struct {
+	Revision int `json:"revision"`
+}
 
-	log.Println("Update ", uuid, data.SessionSlotId, data.Session)
-	err = savedata.Update(uuid, data.SessionSlotId, data.Session)
-	if err != nil {
-		log.Print(err)
-		httpError(w, r, err, http.StatusInternalServerError)
-		return
-	}
+type RevisionConflictResponse struct {
+	Error    string `json:"error"`
+	Part     string `json:"part"`
+	Revision int    `json:"revision"`
+}
 
-	err = savedata.Update(uuid, 0, data.System)
-	if err != nil {
-		log.Print(err)
+// saveUpdateError maps a failed save update to a response. Stale revisions
+// get 409 with the current revision so the client can refetch and retry.
+func saveUpdateError(w http.ResponseWriter, r *http.Request, err error) {
+	var revisionErr *savedata.RevisionError
+	switch {
+	case errors.As(err, &revisionErr):
+		slog.WarnContext(r.Context(), "request failed", "path", r.URL.Path, "status", http.StatusConflict, "error", err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(RevisionConflictResponse{
+			Error:    err.Error(),
+			Part:     revisionErr.Part,
+			Revision: revisionErr.Current,
+		})
+	case errors.Is(err, savedata.ErrInvalidSave):
+		httpError(w, r, err, http.StatusBadRequest)
+	case errors.Is(err, savedata.ErrOutOfDate), errors.Is(err, storage.ErrConflict):
+		httpError(w, r, err, http.StatusConflict)
+	default:
 		httpError(w, r, err, http.StatusInternalServerError)
-		return
 	}
-
-	w.WriteHeader(http.StatusOK)
 }
 
 type SystemVerifyResponse struct {
@@ -418,30 +365,28 @@ func handleSystem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//active, err = db.IsActiveSession(uuid, r.URL.Query().Get("clientSessionId"))
-	active, err = cache.IsActiveSession(uuid, r.URL.Query().Get("clientSessionId"))
+	active, err = storage.IsActiveSession(r.Context(), uuid, r.URL.Query().Get("clientSessionId"))
 	if err != nil {
-		httpError(w, r, fmt.Errorf("failed to check active session: %s", err), http.StatusBadRequest)
+		httpError(w, r, fmt.Errorf("failed to check active session: %w", err), http.StatusBadRequest)
 		return
 	}
 
 	switch r.PathValue("action") {
 	case "get":
 		if !active {
-			//err = db.UpdateActiveSession(uuid, r.URL.Query().Get("clientSessionId"))
-			err = cache.UpdateActiveSession(uuid, r.URL.Query().Get("clientSessionId"))
+			err = storage.UpdateActiveSession(r.Context(), uuid, r.URL.Query().Get("clientSessionId"))
 			if err != nil {
-				httpError(w, r, fmt.Errorf("handleSystem_get : failed to update active session: %s", err), http.StatusBadRequest)
+				httpError(w, r, fmt.Errorf("handleSystem_get : failed to update active session: %w", err), http.StatusBadRequest)
 				return
 			}
 		}
 
-		save, err := savedata.GetSystem(uuid)
+		save, err := savedata.GetSystem(r.Context(), uuid)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				http.Error(w, err.Error(), http.StatusNotFound)
 			} else {
-				httpError(w, r, fmt.Errorf("failed to get system save data: %s", err), http.StatusInternalServerError)
+				httpError(w, r, fmt.Errorf("failed to get system save data: %w", err), http.StatusInternalServerError)
 			}
 
 			return
@@ -461,9 +406,9 @@ func handleSystem(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		existingPlaytime, err := db.RetrievePlaytime(uuid)
+		existingPlaytime, err := storage.RetrievePlaytime(r.Context(), uuid)
 		if err != nil && !errors.Is(err, sql.ErrNoRows) {
-			httpError(w, r, fmt.Errorf("failed to retrieve playtime: %s", err), http.StatusInternalServerError)
+			httpError(w, r, fmt.Errorf("failed to retrieve playtime: %w", err), http.StatusInternalServerError)
 			return
 		} else {
 			playtime, ok := system.GameStats.(map[string]interface{})["playTime"].(float64)
@@ -478,13 +423,13 @@ func handleSystem(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		err = savedata.UpdateSystem(uuid, system)
+		revision, err := savedata.UpdateSystem(r.Context(), uuid, system)
 		if err != nil {
-			httpError(w, r, fmt.Errorf("failed to put system data: %s", err), http.StatusInternalServerError)
+			saveUpdateError(w, r, fmt.Errorf("failed to put system data: %w", err))
 			return
 		}
 
-		w.WriteHeader(http.StatusNoContent)
+		writeJSON(w, r, SaveRevisionResponse{Revision: revision})
 	case "verify":
 		response := SystemVerifyResponse{
 			Valid: active,
@@ -492,16 +437,16 @@ func handleSystem(w http.ResponseWriter, r *http.Request) {
 
 		// not valid, send server state
 		if !active {
-			err = db.UpdateActiveSession(uuid, r.URL.Query().Get("clientSessionId"))
+			err = storage.UpdateActiveSession(r.Context(), uuid, r.URL.Query().Get("clientSessionId"))
 			if err != nil {
-				httpError(w, r, fmt.Errorf("handleSystem_verify : failed to update active session: %s", err), http.StatusBadRequest)
+				httpError(w, r, fmt.Errorf("handleSystem_verify : failed to update active session: %w", err), http.StatusBadRequest)
 				return
 			}
 
 			var storedSaveData defs.SystemSaveData
-			storedSaveData, err = db.ReadSystemSaveData(uuid)
+			storedSaveData, err = storage.ReadSystemSaveData(r.Context(), uuid)
 			if err != nil {
-				httpError(w, r, fmt.Errorf("failed to read session save data: %s", err), http.StatusInternalServerError)
+				httpError(w, r, fmt.Errorf("failed to read session save data: %w", err), http.StatusInternalServerError)
 				return
 			}
 
@@ -510,7 +455,7 @@ func handleSystem(w http.ResponseWriter, r *http.Request) {
 
 		writeJSON(w, r, response)
 	case "delete":
-		err := savedata.DeleteSystem(uuid)
+		err := savedata.DeleteSystem(r.Context(), uuid)
 		if err != nil {
 			httpError(w, r, err, http.StatusInternalServerError)
 			return
@@ -523,9 +468,75 @@ func handleSystem(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func handleRuns(w http.ResponseWriter, r *http.Request) {
+	uuid, err := uuidFromRequest(r)
+	if err != nil {
+		httpError(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	page := 1
+	if r.URL.Query().Has("page") {
+		page, err = strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil || page < 1 {
+			httpError(w, r, fmt.Errorf("invalid page: %s", r.URL.Query().Get("page")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	runs, err := savedata.Runs(r.Context(), uuid, page)
+	if err != nil {
+		httpError(w, r, fmt.Errorf("failed to fetch runs: %w", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, runs)
+}
+
+func handleRunPageCount(w http.ResponseWriter, r *http.Request) {
+	uuid, err := uuidFromRequest(r)
+	if err != nil {
+		httpError(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	count, err := savedata.RunPageCount(r.Context(), uuid)
+	if err != nil {
+		httpError(w, r, fmt.Errorf("failed to count runs: %w", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte(strconv.Itoa(count)))
+}
+
+func handleRun(w http.ResponseWriter, r *http.Request) {
+	uuid, err := uuidFromRequest(r)
+	if err != nil {
+		httpError(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		httpError(w, r, fmt.Errorf("invalid run id: %s", r.PathValue("id")), http.StatusBadRequest)
+		return
+	}
+
+	run, err := savedata.Run(r.Context(), uuid, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		httpError(w, r, fmt.Errorf("run not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		httpError(w, r, fmt.Errorf("failed to fetch run: %w", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, run)
+}
+
 // daily
 func handleDailySeed(w http.ResponseWriter, r *http.Request) {
-	seed, err := db.GetDailyRunSeed()
+	seed, err := db.GetDailyRunSeed(r.Context())
 	if err != nil {
 		httpError(w, r, err, http.StatusInternalServerError)
 		return
@@ -558,8 +569,22 @@ func handleDailyRankings(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	rankings, err := daily.Rankings(category, page)
+	if page < 1 {
+		httpError(w, r, fmt.Errorf("page %d out of range", page), http.StatusBadRequest)
+		return
+	}
+
+	date, err := daily.RankingDate(category, r.URL.Query().Get("date"), r.URL.Query().Get("week"))
 	if err != nil {
+		httpError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	rankings, err := daily.Rankings(r.Context(), category, date, page)
+	if errors.Is(err, daily.ErrUnknownCategory) {
+		httpError(w, r, err, http.StatusBadRequest)
+		return
+	} else if err != nil {
 		httpError(w, r, err, http.StatusInternalServerError)
 		return
 	}
@@ -567,6 +592,56 @@ func handleDailyRankings(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, r, rankings)
 }
 
+func handleDailyRankingCategories(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, daily.Categories())
+}
+
+func handleDailyPersonalRanking(w http.ResponseWriter, r *http.Request) {
+	uuid, err := uuidFromRequest(r)
+	if err != nil {
+		httpError(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	var category int
+	if r.URL.Query().Has("category") {
+		category, err = strconv.Atoi(r.URL.Query().Get("category"))
+		if err != nil {
+			httpError(w, r, fmt.Errorf("failed to convert category: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	around := 5
+	if r.URL.Query().Has("around") {
+		around, err = strconv.Atoi(r.URL.Query().Get("around"))
+		if err != nil || around < 0 || around > daily.MaxRankingsAround {
+			httpError(w, r, fmt.Errorf("invalid around: %s", r.URL.Query().Get("around")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	date, err := daily.RankingDate(category, r.URL.Query().Get("date"), r.URL.Query().Get("week"))
+	if err != nil {
+		httpError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	ranking, err := daily.PersonalRanking(r.Context(), uuid, category, date, around)
+	if errors.Is(err, daily.ErrUnknownCategory) {
+		httpError(w, r, err, http.StatusBadRequest)
+		return
+	} else if errors.Is(err, daily.ErrNotRanked) {
+		httpError(w, r, err, http.StatusNotFound)
+		return
+	} else if err != nil {
+		httpError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, ranking)
+}
+
 func handleDailyRankingPageCount(w http.ResponseWriter, r *http.Request) {
 	var category int
 	if r.URL.Query().Has("category") {
@@ -578,14 +653,175 @@ func handleDailyRankingPageCount(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	count, err := daily.RankingPageCount(category)
+	date, err := daily.RankingDate(category, r.URL.Query().Get("date"), r.URL.Query().Get("week"))
+	if err != nil {
+		httpError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	count, err := daily.RankingPageCount(r.Context(), category, date)
+	if errors.Is(err, daily.ErrUnknownCategory) {
+		httpError(w, r, err, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		httpError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte(strconv.Itoa(count)))
+}
+
+func handleDailyHistory(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	page := 1
+	if r.URL.Query().Has("page") {
+		page, err = strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil || page < 1 {
+			httpError(w, r, fmt.Errorf("invalid page: %s", r.URL.Query().Get("page")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	history, err := daily.History(r.Context(), page)
+	if err != nil {
+		httpError(w, r, fmt.Errorf("failed to fetch daily run history: %w", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, history)
+}
+
+func handleDailyExport(w http.ResponseWriter, r *http.Request) {
+	date, err := daily.RankingDate(daily.CategoryDaily, r.URL.Query().Get("date"), "")
+	if err != nil {
+		httpError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	format := daily.ExportNDJSON
+	if r.URL.Query().Has("format") {
+		format = r.URL.Query().Get("format")
+	}
+
+	contentType, err := daily.ExportContentType(format)
+	if err != nil {
+		httpError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"daily-%s.%s\"", date.Format(time.DateOnly), format))
+
+	// the export streams for longer than the request deadline allows, under
+	// the deadline of its own query; a client that goes away fails the writes
+	ctx := context.WithoutCancel(r.Context())
+
+	ew := &exportWriter{w: w}
+	err = daily.Export(ctx, date, format, ew)
 	if err != nil {
+		if ew.written {
+			// the status line went out with the first line of the export, so
+			// cut the response short rather than append an error to it
+			slog.ErrorContext(r.Context(), "request failed", "path", r.URL.Path, "error", err)
+			panic(http.ErrAbortHandler)
+		}
+
+		w.Header().Del("Content-Disposition")
 		httpError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+}
+
+// exportWriter records whether any of an export reached the client.
+type exportWriter struct {
+	w       io.Writer
+	written bool
+}
+
+func (w *exportWriter) Write(b []byte) (int, error) {
+	w.written = true
+
+	return w.w.Write(b)
+}
+
+// speedrunRanking reads which speedrun ranking a request is for: gameMode
+// (classic by default), challenges and version.
+func speedrunRanking(r *http.Request) (defs.GameMode, string, string, error) {
+	var gameMode int
+	if r.URL.Query().Has("gameMode") {
+		var err error
+		gameMode, err = strconv.Atoi(r.URL.Query().Get("gameMode"))
+		if err != nil || gameMode < 0 {
+			return 0, "", "", fmt.Errorf("invalid gameMode: %s", r.URL.Query().Get("gameMode"))
+		}
+	}
+
+	challenges, err := savedata.ParseChallengeSet(r.URL.Query().Get("challenges"))
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	return defs.GameMode(gameMode), challenges, r.URL.Query().Get("version"), nil
+}
+
+func handleSpeedruns(w http.ResponseWriter, r *http.Request) {
+	gameMode, challenges, version, err := speedrunRanking(r)
+	if err != nil {
+		httpError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	page := 1
+	if r.URL.Query().Has("page") {
+		page, err = strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil || page < 1 {
+			httpError(w, r, fmt.Errorf("invalid page: %s", r.URL.Query().Get("page")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	runs, err := savedata.Speedruns(r.Context(), gameMode, challenges, version, page)
+	if err != nil {
+		httpError(w, r, fmt.Errorf("failed to fetch speedruns: %w", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, runs)
+}
+
+func handleSpeedrunPageCount(w http.ResponseWriter, r *http.Request) {
+	gameMode, challenges, version, err := speedrunRanking(r)
+	if err != nil {
+		httpError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	count, err := savedata.SpeedrunPageCount(r.Context(), gameMode, challenges, version)
+	if err != nil {
+		httpError(w, r, fmt.Errorf("failed to fetch speedrun page count: %w", err), http.StatusInternalServerError)
+		return
 	}
 
 	w.Write([]byte(strconv.Itoa(count)))
 }
 
+func handlePersonalBests(w http.ResponseWriter, r *http.Request) {
+	uuid, err := uuidFromRequest(r)
+	if err != nil {
+		httpError(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	runs, err := savedata.PersonalBests(r.Context(), uuid, r.URL.Query().Get("version"))
+	if err != nil {
+		httpError(w, r, fmt.Errorf("failed to fetch personal bests: %w", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, runs)
+}
+
 // redirect link after authorizing application link
 func handleProviderCallback(w http.ResponseWriter, r *http.Request) {
 	provider := r.PathValue("provider")
@@ -615,7 +851,7 @@ func handleProviderCallback(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		userName, err := db.FetchUsernameBySessionToken(stateByte)
+		userName, err := db.FetchUsernameBySessionToken(r.Context(), stateByte)
 		if err != nil {
 			http.Redirect(w, r, account.GameURL, http.StatusSeeOther)
 			return
@@ -623,9 +859,9 @@ func handleProviderCallback(w http.ResponseWriter, r *http.Request) {
 
 		switch provider {
 		case "discord":
-			err = db.AddDiscordIdByUsername(externalAuthId, userName)
+			err = db.AddDiscordIdByUsername(r.Context(), externalAuthId, userName)
 		case "google":
-			err = db.AddGoogleIdByUsername(externalAuthId, userName)
+			err = db.AddGoogleIdByUsername(r.Context(), externalAuthId, userName)
 		}
 
 		if err != nil {
@@ -637,16 +873,16 @@ func handleProviderCallback(w http.ResponseWriter, r *http.Request) {
 		var userName string
 		switch provider {
 		case "discord":
-			userName, err = db.FetchUsernameByDiscordId(externalAuthId)
+			userName, err = db.FetchUsernameByDiscordId(r.Context(), externalAuthId)
 		case "google":
-			userName, err = db.FetchUsernameByGoogleId(externalAuthId)
+			userName, err = db.FetchUsernameByGoogleId(r.Context(), externalAuthId)
 		}
 		if err != nil {
 			http.Redirect(w, r, account.GameURL, http.StatusSeeOther)
 			return
 		}
 
-		sessionToken, err := account.GenerateTokenForUsername(userName)
+		sessionToken, err := account.GenerateTokenForUsername(r.Context(), userName)
 		if err != nil {
 			http.Redirect(w, r, account.GameURL, http.StatusSeeOther)
 			return
@@ -675,9 +911,9 @@ func handleProviderLogout(w http.ResponseWriter, r *http.Request) {
 
 	switch r.PathValue("provider") {
 	case "discord":
-		err = db.RemoveDiscordIdByUUID(uuid)
+		err = db.RemoveDiscordIdByUUID(r.Context(), uuid)
 	case "google":
-		err = db.RemoveGoogleIdByUUID(uuid)
+		err = db.RemoveGoogleIdByUUID(r.Context(), uuid)
 	default:
 		http.Error(w, "invalid provider", http.StatusBadRequest)
 		return
@@ -702,7 +938,7 @@ func handleAdminDiscordLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userDiscordId, err := db.FetchDiscordIdByUUID(uuid)
+	userDiscordId, err := db.FetchDiscordIdByUUID(r.Context(), uuid)
 	if err != nil {
 		httpError(w, r, err, http.StatusUnauthorized)
 		return
@@ -719,25 +955,25 @@ func handleAdminDiscordLink(w http.ResponseWriter, r *http.Request) {
 
 	// this does a quick call to make sure the username exists on the server before allowing the rest of the code to run
 	// this calls error value 404 (StatusNotFound) if there's no data; this means the username does not exist in the server
-	_, err = db.CheckUsernameExists(username)
+	_, err = db.CheckUsernameExists(r.Context(), username)
 	if err != nil {
 		httpError(w, r, fmt.Errorf("username does not exist on the server"), http.StatusNotFound)
 		return
 	}
 
-	userUuid, err := db.FetchUUIDFromUsername(username)
+	userUuid, err := db.FetchUUIDFromUsername(r.Context(), username)
 	if err != nil {
 		httpError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
-	err = db.AddDiscordIdByUUID(discordId, userUuid)
+	err = db.AddDiscordIdByUUID(r.Context(), discordId, userUuid)
 	if err != nil {
 		httpError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("%s: %s added discord id %s to username %s", r.URL.Path, userDiscordId, discordId, username)
+	slog.InfoContext(r.Context(), "admin added discord id", "path", r.URL.Path, "admin", userDiscordId, "discord_id", discordId, "username", username)
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -755,7 +991,7 @@ func handleAdminDiscordUnlink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userDiscordId, err := db.FetchDiscordIdByUUID(uuid)
+	userDiscordId, err := db.FetchDiscordIdByUUID(r.Context(), uuid)
 	if err != nil {
 		httpError(w, r, err, http.StatusUnauthorized)
 		return
@@ -772,36 +1008,36 @@ func handleAdminDiscordUnlink(w http.ResponseWriter, r *http.Request) {
 
 	switch {
 	case username != "":
-		log.Printf("Username given, removing discordId")
+		slog.DebugContext(r.Context(), "username given, removing discord id")
 		// this does a quick call to make sure the username exists on the server before allowing the rest of the code to run
 		// this calls error value 404 (StatusNotFound) if there's no data; this means the username does not exist in the server
-		_, err = db.CheckUsernameExists(username)
+		_, err = db.CheckUsernameExists(r.Context(), username)
 		if err != nil {
 			httpError(w, r, fmt.Errorf("username does not exist on the server"), http.StatusNotFound)
 			return
 		}
 
-		userUuid, err := db.FetchUUIDFromUsername(username)
+		userUuid, err := db.FetchUUIDFromUsername(r.Context(), username)
 		if err != nil {
 			httpError(w, r, err, http.StatusInternalServerError)
 			return
 		}
 
-		err = db.RemoveDiscordIdByUUID(userUuid)
+		err = db.RemoveDiscordIdByUUID(r.Context(), userUuid)
 		if err != nil {
 			httpError(w, r, err, http.StatusInternalServerError)
 			return
 		}
 	case discordId != "":
-		log.Printf("DiscordID given, removing discordId")
-		err = db.RemoveDiscordIdByDiscordId(discordId)
+		slog.DebugContext(r.Context(), "discord id given, removing discord id")
+		err = db.RemoveDiscordIdByDiscordId(r.Context(), discordId)
 		if err != nil {
 			httpError(w, r, err, http.StatusInternalServerError)
 			return
 		}
 	}
 
-	log.Printf("%s: %s removed discord id %s from username %s", userDiscordId, r.URL.Path, r.Form.Get("discordId"), r.Form.Get("username"))
+	slog.InfoContext(r.Context(), "admin removed discord id", "path", r.URL.Path, "admin", userDiscordId, "discord_id", r.Form.Get("discordId"), "username", r.Form.Get("username"))
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -819,7 +1055,7 @@ func handleAdminGoogleLink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userDiscordId, err := db.FetchDiscordIdByUUID(uuid)
+	userDiscordId, err := db.FetchDiscordIdByUUID(r.Context(), uuid)
 	if err != nil {
 		httpError(w, r, err, http.StatusUnauthorized)
 		return
@@ -836,25 +1072,25 @@ func handleAdminGoogleLink(w http.ResponseWriter, r *http.Request) {
 
 	// this does a quick call to make sure the username exists on the server before allowing the rest of the code to run
 	// this calls error value 404 (StatusNotFound) if there's no data; this means the username does not exist in the server
-	_, err = db.CheckUsernameExists(username)
+	_, err = db.CheckUsernameExists(r.Context(), username)
 	if err != nil {
 		httpError(w, r, fmt.Errorf("username does not exist on the server"), http.StatusNotFound)
 		return
 	}
 
-	userUuid, err := db.FetchUUIDFromUsername(username)
+	userUuid, err := db.FetchUUIDFromUsername(r.Context(), username)
 	if err != nil {
 		httpError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
-	err = db.AddGoogleIdByUUID(googleId, userUuid)
+	err = db.AddGoogleIdByUUID(r.Context(), googleId, userUuid)
 	if err != nil {
 		httpError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("%s: %s added google id %s to username %s", r.URL.Path, userDiscordId, googleId, username)
+	slog.InfoContext(r.Context(), "admin added google id", "path", r.URL.Path, "admin", userDiscordId, "google_id", googleId, "username", username)
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -872,7 +1108,7 @@ func handleAdminGoogleUnlink(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userDiscordId, err := db.FetchDiscordIdByUUID(uuid)
+	userDiscordId, err := db.FetchDiscordIdByUUID(r.Context(), uuid)
 	if err != nil {
 		httpError(w, r, err, http.StatusUnauthorized)
 		return
@@ -889,36 +1125,36 @@ func handleAdminGoogleUnlink(w http.ResponseWriter, r *http.Request) {
 
 	switch {
 	case username != "":
-		log.Printf("Username given, removing googleId")
+		slog.DebugContext(r.Context(), "username given, removing google id")
 		// this does a quick call to make sure the username exists on the server before allowing the rest of the code to run
 		// this calls error value 404 (StatusNotFound) if there's no data; this means the username does not exist in the server
-		_, err = db.CheckUsernameExists(username)
+		_, err = db.CheckUsernameExists(r.Context(), username)
 		if err != nil {
 			httpError(w, r, fmt.Errorf("username does not exist on the server"), http.StatusNotFound)
 			return
 		}
 
-		userUuid, err := db.FetchUUIDFromUsername(username)
+		userUuid, err := db.FetchUUIDFromUsername(r.Context(), username)
 		if err != nil {
 			httpError(w, r, err, http.StatusInternalServerError)
 			return
 		}
 
-		err = db.RemoveGoogleIdByUUID(userUuid)
+		err = db.RemoveGoogleIdByUUID(r.Context(), userUuid)
 		if err != nil {
 			httpError(w, r, err, http.StatusInternalServerError)
 			return
 		}
 	case googleId != "":
-		log.Printf("DiscordID given, removing googleId")
-		err = db.RemoveGoogleIdByDiscordId(googleId)
+		slog.DebugContext(r.Context(), "discord id given, removing google id")
+		err = db.RemoveGoogleIdByDiscordId(r.Context(), googleId)
 		if err != nil {
 			httpError(w, r, err, http.StatusInternalServerError)
 			return
 		}
 	}
 
-	log.Printf("%s: %s removed google id %s from username %s", userDiscordId, r.URL.Path, r.Form.Get("googleId"), r.Form.Get("username"))
+	slog.InfoContext(r.Context(), "admin removed google id", "path", r.URL.Path, "admin", userDiscordId, "google_id", r.Form.Get("googleId"), "username", r.Form.Get("username"))
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -936,7 +1172,7 @@ func handleAdminSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userDiscordId, err := db.FetchDiscordIdByUUID(uuid)
+	userDiscordId, err := db.FetchDiscordIdByUUID(r.Context(), uuid)
 	if err != nil {
 		httpError(w, r, err, http.StatusUnauthorized)
 		return
@@ -952,19 +1188,412 @@ func handleAdminSearch(w http.ResponseWriter, r *http.Request) {
 
 	// this does a quick call to make sure the username exists on the server before allowing the rest of the code to run
 	// this calls error value 404 (StatusNotFound) if there's no data; this means the username does not exist in the server
-	_, err = db.CheckUsernameExists(username)
+	_, err = db.CheckUsernameExists(r.Context(), username)
 	if err != nil {
 		httpError(w, r, fmt.Errorf("username does not exist on the server"), http.StatusNotFound)
 		return
 	}
 
 	// this does a single call that does a query for multiple columns from our database and makes an object out of it, which is returned to us
-	adminSearchResult, err := db.FetchAdminDetailsByUsername(username)
+	adminSearchResult, err := db.FetchAdminDetailsByUsername(r.Context(), username)
 	if err != nil {
 		httpError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
 	writeJSON(w, r, adminSearchResult)
-	log.Printf("%s: %s searched for username %s", userDiscordId, r.URL.Path, username)
+	slog.InfoContext(r.Context(), "admin searched for username", "path", r.URL.Path, "admin", userDiscordId, "username", username)
+}
+
+// handleAdminBan bans the account of username, or unbans it if banned is
+// false. Banned accounts don't show up in the rankings.
+func handleAdminBan(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		httpError(w, r, fmt.Errorf("failed to parse request form: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	uuid, err := uuidFromRequest(r)
+	if err != nil {
+		httpError(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	userDiscordId, err := db.FetchDiscordIdByUUID(r.Context(), uuid)
+	if err != nil {
+		httpError(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	hasRole, err := account.IsUserDiscordAdmin(userDiscordId, account.DiscordGuildID)
+	if !hasRole || err != nil {
+		httpError(w, r, fmt.Errorf("user does not have the required role"), http.StatusForbidden)
+		return
+	}
+
+	banned := true
+	if r.Form.Has("banned") {
+		banned, err = strconv.ParseBool(r.Form.Get("banned"))
+		if err != nil {
+			httpError(w, r, fmt.Errorf("invalid banned value: %s", r.Form.Get("banned")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	target, err := db.FetchUUIDFromUsername(r.Context(), r.Form.Get("username"))
+	if errors.Is(err, sql.ErrNoRows) {
+		httpError(w, r, fmt.Errorf("username does not exist on the server"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		httpError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = daily.SetBanned(r.Context(), target, banned)
+	if err != nil {
+		httpError(w, r, fmt.Errorf("failed to set banned: %w", err), http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "admin set account banned", "path", r.URL.Path, "admin", userDiscordId, "username", r.Form.Get("username"), "banned", banned)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleAdminCacheConsistency diffs cached user documents against the
+// database, for one username or a random sample of cached users. POST can
+// also repair the differences in the direction given by repair.
+func handleAdminCacheConsistency(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		httpError(w, r, fmt.Errorf("failed to parse request form: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	uuid, err := uuidFromRequest(r)
+	if err != nil {
+		httpError(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	userDiscordId, err := db.FetchDiscordIdByUUID(r.Context(), uuid)
+	if err != nil {
+		httpError(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	hasRole, err := account.IsUserDiscordAdmin(userDiscordId, account.DiscordGuildID)
+	if !hasRole || err != nil {
+		httpError(w, r, fmt.Errorf("user does not have the required role"), http.StatusForbidden)
+		return
+	}
+
+	if !cache.Enabled() {
+		httpError(w, r, fmt.Errorf("no cache in use"), http.StatusBadRequest)
+		return
+	}
+
+	if !cache.Available() {
+		httpError(w, r, cache.ErrUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	repair := cache.RepairNone
+	if r.Method == http.MethodPost {
+		repair, err = cache.ParseRepair(r.Form.Get("repair"))
+		if err != nil {
+			httpError(w, r, err, http.StatusBadRequest)
+			return
+		}
+	}
+
+	sample := 10
+	if r.Form.Has("sample") {
+		sample, err = strconv.Atoi(r.Form.Get("sample"))
+		if err != nil || sample < 1 {
+			httpError(w, r, fmt.Errorf("invalid sample size: %s", r.Form.Get("sample")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	uuids, err := cache.ConsistencyTargets(r.Context(), r.Form.Get("username"), sample)
+	if errors.Is(err, sql.ErrNoRows) {
+		httpError(w, r, fmt.Errorf("username does not exist on the server"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		httpError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	reports := make([]cache.ConsistencyReport, 0, len(uuids))
+	for _, target := range uuids {
+		report, err := cache.CheckConsistency(r.Context(), target, repair)
+		if err != nil {
+			httpError(w, r, fmt.Errorf("failed to check %s: %s", base64.StdEncoding.EncodeToString(target), err), http.StatusInternalServerError)
+			return
+		}
+
+		reports = append(reports, report)
+	}
+
+	writeJSON(w, r, reports)
+	slog.InfoContext(r.Context(), "admin checked cached users", "path", r.URL.Path, "admin", userDiscordId, "users", len(reports), "repair", string(repair))
+}
+
+// handleAdminCacheWarmup reports the progress of the cache warm-up. POST
+// starts one for the given number of most recently active accounts.
+func handleAdminCacheWarmup(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		httpError(w, r, fmt.Errorf("failed to parse request form: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	uuid, err := uuidFromRequest(r)
+	if err != nil {
+		httpError(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	userDiscordId, err := db.FetchDiscordIdByUUID(r.Context(), uuid)
+	if err != nil {
+		httpError(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	hasRole, err := account.IsUserDiscordAdmin(userDiscordId, account.DiscordGuildID)
+	if !hasRole || err != nil {
+		httpError(w, r, fmt.Errorf("user does not have the required role"), http.StatusForbidden)
+		return
+	}
+
+	if !cache.Enabled() {
+		httpError(w, r, fmt.Errorf("no cache in use"), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeJSON(w, r, cache.WarmupProgress())
+		return
+	}
+
+	accounts := 1000
+	if r.Form.Has("accounts") {
+		accounts, err = strconv.Atoi(r.Form.Get("accounts"))
+		if err != nil || accounts < 1 {
+			httpError(w, r, fmt.Errorf("invalid account count: %s", r.Form.Get("accounts")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !cache.Available() {
+		httpError(w, r, cache.ErrUnavailable, http.StatusServiceUnavailable)
+		return
+	}
+
+	err = cache.StartWarmup(accounts)
+	if errors.Is(err, cache.ErrWarmupRunning) {
+		httpError(w, r, err, http.StatusConflict)
+		return
+	} else if err != nil {
+		httpError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, r, cache.WarmupProgress())
+	slog.InfoContext(r.Context(), "admin started a cache warm-up", "path", r.URL.Path, "admin", userDiscordId, "accounts", accounts)
+}
+
+// saveHistoryTarget resolves the account and save a save history request is
+// about: the session save in slot if it is given, else the system save.
+func saveHistoryTarget(r *http.Request) ([]byte, int, int, error) {
+	slot := db.SystemSlot
+	if r.Form.Has("slot") {
+		var err error
+		slot, err = strconv.Atoi(r.Form.Get("slot"))
+		if err != nil || slot < 0 || slot >= defs.SessionSlotCount {
+			return nil, 0, http.StatusBadRequest, fmt.Errorf("invalid slot id: %s", r.Form.Get("slot"))
+		}
+	}
+
+	uuid, err := db.FetchUUIDFromUsername(r.Context(), r.Form.Get("username"))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, 0, http.StatusNotFound, fmt.Errorf("username does not exist on the server")
+	} else if err != nil {
+		return nil, 0, http.StatusInternalServerError, fmt.Errorf("failed to look up username: %w", err)
+	}
+
+	return uuid, slot, 0, nil
+}
+
+// saveVersionParam parses a save version id; "current" or an absent one is
+// the current save.
+func saveVersionParam(r *http.Request, name string) (int64, error) {
+	raw := r.Form.Get(name)
+	if raw == "" || raw == "current" {
+		return storage.CurrentVersion, nil
+	}
+
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid %s version: %s", name, raw)
+	}
+
+	return id, nil
+}
+
+// handleAdminSaveHistory lists the archived versions of a player's system
+// save, or of the session save in slot.
+func handleAdminSaveHistory(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		httpError(w, r, fmt.Errorf("failed to parse request form: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	uuid, err := uuidFromRequest(r)
+	if err != nil {
+		httpError(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	userDiscordId, err := db.FetchDiscordIdByUUID(r.Context(), uuid)
+	if err != nil {
+		httpError(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	hasRole, err := account.IsUserDiscordAdmin(userDiscordId, account.DiscordGuildID)
+	if !hasRole || err != nil {
+		httpError(w, r, fmt.Errorf("user does not have the required role"), http.StatusForbidden)
+		return
+	}
+
+	target, slot, status, err := saveHistoryTarget(r)
+	if err != nil {
+		httpError(w, r, err, status)
+		return
+	}
+
+	versions, err := storage.SaveHistory(r.Context(), target, slot)
+	if err != nil {
+		httpError(w, r, fmt.Errorf("failed to list save history: %w", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, versions)
+	slog.InfoContext(r.Context(), "admin listed save history", "path", r.URL.Path, "admin", userDiscordId, "username", r.Form.Get("username"), "slot", slot)
+}
+
+// handleAdminSaveHistoryDiff lists what changed in a save between the
+// versions from and to, each the current save if not given.
+func handleAdminSaveHistoryDiff(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		httpError(w, r, fmt.Errorf("failed to parse request form: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	uuid, err := uuidFromRequest(r)
+	if err != nil {
+		httpError(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	userDiscordId, err := db.FetchDiscordIdByUUID(r.Context(), uuid)
+	if err != nil {
+		httpError(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	hasRole, err := account.IsUserDiscordAdmin(userDiscordId, account.DiscordGuildID)
+	if !hasRole || err != nil {
+		httpError(w, r, fmt.Errorf("user does not have the required role"), http.StatusForbidden)
+		return
+	}
+
+	target, slot, status, err := saveHistoryTarget(r)
+	if err != nil {
+		httpError(w, r, err, status)
+		return
+	}
+
+	from, err := saveVersionParam(r, "from")
+	if err != nil {
+		httpError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	to, err := saveVersionParam(r, "to")
+	if err != nil {
+		httpError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	changes, err := storage.DiffSaveVersions(r.Context(), target, slot, from, to)
+	if errors.Is(err, sql.ErrNoRows) {
+		httpError(w, r, fmt.Errorf("save not found: %w", err), http.StatusNotFound)
+		return
+	} else if err != nil {
+		httpError(w, r, fmt.Errorf("failed to diff save versions: %w", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, r, changes)
+	slog.InfoContext(r.Context(), "admin diffed save versions", "path", r.URL.Path, "admin", userDiscordId, "username", r.Form.Get("username"), "slot", slot, "from", from, "to", to)
+}
+
+// handleAdminSaveHistoryRestore makes an archived version a player's current
+// save. The save it replaces is archived, so a restore can be undone.
+func handleAdminSaveHistoryRestore(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		httpError(w, r, fmt.Errorf("failed to parse request form: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	uuid, err := uuidFromRequest(r)
+	if err != nil {
+		httpError(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	userDiscordId, err := db.FetchDiscordIdByUUID(r.Context(), uuid)
+	if err != nil {
+		httpError(w, r, err, http.StatusUnauthorized)
+		return
+	}
+
+	hasRole, err := account.IsUserDiscordAdmin(userDiscordId, account.DiscordGuildID)
+	if !hasRole || err != nil {
+		httpError(w, r, fmt.Errorf("user does not have the required role"), http.StatusForbidden)
+		return
+	}
+
+	target, slot, status, err := saveHistoryTarget(r)
+	if err != nil {
+		httpError(w, r, err, status)
+		return
+	}
+
+	version, err := saveVersionParam(r, "version")
+	if err != nil || version == storage.CurrentVersion {
+		httpError(w, r, fmt.Errorf("invalid version: %s", r.Form.Get("version")), http.StatusBadRequest)
+		return
+	}
+
+	err = storage.RestoreSaveVersion(r.Context(), target, slot, version)
+	if errors.Is(err, sql.ErrNoRows) {
+		httpError(w, r, fmt.Errorf("save version %d not found", version), http.StatusNotFound)
+		return
+	} else if err != nil {
+		httpError(w, r, fmt.Errorf("failed to restore save version: %w", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	slog.InfoContext(r.Context(), "admin restored save version", "path", r.URL.Path, "admin", userDiscordId, "username", r.Form.Get("username"), "slot", slot, "version", version)
 }
@@ -0,0 +1,165 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/cache"
+	"github.com/pagefaultgames/rogueserver/db"
+)
+
+// readyTimeout bounds each dependency check of /readyz.
+const readyTimeout = 2 * time.Second
+
+// shuttingDown turns /readyz to not ready so load balancers stop sending
+// traffic before the listener closes.
+var shuttingDown atomic.Bool
+
+// SetShuttingDown marks the server as not ready.
+func SetShuttingDown() {
+	shuttingDown.Store(true)
+}
+
+type ReadinessCheck struct {
+	Status  string `json:"status"`
+	Latency string `json:"latency,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	// circuit breaker state, for cache_breaker
+	State string `json:"state,omitempty"`
+}
+
+type ReadinessResponse struct {
+	Status string                    `json:"status"`
+	Checks map[string]ReadinessCheck `json:"checks,omitempty"`
+}
+
+// /healthz - the process is up
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, ReadinessResponse{Status: "ok"})
+}
+
+// /readyz - every dependency needed to serve requests is reachable. Without
+// the cache requests are served from the database, so a cache outage only
+// makes the server degraded, which still counts as ready.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		writeReadiness(w, r, http.StatusServiceUnavailable, ReadinessResponse{Status: "shutting down"})
+		return
+	}
+
+	checks := map[string]func(ctx context.Context) error{
+		"database": db.Ping,
+		"daily_seed": func(ctx context.Context) error {
+			exists, err := db.HasDailyRun(ctx)
+			if err == nil && !exists {
+				err = errors.New("no daily run seed for today")
+			}
+
+			return err
+		},
+	}
+
+	// the server can do without these
+	optional := map[string]bool{}
+
+	if cache.Enabled() {
+		checks["cache"] = cache.Ping
+		checks["redisjson"] = cache.PingJSON
+
+		optional["cache"] = true
+		optional["redisjson"] = true
+	}
+
+	response := ReadinessResponse{
+		Status: "ready",
+		Checks: make(map[string]ReadinessCheck, len(checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(ctx)
+
+			result := ReadinessCheck{Status: "ok", Latency: time.Since(start).String()}
+			if err != nil {
+				result.Status = "failed"
+				if optional[name] {
+					result.Status = "degraded"
+				}
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			response.Checks[name] = result
+			if err != nil {
+				degrade(&response, !optional[name])
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if cache.Enabled() {
+		result := ReadinessCheck{Status: "ok", State: cache.BreakerState()}
+		if !cache.Available() {
+			result.Status = "degraded"
+			degrade(&response, false)
+		}
+
+		response.Checks["cache_breaker"] = result
+	}
+
+	code := http.StatusOK
+	if response.Status == "not ready" {
+		code = http.StatusServiceUnavailable
+	}
+
+	writeReadiness(w, r, code, response)
+}
+
+// degrade lowers the overall status after a failed check. A degraded server
+// stays ready, a failed required check makes it not ready.
+func degrade(response *ReadinessResponse, required bool) {
+	if required {
+		response.Status = "not ready"
+	} else if response.Status == "ready" {
+		response.Status = "degraded"
+	}
+}
+
+func writeReadiness(w http.ResponseWriter, r *http.Request, code int, response ReadinessResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	writeJSON(w, r, response)
+}
@@ -0,0 +1,138 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/logging"
+	"github.com/pagefaultgames/rogueserver/metrics"
+)
+
+// RequestIDHeader carries the id of a request in its response.
+const RequestIDHeader = "X-Request-Id"
+
+// RequestID returns the id Instrument assigned to the request ctx belongs to.
+func RequestID(ctx context.Context) string {
+	return logging.RequestID(ctx)
+}
+
+// Instrument wraps next, which serves the routes of mux, with request metrics
+// and an access log line per request. Both are labelled with the mux pattern
+// the request matched rather than its path, so path values like the save
+// slot don't multiply the series.
+func Instrument(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := newRequestID()
+		w.Header().Set(RequestIDHeader, id)
+		r = r.WithContext(logging.WithRequest(r.Context(), id))
+
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		route := routeOf(mux, r)
+		duration := time.Since(start)
+
+		metrics.HTTPRequests.WithLabelValues(route, strconv.Itoa(rw.status)).Inc()
+		metrics.HTTPDuration.WithLabelValues(route).Observe(duration.Seconds())
+		metrics.HTTPResponseSize.WithLabelValues(route).Observe(float64(rw.written))
+
+		slog.InfoContext(r.Context(), "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", route,
+			"status", rw.status,
+			"bytes", rw.written,
+			"duration", duration,
+			"remote", r.RemoteAddr,
+		)
+	})
+}
+
+// Timeout gives each request handled by next a deadline. The cache and
+// database calls made for a request give up once it has passed or the client
+// has gone away.
+func Timeout(next http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// routeOf returns the pattern of mux that r matches. CORS preflights are
+// answered before the mux and unknown routes share a single label.
+func routeOf(mux *http.ServeMux, r *http.Request) string {
+	if r.Method == http.MethodOptions {
+		return "OPTIONS"
+	}
+
+	_, pattern := mux.Handler(r)
+	if pattern == "" {
+		return "unmatched"
+	}
+
+	return pattern
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// responseWriter records the status code and body size of a response.
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	written     int
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+
+	n, err := w.ResponseWriter.Write(b)
+	w.written += n
+
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
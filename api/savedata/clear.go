@@ -18,11 +18,15 @@
 package savedata
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
-	"log"
+	"log/slog"
 
+	"github.com/pagefaultgames/rogueserver/api/daily"
 	"github.com/pagefaultgames/rogueserver/db"
 	"github.com/pagefaultgames/rogueserver/defs"
+	"github.com/pagefaultgames/rogueserver/storage"
 )
 
 type ClearResponse struct {
@@ -30,12 +34,12 @@ type ClearResponse struct {
 	Error   string `json:"error"`
 }
 
-// /savedata/clear - mark session save data as cleared and delete
-func Clear(uuid []byte, slot int, seed string, save defs.SessionSaveData) (ClearResponse, error) {
+// /savedata/clear - mark session save data as cleared, record it in the run history and delete
+func Clear(ctx context.Context, uuid []byte, slot int, seed string, save defs.SessionSaveData) (ClearResponse, error) {
 	var response ClearResponse
-	err := db.UpdateAccountLastActivity(uuid)
+	err := storage.UpdateAccountLastActivity(ctx, uuid)
 	if err != nil {
-		log.Print("failed to update account last activity")
+		slog.Warn("failed to update account last activity", "uuid", base64.StdEncoding.EncodeToString(uuid), "error", err)
 	}
 
 	if slot < 0 || slot >= defs.SessionSlotCount {
@@ -50,26 +54,47 @@ func Clear(uuid []byte, slot int, seed string, save defs.SessionSaveData) (Clear
 			waveCompleted--
 		}
 
-		if save.Score >= 20000 {
-			db.SetAccountBanned(uuid, true)
+		if DailyBanScore > 0 && save.Score >= DailyBanScore {
+			err = daily.SetBanned(ctx, uuid, true)
+			if err != nil {
+				slog.Error("failed to ban account", "uuid", base64.StdEncoding.EncodeToString(uuid), "error", err)
+			}
 		}
 
-		err = db.AddOrUpdateAccountDailyRun(uuid, save.Score, waveCompleted)
+		err = daily.RecordRun(ctx, uuid, save.Score, waveCompleted)
 		if err != nil {
-			log.Printf("failed to add or update daily run record: %s", err)
+			slog.Error("failed to add or update daily run record", "uuid", base64.StdEncoding.EncodeToString(uuid), "error", err)
 		}
 	}
 
 	if sessionCompleted {
-		response.Success, err = db.TryAddSeedCompletion(uuid, save.Seed, int(save.GameMode))
+		response.Success, err = db.TryAddSeedCompletion(ctx, uuid, save.Seed, int(save.GameMode))
 		if err != nil {
-			log.Printf("failed to mark seed as completed: %s", err)
+			slog.Error("failed to mark seed as completed", "uuid", base64.StdEncoding.EncodeToString(uuid), "error", err)
 		}
 	}
 
-	err = db.DeleteSessionSaveData(uuid, slot)
+	// only the first clear of a seed counts as a speedrun
+	if response.Success {
+		err = recordClearTime(ctx, uuid, slot, save)
+		if err != nil {
+			slog.Warn("failed to record clear time", "uuid", base64.StdEncoding.EncodeToString(uuid), "error", err)
+		}
+	}
+
+	result := defs.SessionHistoryLoss
+	if sessionCompleted {
+		result = defs.SessionHistoryWin
+	}
+
+	_, err = db.AddSessionHistory(ctx, uuid, sessionHistory(save, result))
+	if err != nil {
+		slog.Error("failed to record session history", "uuid", base64.StdEncoding.EncodeToString(uuid), "error", err)
+	}
+
+	err = storage.DeleteSessionSaveData(ctx, uuid, slot)
 	if err != nil {
-		log.Printf("failed to delete session save data: %s", err)
+		slog.Error("failed to delete session save data", "uuid", base64.StdEncoding.EncodeToString(uuid), "slot", slot, "error", err)
 	}
 
 	return response, nil
@@ -21,6 +21,9 @@ import (
 	"github.com/pagefaultgames/rogueserver/defs"
 )
 
+// DailyBanScore is the daily run score that gets an account banned, 0 disables it.
+var DailyBanScore = 20000
+
 func validateSessionCompleted(session defs.SessionSaveData) bool {
 	switch session.GameMode {
 	case 0:
@@ -18,18 +18,20 @@
 package savedata
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
-	"log"
+	"log/slog"
 
-	"github.com/pagefaultgames/rogueserver/db"
 	"github.com/pagefaultgames/rogueserver/defs"
+	"github.com/pagefaultgames/rogueserver/storage"
 )
 
 // /savedata/delete - delete save data
-func Delete(uuid []byte, datatype, slot int) error {
-	err := db.UpdateAccountLastActivity(uuid)
+func Delete(ctx context.Context, uuid []byte, datatype, slot int) error {
+	err := storage.UpdateAccountLastActivity(ctx, uuid)
 	if err != nil {
-		log.Print("failed to update account last activity")
+		slog.Warn("failed to update account last activity", "uuid", base64.StdEncoding.EncodeToString(uuid), "error", err)
 	}
 
 	switch datatype {
@@ -39,7 +41,7 @@ func Delete(uuid []byte, datatype, slot int) error {
 			break
 		}
 
-		err = db.DeleteSessionSaveData(uuid, slot)
+		err = storage.DeleteSessionSaveData(ctx, uuid, slot)
 	default:
 		err = fmt.Errorf("invalid data type")
 	}
@@ -18,26 +18,28 @@
 package savedata
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/pagefaultgames/rogueserver/db"
 	"github.com/pagefaultgames/rogueserver/defs"
+	"github.com/pagefaultgames/rogueserver/storage"
 )
 
 // /savedata/newclear - return whether a session is a new clear for its seed
-func NewClear(uuid []byte, slot int) (bool, error) {
+func NewClear(ctx context.Context, uuid []byte, slot int) (bool, error) {
 	if slot < 0 || slot >= defs.SessionSlotCount {
 		return false, fmt.Errorf("slot id %d out of range", slot)
 	}
 
-	session, err := db.ReadSessionSaveData(uuid, slot)
+	session, err := storage.ReadSessionSaveData(ctx, uuid, slot)
 	if err != nil {
 		return false, err
 	}
 
-	completed, err := db.ReadSeedCompleted(uuid, session.Seed)
+	completed, err := db.ReadSeedCompleted(ctx, uuid, session.Seed)
 	if err != nil {
-		return false, fmt.Errorf("failed to read seed completed: %s", err)
+		return false, fmt.Errorf("failed to read seed completed: %w", err)
 	}
 
 	return !completed, nil
@@ -0,0 +1,41 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package savedata
+
+import "fmt"
+
+// RevisionError is returned when an update was made against an older revision
+// of a save than the stored one. The client should refetch and retry.
+type RevisionError struct {
+	Part    string // "system" or "session"
+	Current int
+}
+
+func (e *RevisionError) Error() string {
+	return fmt.Sprintf("%s save out of date: current revision is %d", e.Part, e.Current)
+}
+
+// checkRevision compares the revision an update was based on with the stored
+// one, which is 0 for a save that doesn't exist yet.
+func checkRevision(part string, sent, current int) error {
+	if sent != current {
+		return &RevisionError{Part: part, Current: current}
+	}
+
+	return nil
+}
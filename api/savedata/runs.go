@@ -0,0 +1,58 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package savedata
+
+import (
+	"context"
+
+	"github.com/pagefaultgames/rogueserver/db"
+	"github.com/pagefaultgames/rogueserver/defs"
+)
+
+// sessionHistory is what the run history keeps of a finished session.
+func sessionHistory(save defs.SessionSaveData, result defs.SessionHistoryResult) defs.SessionHistoryData {
+	return defs.SessionHistoryData{
+		Seed:        save.Seed,
+		PlayTime:    save.PlayTime,
+		Result:      result,
+		GameMode:    save.GameMode,
+		Party:       save.Party,
+		Modifiers:   save.Modifiers,
+		Money:       save.Money,
+		Score:       save.Score,
+		WaveIndex:   save.WaveIndex,
+		BattleType:  save.BattleType,
+		GameVersion: save.GameVersion,
+		Timestamp:   save.Timestamp,
+	}
+}
+
+// /savedata/runs - fetch a page of the player's finished runs
+func Runs(ctx context.Context, uuid []byte, page int) ([]defs.SessionHistorySummary, error) {
+	return db.FetchSessionHistory(ctx, uuid, page)
+}
+
+// /savedata/runs/pagecount - fetch the number of pages of finished runs
+func RunPageCount(ctx context.Context, uuid []byte) (int, error) {
+	return db.FetchSessionHistoryPageCount(ctx, uuid)
+}
+
+// /savedata/runs/{id} - fetch a finished run
+func Run(ctx context.Context, uuid []byte, id int64) (defs.SessionHistoryData, error) {
+	return db.FetchSessionHistoryRun(ctx, uuid, id)
+}
@@ -18,56 +18,51 @@
 package savedata
 
 import (
+	"context"
 	"encoding/base64"
-	"errors"
-	"log"
+	"fmt"
+	"log/slog"
 
-	"github.com/pagefaultgames/rogueserver/cache"
-	"github.com/pagefaultgames/rogueserver/db"
 	"github.com/pagefaultgames/rogueserver/defs"
-	"github.com/redis/go-redis/v9"
+	"github.com/pagefaultgames/rogueserver/storage"
 )
 
-func GetSession(uuid []byte, slot int) (defs.SessionSaveData, error) {
-	log.Println("GetSession")
-
-	encodedUUID := base64.StdEncoding.EncodeToString(uuid)
-
-	session, err := cache.ReadSessionSaveData(uuid, slot)
-
-	if errors.Is(err, redis.Nil) {
-		// 캐시에 저장된 세션 정보가 없으면
-		log.Printf("세션 정보가 캐시에 없습니다.(key : %s) : %s", encodedUUID, err)
-		session, err = db.ReadSessionSaveData(uuid, slot)
-		log.Printf("세션 정보를 DB에서 찾습니다.")
-
-		if err == nil {
-			// DB에서 세션 값을 가져왔을 때만
-			UpdateSession(uuid, slot, session)
-		}
-	}
-
+func GetSession(ctx context.Context, uuid []byte, slot int) (defs.SessionSaveData, error) {
+	session, err := storage.ReadSessionSaveData(ctx, uuid, slot)
 	if err != nil {
-		log.Printf("Fail to Get Session (key : %s) : %s", encodedUUID, err)
+		slog.Debug("failed to get session", "uuid", base64.StdEncoding.EncodeToString(uuid), "slot", slot, "error", err)
 		return session, err
 	}
 
 	return session, nil
 }
 
-func UpdateSession(uuid []byte, slot int, data defs.SessionSaveData) error {
-	//err := db.StoreSessionSaveData(uuid, data, slot)
-	err := cache.StoreSessionSaveData(uuid, data, slot)
+// UpdateSession stores a session save made against data.Revision and returns
+// its new revision.
+func UpdateSession(ctx context.Context, uuid []byte, slot int, data defs.SessionSaveData) (int, error) {
+	sent := data.Revision
+	data.Revision++
+
+	err := storage.UpdateSessionSaveData(ctx, uuid, data, slot, func(current *defs.SessionSaveData) error {
+		if current == nil {
+			return checkRevision("session", sent, 0)
+		}
+
+		if current.Seed == data.Seed && current.WaveIndex > data.WaveIndex {
+			return fmt.Errorf("%w: existing wave index is greater", ErrOutOfDate)
+		}
+
+		return checkRevision("session", sent, current.Revision)
+	})
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	return data.Revision, nil
 }
 
-func DeleteSession(uuid []byte, slot int) error {
-	//err := db.DeleteSessionSaveData(uuid, slot)
-	err := cache.DeleteSessionSaveData(uuid, slot)
+func DeleteSession(ctx context.Context, uuid []byte, slot int) error {
+	err := storage.DeleteSessionSaveData(ctx, uuid, slot)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,127 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package savedata
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pagefaultgames/rogueserver/db"
+	"github.com/pagefaultgames/rogueserver/defs"
+	"github.com/pagefaultgames/rogueserver/storage"
+)
+
+// challengeSet returns the active challenges in the form speedruns are
+// grouped by: "<id>:<value>" of each, by id, comma separated.
+func challengeSet(challenges []defs.ChallengeData) string {
+	var active []defs.ChallengeData
+	for _, challenge := range challenges {
+		if challenge.Value != 0 {
+			active = append(active, challenge)
+		}
+	}
+
+	slices.SortFunc(active, func(a, b defs.ChallengeData) int {
+		return a.Id - b.Id
+	})
+
+	set := make([]string, len(active))
+	for i, challenge := range active {
+		set[i] = fmt.Sprintf("%d:%d", challenge.Id, challenge.Value)
+	}
+
+	return strings.Join(set, ",")
+}
+
+// ParseChallengeSet reads a challenge set as challengeSet writes it, in any
+// order, and returns it the way speedruns are grouped by.
+func ParseChallengeSet(set string) (string, error) {
+	if set == "" {
+		return "", nil
+	}
+
+	var challenges []defs.ChallengeData
+	for _, field := range strings.Split(set, ",") {
+		id, value, ok := strings.Cut(field, ":")
+		if !ok {
+			return "", fmt.Errorf("invalid challenge %q, expected <id>:<value>", field)
+		}
+
+		var challenge defs.ChallengeData
+		var err error
+		challenge.Id, err = strconv.Atoi(id)
+		if err != nil {
+			return "", fmt.Errorf("invalid challenge id %q", id)
+		}
+
+		challenge.Value, err = strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid challenge value %q", value)
+		}
+
+		challenges = append(challenges, challenge)
+	}
+
+	return challengeSet(challenges), nil
+}
+
+// recordClearTime records the completion time of a cleared session. The
+// session stored in the slot has to be the same run, and can't have taken
+// longer than the clear claims.
+func recordClearTime(ctx context.Context, uuid []byte, slot int, save defs.SessionSaveData) error {
+	stored, err := storage.ReadSessionSaveData(ctx, uuid, slot)
+	if err != nil {
+		return fmt.Errorf("failed to read stored session: %w", err)
+	}
+
+	if stored.Seed != save.Seed || stored.GameMode != save.GameMode || challengeSet(stored.Challenges) != challengeSet(save.Challenges) {
+		return fmt.Errorf("cleared session doesn't match the stored one")
+	}
+
+	if save.PlayTime <= 0 || stored.PlayTime > save.PlayTime {
+		return fmt.Errorf("play time %d doesn't match the stored %d", save.PlayTime, stored.PlayTime)
+	}
+
+	_, err = db.AddSpeedrun(ctx, uuid, defs.Speedrun{
+		GameMode:    save.GameMode,
+		Challenges:  challengeSet(save.Challenges),
+		PlayTime:    save.PlayTime,
+		GameVersion: save.GameVersion,
+		Seed:        save.Seed,
+	})
+
+	return err
+}
+
+// /speedruns - fetch a page of the fastest clears of a game mode and challenge set
+func Speedruns(ctx context.Context, gameMode defs.GameMode, challenges, version string, page int) ([]defs.Speedrun, error) {
+	return db.FetchSpeedruns(ctx, gameMode, challenges, version, page)
+}
+
+// /speedruns/pagecount - fetch the number of pages of fastest clears
+func SpeedrunPageCount(ctx context.Context, gameMode defs.GameMode, challenges, version string) (int, error) {
+	return db.FetchSpeedrunPageCount(ctx, gameMode, challenges, version)
+}
+
+// /speedruns/me - fetch the player's fastest clear of each game mode and challenge set
+func PersonalBests(ctx context.Context, uuid []byte, version string) ([]defs.Speedrun, error) {
+	return db.FetchPersonalBests(ctx, uuid, version)
+}
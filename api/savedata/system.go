@@ -18,70 +18,53 @@
 package savedata
 
 import (
+	"context"
 	"fmt"
-	"os"
-	"log"
-	"encoding/base64"
-	"errors"
 
-	"github.com/pagefaultgames/rogueserver/db"
 	"github.com/pagefaultgames/rogueserver/defs"
-	"github.com/pagefaultgames/rogueserver/cache"
-	"github.com/redis/go-redis/v9"
+	"github.com/pagefaultgames/rogueserver/storage"
 )
 
-func GetSystem(uuid []byte) (defs.SystemSaveData, error) {
-	var system defs.SystemSaveData
-	var err error
-
-	encodedUUID := base64.StdEncoding.EncodeToString(uuid)
-
-	system, err = cache.ReadSystemSaveData(uuid)
-
-	if errors.Is(err, redis.Nil) {
-		// 캐시에 저장된 세션 정보가 없으면
-		log.Printf("시스템 정보가 캐시에 없습니다.(key : %s) : %s", encodedUUID, err)
-
-		if os.Getenv("S3_SYSTEM_BUCKET_NAME") != "" { // use S3
-			system, err = db.GetSystemSaveFromS3(uuid)
-		} else { // use database
-			//log.Println("use database GetSystem");
-			system, err = db.ReadSystemSaveData(uuid)
-		}
-		log.Printf("시스템 정보를 DB에서 찾습니다.")
-
-		if err != nil {
-			return system, err
-		}
+func GetSystem(ctx context.Context, uuid []byte) (defs.SystemSaveData, error) {
+	system, err := storage.ReadSystemSaveData(ctx, uuid)
+	if err != nil {
+		return system, err
 	}
 
 	return system, nil
 }
 
-func UpdateSystem(uuid []byte, data defs.SystemSaveData) error {
+// UpdateSystem stores a system save made against data.Revision, then the
+// account stats from it, and returns the new revision.
+func UpdateSystem(ctx context.Context, uuid []byte, data defs.SystemSaveData) (int, error) {
 	if data.TrainerId == 0 && data.SecretId == 0 {
-		return fmt.Errorf("invalid system data")
+		return 0, fmt.Errorf("%w: invalid system data", ErrInvalidSave)
 	}
 
-	err := db.UpdateAccountStats(uuid, data.GameStats, data.VoucherCounts)
+	sent := data.Revision
+	data.Revision++
+
+	err := storage.UpdateSystemSaveData(ctx, uuid, data, func(current *defs.SystemSaveData) error {
+		if current == nil {
+			return checkRevision("system", sent, 0)
+		}
+
+		return checkRevision("system", sent, current.Revision)
+	})
 	if err != nil {
-		return fmt.Errorf("failed to update account stats: %s", err)
+		return 0, err
 	}
 
-	if os.Getenv("S3_SYSTEM_BUCKET_NAME") != "" { // use S3
-		err = db.StoreSystemSaveDataS3(uuid, data)
-	} else {
-		err = db.StoreSystemSaveData(uuid, data)
-	}
+	err = storage.UpdateAccountStats(ctx, uuid, data.GameStats, data.VoucherCounts)
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("failed to update account stats: %w", err)
 	}
 
-	return nil
+	return data.Revision, nil
 }
 
-func DeleteSystem(uuid []byte) error {
-	err := db.DeleteSystemSaveData(uuid)
+func DeleteSystem(ctx context.Context, uuid []byte) error {
+	err := storage.DeleteSystemSaveData(ctx, uuid)
 	if err != nil {
 		return err
 	}
@@ -18,18 +18,20 @@
 package savedata
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
-	"log"
+	"log/slog"
 
-	"github.com/pagefaultgames/rogueserver/cache"
 	"github.com/pagefaultgames/rogueserver/defs"
+	"github.com/pagefaultgames/rogueserver/storage"
 )
 
 // /savedata/update - update save data
-func Update(uuid []byte, slot int, save any) error {
-	err := cache.UpdateAccountLastActivity(uuid)
+func Update(ctx context.Context, uuid []byte, slot int, save any) error {
+	err := storage.UpdateAccountLastActivity(ctx, uuid)
 	if err != nil {
-		log.Print("failed to update account last activity")
+		slog.Warn("failed to update account last activity", "uuid", base64.StdEncoding.EncodeToString(uuid), "error", err)
 	}
 
 	switch save := save.(type) {
@@ -38,20 +40,17 @@ func Update(uuid []byte, slot int, save any) error {
 			return fmt.Errorf("invalid system data")
 		}
 
-		err = cache.UpdateAccountStats(uuid, save.GameStats, save.VoucherCounts)
-		//err = db.UpdateAccountStats(uuid, save.GameStats, save.VoucherCounts)
+		err = storage.UpdateAccountStats(ctx, uuid, save.GameStats, save.VoucherCounts)
 		if err != nil {
-			return fmt.Errorf("failed to update account stats: %s", err)
+			return fmt.Errorf("failed to update account stats: %w", err)
 		}
-		//return db.StoreSystemSaveData(uuid, save)
-		return cache.StoreSystemSaveData(uuid, save)
+		return storage.StoreSystemSaveData(ctx, uuid, save)
 
 	case defs.SessionSaveData: // Session
 		if slot < 0 || slot >= defs.SessionSlotCount {
 			return fmt.Errorf("slot id %d out of range", slot)
 		}
-		//return db.StoreSessionSaveData(uuid, save, slot)
-		return cache.StoreSessionSaveData(uuid, save, slot)
+		return storage.StoreSessionSaveData(ctx, uuid, save, slot)
 
 	default:
 		return fmt.Errorf("invalid data type")
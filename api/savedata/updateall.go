@@ -0,0 +1,111 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package savedata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/pagefaultgames/rogueserver/defs"
+	"github.com/pagefaultgames/rogueserver/storage"
+)
+
+var (
+	// ErrInvalidSave is returned for updates that can never be stored.
+	ErrInvalidSave = errors.New("invalid save data")
+
+	// ErrOutOfDate is returned when the stored state is newer than the update,
+	// or another client session owns the account.
+	ErrOutOfDate = errors.New("session out of date")
+)
+
+// /savedata/updateall - validate and store a session and the system save
+// together; both must be made against their stored revisions. Returns the new
+// session and system revisions.
+func UpdateAll(ctx context.Context, uuid []byte, clientSessionId string, slot int, session defs.SessionSaveData, system defs.SystemSaveData) (int, int, error) {
+	if clientSessionId == "" {
+		return 0, 0, fmt.Errorf("%w: missing clientSessionId", ErrInvalidSave)
+	}
+
+	if slot < 0 || slot >= defs.SessionSlotCount {
+		return 0, 0, fmt.Errorf("%w: slot id %d out of range", ErrInvalidSave, slot)
+	}
+
+	if system.TrainerId == 0 && system.SecretId == 0 {
+		return 0, 0, fmt.Errorf("%w: invalid system data", ErrInvalidSave)
+	}
+
+	stats, ok := system.GameStats.(map[string]interface{})
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: no playtime found", ErrInvalidSave)
+	}
+
+	playtime, ok := stats["playTime"].(float64)
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: no playtime found", ErrInvalidSave)
+	}
+
+	sentSession, sentSystem := session.Revision, system.Revision
+	session.Revision++
+	system.Revision++
+
+	update := defs.SaveUpdate{
+		ClientSessionId: clientSessionId,
+		Slot:            slot,
+		Session:         session,
+		System:          system,
+	}
+
+	err := storage.UpdateAll(ctx, uuid, update, func(stored defs.SaveSnapshot) error {
+		if stored.ActiveClientSession != "" && stored.ActiveClientSession != clientSessionId {
+			return fmt.Errorf("%w: not active", ErrOutOfDate)
+		}
+
+		if stored.TrainerId > 0 || stored.SecretId > 0 {
+			if system.TrainerId != stored.TrainerId || system.SecretId != stored.SecretId {
+				return fmt.Errorf("%w: stored trainer or secret ID does not match", ErrOutOfDate)
+			}
+		}
+
+		if float64(stored.PlayTime) > playtime {
+			return fmt.Errorf("%w: existing playtime is greater", ErrOutOfDate)
+		}
+
+		if stored.Session != nil && stored.Session.Seed == session.Seed && stored.Session.WaveIndex > session.WaveIndex {
+			return fmt.Errorf("%w: existing wave index is greater", ErrOutOfDate)
+		}
+
+		storedSession := 0
+		if stored.Session != nil {
+			storedSession = stored.Session.Revision
+		}
+
+		err := checkRevision("session", sentSession, storedSession)
+		if err != nil {
+			return err
+		}
+
+		return checkRevision("system", sentSystem, stored.SystemRevision)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return session.Revision, system.Revision, nil
+}
@@ -18,7 +18,8 @@
 package api
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"time"
 
 	"github.com/pagefaultgames/rogueserver/db"
@@ -34,9 +35,9 @@ var (
 
 func scheduleStatRefresh() error {
 	_, err := scheduler.AddFunc("@every 30s", func() {
-		err := updateStats()
+		err := updateStats(context.Background())
 		if err != nil {
-			log.Printf("failed to update stats: %s", err)
+			slog.Error("failed to update stats", "error", err)
 		}
 	})
 	if err != nil {
@@ -47,19 +48,19 @@ func scheduleStatRefresh() error {
 	return nil
 }
 
-func updateStats() error {
+func updateStats(ctx context.Context) error {
 	var err error
-	playerCount, err = db.FetchPlayerCount()
+	playerCount, err = db.FetchPlayerCount(ctx)
 	if err != nil {
 		return err
 	}
 
-	battleCount, err = db.FetchBattleCount()
+	battleCount, err = db.FetchBattleCount(ctx)
 	if err != nil {
 		return err
 	}
 
-	classicSessionCount, err = db.FetchClassicSessionCount()
+	classicSessionCount, err = db.FetchClassicSessionCount(ctx)
 	if err != nil {
 		return err
 	}
@@ -1,25 +1,22 @@
 package cache
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"slices"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/pagefaultgames/rogueserver/defs"
 	"github.com/redis/go-redis/v9"
 )
 
-// DB에서 가져온 AccountDBRow를 Redis 캐시에 저장하는 함수
-func CacheAccountInRedis(dbRow defs.AccountDBRow) error {
-
-	// Redis 키 생성: UUID (binary)를 16진수 문자열로 변환하고 접두사 추가
-	redisKey := "session:" + base64.StdEncoding.EncodeToString(dbRow.UUID)
-
-	// AccountDBRow를 AccountRedisData로 변환
+// accountToRedisData converts an accounts row into its cached form.
+func accountToRedisData(dbRow defs.AccountDBRow) defs.AccountRedisData {
 	redisData := defs.AccountRedisData{
 		Username:   dbRow.Username,
 		Hash:       base64.StdEncoding.EncodeToString(dbRow.Hash),
@@ -50,180 +47,255 @@ func CacheAccountInRedis(dbRow defs.AccountDBRow) error {
 		redisData.GoogleID = &dbRow.GoogleID.String
 	}
 
+	return redisData
+}
+
+// accountStatsToRedisData converts an accountStats row into its cached form.
+func accountStatsToRedisData(dbStats defs.AccountStatsData) defs.AccountStatsRedisData {
+	return defs.AccountStatsRedisData{
+		PlayTime:              dbStats.PlayTime,
+		Battles:               dbStats.Battles,
+		ClassicSessionsPlayed: dbStats.ClassicSessionsPlayed,
+		SessionsWon:           dbStats.SessionsWon,
+		HighestEndlessWave:    dbStats.HighestEndlessWave,
+		HighestLevel:          dbStats.HighestLevel,
+		PokemonSeen:           dbStats.PokemonSeen,
+		PokemonDefeated:       dbStats.PokemonDefeated,
+		PokemonCaught:         dbStats.PokemonCaught,
+		PokemonHatched:        dbStats.PokemonHatched,
+		EggsPulled:            dbStats.EggsPulled,
+		RegularVouchers:       dbStats.RegularVouchers,
+		PlusVouchers:          dbStats.PlusVouchers,
+		PremiumVouchers:       dbStats.PremiumVouchers,
+		GoldenVouchers:        dbStats.GoldenVouchers,
+	}
+}
+
+// mergeAccountStats applies the game stats and voucher counts of a system
+// save on top of the cached stats, using the same columns as the database.
+func mergeAccountStats(current *defs.AccountStatsRedisData, stats defs.GameStats, voucherCounts map[string]int) (*defs.AccountStatsRedisData, error) {
+	m, ok := stats.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected map[string]interface{}, got %T", stats)
+	}
+
+	validStatColumns := []string{"playTime", "battles", "classicSessionsPlayed", "sessionsWon", "highestEndlessWave", "highestLevel", "pokemonSeen", "pokemonDefeated", "pokemonCaught", "pokemonHatched", "eggsPulled"}
+	voucherColumnMap := map[string]string{
+		"0": "regularVouchers",
+		"1": "plusVouchers",
+		"2": "premiumVouchers",
+		"3": "goldenVouchers",
+	}
+
+	merged := make(map[string]int)
+	if current != nil {
+		raw, err := json.Marshal(current)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(raw, &merged)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for key, val := range m {
+		if !slices.Contains(validStatColumns, key) {
+			continue
+		}
+
+		floatVal, ok := val.(float64)
+		if !ok {
+			continue
+		}
+
+		merged[key] = int(floatVal)
+	}
+	for key, count := range voucherCounts {
+		columnName, ok := voucherColumnMap[key]
+		if !ok {
+			continue
+		}
+
+		merged[columnName] = count
+	}
+
+	raw, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+
+	var updated defs.AccountStatsRedisData
+	err = json.Unmarshal(raw, &updated)
+	if err != nil {
+		return nil, err
+	}
+
+	return &updated, nil
+}
+
+// DB에서 가져온 AccountDBRow를 Redis 캐시에 저장하는 함수
+func (s *redisStore) CacheAccount(ctx context.Context, dbRow defs.AccountDBRow) error {
+
+	// Redis 키 생성: UUID (binary)를 16진수 문자열로 변환하고 접두사 추가
+	redisKey := "session:" + base64.StdEncoding.EncodeToString(dbRow.UUID)
+
+	// AccountDBRow를 AccountRedisData로 변환
+	redisData := accountToRedisData(dbRow)
+
 	// JSON으로 마샬링
 	jsonData, err := json.Marshal(redisData)
 	if err != nil {
-		log.Printf("Redis 데이터 JSON 마샬링 오류 (키: %s): %s", redisKey, err)
+		slog.Debug("failed to marshal account", "key", redisKey, "error", err)
 		return err
 	}
 
 	// Redis에 저장
-	err = Rdb.JSONSet(Ctx, redisKey, "$.account", jsonData).Err()
+	err = s.client.JSONSet(ctx, redisKey, "$.account", jsonData).Err()
 	if err != nil {
-		log.Printf("Redis에 데이터 캐싱 오류 (키: %s): %s", redisKey, err)
+		slog.Debug("failed to cache account", "key", redisKey, "error", err)
 		return err
 	}
 
-	log.Printf("계정 정보가 Redis에 성공적으로 캐시되었습니다. Key: %s, Expiration: %s\n", redisKey, sessionDataTTL)
+	slog.Debug("cached account", "key", redisKey)
 	return nil
 }
 
 // CacheAccountStatsInRedis 함수는 AccountStatsData를 Redis에 캐시합니다.
 // dbStats는 DB에서 읽어온 AccountStatsData 구조체입니다.
-func CacheAccountStatsInRedis(uuid []byte, dbStats defs.AccountStatsData) error {
+func (s *redisStore) CacheAccountStats(ctx context.Context, uuid []byte, dbStats defs.AccountStatsData) error {
 
 	// Redis 키 생성
 	redisKey := "session:" + base64.StdEncoding.EncodeToString(uuid)
 
 	// AccountStatsData를 AccountStatsRedisData로 변환 (UUID 제외)
-	redisData := defs.AccountStatsRedisData{
-		PlayTime:              dbStats.PlayTime,
-		Battles:               dbStats.Battles,
-		ClassicSessionsPlayed: dbStats.ClassicSessionsPlayed,
-		SessionsWon:           dbStats.SessionsWon,
-		HighestEndlessWave:    dbStats.HighestEndlessWave,
-		HighestLevel:          dbStats.HighestLevel,
-		PokemonSeen:           dbStats.PokemonSeen,
-		PokemonDefeated:       dbStats.PokemonDefeated,
-		PokemonCaught:         dbStats.PokemonCaught,
-		PokemonHatched:        dbStats.PokemonHatched,
-		EggsPulled:            dbStats.EggsPulled,
-		RegularVouchers:       dbStats.RegularVouchers,
-		PlusVouchers:          dbStats.PlusVouchers,
-		PremiumVouchers:       dbStats.PremiumVouchers,
-		GoldenVouchers:        dbStats.GoldenVouchers,
-	}
+	redisData := accountStatsToRedisData(dbStats)
 
 	// Redis 저장용 데이터를 JSON으로 마샬링
 	jsonData, err := json.Marshal(redisData)
 	if err != nil {
-		log.Printf("통계 데이터 JSON 마샬링 오류 (키: %s): %s", redisKey, err)
+		slog.Debug("failed to marshal account stats", "key", redisKey, "error", err)
 		return err
 	}
 
 	// Redis에 JSON 데이터 저장
-	err = Rdb.JSONSet(Ctx, redisKey, "$.accountStats", jsonData).Err()
+	err = s.client.JSONSet(ctx, redisKey, "$.accountStats", jsonData).Err()
 
 	if err != nil {
-		log.Printf("Redis에 통계 데이터 캐싱 오류 (키: %s): %s", redisKey, err)
+		slog.Debug("failed to cache account stats", "key", redisKey, "error", err)
 		return err
 	}
 
-	log.Printf("계정 통계 데이터가 Redis에 성공적으로 캐시되었습니다. Key: %s, Expiration: %s\n", redisKey, sessionDataTTL)
+	slog.Debug("cached account stats", "key", redisKey)
 	return nil
 }
 
 // session 활성화
-func UpdateActiveSession(uuid []byte, sessionId string) error {
-
-	log.Printf("UpdateActiveSession uuid : %s, sessionId : %s", base64.StdEncoding.EncodeToString(uuid), sessionId)
+func (s *redisStore) UpdateActiveSession(ctx context.Context, uuid []byte, sessionId string) error {
 	redisKey := "session:" + base64.StdEncoding.EncodeToString(uuid)
+	slog.Debug("updating active session", "key", redisKey, "session_id", sessionId)
 	if sessionId == "" {
 		return fmt.Errorf("sessionId is empty")
 	}
-	return Rdb.JSONSet(Ctx, redisKey, "$.activeClientSession", fmt.Sprintf("\"%s\"", sessionId)).Err()
+
+	pipe := s.client.TxPipeline()
+	pipe.JSONSet(ctx, redisKey, "$.activeClientSession", strconv.Quote(sessionId))
+	s.markDirty(ctx, pipe, uuid, dirtyActiveSession)
+
+	_, err := pipe.Exec(ctx)
+	return err
 }
 
-// 현재 session이 활성화되어 있는지 확인, 비활성화 시 새롭게 활성화
-func IsActiveSession(uuid []byte, sessionId string) (bool, error) {
-	//var id string
+// 현재 활성화된 client session id 조회. 없거나 빈 문자열이면 ErrMiss 반환
+func (s *redisStore) FetchActiveSession(ctx context.Context, uuid []byte) (string, error) {
 	redisKey := "session:" + base64.StdEncoding.EncodeToString(uuid)
-	id, err := Rdb.JSONGet(Ctx, redisKey, ".activeClientSession").Result()
 
+	var id string
+	err := s.getJSON(ctx, redisKey, "$.activeClientSession", &id)
 	if err != nil {
-		// 초기화를 빈 문자열로 ""로 해서 확인하기
-		err = UpdateActiveSession(uuid, sessionId)
-		if err != nil {
-			log.Printf("fail to Set Active Session in redis")
-			return false, err
-		}
-		return true, nil
+		return "", err
+	}
+
+	if id == "" {
+		return "", fmt.Errorf("%w: %s $.activeClientSession", ErrMiss, redisKey)
 	}
 
-	id = strings.Trim(id, "\"") // 쌍따옴표 제거
-	log.Printf("id : %s, session id : %s", id, sessionId)
-	return id == "" || id == sessionId, nil
+	return id, nil
 }
 
 // StoreSessionToken stores a token-uuid pair in Redis with TTL.
-func StoreSessionToken(uuid []byte, token []byte) error {
+func (s *redisStore) StoreSessionToken(ctx context.Context, uuid []byte, token []byte) error {
+	return s.StoreSessionTokenTTL(ctx, uuid, token, sessionTokenTTL)
+}
+
+// StoreSessionTokenTTL stores a token-uuid pair that expires after ttl.
+func (s *redisStore) StoreSessionTokenTTL(ctx context.Context, uuid []byte, token []byte, ttl time.Duration) error {
 	key := "token:" + base64.StdEncoding.EncodeToString(token)
-	return Rdb.Set(Ctx, key, uuid, sessionTokenTTL).Err()
+	return s.client.Set(ctx, key, uuid, ttl).Err()
 }
 
 // FetchSessionToken retrieves the uuid for a given token from Redis.
-func FetchSessionToken(token []byte) ([]byte, error) {
+// An unknown token is reported as ErrMiss.
+func (s *redisStore) FetchSessionToken(ctx context.Context, token []byte) ([]byte, error) {
 	key := "token:" + base64.StdEncoding.EncodeToString(token)
-	return Rdb.Get(Ctx, key).Bytes()
+	uuid, err := s.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("%w: %s", ErrMiss, key)
+	}
+
+	return uuid, err
 }
 
 // RemoveSessionFromToken removes the token-uuid mapping from Redis.
-func RemoveSessionFromToken(token []byte) error {
+func (s *redisStore) RemoveSessionFromToken(ctx context.Context, token []byte) error {
 	key := "token:" + base64.StdEncoding.EncodeToString(token)
-	return Rdb.Del(Ctx, key).Err()
+	return s.client.Del(ctx, key).Err()
 }
 
-func FetchTrainerIds(uuid []byte) (int, int, error) {
-	log.Println("FetchTrainerIds")
+func (s *redisStore) FetchTrainerIds(ctx context.Context, uuid []byte) (int, int, error) {
 	redisKey := "session:" + base64.StdEncoding.EncodeToString(uuid)
 
-	// JSON.MGET을 사용하여 여러 경로의 값을 한 번에 가져올 수 있음
-	// 결과는 []interface{} 형태의 슬라이스로 오며, 각 요소는 해당 경로의 값 또는 nil
-	vals, err := Rdb.JSONMGet(Ctx, redisKey, "$.account.trainerId", "$.account.secretId").Result()
-
-	if err == redis.Nil {
-		return 0, 0, fmt.Errorf("캐시에서 UUID '%s'에 해당하는 계정을 찾을 수 없음: %w", uuid, err)
-	} else if err != nil {
-		return 0, 0, fmt.Errorf("RedisJSON.MGET 오류 (키: %s): %w", redisKey, err)
-	}
-
-	var trainerID int
-	if vals[0] != nil {
-		// RedisJSON은 숫자를 float64로 반환하는 경우가 많으므로 타입 변환 필요
-		if tidFloat, ok := vals[0].(float64); ok {
-			tidVal := int(tidFloat)
-			trainerID = tidVal
-		} else if tidInt, ok := vals[0].(int64); ok { // 또는 int64
-			tidVal := int(tidInt)
-			trainerID = tidVal
-		}
+	var account defs.AccountRedisData
+	err := s.getJSON(ctx, redisKey, "$.account", &account)
+	if err != nil {
+		return 0, 0, fmt.Errorf("캐시에서 계정 정보 조회 실패 (키: %s): %w", redisKey, err)
 	}
 
-	var secretID int
-	if vals[1] != nil {
-		if sidFloat, ok := vals[1].(float64); ok {
-			sidVal := int(sidFloat)
-			secretID = sidVal
-		} else if sidInt, ok := vals[1].(int64); ok {
-			sidVal := int(sidInt)
-			secretID = sidVal
-		}
+	var trainerID, secretID int
+	if account.TrainerID != nil {
+		trainerID = int(*account.TrainerID)
+	}
+	if account.SecretID != nil {
+		secretID = int(*account.SecretID)
 	}
 
 	return trainerID, secretID, nil
 }
 
 // 트레이너 아이디 업데이트
-func UpdateTrainerIds(trainerId, secretId int, uuid []byte) error {
+func (s *redisStore) UpdateTrainerIds(ctx context.Context, trainerId, secretId int, uuid []byte) error {
 
 	redisKey := "session:" + base64.StdEncoding.EncodeToString(uuid)
 
 	// Redis 파이프라인을 사용하여 여러 명령을 원자적으로 (또는 더 효율적으로) 실행
-	pipe := Rdb.Pipeline()
+	pipe := s.client.TxPipeline()
 
 	// 2. trainerId 업데이트
 	// JSON.SET key path value
 	// path는 "$.trainerId"
 	// value는 int 타입이므로 Redis가 JSON 숫자로 저장합니다.
-	pipe.JSONSet(Ctx, redisKey, "$.account.trainerId", trainerId)
+	pipe.JSONSet(ctx, redisKey, "$.account.trainerId", trainerId)
 
 	// 3. secretId 업데이트
-	pipe.JSONSet(Ctx, redisKey, "$.account.secretId", secretId)
+	pipe.JSONSet(ctx, redisKey, "$.account.secretId", secretId)
+
+	s.markDirty(ctx, pipe, uuid, dirtyAccount)
 
 	// 4. 파이프라인 실행
-	cmders, err := pipe.Exec(Ctx)
+	cmders, err := pipe.Exec(ctx)
 	if err != nil {
-		log.Printf("Redis 파이프라인 실행 오류 (키: %s): %s", redisKey, err)
+		slog.Debug("failed to update trainer ids", "key", redisKey, "error", err)
 		return err
 	}
 
@@ -236,17 +308,17 @@ func UpdateTrainerIds(trainerId, secretId int, uuid []byte) error {
 			}
 			// 파이프라인 내의 특정 명령 실패 시 롤백 전략이 필요할 수 있으나,
 			// 여기서는 일단 에러를 반환합니다.
-			log.Printf("Redis 파이프라인 내 '%s' 업데이트 실패 (키: %s): %s", fieldName, redisKey, cmd.Err())
+			slog.Debug("failed to update trainer ids", "key", redisKey, "field", fieldName, "error", cmd.Err())
 			return err
 		}
 		// log.Printf("Debug: Command %d result: %v", i, cmd.String())
 	}
 
-	log.Printf("키 %s의 trainerId가 %d로, secretId가 %d로 업데이트되었습니다.", redisKey, trainerId, secretId)
+	slog.Debug("updated trainer ids", "key", redisKey, "trainer_id", trainerId, "secret_id", secretId)
 	return nil
 }
 
-func UpdateAccountLastActivity(uuid []byte) error {
+func (s *redisStore) UpdateAccountLastActivity(ctx context.Context, uuid []byte) error {
 	redisKey := "session:" + base64.StdEncoding.EncodeToString(uuid)
 
 	// 2. 현재 UTC 시간을 ISO 8601 형식 문자열로 준비
@@ -262,26 +334,31 @@ func UpdateAccountLastActivity(uuid []byte) error {
 	// JSON.SET key path value
 	// path는 "$.lastActivity"
 	// value는 준비된 시간 문자열 (또는 숫자 타임스탬프)
-	err := Rdb.JSONSet(Ctx, redisKey, "$.account.lastActivity", currentTimeStr).Err()
+	pipe := s.client.TxPipeline()
+	// 문자열 값은 그대로 전달되므로 JSON 문자열로 따옴표 처리
+	pipe.JSONSet(ctx, redisKey, "$.account.lastActivity", strconv.Quote(currentTimeStr))
+	s.markDirty(ctx, pipe, uuid, dirtyAccount)
+
+	_, err := pipe.Exec(ctx)
 	if err != nil {
-		log.Printf("Redis JSON.SET lastActivity 오류 (키: %s): %s", redisKey, err)
+		slog.Debug("failed to update last activity", "key", redisKey, "error", err)
 		return err
 	}
 
 	// JSON.SET 결과 확인 (선택적)
 	// log.Printf("JSON.SET 결과: %v", cmdResult)
 
-	log.Printf("키 %s의 lastActivity가 '%s'로 업데이트되었습니다 (Redis).", redisKey, currentTimeStr)
+	slog.Debug("updated last activity", "key", redisKey, "last_activity", currentTimeStr)
 	return nil
 }
 
 // UpdateAccountStatsInRedis 함수는 Redis에 저장된 계정 통계를 업데이트합니다.
-func UpdateAccountStats(uuid []byte, stats defs.GameStats, voucherCounts map[string]int) error {
+func (s *redisStore) UpdateAccountStats(ctx context.Context, uuid []byte, stats defs.GameStats, voucherCounts map[string]int) error {
 
 	redisKey := "session:" + base64.StdEncoding.EncodeToString(uuid)
 
 	// Redis 파이프라인을 사용하여 여러 JSON.SET 명령을 효율적으로 실행
-	pipe := Rdb.Pipeline()
+	pipe := s.client.TxPipeline()
 	updateCount := 0
 
 	// 2. `stats` (GameStats) 처리
@@ -303,14 +380,14 @@ func UpdateAccountStats(uuid []byte, stats defs.GameStats, voucherCounts map[str
 		// DB 스키마는 int(11)이었으므로, float64로 온 값을 int로 변환
 		floatVal, ok := val.(float64)
 		if !ok {
-			log.Printf("경고: GameStats의 키 '%s'의 값이 float64가 아닙니다 (타입: %T). 무시합니다.", key, val)
+			slog.Warn("ignoring non-numeric game stat", "key", redisKey, "stat", key, "type", fmt.Sprintf("%T", val))
 			continue
 		}
 		intValue := int(floatVal) // 소수점 버림
 
 		// JSONPath 생성 (예: "$.playTime")
 		jsonPath := "$.accountStats." + key
-		pipe.JSONSet(Ctx, redisKey, jsonPath, intValue)
+		pipe.JSONSet(ctx, redisKey, jsonPath, intValue)
 		updateCount++
 		// log.Printf("Debug: Pipelining JSON.SET %s %s %d", redisKey, jsonPath, intValue)
 	}
@@ -325,36 +402,38 @@ func UpdateAccountStats(uuid []byte, stats defs.GameStats, voucherCounts map[str
 	for key, count := range voucherCounts {
 		columnName, ok := voucherColumnMap[key]
 		if !ok {
-			log.Printf("경고: voucherCounts에 유효하지 않은 키 '%s'가 포함되어 무시합니다.", key)
+			slog.Warn("ignoring unknown voucher type", "key", redisKey, "voucher", key)
 			continue
 		}
 		jsonPath := "$.accountStats." + columnName
-		pipe.JSONSet(Ctx, redisKey, jsonPath, count) // count는 이미 int
+		pipe.JSONSet(ctx, redisKey, jsonPath, count) // count는 이미 int
 		updateCount++
 		// log.Printf("Debug: Pipelining JSON.SET %s %s %d", redisKey, jsonPath, count)
 	}
 
 	// 4. 파이프라인 실행 (실제로 업데이트할 내용이 있을 때만)
 	if updateCount == 0 {
-		log.Printf("업데이트할 통계 또는 바우처 정보가 없습니다 (키: %s).", redisKey)
+		slog.Debug("no account stats to update", "key", redisKey)
 		return nil // 아무것도 안하고 성공
 	}
 
-	cmders, err := pipe.Exec(Ctx)
+	s.markDirty(ctx, pipe, uuid, dirtyStats)
+
+	cmders, err := pipe.Exec(ctx)
 	if err != nil {
-		log.Printf("Redis 파이프라인 실행 오류 (키: %s): %s", redisKey, err)
+		slog.Debug("failed to update account stats", "key", redisKey, "error", err)
 		return err
 	}
 
 	// 각 명령어의 성공 여부 확인 (선택적)
 	for i, cmd := range cmders {
 		if cmd.Err() != nil {
-			log.Printf("Redis 파이프라인 내 %d번째 업데이트 실패 (키: %s): %s", i+1, redisKey, cmd.Err())
+			slog.Debug("failed to update account stats", "key", redisKey, "command", i+1, "error", cmd.Err())
 			// 어떤 필드 업데이트가 실패했는지 특정하기 어려울 수 있음 (파이프라인 순서 기반 추정)
 			return err
 		}
 	}
 
-	log.Printf("키 %s의 계정 통계가 성공적으로 업데이트되었습니다 (업데이트된 필드 수: %d).", redisKey, updateCount)
+	slog.Debug("updated account stats", "key", redisKey, "fields", updateCount)
 	return nil
 }
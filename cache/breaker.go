@@ -0,0 +1,385 @@
+package cache
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/metrics"
+	"github.com/redis/go-redis/v9"
+)
+
+// The circuit breaker keeps a Redis outage from failing every request. After
+// breakerFailures consecutive calls fail because Redis can't be reached or
+// doesn't answer in time, the breaker opens: cache calls fail right away with
+// ErrUnavailable and storage serves everything from the database. While open,
+// Redis is pinged every breakerCooldown. Once it answers the
+// breaker is half-open: calls still bypass the cache while everything written
+// to the database in the meantime is dropped from the cached documents, then
+// it closes and cached operation resumes.
+var (
+	breakerFailures = 5
+	breakerCooldown = time.Second * 5
+
+	// nil for backends that can't become unavailable
+	breaker *circuitBreaker
+)
+
+// ErrUnavailable is returned by cache calls while the circuit breaker is open.
+var ErrUnavailable = errors.New("cache unavailable")
+
+type breakerState int32
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+type circuitBreaker struct {
+	// the backend without the breaker, for probes and reconciliation
+	store Store
+
+	state    atomic.Int32
+	failures atomic.Int32
+	openedAt atomic.Int64
+
+	// held for reading by database writes that bypass the cache and for
+	// writing while the breaker closes, so reconciliation can't miss one
+	bypassMu sync.RWMutex
+
+	staleMu sync.Mutex
+	// parts of user documents the database has newer data for, by base64 uuid
+	stale map[string]map[string]struct{}
+	// tokens removed from the database but maybe still cached
+	revoked map[string]struct{}
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+func newCircuitBreaker(s Store) *circuitBreaker {
+	b := &circuitBreaker{
+		store:   s,
+		stale:   make(map[string]map[string]struct{}),
+		revoked: make(map[string]struct{}),
+		stop:    make(chan struct{}),
+	}
+
+	b.setState(breakerClosed)
+
+	return b
+}
+
+func (b *circuitBreaker) current() breakerState {
+	return breakerState(b.state.Load())
+}
+
+func (b *circuitBreaker) setState(state breakerState) {
+	b.state.Store(int32(state))
+
+	metrics.CacheBreakerState.Reset()
+	metrics.CacheBreakerState.WithLabelValues(state.String()).Set(1)
+}
+
+// allow reports whether calls may go to the backend.
+func (b *circuitBreaker) allow() bool {
+	return b.current() == breakerClosed
+}
+
+// record counts the outcome of a call that went to the backend. A call cut
+// short by its caller giving up says nothing about the backend.
+func (b *circuitBreaker) record(ctx context.Context, err error) {
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+
+	if !isConnectionError(err) {
+		if b.failures.Load() != 0 {
+			b.failures.Store(0)
+		}
+
+		return
+	}
+
+	if int(b.failures.Add(1)) >= breakerFailures {
+		b.trip(err)
+	}
+}
+
+// trip opens the breaker and starts probing the backend.
+func (b *circuitBreaker) trip(err error) {
+	if !b.state.CompareAndSwap(int32(breakerClosed), int32(breakerOpen)) {
+		return
+	}
+
+	b.setState(breakerOpen)
+	b.openedAt.Store(time.Now().UnixNano())
+	metrics.CacheBreakerTrips.Inc()
+
+	slog.Error("cache unavailable, serving from the database", "error", err, "retry", breakerCooldown)
+
+	go b.probe(breakerCooldown)
+}
+
+// probe pings the backend every cooldown until it answers and the breaker
+// closes.
+func (b *circuitBreaker) probe(cooldown time.Duration) {
+	ctx := context.Background()
+
+	ticker := time.NewTicker(cooldown)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if b.store.Ping(ctx) != nil {
+			continue
+		}
+
+		b.setState(breakerHalfOpen)
+
+		err := b.reconcile(ctx)
+		if err != nil {
+			slog.Warn("cache reconciliation failed, still serving from the database", "error", err)
+			b.setState(breakerOpen)
+			continue
+		}
+
+		return
+	}
+}
+
+// reconcile drops what was written to the database while the cache was
+// bypassed from the cache, then closes the breaker. Writes keep bypassing the
+// cache until the last batch, which is applied with them held off.
+func (b *circuitBreaker) reconcile(ctx context.Context) error {
+	users := 0
+	for {
+		stale, revoked := b.takePending()
+		if len(stale) == 0 && len(revoked) == 0 {
+			break
+		}
+
+		users += len(stale)
+
+		err := b.apply(ctx, stale, revoked)
+		if err != nil {
+			return err
+		}
+	}
+
+	b.bypassMu.Lock()
+	defer b.bypassMu.Unlock()
+
+	stale, revoked := b.takePending()
+	users += len(stale)
+
+	err := b.apply(ctx, stale, revoked)
+	if err != nil {
+		return err
+	}
+
+	b.failures.Store(0)
+	b.setState(breakerClosed)
+
+	slog.Info("cache available again", "downtime", time.Since(time.Unix(0, b.openedAt.Load())).Round(time.Second), "reconciled_users", users)
+
+	return nil
+}
+
+func (b *circuitBreaker) takePending() (map[string]map[string]struct{}, map[string]struct{}) {
+	b.staleMu.Lock()
+	defer b.staleMu.Unlock()
+
+	stale, revoked := b.stale, b.revoked
+	b.stale = make(map[string]map[string]struct{})
+	b.revoked = make(map[string]struct{})
+	metrics.CacheBreakerStaleUsers.Set(0)
+
+	return stale, revoked
+}
+
+// apply invalidates stale parts and removes revoked tokens. Whatever it
+// couldn't apply is kept for the next attempt.
+func (b *circuitBreaker) apply(ctx context.Context, stale map[string]map[string]struct{}, revoked map[string]struct{}) error {
+	for encodedUUID, parts := range stale {
+		uuid, err := base64.StdEncoding.DecodeString(encodedUUID)
+		if err != nil {
+			delete(stale, encodedUUID)
+			continue
+		}
+
+		fields := make([]string, 0, len(parts))
+		for part := range parts {
+			fields = append(fields, part)
+		}
+
+		err = b.store.Invalidate(ctx, uuid, fields...)
+		if err != nil {
+			b.restore(stale, revoked)
+			return err
+		}
+
+		delete(stale, encodedUUID)
+	}
+
+	for token := range revoked {
+		err := b.store.RemoveSessionFromToken(ctx, []byte(token))
+		if err != nil {
+			b.restore(stale, revoked)
+			return err
+		}
+
+		delete(revoked, token)
+	}
+
+	return nil
+}
+
+func (b *circuitBreaker) restore(stale map[string]map[string]struct{}, revoked map[string]struct{}) {
+	b.staleMu.Lock()
+	defer b.staleMu.Unlock()
+
+	for encodedUUID, parts := range stale {
+		b.markStale(encodedUUID, parts)
+	}
+
+	for token := range revoked {
+		b.revoked[token] = struct{}{}
+	}
+
+	metrics.CacheBreakerStaleUsers.Set(float64(len(b.stale)))
+}
+
+// markStale adds parts to the stale set. The caller must hold b.staleMu.
+func (b *circuitBreaker) markStale(encodedUUID string, parts map[string]struct{}) {
+	set, ok := b.stale[encodedUUID]
+	if !ok {
+		set = make(map[string]struct{})
+		b.stale[encodedUUID] = set
+	}
+
+	for part := range parts {
+		set[part] = struct{}{}
+	}
+}
+
+// bypass runs fn while the breaker isn't closed, after remember has noted
+// what it changes. It reports false without doing either if the breaker is
+// closed.
+func (b *circuitBreaker) bypass(remember func(), fn func() error) (bool, error) {
+	b.bypassMu.RLock()
+	defer b.bypassMu.RUnlock()
+
+	if b.allow() {
+		return false, nil
+	}
+
+	b.staleMu.Lock()
+	remember()
+	metrics.CacheBreakerStaleUsers.Set(float64(len(b.stale)))
+	b.staleMu.Unlock()
+
+	if fn == nil {
+		return true, nil
+	}
+
+	return true, fn()
+}
+
+func (b *circuitBreaker) close() {
+	b.stopOnce.Do(func() { close(b.stop) })
+}
+
+// isConnectionError reports whether err means the backend couldn't be reached
+// or didn't answer in time, as opposed to a miss or a rejected operation.
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.Is(err, ErrUnavailable) ||
+		errors.As(err, &netErr) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, redis.ErrPoolTimeout) ||
+		errors.Is(err, redis.ErrClosed)
+}
+
+// Available reports whether cache calls currently go to the backend.
+func Available() bool {
+	return store != nil && (breaker == nil || breaker.allow())
+}
+
+// BreakerState returns the state of the circuit breaker: closed, open or
+// half-open. Backends without one are always closed.
+func BreakerState() string {
+	if breaker == nil {
+		return breakerClosed.String()
+	}
+
+	return breaker.current().String()
+}
+
+// IsUnavailable reports whether err comes from the cache being down, slow or
+// bypassed by the circuit breaker.
+func IsUnavailable(err error) bool {
+	return isConnectionError(err)
+}
+
+// Bypass runs fn, a database write that skips the cache because it is
+// unavailable, and remembers that the given parts of the user document are
+// stale so they are invalidated when the cache is back. fn may be nil if the
+// database already has the change. If the cache is available nothing is run
+// and false is returned; the caller should write the usual way.
+func Bypass(fn func() error, uuid []byte, parts ...string) (bool, error) {
+	if breaker == nil {
+		return false, nil
+	}
+
+	encodedUUID := base64.StdEncoding.EncodeToString(uuid)
+	return breaker.bypass(func() {
+		set := make(map[string]struct{}, len(parts))
+		for _, part := range parts {
+			set[part] = struct{}{}
+		}
+
+		breaker.markStale(encodedUUID, set)
+	}, fn)
+}
+
+// BypassTokenRemoval is Bypass for fn removing a session token from the
+// database: the token is removed from the cache when it is back.
+func BypassTokenRemoval(token []byte, fn func() error) (bool, error) {
+	if breaker == nil {
+		return false, nil
+	}
+
+	return breaker.bypass(func() {
+		breaker.revoked[string(token)] = struct{}{}
+	}, fn)
+}
@@ -0,0 +1,228 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/defs"
+	"github.com/redis/go-redis/v9"
+)
+
+// testBreaker returns a closed breaker for s that doesn't probe during the
+// test unless cooldown is short enough.
+func testBreaker(t *testing.T, s Store, cooldown time.Duration) *circuitBreaker {
+	t.Helper()
+
+	failures, previous := breakerFailures, breakerCooldown
+	breakerFailures, breakerCooldown = 3, cooldown
+
+	b := newCircuitBreaker(s)
+	t.Cleanup(func() {
+		b.close()
+		breakerFailures, breakerCooldown = failures, previous
+	})
+
+	return b
+}
+
+func TestIsConnectionError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{ErrMiss, false},
+		{redis.Nil, false},
+		{errors.New("WRONGTYPE"), false},
+		{context.Canceled, false},
+		{ErrUnavailable, true},
+		{context.DeadlineExceeded, true},
+		{io.EOF, true},
+		{fmt.Errorf("read: %w", io.ErrUnexpectedEOF), true},
+		{redis.ErrPoolTimeout, true},
+		{redis.ErrClosed, true},
+	}
+
+	for _, tt := range tests {
+		if got := isConnectionError(tt.err); got != tt.want {
+			t.Errorf("isConnectionError(%v) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestBreakerRecord(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	type call struct {
+		ctx context.Context
+		err error
+	}
+
+	failure := call{context.Background(), io.EOF}
+	success := call{context.Background(), nil}
+
+	tests := []struct {
+		name     string
+		calls    []call
+		want     breakerState
+		failures int32
+	}{
+		{"successes", []call{success, success}, breakerClosed, 0},
+		{"failures below the threshold", []call{failure, failure}, breakerClosed, 2},
+		{"failures at the threshold", []call{failure, failure, failure}, breakerOpen, 3},
+		{"a success resets the count", []call{failure, failure, success, failure, failure}, breakerClosed, 2},
+		{"misses aren't failures", []call{failure, failure, {context.Background(), ErrMiss}, failure}, breakerClosed, 1},
+		{"calls given up by the caller don't count", []call{failure, failure, {canceled, context.Canceled}, {canceled, io.EOF}}, breakerClosed, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testBreaker(t, newMemoryStore(), time.Hour)
+
+			for _, c := range tt.calls {
+				b.record(c.ctx, c.err)
+			}
+
+			if state := b.current(); state != tt.want {
+				t.Errorf("state %s, want %s", state, tt.want)
+			}
+
+			if failures := b.failures.Load(); failures != tt.failures {
+				t.Errorf("%d failures, want %d", failures, tt.failures)
+			}
+		})
+	}
+}
+
+func TestBreakerGuard(t *testing.T) {
+	ctx := context.Background()
+
+	s := newMemoryStore()
+	b := testBreaker(t, s, time.Hour)
+	guarded := guard(s, b)
+
+	token, uuid := []byte("token"), []byte("aaaaaaaaaaaaaaaa")
+	err := guarded.StoreSessionToken(ctx, uuid, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.trip(io.EOF)
+
+	_, err = guarded.FetchSessionToken(ctx, token)
+	if !errors.Is(err, ErrUnavailable) {
+		t.Errorf("fetched through an open breaker: %v", err)
+	}
+
+	err = guarded.Ping(ctx)
+	if err != nil {
+		t.Errorf("ping through an open breaker: %v", err)
+	}
+
+	// an open breaker can't be tripped again
+	b.trip(io.EOF)
+	if b.current() != breakerOpen {
+		t.Errorf("state %s after tripping twice", b.current())
+	}
+}
+
+func TestBreakerReconcile(t *testing.T) {
+	ctx := context.Background()
+
+	s := newMemoryStore()
+	b := testBreaker(t, s, time.Hour)
+
+	previous := breaker
+	breaker = b
+	t.Cleanup(func() { breaker = previous })
+
+	uuid, token := []byte("aaaaaaaaaaaaaaaa"), []byte("token")
+	err := s.save(uuid, defs.UserCacheData{
+		SystemSaveData: &defs.SystemSaveData{TrainerId: 1},
+		AccountStats:   &defs.AccountStatsRedisData{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.StoreSessionToken(ctx, uuid, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bypassed, err := Bypass(func() error { t.Error("bypassed a closed breaker"); return nil }, uuid, dirtySystem)
+	if bypassed || err != nil {
+		t.Fatalf("bypassed a closed breaker: %t %v", bypassed, err)
+	}
+
+	b.trip(io.EOF)
+
+	written := false
+	bypassed, err = Bypass(func() error { written = true; return nil }, uuid, dirtySystem)
+	if !bypassed || err != nil || !written {
+		t.Fatalf("bypass %t %v, written %t", bypassed, err, written)
+	}
+
+	bypassed, err = BypassTokenRemoval(token, nil)
+	if !bypassed || err != nil {
+		t.Fatalf("token removal bypass %t %v", bypassed, err)
+	}
+
+	err = b.reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.current() != breakerClosed {
+		t.Errorf("state %s after reconciling", b.current())
+	}
+
+	s.mu.Lock()
+	doc, err := s.load(uuid)
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.SystemSaveData != nil {
+		t.Error("stale system save still cached")
+	}
+
+	if doc.AccountStats == nil {
+		t.Error("untouched stats invalidated")
+	}
+
+	if _, err := s.FetchSessionToken(ctx, token); !errors.Is(err, ErrMiss) {
+		t.Errorf("revoked token still cached: %v", err)
+	}
+}
+
+func TestBreakerProbe(t *testing.T) {
+	b := testBreaker(t, newMemoryStore(), 10*time.Millisecond)
+
+	for range breakerFailures {
+		b.record(context.Background(), io.EOF)
+	}
+
+	if b.current() != breakerOpen {
+		t.Fatalf("state %s after %d failures", b.current(), breakerFailures)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for b.current() != breakerClosed {
+		if time.Now().After(deadline) {
+			t.Fatalf("state %s once the backend answers", b.current())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if b.failures.Load() != 0 {
+		t.Errorf("%d failures after closing", b.failures.Load())
+	}
+}
@@ -1,19 +1,26 @@
 package cache
 
 import (
+	"context"
+	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"strconv"
+	"strings"
 
+	"github.com/pagefaultgames/rogueserver/db"
 	"github.com/pagefaultgames/rogueserver/defs"
+	"github.com/redis/go-redis/v9"
 )
 
 // uuid로 한 유저의 cachedata가 있는지 확인
-func IsValidCacheData(uuid []byte) error {
+func (s *redisStore) IsValidCacheData(ctx context.Context, uuid []byte) error {
 
 	redisKey := "session:" + base64.StdEncoding.EncodeToString(uuid)
-	exists, err := Rdb.Exists(Ctx, redisKey).Result()
+	exists, err := s.client.Exists(ctx, redisKey).Result()
 
 	if exists == 0 {
 		// UserCacheData의 초기 상태 정의
@@ -33,8 +40,8 @@ func IsValidCacheData(uuid []byte) error {
 		jsonData := string(jsonDataBytes)
 
 		// Redis에 저장
-		err = Rdb.JSONSet(Ctx, redisKey, "$", jsonData).Err()
-		log.Printf("캐시에서 키 '%s'를 찾을 수 없음", redisKey)
+		err = s.client.JSONSet(ctx, redisKey, "$", jsonData).Err()
+		slog.Debug("created empty user document", "key", redisKey)
 		return err
 	}
 
@@ -42,10 +49,10 @@ func IsValidCacheData(uuid []byte) error {
 }
 
 // db에서 가져온 유저 데이터 session:uuid / cachedata로 넣기
-func StoreCacheData(uuid []byte, userData defs.UserCacheData) error {
+func (s *redisStore) StoreCacheData(ctx context.Context, uuid []byte, userData defs.UserCacheData) error {
 
 	redisKey := "session:" + base64.StdEncoding.EncodeToString(uuid)
-	err := Rdb.JSONSet(Ctx, redisKey, "$", userData).Err()
+	err := s.client.JSONSet(ctx, redisKey, "$", userData).Err()
 
 	if err != nil {
 		return err
@@ -55,10 +62,10 @@ func StoreCacheData(uuid []byte, userData defs.UserCacheData) error {
 }
 
 // uuid로 cachedata 제거
-func DeleteCachedata(uuid []byte) error {
+func (s *redisStore) DeleteCacheData(ctx context.Context, uuid []byte) error {
 
 	redisKey := "session:" + base64.StdEncoding.EncodeToString(uuid)
-	err := Rdb.JSONDel(Ctx, redisKey, "$").Err()
+	err := s.client.JSONDel(ctx, redisKey, "$").Err()
 
 	if err != nil {
 		return err
@@ -67,3 +74,170 @@ func DeleteCachedata(uuid []byte) error {
 	return nil
 
 }
+
+// uuid로 cachedata가 있는지만 확인
+func (s *redisStore) HasCacheData(ctx context.Context, uuid []byte) (bool, error) {
+
+	redisKey := "session:" + base64.StdEncoding.EncodeToString(uuid)
+	exists, err := s.client.Exists(ctx, redisKey).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return exists > 0, nil
+}
+
+// cachedata가 없을 때만 저장 (NX). 이미 있으면 아직 DB에 반영되지 않은 변경이 있을 수 있으므로 그대로 둠
+func (s *redisStore) AddCacheData(ctx context.Context, uuid []byte, userData defs.UserCacheData) error {
+
+	redisKey := "session:" + base64.StdEncoding.EncodeToString(uuid)
+	err := s.client.JSONSetMode(ctx, redisKey, "$", userData, "NX").Err()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	return nil
+}
+
+// documentPath maps a write-back field name to its JSONPath in the user document.
+func documentPath(field string) (string, bool) {
+	switch {
+	case field == dirtySystem:
+		return "$.systemSaveData", true
+	case field == dirtyStats:
+		return "$.accountStats", true
+	case field == dirtyAccount:
+		return "$.account", true
+	case field == dirtyActiveSession:
+		return "$.activeClientSession", true
+	case strings.HasPrefix(field, dirtySessionPrefix):
+		slot, err := strconv.Atoi(strings.TrimPrefix(field, dirtySessionPrefix))
+		if err != nil {
+			return "", false
+		}
+
+		return fmt.Sprintf(`$.sessionSaveData["%d"]`, slot), true
+	}
+
+	return "", false
+}
+
+// 유저 데이터 일부를 캐시에서 제거. 다음 읽기는 DB에서 가져옴
+func (s *redisStore) Invalidate(ctx context.Context, uuid []byte, fields ...string) error {
+
+	encodedUUID := base64.StdEncoding.EncodeToString(uuid)
+	redisKey := "session:" + encodedUUID
+
+	pipe := s.client.TxPipeline()
+	for _, field := range fields {
+		path, ok := documentPath(field)
+		if !ok {
+			return fmt.Errorf("unknown cache data field: %s", field)
+		}
+
+		pipe.JSONDel(ctx, redisKey, path)
+
+		// otherwise the flusher would persist the missing part, which deletes a session slot
+		pipe.SRem(ctx, dirtyFieldsKeyPrefix+encodedUUID, field)
+	}
+
+	_, err := pipe.Exec(ctx)
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	return nil
+}
+
+// EnsureCacheData makes sure the user document for uuid is cached, loading it
+// from the database on a miss.
+func EnsureCacheData(ctx context.Context, uuid []byte) error {
+	// touch first: once touched, the sweeper can't evict the document under us
+	err := store.Touch(ctx, uuid)
+	if err != nil {
+		return err
+	}
+
+	exists, err := store.HasCacheData(ctx, uuid)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return nil
+	}
+
+	return Rehydrate(ctx, uuid)
+}
+
+// Rehydrate loads the user document for uuid from the database into the cache.
+// An existing document is left untouched so unflushed writes are never lost.
+func Rehydrate(ctx context.Context, uuid []byte) error {
+	userData, err := LoadCacheData(ctx, uuid)
+	if err != nil {
+		return err
+	}
+
+	err = store.AddCacheData(ctx, uuid, userData)
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("loaded user document from the database", "uuid", base64.StdEncoding.EncodeToString(uuid))
+	return nil
+}
+
+// LoadCacheData builds the complete user document for uuid from the database.
+func LoadCacheData(ctx context.Context, uuid []byte) (defs.UserCacheData, error) {
+	userData := defs.UserCacheData{
+		SessionSaveData: make(map[string]defs.SessionSaveData),
+	}
+
+	accountRow, err := db.GetAccountFromDB(ctx, uuid)
+	if err != nil {
+		return userData, err
+	}
+
+	account := accountToRedisData(accountRow)
+	userData.Account = &account
+
+	statsRow, err := db.GetAccountStatsFromDB(ctx, uuid)
+	if err == nil {
+		stats := accountStatsToRedisData(statsRow)
+		userData.AccountStats = &stats
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return userData, err
+	}
+
+	// S3 system saves are read through on demand by savedata.GetSystem
+	if !db.UseS3() {
+		system, err := db.ReadSystemSaveData(ctx, uuid)
+		if err == nil {
+			userData.SystemSaveData = &system
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return userData, err
+		}
+	}
+
+	activeSession, err := db.FetchActiveSession(ctx, uuid)
+	if err == nil {
+		userData.ActiveClientSession = activeSession
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return userData, err
+	}
+
+	for slot := range defs.SessionSlotCount {
+		session, err := db.ReadSessionSaveData(ctx, uuid, slot)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+
+			return userData, err
+		}
+
+		userData.SessionSaveData[strconv.Itoa(slot)] = session
+	}
+
+	return userData, nil
+}
@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/pagefaultgames/rogueserver/defs"
+	"github.com/redis/go-redis/v9"
+)
+
+// UpdateSessionSaveData stores a session save if validate accepts the cached
+// one it replaces (nil for an empty slot). The user document must be cached.
+func (s *redisStore) UpdateSessionSaveData(ctx context.Context, uuid []byte, data defs.SessionSaveData, slot int, validate func(current *defs.SessionSaveData) error) error {
+	redisKey := "session:" + base64.StdEncoding.EncodeToString(uuid)
+	jsonPath := fmt.Sprintf(`$.sessionSaveData["%d"]`, slot)
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return s.watch(ctx, redisKey, func(tx *redis.Tx) error {
+		current, err := watchedPart[defs.SessionSaveData](ctx, tx, redisKey, jsonPath)
+		if err != nil {
+			return err
+		}
+
+		err = validate(current)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.JSONSet(ctx, redisKey, jsonPath, jsonData)
+			s.markDirty(ctx, pipe, uuid, dirtySession(slot))
+
+			return nil
+		})
+
+		return err
+	})
+}
+
+// UpdateSystemSaveData stores a system save if validate accepts the cached one
+// it replaces (nil if there is none). The user document must be cached.
+func (s *redisStore) UpdateSystemSaveData(ctx context.Context, uuid []byte, data defs.SystemSaveData, validate func(current *defs.SystemSaveData) error) error {
+	redisKey := "session:" + base64.StdEncoding.EncodeToString(uuid)
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return s.watch(ctx, redisKey, func(tx *redis.Tx) error {
+		current, err := watchedPart[defs.SystemSaveData](ctx, tx, redisKey, "$.systemSaveData")
+		if err != nil {
+			return err
+		}
+
+		err = validate(current)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.JSONSet(ctx, redisKey, "$.systemSaveData", jsonData)
+			s.markDirty(ctx, pipe, uuid, dirtySystem)
+
+			return nil
+		})
+
+		return err
+	})
+}
+
+// watchedPart reads a part of a user document inside a WATCH. A missing part
+// is nil; a missing document is ErrMiss.
+func watchedPart[T any](ctx context.Context, tx *redis.Tx, key, path string) (*T, error) {
+	exists, err := tx.Exists(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	} else if exists == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrMiss, key)
+	}
+
+	var part T
+	err = getJSON(ctx, tx, key, path, &part)
+	if errors.Is(err, ErrMiss) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &part, nil
+}
+
+func (s *memoryStore) UpdateSessionSaveData(ctx context.Context, uuid []byte, data defs.SessionSaveData, slot int, validate func(current *defs.SessionSaveData) error) error {
+	return s.update(uuid, func(doc *defs.UserCacheData) error {
+		var current *defs.SessionSaveData
+		if session, ok := doc.SessionSaveData[strconv.Itoa(slot)]; ok {
+			current = &session
+		}
+
+		err := validate(current)
+		if err != nil {
+			return err
+		}
+
+		if doc.SessionSaveData == nil {
+			doc.SessionSaveData = make(map[string]defs.SessionSaveData)
+		}
+		doc.SessionSaveData[strconv.Itoa(slot)] = data
+
+		return nil
+	}, dirtySession(slot))
+}
+
+func (s *memoryStore) UpdateSystemSaveData(ctx context.Context, uuid []byte, data defs.SystemSaveData, validate func(current *defs.SystemSaveData) error) error {
+	return s.update(uuid, func(doc *defs.UserCacheData) error {
+		err := validate(doc.SystemSaveData)
+		if err != nil {
+			return err
+		}
+
+		doc.SystemSaveData = &data
+
+		return nil
+	}, dirtySystem)
+}
@@ -0,0 +1,423 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/db"
+	"github.com/pagefaultgames/rogueserver/defs"
+	"github.com/redis/go-redis/v9"
+)
+
+// Repair is the direction a consistency check fixes differences in.
+type Repair string
+
+const (
+	RepairNone = Repair("")
+	// RepairCacheToDB writes the cached parts of a user document to the database.
+	RepairCacheToDB = Repair("cache-to-db")
+	// RepairDBToCache evicts the user document and reloads it from the database,
+	// dropping changes that weren't written back.
+	RepairDBToCache = Repair("db-to-cache")
+)
+
+// ParseRepair validates a repair direction; an empty string means check only.
+func ParseRepair(s string) (Repair, error) {
+	switch Repair(s) {
+	case RepairNone, RepairCacheToDB, RepairDBToCache:
+		return Repair(s), nil
+	}
+
+	return "", fmt.Errorf("unknown repair direction %q (want %s or %s)", s, RepairCacheToDB, RepairDBToCache)
+}
+
+// ConsistencyReport compares a cached user document with the database rows it
+// was loaded from.
+type ConsistencyReport struct {
+	UUID     string `json:"uuid"` // base64
+	Username string `json:"username"`
+	Cached   bool   `json:"cached"`
+
+	// Pending lists parts with changes the flusher hasn't written back yet;
+	// differences in them are expected under write-back.
+	Pending []string `json:"pending,omitempty"`
+	// Uncached lists parts the document doesn't hold, which aren't compared.
+	Uncached []string `json:"uncached,omitempty"`
+
+	Differences []Difference `json:"differences"`
+
+	// set when a repair ran, with what was still different afterwards
+	Repaired  Repair       `json:"repaired,omitempty"`
+	Remaining []Difference `json:"remaining,omitempty"`
+}
+
+// Difference is a single value that differs between the cache and the database.
+type Difference struct {
+	Part    string `json:"part"` // write-back part, e.g. "session:1"
+	Path    string `json:"path"`
+	Cache   any    `json:"cache"`
+	DB      any    `json:"db"`
+	Pending bool   `json:"pending,omitempty"`
+}
+
+// never shown in reports
+var redactedPaths = []string{"$.account.hash", "$.account.salt"}
+
+// CheckConsistency diffs the cached user document for uuid against the
+// database and, unless repair is RepairNone, fixes what differs.
+func CheckConsistency(ctx context.Context, uuid []byte, repair Repair) (ConsistencyReport, error) {
+	report, doc, err := checkConsistency(ctx, uuid)
+	if err != nil || repair == RepairNone || len(report.Differences) == 0 {
+		return report, err
+	}
+
+	switch repair {
+	case RepairCacheToDB:
+		err = persistUserDocument(ctx, uuid, doc, cachedParts(doc))
+	case RepairDBToCache:
+		err = store.DeleteCacheData(ctx, uuid)
+		if err == nil {
+			err = Rehydrate(ctx, uuid)
+		}
+	}
+	if err != nil {
+		return report, fmt.Errorf("failed to repair %s: %w", repair, err)
+	}
+
+	after, _, err := checkConsistency(ctx, uuid)
+	if err != nil {
+		return report, err
+	}
+
+	report.Repaired = repair
+	report.Remaining = after.Differences
+
+	return report, nil
+}
+
+// ConsistencyTargets resolves what a consistency check looks at: the account
+// of username, or else up to sample random cached users.
+func ConsistencyTargets(ctx context.Context, username string, sample int) ([][]byte, error) {
+	if username != "" {
+		uuid, err := db.FetchUUIDFromUsername(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+
+		return [][]byte{uuid}, nil
+	}
+
+	return SampleUsers(ctx, sample)
+}
+
+// SampleUsers returns up to n random uuids of cached user documents.
+func SampleUsers(ctx context.Context, n int) ([][]byte, error) {
+	encodedUUIDs, err := store.SampleUsers(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+
+	uuids := make([][]byte, 0, len(encodedUUIDs))
+	for _, encodedUUID := range encodedUUIDs {
+		uuid, err := base64.StdEncoding.DecodeString(encodedUUID)
+		if err != nil {
+			continue
+		}
+
+		uuids = append(uuids, uuid)
+	}
+
+	return uuids, nil
+}
+
+type comparedPart struct {
+	part, path     string
+	cached, stored any
+	isCached       bool
+}
+
+func checkConsistency(ctx context.Context, uuid []byte) (ConsistencyReport, *defs.UserCacheData, error) {
+	report := ConsistencyReport{
+		UUID:        base64.StdEncoding.EncodeToString(uuid),
+		Differences: []Difference{},
+	}
+
+	username, err := db.FetchUsernameFromUUID(ctx, uuid)
+	if err != nil {
+		return report, nil, err
+	}
+	report.Username = username
+
+	cached, err := store.ReadCacheData(ctx, uuid)
+	if errors.Is(err, ErrMiss) {
+		return report, nil, nil
+	} else if err != nil {
+		return report, nil, err
+	}
+	report.Cached = true
+
+	stored, err := LoadCacheData(ctx, uuid)
+	if err != nil {
+		return report, nil, err
+	}
+
+	// LoadCacheData leaves S3 system saves to be read through on demand
+	if db.UseS3() && cached.SystemSaveData != nil {
+		system, err := db.GetSystemSaveFromS3(ctx, uuid)
+		if err == nil {
+			stored.SystemSaveData = &system
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return report, nil, err
+		}
+	}
+
+	report.Pending, err = store.PendingParts(ctx, uuid)
+	if err != nil {
+		return report, nil, err
+	}
+	sort.Strings(report.Pending)
+
+	normalizeAccount(cached.Account)
+	normalizeAccount(stored.Account)
+
+	parts := []comparedPart{
+		{dirtyAccount, "$.account", cached.Account, stored.Account, cached.Account != nil},
+		{dirtyStats, "$.accountStats", cached.AccountStats, stored.AccountStats, cached.AccountStats != nil},
+		{dirtySystem, "$.systemSaveData", cached.SystemSaveData, stored.SystemSaveData, cached.SystemSaveData != nil},
+		{dirtyActiveSession, "$.activeClientSession", cached.ActiveClientSession, stored.ActiveClientSession, cached.ActiveClientSession != ""},
+	}
+
+	for slot := range defs.SessionSlotCount {
+		key := strconv.Itoa(slot)
+		cachedSession, inCache := cached.SessionSaveData[key]
+		storedSession, inDB := stored.SessionSaveData[key]
+
+		var c, s any
+		if inCache {
+			c = cachedSession
+		}
+		if inDB {
+			s = storedSession
+		}
+
+		// without write-back a missing slot may just not have been cached
+		parts = append(parts, comparedPart{dirtySession(slot), fmt.Sprintf(`$.sessionSaveData["%d"]`, slot), c, s, inCache || writeBack})
+	}
+
+	for _, p := range parts {
+		if !p.isCached {
+			report.Uncached = append(report.Uncached, p.part)
+			continue
+		}
+
+		c, err := normalizeJSON(p.cached)
+		if err != nil {
+			return report, nil, err
+		}
+
+		s, err := normalizeJSON(p.stored)
+		if err != nil {
+			return report, nil, err
+		}
+
+		pending := slices.Contains(report.Pending, p.part)
+		diffJSON(p.part, p.path, c, s, pending, &report.Differences)
+	}
+
+	return report, &cached, nil
+}
+
+// cachedParts lists the parts of doc a cache-to-db repair writes.
+func cachedParts(doc *defs.UserCacheData) []string {
+	var parts []string
+	if doc.Account != nil {
+		parts = append(parts, dirtyAccount)
+	}
+	if doc.AccountStats != nil {
+		parts = append(parts, dirtyStats)
+	}
+	if doc.SystemSaveData != nil {
+		parts = append(parts, dirtySystem)
+	}
+	if doc.ActiveClientSession != "" {
+		parts = append(parts, dirtyActiveSession)
+	}
+
+	for slot := range defs.SessionSlotCount {
+		// under write-back a missing slot is a deleted one and is deleted in the database too
+		if _, ok := doc.SessionSaveData[strconv.Itoa(slot)]; ok || writeBack {
+			parts = append(parts, dirtySession(slot))
+		}
+	}
+
+	return parts
+}
+
+// normalizeAccount drops what the database can't store, so an account that
+// was written back compares equal: timestamps only keep whole seconds.
+func normalizeAccount(account *defs.AccountRedisData) {
+	if account == nil {
+		return
+	}
+
+	account.Registered = account.Registered.UTC().Truncate(time.Second)
+
+	for _, t := range []**time.Time{&account.LastLoggedIn, &account.LastActivity} {
+		if *t != nil {
+			normalized := (*t).UTC().Truncate(time.Second)
+			*t = &normalized
+		}
+	}
+}
+
+// normalizeJSON turns v into its generic JSON form so values compare the way
+// they are stored.
+func normalizeJSON(v any) (any, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var normalized any
+	err = json.Unmarshal(raw, &normalized)
+
+	return normalized, err
+}
+
+// diffJSON appends a Difference for every leaf that differs between two
+// generic JSON values.
+func diffJSON(part, path string, cached, stored any, pending bool, out *[]Difference) {
+	if slices.Contains(redactedPaths, path) {
+		if !jsonEqual(cached, stored) {
+			*out = append(*out, Difference{Part: part, Path: path, Cache: "<redacted>", DB: "<redacted>", Pending: pending})
+		}
+		return
+	}
+
+	switch c := cached.(type) {
+	case map[string]any:
+		s, ok := stored.(map[string]any)
+		if !ok {
+			break
+		}
+
+		keys := make([]string, 0, len(c)+len(s))
+		for key := range c {
+			keys = append(keys, key)
+		}
+		for key := range s {
+			if _, ok := c[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			diffJSON(part, path+"."+key, c[key], s[key], pending, out)
+		}
+		return
+	case []any:
+		s, ok := stored.([]any)
+		if !ok {
+			break
+		}
+
+		for i := range max(len(c), len(s)) {
+			var ci, si any
+			if i < len(c) {
+				ci = c[i]
+			}
+			if i < len(s) {
+				si = s[i]
+			}
+
+			diffJSON(part, fmt.Sprintf("%s[%d]", path, i), ci, si, pending, out)
+		}
+		return
+	}
+
+	if !jsonEqual(cached, stored) {
+		*out = append(*out, Difference{Part: part, Path: path, Cache: cached, DB: stored, Pending: pending})
+	}
+}
+
+func jsonEqual(a, b any) bool {
+	rawA, errA := json.Marshal(a)
+	rawB, errB := json.Marshal(b)
+
+	return errA == nil && errB == nil && string(rawA) == string(rawB)
+}
+
+// ReadCacheData returns the whole cached user document.
+func (s *redisStore) ReadCacheData(ctx context.Context, uuid []byte) (defs.UserCacheData, error) {
+	var doc defs.UserCacheData
+	err := s.getJSON(ctx, "session:"+base64.StdEncoding.EncodeToString(uuid), "$", &doc)
+
+	return doc, err
+}
+
+// PendingParts lists the parts of a user document that are dirty or being flushed.
+func (s *redisStore) PendingParts(ctx context.Context, uuid []byte) ([]string, error) {
+	encodedUUID := base64.StdEncoding.EncodeToString(uuid)
+	return s.client.SUnion(ctx, dirtyFieldsKeyPrefix+encodedUUID, flushingFieldsKeyPrefix+encodedUUID).Result()
+}
+
+// SampleUsers returns up to n random base64 uuids of cached user documents.
+func (s *redisStore) SampleUsers(ctx context.Context, n int) ([]string, error) {
+	encodedUUIDs, err := s.client.ZRandMember(ctx, accessUsersKey, n).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+
+	return encodedUUIDs, err
+}
+
+func (s *memoryStore) ReadCacheData(ctx context.Context, uuid []byte) (defs.UserCacheData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.load(uuid)
+}
+
+func (s *memoryStore) PendingParts(ctx context.Context, uuid []byte) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	encodedUUID := base64.StdEncoding.EncodeToString(uuid)
+
+	var parts []string
+	for _, fields := range []map[string]struct{}{s.dirtyFields[encodedUUID], s.flushingFields[encodedUUID]} {
+		for field := range fields {
+			if !slices.Contains(parts, field) {
+				parts = append(parts, field)
+			}
+		}
+	}
+
+	return parts, nil
+}
+
+func (s *memoryStore) SampleUsers(ctx context.Context, n int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// map iteration order is random enough for sampling
+	var encodedUUIDs []string
+	for encodedUUID := range s.docs {
+		if len(encodedUUIDs) == n {
+			break
+		}
+
+		encodedUUIDs = append(encodedUUIDs, encodedUUID)
+	}
+
+	return encodedUUIDs, nil
+}
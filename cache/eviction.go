@@ -0,0 +1,252 @@
+package cache
+
+import (
+	"context"
+	"encoding/base64"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/metrics"
+	"github.com/redis/go-redis/v9"
+)
+
+// Idle user documents are evicted by a sweeper rather than a Redis TTL, so a
+// document can never expire with changes that haven't been written back:
+//
+//	access:users  sorted set of base64 uuids, scored by the unix time they were last used
+//
+// Every request touches the user's entry before it looks at the document. The
+// sweeper evicts documents untouched for sessionDataTTL, but only while they
+// are neither dirty nor claimed by the flusher, checked atomically with the
+// delete. The next request reloads the document from the database.
+const accessUsersKey = "access:users"
+
+var (
+	sweepInterval = time.Minute
+
+	sweeperStop chan struct{}
+	sweeperDone chan struct{}
+)
+
+// evictScript deletes an idle user document unless it was touched after
+// ARGV[2] or still has changes waiting to be written back.
+//
+//	KEYS: session:<uuid>, access:users, dirty:users, flushing:users
+//	ARGV: base64 uuid, unix time
+var evictScript = redis.NewScript(`
+local seen = redis.call('ZSCORE', KEYS[2], ARGV[1])
+if seen and tonumber(seen) > tonumber(ARGV[2]) then
+	return 0
+end
+
+if redis.call('ZSCORE', KEYS[3], ARGV[1]) or redis.call('ZSCORE', KEYS[4], ARGV[1]) then
+	return 0
+end
+
+redis.call('DEL', KEYS[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+return 1
+`)
+
+// Touch restarts the idle window of a user document.
+func (s *redisStore) Touch(ctx context.Context, uuid []byte) error {
+	encodedUUID := base64.StdEncoding.EncodeToString(uuid)
+	return s.client.ZAdd(ctx, accessUsersKey, redis.Z{Score: float64(time.Now().Unix()), Member: encodedUUID}).Err()
+}
+
+// IdleUsers returns up to limit base64 uuids last touched by until, longest
+// idle first. A limit of 0 returns all of them.
+func (s *redisStore) IdleUsers(ctx context.Context, until time.Time, limit int) ([]string, error) {
+	return s.client.ZRangeByScore(ctx, accessUsersKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(until.Unix(), 10),
+		Count: int64(max(limit, 0)),
+	}).Result()
+}
+
+// Evict deletes the document of an idle user if it hasn't been touched since
+// until and has nothing left to write back.
+func (s *redisStore) Evict(ctx context.Context, encodedUUID string, until time.Time) (bool, error) {
+	keys := []string{"session:" + encodedUUID, accessUsersKey, dirtyUsersKey, flushingUsersKey}
+
+	evicted, err := evictScript.Run(ctx, s.client, keys, encodedUUID, until.Unix()).Int()
+	if err != nil {
+		return false, err
+	}
+
+	return evicted == 1, nil
+}
+
+// AdoptUntracked starts the idle window of documents cached before eviction
+// existed, which would otherwise never be evicted.
+func (s *redisStore) AdoptUntracked(ctx context.Context) (int, error) {
+	now := float64(time.Now().Unix())
+
+	adopted := 0
+	iter := s.client.Scan(ctx, 0, "session:*", 1000).Iterator()
+	for iter.Next(ctx) {
+		encodedUUID := strings.TrimPrefix(iter.Val(), "session:")
+
+		added, err := s.client.ZAddNX(ctx, accessUsersKey, redis.Z{Score: now, Member: encodedUUID}).Result()
+		if err != nil {
+			return adopted, err
+		}
+
+		adopted += int(added)
+	}
+
+	return adopted, iter.Err()
+}
+
+func (s *memoryStore) Touch(ctx context.Context, uuid []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.accessedAt[base64.StdEncoding.EncodeToString(uuid)] = time.Now()
+
+	return nil
+}
+
+func (s *memoryStore) IdleUsers(ctx context.Context, until time.Time, limit int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var encodedUUIDs []string
+	for encodedUUID, at := range s.accessedAt {
+		if !at.After(until) {
+			encodedUUIDs = append(encodedUUIDs, encodedUUID)
+		}
+	}
+
+	slices.SortFunc(encodedUUIDs, func(a, b string) int {
+		return s.accessedAt[a].Compare(s.accessedAt[b])
+	})
+
+	if limit > 0 && len(encodedUUIDs) > limit {
+		encodedUUIDs = encodedUUIDs[:limit]
+	}
+
+	return encodedUUIDs, nil
+}
+
+func (s *memoryStore) Evict(ctx context.Context, encodedUUID string, until time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if at, ok := s.accessedAt[encodedUUID]; ok && at.After(until) {
+		return false, nil
+	}
+
+	_, dirty := s.dirtyAt[encodedUUID]
+	_, flushing := s.flushingAt[encodedUUID]
+	if dirty || flushing {
+		return false, nil
+	}
+
+	delete(s.docs, encodedUUID)
+	delete(s.accessedAt, encodedUUID)
+
+	return true, nil
+}
+
+func (s *memoryStore) AdoptUntracked(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	adopted := 0
+	for encodedUUID := range s.docs {
+		if _, ok := s.accessedAt[encodedUUID]; !ok {
+			s.accessedAt[encodedUUID] = now
+			adopted++
+		}
+	}
+
+	return adopted, nil
+}
+
+// StartSweeper starts the background worker that evicts idle user documents.
+func StartSweeper() {
+	if sweeperStop != nil {
+		return
+	}
+
+	adopted, err := store.AdoptUntracked(context.Background())
+	if err != nil {
+		slog.Error("failed to track idle time of existing user documents", "error", err)
+	} else if adopted > 0 {
+		slog.Info("tracking idle time of existing user documents", "users", adopted)
+	}
+
+	sweeperStop = make(chan struct{})
+	sweeperDone = make(chan struct{})
+
+	go func() {
+		defer close(sweeperDone)
+
+		// not cancelled, StopSweeper lets the current batch finish
+		ctx := context.Background()
+
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-sweeperStop:
+				return
+			case <-ticker.C:
+				if !Available() {
+					continue
+				}
+
+				err := sweepIdle(ctx)
+				if err != nil {
+					slog.Error("idle eviction failed", "error", err)
+				}
+			}
+		}
+	}()
+
+	slog.Info("idle eviction started", "idle_ttl", sessionDataTTL, "interval", sweepInterval)
+}
+
+// StopSweeper stops the background worker and waits for the current batch to finish.
+func StopSweeper() {
+	if sweeperStop == nil {
+		return
+	}
+
+	close(sweeperStop)
+	<-sweeperDone
+
+	sweeperStop = nil
+	sweeperDone = nil
+}
+
+// sweepIdle evicts idle user documents. Documents that still have changes to
+// write back are skipped and retried on a later sweep.
+func sweepIdle(ctx context.Context) error {
+	until := time.Now().Add(-sessionDataTTL)
+
+	encodedUUIDs, err := store.IdleUsers(ctx, until, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, encodedUUID := range encodedUUIDs {
+		evicted, err := store.Evict(ctx, encodedUUID, until)
+		if err != nil {
+			return err
+		}
+
+		if evicted {
+			metrics.CacheEvictedUsers.Inc()
+		}
+	}
+
+	return nil
+}
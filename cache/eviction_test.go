@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"context"
+	"encoding/base64"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestEvict(t *testing.T) {
+	ctx := context.Background()
+
+	uuid := []byte("aaaaaaaaaaaaaaaa")
+	encodedUUID := base64.StdEncoding.EncodeToString(uuid)
+
+	enabled := writeBack
+	writeBack = true
+	t.Cleanup(func() { writeBack = enabled })
+
+	for backend, s := range testStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			switch s := s.(type) {
+			case *memoryStore:
+				s.mu.Lock()
+				s.docs[encodedUUID] = []byte("{}")
+				s.mu.Unlock()
+			case *redisStore:
+				err := s.client.Set(ctx, "session:"+encodedUUID, "{}", 0).Err()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := s.Touch(ctx, uuid)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// every document is idle by this cutoff, and none by the other
+			idle, touched := time.Now().Add(time.Second), time.Now().Add(-time.Hour)
+
+			evict := func(until time.Time) bool {
+				t.Helper()
+
+				evicted, err := s.Evict(ctx, encodedUUID, until)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return evicted
+			}
+
+			markTestDirty(t, ctx, s, uuid, dirtySystem)
+			if evict(idle) {
+				t.Fatal("evicted while dirty")
+			}
+
+			claimTest(t, ctx, s, encodedUUID)
+			if evict(idle) {
+				t.Fatal("evicted while being flushed")
+			}
+
+			err = s.ReleaseDirty(ctx, []string{encodedUUID})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if evict(touched) {
+				t.Fatal("evicted after being touched")
+			}
+
+			if due, err := s.IdleUsers(ctx, idle, 0); err != nil || !slices.Equal(due, []string{encodedUUID}) {
+				t.Fatalf("idle users %v %v", due, err)
+			}
+
+			if !evict(idle) {
+				t.Fatal("kept while clean and idle")
+			}
+
+			if has, err := s.HasCacheData(ctx, uuid); err != nil || has {
+				t.Errorf("document left after eviction: %t %v", has, err)
+			}
+
+			if due, err := s.IdleUsers(ctx, idle, 0); err != nil || len(due) != 0 {
+				t.Errorf("idle users after eviction %v %v", due, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,480 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/defs"
+)
+
+// guardedStore puts a circuit breaker in front of a backend. Calls fail with
+// ErrUnavailable without reaching the backend while the breaker isn't closed;
+// Ping and Close always go through.
+type guardedStore struct {
+	Store
+	breaker *circuitBreaker
+}
+
+func guard(s Store, b *circuitBreaker) Store {
+	return &guardedStore{Store: s, breaker: b}
+}
+
+func (s *guardedStore) CacheAccount(ctx context.Context, dbRow defs.AccountDBRow) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.CacheAccount(ctx, dbRow)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) CacheAccountStats(ctx context.Context, uuid []byte, dbStats defs.AccountStatsData) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.CacheAccountStats(ctx, uuid, dbStats)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) FetchTrainerIds(ctx context.Context, uuid []byte) (int, int, error) {
+	if !s.breaker.allow() {
+		return 0, 0, ErrUnavailable
+	}
+
+	trainerId, secretId, err := s.Store.FetchTrainerIds(ctx, uuid)
+	s.breaker.record(ctx, err)
+	return trainerId, secretId, err
+}
+
+func (s *guardedStore) UpdateTrainerIds(ctx context.Context, trainerId, secretId int, uuid []byte) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.UpdateTrainerIds(ctx, trainerId, secretId, uuid)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) UpdateAccountLastActivity(ctx context.Context, uuid []byte) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.UpdateAccountLastActivity(ctx, uuid)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) UpdateAccountStats(ctx context.Context, uuid []byte, stats defs.GameStats, voucherCounts map[string]int) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.UpdateAccountStats(ctx, uuid, stats, voucherCounts)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) RetrievePlaytime(ctx context.Context, uuid []byte) (int, error) {
+	if !s.breaker.allow() {
+		return 0, ErrUnavailable
+	}
+
+	playtime, err := s.Store.RetrievePlaytime(ctx, uuid)
+	s.breaker.record(ctx, err)
+	return playtime, err
+}
+
+func (s *guardedStore) UpdateActiveSession(ctx context.Context, uuid []byte, sessionId string) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.UpdateActiveSession(ctx, uuid, sessionId)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) FetchActiveSession(ctx context.Context, uuid []byte) (string, error) {
+	if !s.breaker.allow() {
+		return "", ErrUnavailable
+	}
+
+	sessionId, err := s.Store.FetchActiveSession(ctx, uuid)
+	s.breaker.record(ctx, err)
+	return sessionId, err
+}
+
+func (s *guardedStore) StoreSessionToken(ctx context.Context, uuid []byte, token []byte) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.StoreSessionToken(ctx, uuid, token)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) StoreSessionTokenTTL(ctx context.Context, uuid []byte, token []byte, ttl time.Duration) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.StoreSessionTokenTTL(ctx, uuid, token, ttl)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) FetchSessionToken(ctx context.Context, token []byte) ([]byte, error) {
+	if !s.breaker.allow() {
+		return nil, ErrUnavailable
+	}
+
+	uuid, err := s.Store.FetchSessionToken(ctx, token)
+	s.breaker.record(ctx, err)
+	return uuid, err
+}
+
+func (s *guardedStore) RemoveSessionFromToken(ctx context.Context, token []byte) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.RemoveSessionFromToken(ctx, token)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) ReadSessionSaveData(ctx context.Context, uuid []byte, slot int) (defs.SessionSaveData, error) {
+	if !s.breaker.allow() {
+		return defs.SessionSaveData{}, ErrUnavailable
+	}
+
+	data, err := s.Store.ReadSessionSaveData(ctx, uuid, slot)
+	s.breaker.record(ctx, err)
+	return data, err
+}
+
+func (s *guardedStore) StoreSessionSaveData(ctx context.Context, uuid []byte, data defs.SessionSaveData, slot int) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.StoreSessionSaveData(ctx, uuid, data, slot)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) DeleteSessionSaveData(ctx context.Context, uuid []byte, slot int) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.DeleteSessionSaveData(ctx, uuid, slot)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) ReadSystemSaveData(ctx context.Context, uuid []byte) (defs.SystemSaveData, error) {
+	if !s.breaker.allow() {
+		return defs.SystemSaveData{}, ErrUnavailable
+	}
+
+	data, err := s.Store.ReadSystemSaveData(ctx, uuid)
+	s.breaker.record(ctx, err)
+	return data, err
+}
+
+func (s *guardedStore) StoreSystemSaveData(ctx context.Context, uuid []byte, data defs.SystemSaveData) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.StoreSystemSaveData(ctx, uuid, data)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) IsValidCacheData(ctx context.Context, uuid []byte) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.IsValidCacheData(ctx, uuid)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) HasCacheData(ctx context.Context, uuid []byte) (bool, error) {
+	if !s.breaker.allow() {
+		return false, ErrUnavailable
+	}
+
+	exists, err := s.Store.HasCacheData(ctx, uuid)
+	s.breaker.record(ctx, err)
+	return exists, err
+}
+
+func (s *guardedStore) AddCacheData(ctx context.Context, uuid []byte, userData defs.UserCacheData) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.AddCacheData(ctx, uuid, userData)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) StoreCacheData(ctx context.Context, uuid []byte, userData defs.UserCacheData) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.StoreCacheData(ctx, uuid, userData)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) DeleteCacheData(ctx context.Context, uuid []byte) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.DeleteCacheData(ctx, uuid)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) ReadCacheData(ctx context.Context, uuid []byte) (defs.UserCacheData, error) {
+	if !s.breaker.allow() {
+		return defs.UserCacheData{}, ErrUnavailable
+	}
+
+	doc, err := s.Store.ReadCacheData(ctx, uuid)
+	s.breaker.record(ctx, err)
+	return doc, err
+}
+
+func (s *guardedStore) Invalidate(ctx context.Context, uuid []byte, fields ...string) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.Invalidate(ctx, uuid, fields...)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) DirtyStatus(ctx context.Context) (int, time.Time, error) {
+	if !s.breaker.allow() {
+		return 0, time.Time{}, ErrUnavailable
+	}
+
+	count, oldest, err := s.Store.DirtyStatus(ctx)
+	s.breaker.record(ctx, err)
+	return count, oldest, err
+}
+
+func (s *guardedStore) DirtyUsers(ctx context.Context, until time.Time, limit int) ([]string, error) {
+	if !s.breaker.allow() {
+		return nil, ErrUnavailable
+	}
+
+	encodedUUIDs, err := s.Store.DirtyUsers(ctx, until, limit)
+	s.breaker.record(ctx, err)
+	return encodedUUIDs, err
+}
+
+func (s *guardedStore) ClaimDirty(ctx context.Context, encodedUUIDs []string) ([]DirtyEntry, []DirtyEntry, error) {
+	if !s.breaker.allow() {
+		return nil, nil, ErrUnavailable
+	}
+
+	claimed, missing, err := s.Store.ClaimDirty(ctx, encodedUUIDs)
+	s.breaker.record(ctx, err)
+	return claimed, missing, err
+}
+
+func (s *guardedStore) RequeueDirty(ctx context.Context, entries []DirtyEntry) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.RequeueDirty(ctx, entries)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) ReleaseDirty(ctx context.Context, encodedUUIDs []string) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.ReleaseDirty(ctx, encodedUUIDs)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) RecoverClaims(ctx context.Context, until time.Time) (int, error) {
+	if !s.breaker.allow() {
+		return 0, ErrUnavailable
+	}
+
+	recovered, err := s.Store.RecoverClaims(ctx, until)
+	s.breaker.record(ctx, err)
+	return recovered, err
+}
+
+func (s *guardedStore) PendingParts(ctx context.Context, uuid []byte) ([]string, error) {
+	if !s.breaker.allow() {
+		return nil, ErrUnavailable
+	}
+
+	parts, err := s.Store.PendingParts(ctx, uuid)
+	s.breaker.record(ctx, err)
+	return parts, err
+}
+
+func (s *guardedStore) Touch(ctx context.Context, uuid []byte) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.Touch(ctx, uuid)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) IdleUsers(ctx context.Context, until time.Time, limit int) ([]string, error) {
+	if !s.breaker.allow() {
+		return nil, ErrUnavailable
+	}
+
+	encodedUUIDs, err := s.Store.IdleUsers(ctx, until, limit)
+	s.breaker.record(ctx, err)
+	return encodedUUIDs, err
+}
+
+func (s *guardedStore) Evict(ctx context.Context, encodedUUID string, idleSince time.Time) (bool, error) {
+	if !s.breaker.allow() {
+		return false, ErrUnavailable
+	}
+
+	evicted, err := s.Store.Evict(ctx, encodedUUID, idleSince)
+	s.breaker.record(ctx, err)
+	return evicted, err
+}
+
+func (s *guardedStore) AdoptUntracked(ctx context.Context) (int, error) {
+	if !s.breaker.allow() {
+		return 0, ErrUnavailable
+	}
+
+	adopted, err := s.Store.AdoptUntracked(ctx)
+	s.breaker.record(ctx, err)
+	return adopted, err
+}
+
+func (s *guardedStore) SampleUsers(ctx context.Context, n int) ([]string, error) {
+	if !s.breaker.allow() {
+		return nil, ErrUnavailable
+	}
+
+	encodedUUIDs, err := s.Store.SampleUsers(ctx, n)
+	s.breaker.record(ctx, err)
+	return encodedUUIDs, err
+}
+
+func (s *guardedStore) BeginLeaderboardBuild(ctx context.Context, board string) (string, error) {
+	if !s.breaker.allow() {
+		return "", ErrUnavailable
+	}
+
+	build, err := s.Store.BeginLeaderboardBuild(ctx, board)
+	s.breaker.record(ctx, err)
+	return build, err
+}
+
+func (s *guardedStore) FinishLeaderboardBuild(ctx context.Context, board, build string, entries []defs.LeaderboardEntry, expires time.Time) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.FinishLeaderboardBuild(ctx, board, build, entries, expires)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) AbortLeaderboardBuild(ctx context.Context, board, build string) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.AbortLeaderboardBuild(ctx, board, build)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) SetLeaderboardEntry(ctx context.Context, board string, entry defs.LeaderboardEntry) (bool, error) {
+	if !s.breaker.allow() {
+		return false, ErrUnavailable
+	}
+
+	set, err := s.Store.SetLeaderboardEntry(ctx, board, entry)
+	s.breaker.record(ctx, err)
+	return set, err
+}
+
+func (s *guardedStore) RemoveLeaderboardEntry(ctx context.Context, board string, username string) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
+	}
+
+	err := s.Store.RemoveLeaderboardEntry(ctx, board, username)
+	s.breaker.record(ctx, err)
+	return err
+}
+
+func (s *guardedStore) Leaderboards(ctx context.Context) ([]string, error) {
+	if !s.breaker.allow() {
+		return nil, ErrUnavailable
+	}
+
+	boards, err := s.Store.Leaderboards(ctx)
+	s.breaker.record(ctx, err)
+	return boards, err
+}
+
+func (s *guardedStore) LeaderboardPage(ctx context.Context, board string, offset, count int) ([]defs.LeaderboardEntry, error) {
+	if !s.breaker.allow() {
+		return nil, ErrUnavailable
+	}
+
+	entries, err := s.Store.LeaderboardPage(ctx, board, offset, count)
+	s.breaker.record(ctx, err)
+	return entries, err
+}
+
+func (s *guardedStore) LeaderboardCount(ctx context.Context, board string) (int, error) {
+	if !s.breaker.allow() {
+		return 0, ErrUnavailable
+	}
+
+	count, err := s.Store.LeaderboardCount(ctx, board)
+	s.breaker.record(ctx, err)
+	return count, err
+}
+
+func (s *guardedStore) LeaderboardRank(ctx context.Context, board string, username string) (int, bool, error) {
+	if !s.breaker.allow() {
+		return 0, false, ErrUnavailable
+	}
+
+	rank, ok, err := s.Store.LeaderboardRank(ctx, board, username)
+	s.breaker.record(ctx, err)
+	return rank, ok, err
+}
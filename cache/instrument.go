@@ -0,0 +1,392 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/defs"
+	"github.com/pagefaultgames/rogueserver/metrics"
+)
+
+// instrumentedStore times the calls into a backend. Reads are also counted as
+// hits, misses (ErrMiss) or errors, everything else only as errors.
+type instrumentedStore struct {
+	Store
+	backend string
+}
+
+func instrument(s Store, backend string) Store {
+	return &instrumentedStore{Store: s, backend: backend}
+}
+
+func (s *instrumentedStore) observe(operation string, start time.Time, err error) {
+	metrics.CacheDuration.WithLabelValues(s.backend, operation).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, ErrMiss) {
+		metrics.CacheErrors.WithLabelValues(s.backend, operation).Inc()
+	}
+}
+
+func (s *instrumentedStore) observeRead(operation string, start time.Time, err error) {
+	s.observe(operation, start, err)
+
+	if err == nil {
+		metrics.CacheHits.WithLabelValues(s.backend, operation).Inc()
+	} else if errors.Is(err, ErrMiss) {
+		metrics.CacheMisses.WithLabelValues(s.backend, operation).Inc()
+	}
+}
+
+func (s *instrumentedStore) CacheAccount(ctx context.Context, dbRow defs.AccountDBRow) error {
+	start := time.Now()
+	err := s.Store.CacheAccount(ctx, dbRow)
+	s.observe("cache_account", start, err)
+	return err
+}
+
+func (s *instrumentedStore) CacheAccountStats(ctx context.Context, uuid []byte, dbStats defs.AccountStatsData) error {
+	start := time.Now()
+	err := s.Store.CacheAccountStats(ctx, uuid, dbStats)
+	s.observe("cache_account_stats", start, err)
+	return err
+}
+
+func (s *instrumentedStore) FetchTrainerIds(ctx context.Context, uuid []byte) (int, int, error) {
+	start := time.Now()
+	trainerId, secretId, err := s.Store.FetchTrainerIds(ctx, uuid)
+	s.observeRead("fetch_trainer_ids", start, err)
+	return trainerId, secretId, err
+}
+
+func (s *instrumentedStore) UpdateTrainerIds(ctx context.Context, trainerId, secretId int, uuid []byte) error {
+	start := time.Now()
+	err := s.Store.UpdateTrainerIds(ctx, trainerId, secretId, uuid)
+	s.observe("update_trainer_ids", start, err)
+	return err
+}
+
+func (s *instrumentedStore) UpdateAccountLastActivity(ctx context.Context, uuid []byte) error {
+	start := time.Now()
+	err := s.Store.UpdateAccountLastActivity(ctx, uuid)
+	s.observe("update_last_activity", start, err)
+	return err
+}
+
+func (s *instrumentedStore) UpdateAccountStats(ctx context.Context, uuid []byte, stats defs.GameStats, voucherCounts map[string]int) error {
+	start := time.Now()
+	err := s.Store.UpdateAccountStats(ctx, uuid, stats, voucherCounts)
+	s.observe("update_account_stats", start, err)
+	return err
+}
+
+func (s *instrumentedStore) RetrievePlaytime(ctx context.Context, uuid []byte) (int, error) {
+	start := time.Now()
+	playtime, err := s.Store.RetrievePlaytime(ctx, uuid)
+	s.observeRead("retrieve_playtime", start, err)
+	return playtime, err
+}
+
+func (s *instrumentedStore) UpdateActiveSession(ctx context.Context, uuid []byte, sessionId string) error {
+	start := time.Now()
+	err := s.Store.UpdateActiveSession(ctx, uuid, sessionId)
+	s.observe("update_active_session", start, err)
+	return err
+}
+
+func (s *instrumentedStore) FetchActiveSession(ctx context.Context, uuid []byte) (string, error) {
+	start := time.Now()
+	sessionId, err := s.Store.FetchActiveSession(ctx, uuid)
+	s.observeRead("fetch_active_session", start, err)
+	return sessionId, err
+}
+
+func (s *instrumentedStore) StoreSessionToken(ctx context.Context, uuid []byte, token []byte) error {
+	start := time.Now()
+	err := s.Store.StoreSessionToken(ctx, uuid, token)
+	s.observe("store_token", start, err)
+	return err
+}
+
+func (s *instrumentedStore) StoreSessionTokenTTL(ctx context.Context, uuid []byte, token []byte, ttl time.Duration) error {
+	start := time.Now()
+	err := s.Store.StoreSessionTokenTTL(ctx, uuid, token, ttl)
+	s.observe("store_token", start, err)
+	return err
+}
+
+func (s *instrumentedStore) FetchSessionToken(ctx context.Context, token []byte) ([]byte, error) {
+	start := time.Now()
+	uuid, err := s.Store.FetchSessionToken(ctx, token)
+	s.observeRead("fetch_token", start, err)
+	return uuid, err
+}
+
+func (s *instrumentedStore) RemoveSessionFromToken(ctx context.Context, token []byte) error {
+	start := time.Now()
+	err := s.Store.RemoveSessionFromToken(ctx, token)
+	s.observe("remove_token", start, err)
+	return err
+}
+
+func (s *instrumentedStore) ReadSessionSaveData(ctx context.Context, uuid []byte, slot int) (defs.SessionSaveData, error) {
+	start := time.Now()
+	data, err := s.Store.ReadSessionSaveData(ctx, uuid, slot)
+	s.observeRead("read_session", start, err)
+	return data, err
+}
+
+func (s *instrumentedStore) StoreSessionSaveData(ctx context.Context, uuid []byte, data defs.SessionSaveData, slot int) error {
+	start := time.Now()
+	err := s.Store.StoreSessionSaveData(ctx, uuid, data, slot)
+	s.observe("store_session", start, err)
+	return err
+}
+
+func (s *instrumentedStore) DeleteSessionSaveData(ctx context.Context, uuid []byte, slot int) error {
+	start := time.Now()
+	err := s.Store.DeleteSessionSaveData(ctx, uuid, slot)
+	s.observe("delete_session", start, err)
+	return err
+}
+
+func (s *instrumentedStore) ReadSystemSaveData(ctx context.Context, uuid []byte) (defs.SystemSaveData, error) {
+	start := time.Now()
+	data, err := s.Store.ReadSystemSaveData(ctx, uuid)
+	s.observeRead("read_system", start, err)
+	return data, err
+}
+
+func (s *instrumentedStore) StoreSystemSaveData(ctx context.Context, uuid []byte, data defs.SystemSaveData) error {
+	start := time.Now()
+	err := s.Store.StoreSystemSaveData(ctx, uuid, data)
+	s.observe("store_system", start, err)
+	return err
+}
+
+func (s *instrumentedStore) UpdateSessionSaveData(ctx context.Context, uuid []byte, data defs.SessionSaveData, slot int, validate func(current *defs.SessionSaveData) error) error {
+	start := time.Now()
+	err := s.Store.UpdateSessionSaveData(ctx, uuid, data, slot, validate)
+	s.observe("update_session", start, err)
+	return err
+}
+
+func (s *instrumentedStore) UpdateSystemSaveData(ctx context.Context, uuid []byte, data defs.SystemSaveData, validate func(current *defs.SystemSaveData) error) error {
+	start := time.Now()
+	err := s.Store.UpdateSystemSaveData(ctx, uuid, data, validate)
+	s.observe("update_system", start, err)
+	return err
+}
+
+func (s *instrumentedStore) UpdateAll(ctx context.Context, uuid []byte, update defs.SaveUpdate, validate func(defs.SaveSnapshot) error) error {
+	start := time.Now()
+	err := s.Store.UpdateAll(ctx, uuid, update, validate)
+	s.observe("update_all", start, err)
+	return err
+}
+
+func (s *instrumentedStore) IsValidCacheData(ctx context.Context, uuid []byte) error {
+	start := time.Now()
+	err := s.Store.IsValidCacheData(ctx, uuid)
+	s.observe("is_valid_cache_data", start, err)
+	return err
+}
+
+func (s *instrumentedStore) HasCacheData(ctx context.Context, uuid []byte) (bool, error) {
+	start := time.Now()
+	exists, err := s.Store.HasCacheData(ctx, uuid)
+	if err == nil && !exists {
+		s.observeRead("has_cache_data", start, ErrMiss)
+	} else {
+		s.observeRead("has_cache_data", start, err)
+	}
+	return exists, err
+}
+
+func (s *instrumentedStore) AddCacheData(ctx context.Context, uuid []byte, userData defs.UserCacheData) error {
+	start := time.Now()
+	err := s.Store.AddCacheData(ctx, uuid, userData)
+	s.observe("add_cache_data", start, err)
+	return err
+}
+
+func (s *instrumentedStore) StoreCacheData(ctx context.Context, uuid []byte, userData defs.UserCacheData) error {
+	start := time.Now()
+	err := s.Store.StoreCacheData(ctx, uuid, userData)
+	s.observe("store_cache_data", start, err)
+	return err
+}
+
+func (s *instrumentedStore) DeleteCacheData(ctx context.Context, uuid []byte) error {
+	start := time.Now()
+	err := s.Store.DeleteCacheData(ctx, uuid)
+	s.observe("delete_cache_data", start, err)
+	return err
+}
+
+func (s *instrumentedStore) ReadCacheData(ctx context.Context, uuid []byte) (defs.UserCacheData, error) {
+	start := time.Now()
+	doc, err := s.Store.ReadCacheData(ctx, uuid)
+	s.observeRead("read_cache_data", start, err)
+	return doc, err
+}
+
+func (s *instrumentedStore) Invalidate(ctx context.Context, uuid []byte, fields ...string) error {
+	start := time.Now()
+	err := s.Store.Invalidate(ctx, uuid, fields...)
+	s.observe("invalidate", start, err)
+	return err
+}
+
+func (s *instrumentedStore) DirtyStatus(ctx context.Context) (int, time.Time, error) {
+	start := time.Now()
+	count, oldest, err := s.Store.DirtyStatus(ctx)
+	s.observe("dirty_status", start, err)
+	return count, oldest, err
+}
+
+func (s *instrumentedStore) DirtyUsers(ctx context.Context, until time.Time, limit int) ([]string, error) {
+	start := time.Now()
+	encodedUUIDs, err := s.Store.DirtyUsers(ctx, until, limit)
+	s.observe("dirty_users", start, err)
+	return encodedUUIDs, err
+}
+
+func (s *instrumentedStore) ClaimDirty(ctx context.Context, encodedUUIDs []string) ([]DirtyEntry, []DirtyEntry, error) {
+	start := time.Now()
+	claimed, missing, err := s.Store.ClaimDirty(ctx, encodedUUIDs)
+	s.observe("claim_dirty", start, err)
+	return claimed, missing, err
+}
+
+func (s *instrumentedStore) RequeueDirty(ctx context.Context, entries []DirtyEntry) error {
+	start := time.Now()
+	err := s.Store.RequeueDirty(ctx, entries)
+	s.observe("requeue_dirty", start, err)
+	return err
+}
+
+func (s *instrumentedStore) ReleaseDirty(ctx context.Context, encodedUUIDs []string) error {
+	start := time.Now()
+	err := s.Store.ReleaseDirty(ctx, encodedUUIDs)
+	s.observe("release_dirty", start, err)
+	return err
+}
+
+func (s *instrumentedStore) RecoverClaims(ctx context.Context, until time.Time) (int, error) {
+	start := time.Now()
+	recovered, err := s.Store.RecoverClaims(ctx, until)
+	s.observe("recover_claims", start, err)
+	return recovered, err
+}
+
+func (s *instrumentedStore) PendingParts(ctx context.Context, uuid []byte) ([]string, error) {
+	start := time.Now()
+	parts, err := s.Store.PendingParts(ctx, uuid)
+	s.observe("pending_parts", start, err)
+	return parts, err
+}
+
+func (s *instrumentedStore) Touch(ctx context.Context, uuid []byte) error {
+	start := time.Now()
+	err := s.Store.Touch(ctx, uuid)
+	s.observe("touch", start, err)
+	return err
+}
+
+func (s *instrumentedStore) IdleUsers(ctx context.Context, until time.Time, limit int) ([]string, error) {
+	start := time.Now()
+	encodedUUIDs, err := s.Store.IdleUsers(ctx, until, limit)
+	s.observe("idle_users", start, err)
+	return encodedUUIDs, err
+}
+
+func (s *instrumentedStore) Evict(ctx context.Context, encodedUUID string, idleSince time.Time) (bool, error) {
+	start := time.Now()
+	evicted, err := s.Store.Evict(ctx, encodedUUID, idleSince)
+	s.observe("evict", start, err)
+	return evicted, err
+}
+
+func (s *instrumentedStore) AdoptUntracked(ctx context.Context) (int, error) {
+	start := time.Now()
+	adopted, err := s.Store.AdoptUntracked(ctx)
+	s.observe("adopt_untracked", start, err)
+	return adopted, err
+}
+
+func (s *instrumentedStore) SampleUsers(ctx context.Context, n int) ([]string, error) {
+	start := time.Now()
+	encodedUUIDs, err := s.Store.SampleUsers(ctx, n)
+	s.observe("sample_users", start, err)
+	return encodedUUIDs, err
+}
+
+func (s *instrumentedStore) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := s.Store.Ping(ctx)
+	s.observe("ping", start, err)
+	return err
+}
+
+func (s *instrumentedStore) BeginLeaderboardBuild(ctx context.Context, board string) (string, error) {
+	start := time.Now()
+	build, err := s.Store.BeginLeaderboardBuild(ctx, board)
+	s.observe("begin_leaderboard_build", start, err)
+	return build, err
+}
+
+func (s *instrumentedStore) FinishLeaderboardBuild(ctx context.Context, board, build string, entries []defs.LeaderboardEntry, expires time.Time) error {
+	start := time.Now()
+	err := s.Store.FinishLeaderboardBuild(ctx, board, build, entries, expires)
+	s.observe("finish_leaderboard_build", start, err)
+	return err
+}
+
+func (s *instrumentedStore) AbortLeaderboardBuild(ctx context.Context, board, build string) error {
+	start := time.Now()
+	err := s.Store.AbortLeaderboardBuild(ctx, board, build)
+	s.observe("abort_leaderboard_build", start, err)
+	return err
+}
+
+func (s *instrumentedStore) SetLeaderboardEntry(ctx context.Context, board string, entry defs.LeaderboardEntry) (bool, error) {
+	start := time.Now()
+	set, err := s.Store.SetLeaderboardEntry(ctx, board, entry)
+	s.observe("set_leaderboard_entry", start, err)
+	return set, err
+}
+
+func (s *instrumentedStore) RemoveLeaderboardEntry(ctx context.Context, board string, username string) error {
+	start := time.Now()
+	err := s.Store.RemoveLeaderboardEntry(ctx, board, username)
+	s.observe("remove_leaderboard_entry", start, err)
+	return err
+}
+
+func (s *instrumentedStore) Leaderboards(ctx context.Context) ([]string, error) {
+	start := time.Now()
+	boards, err := s.Store.Leaderboards(ctx)
+	s.observe("leaderboards", start, err)
+	return boards, err
+}
+
+func (s *instrumentedStore) LeaderboardPage(ctx context.Context, board string, offset, count int) ([]defs.LeaderboardEntry, error) {
+	start := time.Now()
+	entries, err := s.Store.LeaderboardPage(ctx, board, offset, count)
+	s.observeRead("leaderboard_page", start, err)
+	return entries, err
+}
+
+func (s *instrumentedStore) LeaderboardCount(ctx context.Context, board string) (int, error) {
+	start := time.Now()
+	count, err := s.Store.LeaderboardCount(ctx, board)
+	s.observeRead("leaderboard_count", start, err)
+	return count, err
+}
+
+func (s *instrumentedStore) LeaderboardRank(ctx context.Context, board string, username string) (int, bool, error) {
+	start := time.Now()
+	rank, ok, err := s.Store.LeaderboardRank(ctx, board, username)
+	s.observeRead("leaderboard_rank", start, err)
+	return rank, ok, err
+}
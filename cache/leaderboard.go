@@ -0,0 +1,694 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/defs"
+	"github.com/redis/go-redis/v9"
+)
+
+// Leaderboards are kept in sorted sets, one per board, like one per day of
+// daily runs:
+//
+//	leaderboard:<board>                  sorted set of entry members, scored by score
+//	leaderboard:<board>:index            hash of username -> the member of its entry
+//	leaderboard:<board>:builds           sorted set of builds in progress, scored by the unix time they are abandoned
+//	leaderboard:<board>:build:<id>       the board a build is staging, with :index and
+//	leaderboard:<board>:build:<id>:removed  set of usernames removed while it was built
+//	leaderboards                         sorted set of complete boards, scored by the unix time they expire
+//
+// A member is "<tie>:<wave>:<username>", with tie counting down from
+// maxLeaderboardTie as the time the score was reached goes up, both
+// zero-padded. Equal scores are ordered by member, so in descending order the
+// earlier one comes first.
+//
+// A board is built from the database by staging a copy under a key of its own
+// and renaming it over the board once complete. Entries set or removed while
+// it is built are applied to the staging copy as well, so whatever the
+// database snapshot missed isn't lost. Setting an entry never lowers it: the
+// better of the two is kept, so a snapshot or a delayed update can't undo a
+// newer one.
+//
+// Entries are only changed on complete boards, i.e. ones that were built and
+// haven't expired. Reads of any other board are a miss and have to go to the
+// database.
+const (
+	leaderboardsKey   = "leaderboards"
+	maxLeaderboardTie = 9999999999
+)
+
+// how long a build may take before it is abandoned
+var leaderboardBuildTimeout = 10 * time.Minute
+
+func leaderboardKey(board string) string {
+	return "leaderboard:" + board
+}
+
+func leaderboardBuildKey(board, build string) string {
+	return leaderboardKey(board) + ":build:" + build
+}
+
+func leaderboardMember(entry defs.LeaderboardEntry) string {
+	return fmt.Sprintf("%010d:%06d:%s", maxLeaderboardTie-entry.Timestamp.Unix(), entry.Wave, entry.Username)
+}
+
+// betterLeaderboardMember reports whether an entry with member and score is
+// at least as good as one with old and oldScore.
+func betterLeaderboardMember(member string, score int, old string, oldScore int) bool {
+	return score > oldScore || score == oldScore && member >= old
+}
+
+func parseLeaderboardMember(member string, score float64) (defs.LeaderboardEntry, error) {
+	fields := strings.SplitN(member, ":", 3)
+	if len(fields) != 3 {
+		return defs.LeaderboardEntry{}, fmt.Errorf("invalid leaderboard member %q", member)
+	}
+
+	tie, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return defs.LeaderboardEntry{}, fmt.Errorf("invalid leaderboard member %q", member)
+	}
+
+	wave, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return defs.LeaderboardEntry{}, fmt.Errorf("invalid leaderboard member %q", member)
+	}
+
+	return defs.LeaderboardEntry{
+		Username:  fields[2],
+		Score:     int(score),
+		Wave:      wave,
+		Timestamp: time.Unix(maxLeaderboardTie-tie, 0).UTC(),
+	}, nil
+}
+
+// leaderboardLua holds the functions the leaderboard scripts share:
+//
+//	set(board, index, username, member, score) keeps the better of the new
+//	entry and the one the user has, see betterLeaderboardMember
+//	remove(board, index, username) removes the entry of the user
+//	stage(key, now, username, member, score, removed) does set or remove on
+//	every build of key in progress, dropping abandoned ones
+const leaderboardLua = `
+local function set(board, index, username, member, score)
+	local old = redis.call('HGET', index, username)
+	if old then
+		local oldScore = tonumber(redis.call('ZSCORE', board, old))
+		if oldScore and (oldScore > tonumber(score) or oldScore == tonumber(score) and old > member) then
+			return
+		end
+		redis.call('ZREM', board, old)
+	end
+
+	redis.call('ZADD', board, score, member)
+	redis.call('HSET', index, username, member)
+end
+
+local function remove(board, index, username)
+	local old = redis.call('HGET', index, username)
+	if old then
+		redis.call('ZREM', board, old)
+		redis.call('HDEL', index, username)
+	end
+end
+
+local function stage(key, now, username, member, score, removed)
+	redis.call('ZREMRANGEBYSCORE', key .. ':builds', '-inf', now)
+
+	local builds = redis.call('ZRANGE', key .. ':builds', 0, -1, 'WITHSCORES')
+	for i = 1, #builds, 2 do
+		local staging = key .. ':build:' .. builds[i]
+		if removed then
+			remove(staging, staging .. ':index', username)
+			redis.call('SADD', staging .. ':removed', username)
+		else
+			set(staging, staging .. ':index', username, member, score)
+			redis.call('SREM', staging .. ':removed', username)
+		end
+
+		for _, k in ipairs({staging, staging .. ':index', staging .. ':removed'}) do
+			redis.call('EXPIREAT', k, builds[i + 1])
+		end
+	end
+end
+`
+
+// setLeaderboardEntryScript sets the entry of a user on the builds of a board
+// in progress and, if it is complete, on the board.
+//
+//	KEYS: leaderboard:<board>, leaderboard:<board>:index, leaderboards
+//	ARGV: board, unix time, username, member, score
+var setLeaderboardEntryScript = redis.NewScript(leaderboardLua + `
+stage(KEYS[1], ARGV[2], ARGV[3], ARGV[4], ARGV[5], false)
+
+local expires = redis.call('ZSCORE', KEYS[3], ARGV[1])
+if not expires or tonumber(expires) <= tonumber(ARGV[2]) then
+	return 0
+end
+
+set(KEYS[1], KEYS[2], ARGV[3], ARGV[4], ARGV[5])
+redis.call('EXPIREAT', KEYS[1], expires)
+redis.call('EXPIREAT', KEYS[2], expires)
+return 1
+`)
+
+// removeLeaderboardEntryScript removes the entry of a user from a board and
+// its builds in progress.
+//
+//	KEYS: leaderboard:<board>, leaderboard:<board>:index
+//	ARGV: unix time, username
+var removeLeaderboardEntryScript = redis.NewScript(leaderboardLua + `
+stage(KEYS[1], ARGV[1], ARGV[2], nil, nil, true)
+remove(KEYS[1], KEYS[2], ARGV[2])
+return 1
+`)
+
+// stageLeaderboardEntriesScript adds entries from the database to a build,
+// except for users removed since it began.
+//
+//	KEYS: staging board, its :index, its :removed
+//	ARGV: unix time the build is abandoned, then username, member, score of each entry
+var stageLeaderboardEntriesScript = redis.NewScript(leaderboardLua + `
+for i = 2, #ARGV, 3 do
+	if redis.call('SISMEMBER', KEYS[3], ARGV[i]) == 0 then
+		set(KEYS[1], KEYS[2], ARGV[i], ARGV[i + 1], ARGV[i + 2])
+	end
+end
+
+redis.call('EXPIREAT', KEYS[1], ARGV[1])
+redis.call('EXPIREAT', KEYS[2], ARGV[1])
+return 1
+`)
+
+// finishLeaderboardBuildScript replaces a board with a build and marks it
+// complete. It returns 0 if the build was abandoned.
+//
+//	KEYS: leaderboard:<board>, leaderboard:<board>:index, leaderboard:<board>:builds, leaderboards, staging board, its :index, its :removed
+//	ARGV: board, build, unix time the board expires
+var finishLeaderboardBuildScript = redis.NewScript(`
+if not redis.call('ZSCORE', KEYS[3], ARGV[2]) then
+	return 0
+end
+
+redis.call('ZREM', KEYS[3], ARGV[2])
+redis.call('DEL', KEYS[7])
+
+for i = 1, 2 do
+	if redis.call('EXISTS', KEYS[i + 4]) == 1 then
+		redis.call('RENAME', KEYS[i + 4], KEYS[i])
+		redis.call('EXPIREAT', KEYS[i], ARGV[3])
+	else
+		redis.call('DEL', KEYS[i])
+	end
+end
+
+redis.call('ZADD', KEYS[4], ARGV[3], ARGV[1])
+return 1
+`)
+
+// leaderboardRankScript returns the position of the entry of a user on a
+// board, best first, or -1 if it has none.
+//
+//	KEYS: leaderboard:<board>, leaderboard:<board>:index
+//	ARGV: username
+var leaderboardRankScript = redis.NewScript(`
+local member = redis.call('HGET', KEYS[2], ARGV[1])
+if not member then
+	return -1
+end
+
+local rank = redis.call('ZREVRANK', KEYS[1], member)
+if not rank then
+	return -1
+end
+
+return rank
+`)
+
+// errLeaderboardBuildAbandoned is returned when a build took so long it was
+// abandoned.
+var errLeaderboardBuildAbandoned = errors.New("leaderboard build abandoned")
+
+func newLeaderboardBuild() (string, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// BeginLeaderboardBuild starts a build of a board. From now on entries set or
+// removed are applied to the build as well.
+func (s *redisStore) BeginLeaderboardBuild(ctx context.Context, board string) (string, error) {
+	build, err := newLeaderboardBuild()
+	if err != nil {
+		return "", err
+	}
+
+	deadline := time.Now().Add(leaderboardBuildTimeout).Unix()
+
+	err = s.client.ZAdd(ctx, leaderboardKey(board)+":builds", redis.Z{Score: float64(deadline), Member: build}).Err()
+	if err != nil {
+		return "", err
+	}
+
+	return build, nil
+}
+
+// FinishLeaderboardBuild adds entries read from the database since the build
+// began to it, replaces the board with it and marks it complete until
+// expires. Readers see the old board or the new one, never a mix.
+func (s *redisStore) FinishLeaderboardBuild(ctx context.Context, board, build string, entries []defs.LeaderboardEntry, expires time.Time) error {
+	staging := leaderboardBuildKey(board, build)
+	stagingKeys := []string{staging, staging + ":index", staging + ":removed"}
+
+	deadline, err := s.client.ZScore(ctx, leaderboardKey(board)+":builds", build).Result()
+	if errors.Is(err, redis.Nil) {
+		return fmt.Errorf("%w: %s", errLeaderboardBuildAbandoned, board)
+	} else if err != nil {
+		return err
+	}
+
+	// in batches, so a big board doesn't block Redis for long
+	for start := 0; start < len(entries); start += 1000 {
+		batch := entries[start:min(start+1000, len(entries))]
+
+		args := make([]any, 1, 1+3*len(batch))
+		args[0] = int64(deadline)
+		for _, entry := range batch {
+			args = append(args, entry.Username, leaderboardMember(entry), entry.Score)
+		}
+
+		err = stageLeaderboardEntriesScript.Run(ctx, s.client, stagingKeys, args...).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	key := leaderboardKey(board)
+
+	finished, err := finishLeaderboardBuildScript.Run(ctx, s.client, append([]string{key, key + ":index", key + ":builds", leaderboardsKey}, stagingKeys...), board, build, expires.Unix()).Int()
+	if err != nil {
+		return err
+	} else if finished == 0 {
+		return fmt.Errorf("%w: %s", errLeaderboardBuildAbandoned, board)
+	}
+
+	return nil
+}
+
+// AbortLeaderboardBuild drops a build that won't be finished.
+func (s *redisStore) AbortLeaderboardBuild(ctx context.Context, board, build string) error {
+	staging := leaderboardBuildKey(board, build)
+
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, leaderboardKey(board)+":builds", build)
+		pipe.Del(ctx, staging, staging+":index", staging+":removed")
+		return nil
+	})
+
+	return err
+}
+
+// SetLeaderboardEntry adds or improves the entry of a user on a board. It
+// reports false and only updates builds in progress if the board isn't
+// complete.
+func (s *redisStore) SetLeaderboardEntry(ctx context.Context, board string, entry defs.LeaderboardEntry) (bool, error) {
+	key := leaderboardKey(board)
+
+	set, err := setLeaderboardEntryScript.Run(ctx, s.client, []string{key, key + ":index", leaderboardsKey}, board, time.Now().Unix(), entry.Username, leaderboardMember(entry), entry.Score).Int()
+	if err != nil {
+		return false, err
+	}
+
+	return set == 1, nil
+}
+
+// RemoveLeaderboardEntry removes the entry of a user from a board, if it has
+// one, and from builds of it in progress.
+func (s *redisStore) RemoveLeaderboardEntry(ctx context.Context, board string, username string) error {
+	key := leaderboardKey(board)
+	return removeLeaderboardEntryScript.Run(ctx, s.client, []string{key, key + ":index"}, time.Now().Unix(), username).Err()
+}
+
+// Leaderboards lists the complete boards.
+func (s *redisStore) Leaderboards(ctx context.Context) ([]string, error) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	err := s.client.ZRemRangeByScore(ctx, leaderboardsKey, "-inf", now).Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.client.ZRange(ctx, leaderboardsKey, 0, -1).Result()
+}
+
+func (s *redisStore) leaderboardComplete(ctx context.Context, board string) error {
+	expires, err := s.client.ZScore(ctx, leaderboardsKey, board).Result()
+	if errors.Is(err, redis.Nil) || err == nil && int64(expires) <= time.Now().Unix() {
+		return fmt.Errorf("%w: leaderboard %s", ErrMiss, board)
+	}
+
+	return err
+}
+
+// LeaderboardPage returns up to count entries of a board from offset on,
+// best first. An incomplete board is reported as ErrMiss.
+func (s *redisStore) LeaderboardPage(ctx context.Context, board string, offset, count int) ([]defs.LeaderboardEntry, error) {
+	err := s.leaderboardComplete(ctx, board)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := s.client.ZRevRangeWithScores(ctx, leaderboardKey(board), int64(offset), int64(offset+count-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]defs.LeaderboardEntry, 0, len(members))
+	for _, member := range members {
+		entry, err := parseLeaderboardMember(member.Member.(string), member.Score)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// LeaderboardCount returns the number of entries on a board. An incomplete
+// board is reported as ErrMiss.
+func (s *redisStore) LeaderboardCount(ctx context.Context, board string) (int, error) {
+	err := s.leaderboardComplete(ctx, board)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := s.client.ZCard(ctx, leaderboardKey(board)).Result()
+
+	return int(count), err
+}
+
+// LeaderboardRank returns the position of the entry of a user on a board,
+// counting from 0 for the best. ok is false if the user has no entry. An
+// incomplete board is reported as ErrMiss.
+func (s *redisStore) LeaderboardRank(ctx context.Context, board string, username string) (int, bool, error) {
+	err := s.leaderboardComplete(ctx, board)
+	if err != nil {
+		return 0, false, err
+	}
+
+	key := leaderboardKey(board)
+
+	rank, err := leaderboardRankScript.Run(ctx, s.client, []string{key, key + ":index"}, username).Int()
+	if err != nil {
+		return 0, false, err
+	}
+
+	return rank, rank >= 0, nil
+}
+
+type memoryLeaderboard struct {
+	entries map[string]defs.LeaderboardEntry // by username
+	expires time.Time
+}
+
+// memoryLeaderboardBuild is a board being built, see BeginLeaderboardBuild.
+type memoryLeaderboardBuild struct {
+	entries  map[string]defs.LeaderboardEntry
+	removed  map[string]struct{}
+	deadline time.Time
+}
+
+// board returns a complete board. The caller must hold s.mu.
+func (s *memoryStore) board(board string) (*memoryLeaderboard, error) {
+	b, ok := s.leaderboards[board]
+	if !ok || !b.expires.After(time.Now()) {
+		delete(s.leaderboards, board)
+		return nil, fmt.Errorf("%w: leaderboard %s", ErrMiss, board)
+	}
+
+	return b, nil
+}
+
+// builds returns the builds of a board in progress. The caller must hold s.mu.
+func (s *memoryStore) builds(board string) map[string]*memoryLeaderboardBuild {
+	builds := s.leaderboardBuilds[board]
+	for build, b := range builds {
+		if !b.deadline.After(time.Now()) {
+			delete(builds, build)
+		}
+	}
+
+	return builds
+}
+
+// setMemoryLeaderboardEntry keeps the better of entry and the one the user has.
+func setMemoryLeaderboardEntry(entries map[string]defs.LeaderboardEntry, entry defs.LeaderboardEntry) {
+	old, ok := entries[entry.Username]
+	if ok && !betterLeaderboardMember(leaderboardMember(entry), entry.Score, leaderboardMember(old), old.Score) {
+		return
+	}
+
+	entries[entry.Username] = entry
+}
+
+func (s *memoryStore) BeginLeaderboardBuild(ctx context.Context, board string) (string, error) {
+	build, err := newLeaderboardBuild()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.leaderboardBuilds[board] == nil {
+		s.leaderboardBuilds[board] = make(map[string]*memoryLeaderboardBuild)
+	}
+
+	s.leaderboardBuilds[board][build] = &memoryLeaderboardBuild{
+		entries:  make(map[string]defs.LeaderboardEntry),
+		removed:  make(map[string]struct{}),
+		deadline: time.Now().Add(leaderboardBuildTimeout),
+	}
+
+	return build, nil
+}
+
+func (s *memoryStore) FinishLeaderboardBuild(ctx context.Context, board, build string, entries []defs.LeaderboardEntry, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	builds := s.builds(board)
+	b, ok := builds[build]
+	if !ok {
+		return fmt.Errorf("%w: %s", errLeaderboardBuildAbandoned, board)
+	}
+	delete(builds, build)
+
+	for _, entry := range entries {
+		if _, removed := b.removed[entry.Username]; !removed {
+			setMemoryLeaderboardEntry(b.entries, entry)
+		}
+	}
+
+	s.leaderboards[board] = &memoryLeaderboard{
+		entries: b.entries,
+		expires: expires,
+	}
+
+	return nil
+}
+
+func (s *memoryStore) AbortLeaderboardBuild(ctx context.Context, board, build string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.leaderboardBuilds[board], build)
+
+	return nil
+}
+
+func (s *memoryStore) SetLeaderboardEntry(ctx context.Context, board string, entry defs.LeaderboardEntry) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, b := range s.builds(board) {
+		setMemoryLeaderboardEntry(b.entries, entry)
+		delete(b.removed, entry.Username)
+	}
+
+	b, err := s.board(board)
+	if err != nil {
+		return false, nil
+	}
+
+	setMemoryLeaderboardEntry(b.entries, entry)
+
+	return true, nil
+}
+
+func (s *memoryStore) RemoveLeaderboardEntry(ctx context.Context, board string, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, b := range s.builds(board) {
+		delete(b.entries, username)
+		b.removed[username] = struct{}{}
+	}
+
+	if b, ok := s.leaderboards[board]; ok {
+		delete(b.entries, username)
+	}
+
+	return nil
+}
+
+func (s *memoryStore) Leaderboards(ctx context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	boards := make([]string, 0, len(s.leaderboards))
+	for board := range s.leaderboards {
+		if _, err := s.board(board); err == nil {
+			boards = append(boards, board)
+		}
+	}
+	sort.Strings(boards)
+
+	return boards, nil
+}
+
+// ranked returns the entries of b best first, in the order Redis would have
+// them. The caller must hold s.mu.
+func (b *memoryLeaderboard) ranked() []defs.LeaderboardEntry {
+	entries := make([]defs.LeaderboardEntry, 0, len(b.entries))
+	members := make(map[string]string, len(b.entries))
+	for username, entry := range b.entries {
+		entries = append(entries, entry)
+		members[username] = leaderboardMember(entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Score != entries[j].Score {
+			return entries[i].Score > entries[j].Score
+		}
+
+		return members[entries[i].Username] > members[entries[j].Username]
+	})
+
+	return entries
+}
+
+func (s *memoryStore) LeaderboardPage(ctx context.Context, board string, offset, count int) ([]defs.LeaderboardEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.board(board)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := b.ranked()
+	if offset >= len(entries) {
+		return []defs.LeaderboardEntry{}, nil
+	}
+
+	return entries[offset:min(offset+count, len(entries))], nil
+}
+
+func (s *memoryStore) LeaderboardCount(ctx context.Context, board string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.board(board)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b.entries), nil
+}
+
+func (s *memoryStore) LeaderboardRank(ctx context.Context, board string, username string) (int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := s.board(board)
+	if err != nil {
+		return 0, false, err
+	}
+
+	for rank, entry := range b.ranked() {
+		if entry.Username == username {
+			return rank, true, nil
+		}
+	}
+
+	return 0, false, nil
+}
+
+// BeginLeaderboardBuild starts building a board from the database and
+// returns the build to finish with the entries read after it began. Entries
+// set or removed in the meantime are kept track of, so they aren't lost.
+func BeginLeaderboardBuild(ctx context.Context, board string) (string, error) {
+	return store.BeginLeaderboardBuild(ctx, board)
+}
+
+// FinishLeaderboardBuild replaces a board with a build and the entries read
+// from the database for it, and keeps it until expires.
+func FinishLeaderboardBuild(ctx context.Context, board, build string, entries []defs.LeaderboardEntry, expires time.Time) error {
+	return store.FinishLeaderboardBuild(ctx, board, build, entries, expires)
+}
+
+// AbortLeaderboardBuild drops a build that won't be finished.
+func AbortLeaderboardBuild(ctx context.Context, board, build string) error {
+	return store.AbortLeaderboardBuild(ctx, board, build)
+}
+
+// SetLeaderboardEntry adds or improves the entry of a user on a complete
+// board; a worse entry than the one the user has is ignored. It reports false
+// if the board isn't complete; it will have the entry once built.
+func SetLeaderboardEntry(ctx context.Context, board string, entry defs.LeaderboardEntry) (bool, error) {
+	return store.SetLeaderboardEntry(ctx, board, entry)
+}
+
+// RemoveLeaderboardEntry removes the entry of a user from a board.
+func RemoveLeaderboardEntry(ctx context.Context, board string, username string) error {
+	return store.RemoveLeaderboardEntry(ctx, board, username)
+}
+
+// Leaderboards lists the complete boards.
+func Leaderboards(ctx context.Context) ([]string, error) {
+	return store.Leaderboards(ctx)
+}
+
+// LeaderboardPage returns up to count entries of a board from offset on, best
+// first. A board that isn't complete is reported as ErrMiss.
+func LeaderboardPage(ctx context.Context, board string, offset, count int) ([]defs.LeaderboardEntry, error) {
+	return store.LeaderboardPage(ctx, board, offset, count)
+}
+
+// LeaderboardCount returns the number of entries on a board. A board that
+// isn't complete is reported as ErrMiss.
+func LeaderboardCount(ctx context.Context, board string) (int, error) {
+	return store.LeaderboardCount(ctx, board)
+}
+
+// LeaderboardRank returns the position of the entry of a user on a board,
+// counting from 0 for the best. ok is false if the user has no entry. A board
+// that isn't complete is reported as ErrMiss.
+func LeaderboardRank(ctx context.Context, board string, username string) (int, bool, error) {
+	return store.LeaderboardRank(ctx, board, username)
+}
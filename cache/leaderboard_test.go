@@ -0,0 +1,272 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/pagefaultgames/rogueserver/defs"
+	"github.com/redis/go-redis/v9"
+)
+
+// leaderboardStores returns each backend, the redis one running on miniredis.
+func leaderboardStores(t *testing.T) map[string]Store {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return map[string]Store{
+		"memory": newMemoryStore(),
+		"redis":  &redisStore{client: client},
+	}
+}
+
+func entry(username string, score, wave int, reached int64) defs.LeaderboardEntry {
+	return defs.LeaderboardEntry{Username: username, Score: score, Wave: wave, Timestamp: time.Unix(reached, 0).UTC()}
+}
+
+// buildLeaderboard builds board from entries, as if read from the database.
+func buildLeaderboard(t *testing.T, ctx context.Context, s Store, board string, entries ...defs.LeaderboardEntry) {
+	t.Helper()
+
+	build, err := s.BeginLeaderboardBuild(ctx, board)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.FinishLeaderboardBuild(ctx, board, build, entries, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// usernames returns the usernames on board, best first, as "name:score".
+func usernames(t *testing.T, ctx context.Context, s Store, board string) string {
+	t.Helper()
+
+	entries, err := s.LeaderboardPage(ctx, board, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names string
+	for i, e := range entries {
+		if i > 0 {
+			names += " "
+		}
+		names += fmt.Sprintf("%s:%d", e.Username, e.Score)
+	}
+
+	return names
+}
+
+func TestLeaderboardOrder(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		entries []defs.LeaderboardEntry
+		want    string
+	}{
+		{
+			name:    "by score",
+			entries: []defs.LeaderboardEntry{entry("a", 10, 1, 100), entry("b", 30, 1, 100), entry("c", 20, 1, 100)},
+			want:    "b:30 c:20 a:10",
+		},
+		{
+			name:    "ties by who reached the score first",
+			entries: []defs.LeaderboardEntry{entry("late", 10, 1, 200), entry("early", 10, 1, 100)},
+			want:    "early:10 late:10",
+		},
+		{
+			name:    "then by wave, numerically",
+			entries: []defs.LeaderboardEntry{entry("nine", 10, 9, 100), entry("ten", 10, 10, 100)},
+			want:    "ten:10 nine:10",
+		},
+		{
+			name:    "empty",
+			entries: nil,
+			want:    "",
+		},
+	}
+
+	for backend, s := range leaderboardStores(t) {
+		for _, tt := range tests {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				board := "order:" + tt.name
+				buildLeaderboard(t, ctx, s, board, tt.entries...)
+
+				got := usernames(t, ctx, s, board)
+				if got != tt.want {
+					t.Errorf("got %q, want %q", got, tt.want)
+				}
+
+				count, err := s.LeaderboardCount(ctx, board)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count != len(tt.entries) {
+					t.Errorf("count %d, want %d", count, len(tt.entries))
+				}
+			})
+		}
+	}
+}
+
+func TestLeaderboardEntries(t *testing.T) {
+	ctx := context.Background()
+
+	for backend, s := range leaderboardStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			_, err := s.LeaderboardPage(ctx, "missing", 0, 10)
+			if !errors.Is(err, ErrMiss) {
+				t.Errorf("page of a board never built: %v, want a miss", err)
+			}
+
+			set, err := s.SetLeaderboardEntry(ctx, "missing", entry("a", 1, 1, 100))
+			if err != nil || set {
+				t.Errorf("set on a board never built: %v %v, want false", set, err)
+			}
+
+			buildLeaderboard(t, ctx, s, "board", entry("a", 10, 1, 100), entry("b", 20, 1, 100))
+
+			set, err = s.SetLeaderboardEntry(ctx, "board", entry("a", 30, 2, 200))
+			if err != nil || !set {
+				t.Fatalf("set: %v %v", set, err)
+			}
+
+			// a delayed, older update doesn't undo a newer one
+			_, err = s.SetLeaderboardEntry(ctx, "board", entry("a", 15, 1, 150))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := usernames(t, ctx, s, "board"); got != "a:30 b:20" {
+				t.Errorf("after updates got %q", got)
+			}
+
+			rank, ok, err := s.LeaderboardRank(ctx, "board", "b")
+			if err != nil || !ok || rank != 1 {
+				t.Errorf("rank of b: %d %v %v, want 1", rank, ok, err)
+			}
+
+			err = s.RemoveLeaderboardEntry(ctx, "board", "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, ok, err = s.LeaderboardRank(ctx, "board", "a")
+			if err != nil || ok {
+				t.Errorf("rank of removed a: %v %v, want none", ok, err)
+			}
+
+			boards, err := s.Leaderboards(ctx)
+			if err != nil || len(boards) != 1 || boards[0] != "board" {
+				t.Errorf("boards: %v %v", boards, err)
+			}
+		})
+	}
+}
+
+func TestLeaderboardBuild(t *testing.T) {
+	ctx := context.Background()
+
+	for backend, s := range leaderboardStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			buildLeaderboard(t, ctx, s, "board", entry("a", 10, 1, 100), entry("b", 20, 1, 100))
+
+			build, err := s.BeginLeaderboardBuild(ctx, "board")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// a second build, like one of another process, doesn't share the first one's keys
+			other, err := s.BeginLeaderboardBuild(ctx, "board")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if other == build {
+				t.Fatalf("builds share the id %s", build)
+			}
+
+			// while the snapshot is read: a improves, b is banned, c plays for the first time
+			_, err = s.SetLeaderboardEntry(ctx, "board", entry("a", 50, 3, 300))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.RemoveLeaderboardEntry(ctx, "board", "b")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = s.SetLeaderboardEntry(ctx, "board", entry("c", 5, 1, 300))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the snapshot was read before all of that
+			snapshot := []defs.LeaderboardEntry{entry("a", 10, 1, 100), entry("b", 20, 1, 100), entry("d", 1, 1, 100)}
+
+			err = s.FinishLeaderboardBuild(ctx, "board", build, snapshot, time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := usernames(t, ctx, s, "board"); got != "a:50 c:5 d:1" {
+				t.Errorf("after build got %q, want a:50 c:5 d:1", got)
+			}
+
+			err = s.AbortLeaderboardBuild(ctx, "board", other)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.FinishLeaderboardBuild(ctx, "board", other, snapshot, time.Now().Add(time.Hour))
+			if !errors.Is(err, errLeaderboardBuildAbandoned) {
+				t.Errorf("finishing an aborted build: %v, want abandoned", err)
+			}
+
+			if got := usernames(t, ctx, s, "board"); got != "a:50 c:5 d:1" {
+				t.Errorf("after aborted build got %q", got)
+			}
+		})
+	}
+}
+
+func TestFirstLeaderboardBuild(t *testing.T) {
+	ctx := context.Background()
+
+	for backend, s := range leaderboardStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			build, err := s.BeginLeaderboardBuild(ctx, "new")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			set, err := s.SetLeaderboardEntry(ctx, "new", entry("a", 10, 1, 100))
+			if err != nil || set {
+				t.Fatalf("set during the first build: %v %v, want only staged", set, err)
+			}
+
+			_, err = s.LeaderboardPage(ctx, "new", 0, 10)
+			if !errors.Is(err, ErrMiss) {
+				t.Errorf("page during the first build: %v, want a miss", err)
+			}
+
+			err = s.FinishLeaderboardBuild(ctx, "new", build, nil, time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := usernames(t, ctx, s, "new"); got != "a:10" {
+				t.Errorf("got %q, want a:10", got)
+			}
+		})
+	}
+}
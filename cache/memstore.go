@@ -0,0 +1,594 @@
+package cache
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/defs"
+)
+
+// memoryStore keeps everything in process, for single-node development and
+// tests. Documents are stored JSON-encoded so callers never share state with
+// the cache, the same as with Redis. Calls never block on anything but the
+// mutex, so they ignore their context.
+type memoryStore struct {
+	mu sync.Mutex
+
+	docs   map[string][]byte // base64 uuid -> UserCacheData
+	tokens map[string]memoryToken
+
+	dirtyAt     map[string]time.Time
+	dirtyFields map[string]map[string]struct{}
+
+	flushingAt     map[string]time.Time
+	flushingFields map[string]map[string]struct{}
+
+	accessedAt map[string]time.Time
+
+	leaderboards      map[string]*memoryLeaderboard
+	leaderboardBuilds map[string]map[string]*memoryLeaderboardBuild // board -> build
+}
+
+type memoryToken struct {
+	uuid    []byte
+	expires time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		docs:              make(map[string][]byte),
+		tokens:            make(map[string]memoryToken),
+		dirtyAt:           make(map[string]time.Time),
+		dirtyFields:       make(map[string]map[string]struct{}),
+		flushingAt:        make(map[string]time.Time),
+		flushingFields:    make(map[string]map[string]struct{}),
+		accessedAt:        make(map[string]time.Time),
+		leaderboards:      make(map[string]*memoryLeaderboard),
+		leaderboardBuilds: make(map[string]map[string]*memoryLeaderboardBuild),
+	}
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// load decodes the document for uuid. The caller must hold s.mu.
+func (s *memoryStore) load(uuid []byte) (defs.UserCacheData, error) {
+	var doc defs.UserCacheData
+
+	encodedUUID := base64.StdEncoding.EncodeToString(uuid)
+	raw, ok := s.docs[encodedUUID]
+	if !ok {
+		return doc, fmt.Errorf("%w: session:%s", ErrMiss, encodedUUID)
+	}
+
+	err := json.Unmarshal(raw, &doc)
+	if err != nil {
+		return doc, fmt.Errorf("failed to decode session:%s: %w", encodedUUID, err)
+	}
+
+	return doc, nil
+}
+
+// save encodes doc as the document for uuid. The caller must hold s.mu.
+func (s *memoryStore) save(uuid []byte, doc defs.UserCacheData) error {
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	s.docs[base64.StdEncoding.EncodeToString(uuid)] = raw
+
+	return nil
+}
+
+// update applies fn to the existing document for uuid and marks the given
+// parts dirty when it succeeds.
+func (s *memoryStore) update(uuid []byte, fn func(doc *defs.UserCacheData) error, fields ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, err := s.load(uuid)
+	if err != nil {
+		return err
+	}
+
+	err = fn(&doc)
+	if err != nil {
+		return err
+	}
+
+	err = s.save(uuid, doc)
+	if err != nil {
+		return err
+	}
+
+	if writeBack && len(fields) > 0 {
+		s.markDirty(base64.StdEncoding.EncodeToString(uuid), time.Now(), false, fields...)
+	}
+
+	return nil
+}
+
+// markDirty records changed parts of a document. Unless reset is set, an
+// existing dirty time is kept, like ZADD NX. The caller must hold s.mu.
+func (s *memoryStore) markDirty(encodedUUID string, at time.Time, reset bool, fields ...string) {
+	set, ok := s.dirtyFields[encodedUUID]
+	if !ok {
+		set = make(map[string]struct{})
+		s.dirtyFields[encodedUUID] = set
+	}
+
+	for _, field := range fields {
+		set[field] = struct{}{}
+	}
+
+	if _, ok := s.dirtyAt[encodedUUID]; reset || !ok {
+		s.dirtyAt[encodedUUID] = at
+	}
+}
+
+func (s *memoryStore) CacheAccount(ctx context.Context, dbRow defs.AccountDBRow) error {
+	account := accountToRedisData(dbRow)
+	return s.update(dbRow.UUID, func(doc *defs.UserCacheData) error {
+		doc.Account = &account
+		return nil
+	})
+}
+
+func (s *memoryStore) CacheAccountStats(ctx context.Context, uuid []byte, dbStats defs.AccountStatsData) error {
+	stats := accountStatsToRedisData(dbStats)
+	return s.update(uuid, func(doc *defs.UserCacheData) error {
+		doc.AccountStats = &stats
+		return nil
+	})
+}
+
+func (s *memoryStore) FetchTrainerIds(ctx context.Context, uuid []byte) (int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, err := s.load(uuid)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if doc.Account == nil {
+		return 0, 0, fmt.Errorf("%w: account", ErrMiss)
+	}
+
+	var trainerID, secretID int
+	if doc.Account.TrainerID != nil {
+		trainerID = int(*doc.Account.TrainerID)
+	}
+	if doc.Account.SecretID != nil {
+		secretID = int(*doc.Account.SecretID)
+	}
+
+	return trainerID, secretID, nil
+}
+
+func (s *memoryStore) UpdateTrainerIds(ctx context.Context, trainerId, secretId int, uuid []byte) error {
+	return s.update(uuid, func(doc *defs.UserCacheData) error {
+		if doc.Account == nil {
+			doc.Account = &defs.AccountRedisData{}
+		}
+
+		trainerID, secretID := uint16(trainerId), uint16(secretId)
+		doc.Account.TrainerID = &trainerID
+		doc.Account.SecretID = &secretID
+
+		return nil
+	}, dirtyAccount)
+}
+
+func (s *memoryStore) UpdateAccountLastActivity(ctx context.Context, uuid []byte) error {
+	return s.update(uuid, func(doc *defs.UserCacheData) error {
+		if doc.Account == nil {
+			doc.Account = &defs.AccountRedisData{}
+		}
+
+		now := time.Now().UTC()
+		doc.Account.LastActivity = &now
+
+		return nil
+	}, dirtyAccount)
+}
+
+func (s *memoryStore) UpdateAccountStats(ctx context.Context, uuid []byte, stats defs.GameStats, voucherCounts map[string]int) error {
+	if _, ok := stats.(map[string]interface{}); !ok {
+		return fmt.Errorf("expected map[string]interface{}, got %T", stats)
+	}
+
+	return s.update(uuid, func(doc *defs.UserCacheData) error {
+		updated, err := mergeAccountStats(doc.AccountStats, stats, voucherCounts)
+		if err != nil {
+			return err
+		}
+
+		doc.AccountStats = updated
+
+		return nil
+	}, dirtyStats)
+}
+
+func (s *memoryStore) RetrievePlaytime(ctx context.Context, uuid []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, err := s.load(uuid)
+	if err != nil {
+		return 0, err
+	}
+
+	if doc.AccountStats == nil {
+		return 0, fmt.Errorf("%w: accountStats", ErrMiss)
+	}
+
+	return doc.AccountStats.PlayTime, nil
+}
+
+func (s *memoryStore) UpdateActiveSession(ctx context.Context, uuid []byte, sessionId string) error {
+	if sessionId == "" {
+		return fmt.Errorf("sessionId is empty")
+	}
+
+	return s.update(uuid, func(doc *defs.UserCacheData) error {
+		doc.ActiveClientSession = sessionId
+		return nil
+	}, dirtyActiveSession)
+}
+
+func (s *memoryStore) FetchActiveSession(ctx context.Context, uuid []byte) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, err := s.load(uuid)
+	if err != nil {
+		return "", err
+	}
+
+	if doc.ActiveClientSession == "" {
+		return "", fmt.Errorf("%w: activeClientSession", ErrMiss)
+	}
+
+	return doc.ActiveClientSession, nil
+}
+
+func (s *memoryStore) StoreSessionToken(ctx context.Context, uuid []byte, token []byte) error {
+	return s.StoreSessionTokenTTL(ctx, uuid, token, sessionTokenTTL)
+}
+
+func (s *memoryStore) StoreSessionTokenTTL(ctx context.Context, uuid []byte, token []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[base64.StdEncoding.EncodeToString(token)] = memoryToken{
+		uuid:    slices.Clone(uuid),
+		expires: time.Now().Add(ttl),
+	}
+
+	return nil
+}
+
+func (s *memoryStore) FetchSessionToken(ctx context.Context, token []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := base64.StdEncoding.EncodeToString(token)
+	entry, ok := s.tokens[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(s.tokens, key)
+		ok = false
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("%w: token:%s", ErrMiss, key)
+	}
+
+	return slices.Clone(entry.uuid), nil
+}
+
+func (s *memoryStore) RemoveSessionFromToken(ctx context.Context, token []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.tokens, base64.StdEncoding.EncodeToString(token))
+
+	return nil
+}
+
+func (s *memoryStore) ReadSessionSaveData(ctx context.Context, uuid []byte, slot int) (defs.SessionSaveData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, err := s.load(uuid)
+	if err != nil {
+		return defs.SessionSaveData{}, err
+	}
+
+	session, ok := doc.SessionSaveData[strconv.Itoa(slot)]
+	if !ok {
+		return defs.SessionSaveData{}, fmt.Errorf("%w: sessionSaveData[%d]", ErrMiss, slot)
+	}
+
+	return session, nil
+}
+
+func (s *memoryStore) StoreSessionSaveData(ctx context.Context, uuid []byte, data defs.SessionSaveData, slot int) error {
+	return s.update(uuid, func(doc *defs.UserCacheData) error {
+		if doc.SessionSaveData == nil {
+			doc.SessionSaveData = make(map[string]defs.SessionSaveData)
+		}
+
+		doc.SessionSaveData[strconv.Itoa(slot)] = data
+
+		return nil
+	}, dirtySession(slot))
+}
+
+func (s *memoryStore) DeleteSessionSaveData(ctx context.Context, uuid []byte, slot int) error {
+	return s.update(uuid, func(doc *defs.UserCacheData) error {
+		delete(doc.SessionSaveData, strconv.Itoa(slot))
+		return nil
+	}, dirtySession(slot))
+}
+
+func (s *memoryStore) ReadSystemSaveData(ctx context.Context, uuid []byte) (defs.SystemSaveData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, err := s.load(uuid)
+	if err != nil {
+		return defs.SystemSaveData{}, err
+	}
+
+	if doc.SystemSaveData == nil {
+		return defs.SystemSaveData{}, fmt.Errorf("%w: systemSaveData", ErrMiss)
+	}
+
+	return *doc.SystemSaveData, nil
+}
+
+func (s *memoryStore) StoreSystemSaveData(ctx context.Context, uuid []byte, data defs.SystemSaveData) error {
+	return s.update(uuid, func(doc *defs.UserCacheData) error {
+		doc.SystemSaveData = &data
+		return nil
+	}, dirtySystem)
+}
+
+func (s *memoryStore) IsValidCacheData(ctx context.Context, uuid []byte) error {
+	return s.AddCacheData(ctx, uuid, defs.UserCacheData{
+		SessionSaveData: make(map[string]defs.SessionSaveData),
+	})
+}
+
+func (s *memoryStore) HasCacheData(ctx context.Context, uuid []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.docs[base64.StdEncoding.EncodeToString(uuid)]
+
+	return ok, nil
+}
+
+func (s *memoryStore) AddCacheData(ctx context.Context, uuid []byte, userData defs.UserCacheData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.docs[base64.StdEncoding.EncodeToString(uuid)]; ok {
+		return nil
+	}
+
+	return s.save(uuid, userData)
+}
+
+func (s *memoryStore) StoreCacheData(ctx context.Context, uuid []byte, userData defs.UserCacheData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.save(uuid, userData)
+}
+
+func (s *memoryStore) DeleteCacheData(ctx context.Context, uuid []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.docs, base64.StdEncoding.EncodeToString(uuid))
+
+	return nil
+}
+
+func (s *memoryStore) Invalidate(ctx context.Context, uuid []byte, fields ...string) error {
+	for _, field := range fields {
+		if _, ok := documentPath(field); !ok {
+			return fmt.Errorf("unknown cache data field: %s", field)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doc, err := s.load(uuid)
+	if errors.Is(err, ErrMiss) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, field := range fields {
+		switch {
+		case field == dirtySystem:
+			doc.SystemSaveData = nil
+		case field == dirtyStats:
+			doc.AccountStats = nil
+		case field == dirtyAccount:
+			doc.Account = nil
+		case field == dirtyActiveSession:
+			doc.ActiveClientSession = ""
+		case strings.HasPrefix(field, dirtySessionPrefix):
+			delete(doc.SessionSaveData, strings.TrimPrefix(field, dirtySessionPrefix))
+		}
+
+		delete(s.dirtyFields[base64.StdEncoding.EncodeToString(uuid)], field)
+	}
+
+	return s.save(uuid, doc)
+}
+
+func (s *memoryStore) DirtyStatus(ctx context.Context) (int, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var oldest time.Time
+	for _, at := range s.dirtyAt {
+		if oldest.IsZero() || at.Before(oldest) {
+			oldest = at
+		}
+	}
+
+	return len(s.dirtyAt), oldest, nil
+}
+
+func (s *memoryStore) DirtyUsers(ctx context.Context, until time.Time, limit int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var encodedUUIDs []string
+	for encodedUUID, at := range s.dirtyAt {
+		if !at.After(until) {
+			encodedUUIDs = append(encodedUUIDs, encodedUUID)
+		}
+	}
+
+	slices.SortFunc(encodedUUIDs, func(a, b string) int {
+		return s.dirtyAt[a].Compare(s.dirtyAt[b])
+	})
+
+	if limit > 0 && len(encodedUUIDs) > limit {
+		encodedUUIDs = encodedUUIDs[:limit]
+	}
+
+	return encodedUUIDs, nil
+}
+
+func (s *memoryStore) ClaimDirty(ctx context.Context, encodedUUIDs []string) ([]DirtyEntry, []DirtyEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var claims, failed []DirtyEntry
+	for _, encodedUUID := range encodedUUIDs {
+		since, ok := s.dirtyAt[encodedUUID]
+		if !ok {
+			continue
+		}
+
+		var fields []string
+		for field := range s.dirtyFields[encodedUUID] {
+			fields = append(fields, field)
+		}
+
+		delete(s.dirtyAt, encodedUUID)
+		delete(s.dirtyFields, encodedUUID)
+
+		flushing, ok := s.flushingFields[encodedUUID]
+		if !ok {
+			flushing = make(map[string]struct{})
+			s.flushingFields[encodedUUID] = flushing
+		}
+		for _, field := range fields {
+			flushing[field] = struct{}{}
+		}
+		s.flushingAt[encodedUUID] = time.Now()
+
+		uuid, err := base64.StdEncoding.DecodeString(encodedUUID)
+		if err != nil {
+			continue
+		}
+
+		claim := DirtyEntry{
+			EncodedUUID: encodedUUID,
+			UUID:        uuid,
+			Since:       since,
+			Fields:      fields,
+		}
+
+		if _, ok := s.docs[encodedUUID]; ok {
+			doc, err := s.load(uuid)
+			if err != nil {
+				failed = append(failed, claim)
+				continue
+			}
+
+			claim.Doc = &doc
+		}
+
+		claims = append(claims, claim)
+	}
+
+	return claims, failed, nil
+}
+
+func (s *memoryStore) RequeueDirty(ctx context.Context, entries []DirtyEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, entry := range entries {
+		delete(s.flushingAt, entry.EncodedUUID)
+		delete(s.flushingFields, entry.EncodedUUID)
+		s.markDirty(entry.EncodedUUID, entry.RetryAt, true, entry.Fields...)
+	}
+
+	return nil
+}
+
+func (s *memoryStore) ReleaseDirty(ctx context.Context, encodedUUIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, encodedUUID := range encodedUUIDs {
+		delete(s.flushingAt, encodedUUID)
+		delete(s.flushingFields, encodedUUID)
+	}
+
+	return nil
+}
+
+func (s *memoryStore) RecoverClaims(ctx context.Context, until time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	recovered := 0
+	for encodedUUID, at := range s.flushingAt {
+		if at.After(until) {
+			continue
+		}
+
+		var fields []string
+		for field := range s.flushingFields[encodedUUID] {
+			fields = append(fields, field)
+		}
+
+		delete(s.flushingAt, encodedUUID)
+		delete(s.flushingFields, encodedUUID)
+		s.markDirty(encodedUUID, now, false, fields...)
+
+		recovered++
+	}
+
+	return recovered, nil
+}
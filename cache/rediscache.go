@@ -3,46 +3,109 @@ package cache
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"strconv"
 	"time"
 
+	"github.com/pagefaultgames/rogueserver/config"
 	"github.com/redis/go-redis/v9"
 )
 
-var (
-	Ctx   = context.Background()
-	Rdb   *redis.Client
-)
+// Rdb is the Redis client when the redis backend is in use, nil otherwise
+var Rdb *redis.Client
+
+// ErrMiss is returned when a key or JSON path is not in the cache.
+var ErrMiss = errors.New("cache miss")
+
+// ErrConflict is returned when a transactional update kept losing to
+// concurrent writes to the same user document.
+var ErrConflict = errors.New("concurrent update, try again")
+
+// sessionDataTTL is how long a user document may go untouched before the
+// sweeper evicts it, see eviction.go.
+var sessionDataTTL = time.Hour * 24 * 7
 
-const sessionDataTTL = time.Hour * 24 * 7
 const sessionTokenTTL = time.Hour * 24 * 7
 
-func Init() error {
-	addr := getEnv("REDIS_ADDR", "redis:6379")
-	pass := os.Getenv("REDIS_PASS") // 없으면 빈 문자열
-	dbNum, _ := strconv.Atoi(getEnv("REDIS_DB", "0"))
-
-	Rdb = redis.NewClient(&redis.Options{
-		Addr:         addr,
-		Password:     pass,
-		DB:           dbNum,
-		PoolSize:     10,
-		MinIdleConns: 5,
+// redisStore keeps each user as a RedisJSON document under session:<uuid>.
+type redisStore struct {
+	client *redis.Client
+}
+
+func newRedisStore(cfg config.Redis) *redisStore {
+	// a slow Redis fails calls instead of holding requests, see breaker.go;
+	// calls also give up when their context is done
+	client := redis.NewClient(&redis.Options{
+		Addr:         cfg.Addr,
+		Password:     cfg.Password,
+		DB:           cfg.DB,
+		PoolSize:     cfg.PoolSize,
+		MinIdleConns: cfg.MinIdleConns,
+		DialTimeout:  cfg.Timeout,
+		ReadTimeout:  cfg.Timeout,
+		WriteTimeout: cfg.Timeout,
+
+		ContextTimeoutEnabled: true,
 	})
 
-	// 1초 내로 PING 응답 없으면 에러
-	ctx, cancel := context.WithTimeout(Ctx, time.Second)
+	return &redisStore{client: client}
+}
+
+func (s *redisStore) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
 	defer cancel()
-	return Rdb.Ping(ctx).Err()
+	return s.client.Ping(ctx).Err()
+}
+
+// PingJSON checks that the RedisJSON module is loaded by reading a key that
+// doesn't exist: without the module the command itself is unknown. It is a
+// no-op for the memory backend.
+func PingJSON(ctx context.Context) error {
+	if Rdb == nil {
+		return nil
+	}
+
+	err := Rdb.JSONGet(ctx, "healthcheck:json").Err()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
 }
 
-func getEnv(k, def string) string {
-	if v, ok := os.LookupEnv(k); ok {
-		return v
+// getJSON reads the first match of a JSONPath into v. A missing key, path or
+// null value is reported as ErrMiss.
+func (s *redisStore) getJSON(ctx context.Context, key, path string, v any) error {
+	return getJSON(ctx, s.client, key, path, v)
+}
+
+// getJSON reads through c, which may be a WATCHing transaction.
+func getJSON(ctx context.Context, c redis.JSONCmdable, key, path string, v any) error {
+	raw, err := c.JSONGet(ctx, key, path).Result()
+	if errors.Is(err, redis.Nil) {
+		return fmt.Errorf("%w: %s %s", ErrMiss, key, path)
+	} else if err != nil {
+		return err
 	}
-	return def
+
+	// JSONPath queries always return an array of matches
+	var matches []json.RawMessage
+	if raw != "" {
+		err = json.Unmarshal([]byte(raw), &matches)
+		if err != nil {
+			return fmt.Errorf("failed to decode %s %s: %w", key, path, err)
+		}
+	}
+
+	if len(matches) == 0 || string(matches[0]) == "null" {
+		return fmt.Errorf("%w: %s %s", ErrMiss, key, path)
+	}
+
+	return json.Unmarshal(matches[0], v)
 }
 
 // parseJSONNumberToInt 헬퍼 함수 (이전 답변 참고 - 필요시 여기에 직접 포함하거나 별도 정의)
@@ -0,0 +1,292 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/config"
+	"github.com/pagefaultgames/rogueserver/defs"
+)
+
+// Store is a cache backend holding one document per user (account, stats,
+// active client session, saves) plus session tokens and the write-back
+// bookkeeping for those documents.
+type Store interface {
+	// account
+	CacheAccount(ctx context.Context, dbRow defs.AccountDBRow) error
+	CacheAccountStats(ctx context.Context, uuid []byte, dbStats defs.AccountStatsData) error
+	FetchTrainerIds(ctx context.Context, uuid []byte) (int, int, error)
+	UpdateTrainerIds(ctx context.Context, trainerId, secretId int, uuid []byte) error
+	UpdateAccountLastActivity(ctx context.Context, uuid []byte) error
+	UpdateAccountStats(ctx context.Context, uuid []byte, stats defs.GameStats, voucherCounts map[string]int) error
+	RetrievePlaytime(ctx context.Context, uuid []byte) (int, error)
+
+	// active client session
+	UpdateActiveSession(ctx context.Context, uuid []byte, sessionId string) error
+	FetchActiveSession(ctx context.Context, uuid []byte) (string, error)
+
+	// session tokens
+	StoreSessionToken(ctx context.Context, uuid []byte, token []byte) error
+	StoreSessionTokenTTL(ctx context.Context, uuid []byte, token []byte, ttl time.Duration) error
+	FetchSessionToken(ctx context.Context, token []byte) ([]byte, error)
+	RemoveSessionFromToken(ctx context.Context, token []byte) error
+
+	// savedata
+	ReadSessionSaveData(ctx context.Context, uuid []byte, slot int) (defs.SessionSaveData, error)
+	StoreSessionSaveData(ctx context.Context, uuid []byte, data defs.SessionSaveData, slot int) error
+	DeleteSessionSaveData(ctx context.Context, uuid []byte, slot int) error
+	ReadSystemSaveData(ctx context.Context, uuid []byte) (defs.SystemSaveData, error)
+	StoreSystemSaveData(ctx context.Context, uuid []byte, data defs.SystemSaveData) error
+
+	// UpdateSessionSaveData and UpdateSystemSaveData store a save if validate
+	// accepts the one it replaces (nil if there is none), atomically per user.
+	UpdateSessionSaveData(ctx context.Context, uuid []byte, data defs.SessionSaveData, slot int, validate func(current *defs.SessionSaveData) error) error
+	UpdateSystemSaveData(ctx context.Context, uuid []byte, data defs.SystemSaveData, validate func(current *defs.SystemSaveData) error) error
+
+	// UpdateAll validates a combined session and system save against the
+	// cached state and stores it, atomically per user. validate may be nil.
+	UpdateAll(ctx context.Context, uuid []byte, update defs.SaveUpdate, validate func(defs.SaveSnapshot) error) error
+
+	// whole user documents
+	IsValidCacheData(ctx context.Context, uuid []byte) error
+	HasCacheData(ctx context.Context, uuid []byte) (bool, error)
+	AddCacheData(ctx context.Context, uuid []byte, userData defs.UserCacheData) error
+	StoreCacheData(ctx context.Context, uuid []byte, userData defs.UserCacheData) error
+	DeleteCacheData(ctx context.Context, uuid []byte) error
+	ReadCacheData(ctx context.Context, uuid []byte) (defs.UserCacheData, error)
+
+	// Invalidate drops the given parts (named like the write-back fields) from
+	// a user document so the next read falls back to the database. Pending
+	// write-back changes to those parts are dropped with them.
+	Invalidate(ctx context.Context, uuid []byte, fields ...string) error
+
+	// write-back bookkeeping
+	DirtyStatus(ctx context.Context) (int, time.Time, error)
+	DirtyUsers(ctx context.Context, until time.Time, limit int) ([]string, error)
+	ClaimDirty(ctx context.Context, encodedUUIDs []string) ([]DirtyEntry, []DirtyEntry, error)
+	RequeueDirty(ctx context.Context, entries []DirtyEntry) error
+	ReleaseDirty(ctx context.Context, encodedUUIDs []string) error
+	RecoverClaims(ctx context.Context, until time.Time) (int, error)
+	PendingParts(ctx context.Context, uuid []byte) ([]string, error)
+
+	// idle eviction
+	Touch(ctx context.Context, uuid []byte) error
+	IdleUsers(ctx context.Context, until time.Time, limit int) ([]string, error)
+	Evict(ctx context.Context, encodedUUID string, idleSince time.Time) (bool, error)
+	AdoptUntracked(ctx context.Context) (int, error)
+	SampleUsers(ctx context.Context, n int) ([]string, error)
+
+	// leaderboards, see leaderboard.go
+	BeginLeaderboardBuild(ctx context.Context, board string) (string, error)
+	FinishLeaderboardBuild(ctx context.Context, board, build string, entries []defs.LeaderboardEntry, expires time.Time) error
+	AbortLeaderboardBuild(ctx context.Context, board, build string) error
+	SetLeaderboardEntry(ctx context.Context, board string, entry defs.LeaderboardEntry) (bool, error)
+	RemoveLeaderboardEntry(ctx context.Context, board string, username string) error
+	Leaderboards(ctx context.Context) ([]string, error)
+	LeaderboardPage(ctx context.Context, board string, offset, count int) ([]defs.LeaderboardEntry, error)
+	LeaderboardCount(ctx context.Context, board string) (int, error)
+	LeaderboardRank(ctx context.Context, board string, username string) (int, bool, error)
+
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// DirtyEntry is a claimed write-back entry: which parts of a user document
+// changed since the last flush, and the document as it was when claimed.
+type DirtyEntry struct {
+	EncodedUUID string
+	UUID        []byte
+	Since       time.Time
+	Fields      []string
+
+	// Doc is nil when the document no longer exists
+	Doc *defs.UserCacheData
+
+	// RetryAt is when a requeued entry becomes due again
+	RetryAt time.Time
+}
+
+var store Store
+
+// writeBack controls whether cache writes are queued for the flusher.
+// Strategies that write the database themselves turn it off.
+var writeBack = true
+
+// SetWriteBack turns write-back bookkeeping for cache writes on or off.
+func SetWriteBack(enabled bool) {
+	writeBack = enabled
+}
+
+// Enabled reports whether a cache backend has been initialized.
+func Enabled() bool {
+	return store != nil
+}
+
+// Init connects the cache backend named by cfg.Backend ("redis" or "memory").
+// An unreachable Redis is not an error: the cache starts out unavailable
+// and is used once Redis answers, see breaker.go.
+func Init(cfg config.Cache) error {
+	flushInterval = cfg.FlushInterval
+	flushBatchSize = cfg.FlushBatch
+	sessionDataTTL = cfg.IdleTTL
+	sweepInterval = cfg.SweepInterval
+	warmupRate = cfg.WarmupRate
+	breakerFailures = cfg.BreakerFailures
+	breakerCooldown = cfg.BreakerCooldown
+
+	switch cfg.Backend {
+	case "", "redis":
+		s := newRedisStore(cfg.Redis)
+		Rdb = s.client
+
+		backend := instrument(s, "redis")
+		breaker = newCircuitBreaker(backend)
+		store = guard(backend, breaker)
+
+		// start without the cache rather than not at all, the breaker closes once Redis answers
+		err := s.Ping(context.Background())
+		if err != nil {
+			breaker.trip(err)
+		}
+	case "memory":
+		store = instrument(newMemoryStore(), "memory")
+	default:
+		return fmt.Errorf("unknown cache backend: %s", cfg.Backend)
+	}
+
+	return nil
+}
+
+// Ping checks that the cache backend is reachable.
+func Ping(ctx context.Context) error {
+	return store.Ping(ctx)
+}
+
+// Close releases the cache backend.
+func Close() error {
+	if breaker != nil {
+		breaker.close()
+	}
+
+	return store.Close()
+}
+
+func CacheAccount(ctx context.Context, dbRow defs.AccountDBRow) error {
+	return store.CacheAccount(ctx, dbRow)
+}
+
+func CacheAccountStats(ctx context.Context, uuid []byte, dbStats defs.AccountStatsData) error {
+	return store.CacheAccountStats(ctx, uuid, dbStats)
+}
+
+func FetchTrainerIds(ctx context.Context, uuid []byte) (int, int, error) {
+	return store.FetchTrainerIds(ctx, uuid)
+}
+
+func UpdateTrainerIds(ctx context.Context, trainerId, secretId int, uuid []byte) error {
+	return store.UpdateTrainerIds(ctx, trainerId, secretId, uuid)
+}
+
+func UpdateAccountLastActivity(ctx context.Context, uuid []byte) error {
+	return store.UpdateAccountLastActivity(ctx, uuid)
+}
+
+func UpdateAccountStats(ctx context.Context, uuid []byte, stats defs.GameStats, voucherCounts map[string]int) error {
+	return store.UpdateAccountStats(ctx, uuid, stats, voucherCounts)
+}
+
+func RetrievePlaytime(ctx context.Context, uuid []byte) (int, error) {
+	return store.RetrievePlaytime(ctx, uuid)
+}
+
+func UpdateActiveSession(ctx context.Context, uuid []byte, sessionId string) error {
+	return store.UpdateActiveSession(ctx, uuid, sessionId)
+}
+
+func FetchActiveSession(ctx context.Context, uuid []byte) (string, error) {
+	return store.FetchActiveSession(ctx, uuid)
+}
+
+func StoreSessionToken(ctx context.Context, uuid []byte, token []byte) error {
+	return store.StoreSessionToken(ctx, uuid, token)
+}
+
+func StoreSessionTokenTTL(ctx context.Context, uuid []byte, token []byte, ttl time.Duration) error {
+	return store.StoreSessionTokenTTL(ctx, uuid, token, ttl)
+}
+
+func FetchSessionToken(ctx context.Context, token []byte) ([]byte, error) {
+	return store.FetchSessionToken(ctx, token)
+}
+
+func RemoveSessionFromToken(ctx context.Context, token []byte) error {
+	return store.RemoveSessionFromToken(ctx, token)
+}
+
+func ReadSessionSaveData(ctx context.Context, uuid []byte, slot int) (defs.SessionSaveData, error) {
+	return store.ReadSessionSaveData(ctx, uuid, slot)
+}
+
+func StoreSessionSaveData(ctx context.Context, uuid []byte, data defs.SessionSaveData, slot int) error {
+	return store.StoreSessionSaveData(ctx, uuid, data, slot)
+}
+
+func DeleteSessionSaveData(ctx context.Context, uuid []byte, slot int) error {
+	return store.DeleteSessionSaveData(ctx, uuid, slot)
+}
+
+func ReadSystemSaveData(ctx context.Context, uuid []byte) (defs.SystemSaveData, error) {
+	return store.ReadSystemSaveData(ctx, uuid)
+}
+
+func StoreSystemSaveData(ctx context.Context, uuid []byte, data defs.SystemSaveData) error {
+	return store.StoreSystemSaveData(ctx, uuid, data)
+}
+
+func UpdateSessionSaveData(ctx context.Context, uuid []byte, data defs.SessionSaveData, slot int, validate func(current *defs.SessionSaveData) error) error {
+	return store.UpdateSessionSaveData(ctx, uuid, data, slot, validate)
+}
+
+func UpdateSystemSaveData(ctx context.Context, uuid []byte, data defs.SystemSaveData, validate func(current *defs.SystemSaveData) error) error {
+	return store.UpdateSystemSaveData(ctx, uuid, data, validate)
+}
+
+func UpdateAll(ctx context.Context, uuid []byte, update defs.SaveUpdate, validate func(defs.SaveSnapshot) error) error {
+	return store.UpdateAll(ctx, uuid, update, validate)
+}
+
+func IsValidCacheData(ctx context.Context, uuid []byte) error {
+	return store.IsValidCacheData(ctx, uuid)
+}
+
+func StoreCacheData(ctx context.Context, uuid []byte, userData defs.UserCacheData) error {
+	return store.StoreCacheData(ctx, uuid, userData)
+}
+
+func DeleteCacheData(ctx context.Context, uuid []byte) error {
+	return store.DeleteCacheData(ctx, uuid)
+}
+
+func Invalidate(ctx context.Context, uuid []byte, fields ...string) error {
+	return store.Invalidate(ctx, uuid, fields...)
+}
+
+// PendingParts lists the parts of the user document for uuid with changes the
+// flusher hasn't written back yet.
+func PendingParts(ctx context.Context, uuid []byte) ([]string, error) {
+	return store.PendingParts(ctx, uuid)
+}
+
+// Parts of a user document, for Invalidate.
+const (
+	PartSystem        = dirtySystem
+	PartStats         = dirtyStats
+	PartAccount       = dirtyAccount
+	PartActiveSession = dirtyActiveSession
+)
+
+// PartSession names the session save in slot.
+func PartSession(slot int) string {
+	return dirtySession(slot)
+}
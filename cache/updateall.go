@@ -0,0 +1,220 @@
+package cache
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/defs"
+	"github.com/redis/go-redis/v9"
+)
+
+// watchRetries is how often a validated update is retried after losing a
+// WATCH race before ErrConflict is returned.
+const watchRetries = 5
+
+// saveSnapshot extracts what a combined save is validated against from a
+// (possibly partial) user document.
+func saveSnapshot(doc *defs.UserCacheData, slot int) defs.SaveSnapshot {
+	snapshot := defs.SaveSnapshot{
+		ActiveClientSession: doc.ActiveClientSession,
+	}
+
+	if doc.Account != nil {
+		if doc.Account.TrainerID != nil {
+			snapshot.TrainerId = int(*doc.Account.TrainerID)
+		}
+		if doc.Account.SecretID != nil {
+			snapshot.SecretId = int(*doc.Account.SecretID)
+		}
+	}
+
+	if doc.AccountStats != nil {
+		snapshot.PlayTime = doc.AccountStats.PlayTime
+	}
+
+	if doc.SystemSaveData != nil {
+		snapshot.SystemRevision = doc.SystemSaveData.Revision
+	}
+
+	if session, ok := doc.SessionSaveData[strconv.Itoa(slot)]; ok {
+		snapshot.Session = &session
+	}
+
+	return snapshot
+}
+
+// applySaveUpdate writes a combined save into a user document: the client
+// session becomes the active one, trainer ids, last activity and stats follow
+// the system save, and both saves are stored.
+func applySaveUpdate(doc *defs.UserCacheData, update defs.SaveUpdate) error {
+	doc.ActiveClientSession = update.ClientSessionId
+
+	if doc.Account != nil {
+		trainerID, secretID := uint16(update.System.TrainerId), uint16(update.System.SecretId)
+		now := time.Now().UTC()
+
+		doc.Account.TrainerID = &trainerID
+		doc.Account.SecretID = &secretID
+		doc.Account.LastActivity = &now
+	}
+
+	stats, err := mergeAccountStats(doc.AccountStats, update.System.GameStats, update.System.VoucherCounts)
+	if err != nil {
+		return err
+	}
+	doc.AccountStats = stats
+
+	system := update.System
+	doc.SystemSaveData = &system
+
+	if doc.SessionSaveData == nil {
+		doc.SessionSaveData = make(map[string]defs.SessionSaveData)
+	}
+	doc.SessionSaveData[strconv.Itoa(update.Slot)] = update.Session
+
+	return nil
+}
+
+func saveUpdateFields(slot int) []string {
+	return []string{dirtyActiveSession, dirtyAccount, dirtyStats, dirtySystem, dirtySession(slot)}
+}
+
+// UpdateAll reads the parts of the user document a combined save touches
+// under WATCH, validates and applies the update, and writes it back in one
+// MULTI. A concurrent write to the document aborts and retries the whole step.
+func (s *redisStore) UpdateAll(ctx context.Context, uuid []byte, update defs.SaveUpdate, validate func(defs.SaveSnapshot) error) error {
+	redisKey := "session:" + base64.StdEncoding.EncodeToString(uuid)
+	slotKey := strconv.Itoa(update.Slot)
+	sessionPath := fmt.Sprintf(`$.sessionSaveData["%s"]`, slotKey)
+
+	txf := func(tx *redis.Tx) error {
+		raw, err := tx.JSONGet(ctx, redisKey, "$.activeClientSession", "$.account", "$.accountStats", "$.systemSaveData.revision", sessionPath).Result()
+		if errors.Is(err, redis.Nil) || (err == nil && raw == "") {
+			return fmt.Errorf("%w: %s", ErrMiss, redisKey)
+		} else if err != nil {
+			return err
+		}
+
+		// multiple paths come back as an object of path -> matches
+		var matches map[string][]json.RawMessage
+		err = json.Unmarshal([]byte(raw), &matches)
+		if err != nil {
+			return fmt.Errorf("failed to decode %s: %w", redisKey, err)
+		}
+
+		decode := func(path string, v any) error {
+			if len(matches[path]) == 0 {
+				return nil
+			}
+
+			return json.Unmarshal(matches[path][0], v)
+		}
+
+		doc := defs.UserCacheData{
+			SessionSaveData: make(map[string]defs.SessionSaveData),
+		}
+
+		var session *defs.SessionSaveData
+		var systemRevision int
+		err = errors.Join(
+			decode("$.activeClientSession", &doc.ActiveClientSession),
+			decode("$.systemSaveData.revision", &systemRevision),
+			decode("$.account", &doc.Account),
+			decode("$.accountStats", &doc.AccountStats),
+			decode(sessionPath, &session),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to decode %s: %w", redisKey, err)
+		}
+
+		if session != nil {
+			doc.SessionSaveData[slotKey] = *session
+		}
+
+		if validate != nil {
+			snapshot := saveSnapshot(&doc, update.Slot)
+			snapshot.SystemRevision = systemRevision
+
+			err = validate(snapshot)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = applySaveUpdate(&doc, update)
+		if err != nil {
+			return err
+		}
+
+		statsJSON, err := json.Marshal(doc.AccountStats)
+		if err != nil {
+			return err
+		}
+
+		systemJSON, err := json.Marshal(doc.SystemSaveData)
+		if err != nil {
+			return err
+		}
+
+		sessionJSON, err := json.Marshal(update.Session)
+		if err != nil {
+			return err
+		}
+
+		var accountJSON []byte
+		if doc.Account != nil {
+			accountJSON, err = json.Marshal(doc.Account)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.JSONSet(ctx, redisKey, "$.activeClientSession", strconv.Quote(doc.ActiveClientSession))
+			if accountJSON != nil {
+				pipe.JSONSet(ctx, redisKey, "$.account", accountJSON)
+			}
+			pipe.JSONSet(ctx, redisKey, "$.accountStats", statsJSON)
+			pipe.JSONSet(ctx, redisKey, "$.systemSaveData", systemJSON)
+			pipe.JSONSet(ctx, redisKey, sessionPath, sessionJSON)
+			s.markDirty(ctx, pipe, uuid, saveUpdateFields(update.Slot)...)
+
+			return nil
+		})
+
+		return err
+	}
+
+	return s.watch(ctx, redisKey, txf)
+}
+
+// watch runs txf under WATCH on key, retrying when a concurrent write to the
+// key aborts the transaction.
+func (s *redisStore) watch(ctx context.Context, key string, txf func(tx *redis.Tx) error) error {
+	for range watchRetries {
+		err := s.client.Watch(ctx, txf, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+
+	return ErrConflict
+}
+
+func (s *memoryStore) UpdateAll(ctx context.Context, uuid []byte, update defs.SaveUpdate, validate func(defs.SaveSnapshot) error) error {
+	return s.update(uuid, func(doc *defs.UserCacheData) error {
+		if validate != nil {
+			err := validate(saveSnapshot(doc, update.Slot))
+			if err != nil {
+				return err
+			}
+		}
+
+		return applySaveUpdate(doc, update)
+	}, saveUpdateFields(update.Slot)...)
+}
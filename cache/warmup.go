@@ -0,0 +1,231 @@
+package cache
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/db"
+	"github.com/pagefaultgames/rogueserver/metrics"
+)
+
+// A warm-up preloads the user documents and live session tokens of the most
+// recently active accounts, so that after a cache restart their first request
+// and login don't have to go to the database. Accounts are visited at most
+// warmupRate per second to leave room for live traffic. Documents that are
+// already cached are left alone.
+var (
+	// accounts per second, 0 means unlimited
+	warmupRate = 50
+
+	warmupMu     sync.Mutex
+	warmupCancel context.CancelFunc
+	warmupDone   chan struct{}
+	warmupStatus WarmupStatus
+)
+
+// ErrWarmupRunning is returned when a warm-up is started while another one is in progress.
+var ErrWarmupRunning = errors.New("cache warm-up already running")
+
+// WarmupStatus is the progress of the current or last warm-up.
+type WarmupStatus struct {
+	Running   bool       `json:"running"`
+	Accounts  int        `json:"accounts"`
+	Processed int        `json:"processed"`
+	Loaded    int        `json:"loaded"`
+	Cached    int        `json:"cached"`
+	Failed    int        `json:"failed"`
+	Tokens    int        `json:"tokens"`
+	Started   time.Time  `json:"started"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// StartWarmup starts warming up the given number of most recently active
+// accounts in the background.
+func StartWarmup(accounts int) error {
+	warmupMu.Lock()
+	defer warmupMu.Unlock()
+
+	if warmupDone != nil {
+		return ErrWarmupRunning
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	warmupCancel = cancel
+	warmupDone = done
+	warmupStatus = WarmupStatus{
+		Running:  true,
+		Accounts: accounts,
+		Started:  time.Now().UTC(),
+	}
+
+	metrics.CacheWarmupRunning.Set(1)
+	metrics.CacheWarmupTarget.Set(float64(accounts))
+	metrics.CacheWarmupProcessed.Set(0)
+
+	go func() {
+		defer close(done)
+
+		err := warmUp(ctx, accounts)
+
+		warmupMu.Lock()
+		defer warmupMu.Unlock()
+
+		finished := time.Now().UTC()
+		warmupStatus.Running = false
+		warmupStatus.Finished = &finished
+		if err != nil {
+			warmupStatus.Error = err.Error()
+		}
+
+		warmupCancel = nil
+		warmupDone = nil
+		metrics.CacheWarmupRunning.Set(0)
+
+		if err != nil {
+			slog.Warn("cache warm-up stopped", "processed", warmupStatus.Processed, "accounts", warmupStatus.Accounts, "error", err)
+			return
+		}
+
+		slog.Info("cache warm-up finished", "loaded", warmupStatus.Loaded, "cached", warmupStatus.Cached, "failed", warmupStatus.Failed, "tokens", warmupStatus.Tokens)
+	}()
+
+	slog.Info("cache warm-up started", "accounts", accounts, "rate", warmupRate)
+
+	return nil
+}
+
+// StopWarmup cancels a running warm-up and waits for it to return.
+func StopWarmup() {
+	warmupMu.Lock()
+	cancel, done := warmupCancel, warmupDone
+	warmupMu.Unlock()
+
+	if done == nil {
+		return
+	}
+
+	cancel()
+	<-done
+}
+
+// WarmupProgress returns the progress of the current or last warm-up.
+func WarmupProgress() WarmupStatus {
+	warmupMu.Lock()
+	defer warmupMu.Unlock()
+
+	return warmupStatus
+}
+
+func warmUp(ctx context.Context, accounts int) error {
+	uuids, err := db.FetchRecentlyActiveUUIDs(ctx, accounts)
+	if err != nil {
+		return err
+	}
+
+	warmupMu.Lock()
+	warmupStatus.Accounts = len(uuids)
+	warmupMu.Unlock()
+	metrics.CacheWarmupTarget.Set(float64(len(uuids)))
+
+	var tick <-chan time.Time
+	if warmupRate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(warmupRate))
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	for _, uuid := range uuids {
+		if tick != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-tick:
+			}
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		loaded, tokens, err := warmAccount(ctx, uuid)
+		if IsUnavailable(err) && !Available() {
+			return err
+		}
+
+		result := "cached"
+		if err != nil {
+			result = "failed"
+			slog.Warn("failed to warm up user", "uuid", base64.StdEncoding.EncodeToString(uuid), "error", err)
+		} else if loaded {
+			result = "loaded"
+		}
+
+		metrics.CacheWarmupAccounts.WithLabelValues(result).Inc()
+		metrics.CacheWarmupTokens.Add(float64(tokens))
+		metrics.CacheWarmupProcessed.Inc()
+
+		warmupMu.Lock()
+		warmupStatus.Processed++
+		warmupStatus.Tokens += tokens
+		switch result {
+		case "failed":
+			warmupStatus.Failed++
+		case "loaded":
+			warmupStatus.Loaded++
+		default:
+			warmupStatus.Cached++
+		}
+		warmupMu.Unlock()
+	}
+
+	return nil
+}
+
+// warmAccount caches the user document and live tokens of uuid. loaded
+// reports whether the document had to be read from the database.
+func warmAccount(ctx context.Context, uuid []byte) (loaded bool, tokens int, err error) {
+	// touch first, like EnsureCacheData, so the sweeper leaves the document be
+	err = store.Touch(ctx, uuid)
+	if err != nil {
+		return false, 0, err
+	}
+
+	exists, err := store.HasCacheData(ctx, uuid)
+	if err != nil {
+		return false, 0, err
+	}
+
+	if !exists {
+		err = Rehydrate(ctx, uuid)
+		if err != nil {
+			return false, 0, err
+		}
+	}
+
+	rows, err := db.FetchLiveSessionTokens(ctx, uuid)
+	if err != nil {
+		return !exists, 0, err
+	}
+
+	for _, row := range rows {
+		ttl := time.Until(row.Expire)
+		if ttl <= 0 {
+			continue
+		}
+
+		err = store.StoreSessionTokenTTL(ctx, uuid, row.Token, ttl)
+		if err != nil {
+			return !exists, tokens, err
+		}
+
+		tokens++
+	}
+
+	return !exists, tokens, nil
+}
@@ -0,0 +1,607 @@
+package cache
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/db"
+	"github.com/pagefaultgames/rogueserver/defs"
+	"github.com/pagefaultgames/rogueserver/metrics"
+	"github.com/redis/go-redis/v9"
+)
+
+// Write-back bookkeeping lives next to the user documents. In Redis it is:
+//
+//	dirty:users             sorted set of base64 uuids, scored by the unix time they became dirty
+//	dirty:fields:<uuid>     set of document parts that changed since the last flush
+//	flushing:users          sorted set of claimed uuids, scored by the unix time they were claimed
+//	flushing:fields:<uuid>  the parts a claim is persisting
+//
+// Mutating cache calls add to the dirty keys in the same transaction as the
+// write itself. The flusher claims entries by moving them to the flushing keys
+// and releases them once the listed parts are persisted, so a document is
+// never evicted while its changes are only in flight.
+// Other backends keep the same bookkeeping in their own form behind Store.
+const (
+	dirtyUsersKey           = "dirty:users"
+	dirtyFieldsKeyPrefix    = "dirty:fields:"
+	flushingUsersKey        = "flushing:users"
+	flushingFieldsKeyPrefix = "flushing:fields:"
+
+	dirtySystem        = "system"
+	dirtyStats         = "stats"
+	dirtyAccount       = "account"
+	dirtyActiveSession = "activeSession"
+
+	dirtySessionPrefix = "session:"
+)
+
+var (
+	flushInterval   = time.Second * 10
+	flushBatchSize  = 100
+	flushBackoff    = time.Second * 5
+	flushMaxBackoff = time.Minute * 5
+
+	// claims older than this are assumed lost with their flusher and requeued
+	flushClaimTimeout = time.Minute * 10
+
+	flusherStop chan struct{}
+	flusherDone chan struct{}
+
+	// failed attempts per base64 uuid, used for backoff
+	flushAttempts   = make(map[string]int)
+	flushAttemptsMu sync.Mutex
+)
+
+func dirtySession(slot int) string {
+	return dirtySessionPrefix + strconv.Itoa(slot)
+}
+
+// markDirty queues the bookkeeping that tells the flusher which parts of the
+// user document have changed. It must be added to the same transaction as the
+// write it describes.
+func (s *redisStore) markDirty(ctx context.Context, pipe redis.Pipeliner, uuid []byte, fields ...string) {
+	if !writeBack {
+		return
+	}
+
+	encodedUUID := base64.StdEncoding.EncodeToString(uuid)
+
+	members := make([]interface{}, len(fields))
+	for i, field := range fields {
+		members[i] = field
+	}
+
+	pipe.SAdd(ctx, dirtyFieldsKeyPrefix+encodedUUID, members...)
+	pipe.ZAddNX(ctx, dirtyUsersKey, redis.Z{Score: float64(time.Now().Unix()), Member: encodedUUID})
+}
+
+// DirtyStatus returns how many users are waiting to be flushed and the
+// earliest time one of them became due.
+func (s *redisStore) DirtyStatus(ctx context.Context) (int, time.Time, error) {
+	count, err := s.client.ZCard(ctx, dirtyUsersKey).Result()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	oldest, err := s.client.ZRangeWithScores(ctx, dirtyUsersKey, 0, 0).Result()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	if len(oldest) == 0 {
+		return int(count), time.Time{}, nil
+	}
+
+	return int(count), time.Unix(int64(oldest[0].Score), 0), nil
+}
+
+// DirtyUsers returns up to limit base64 uuids that are due by until, oldest
+// first. A limit of 0 returns all of them.
+func (s *redisStore) DirtyUsers(ctx context.Context, until time.Time, limit int) ([]string, error) {
+	return s.client.ZRangeByScore(ctx, dirtyUsersKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(until.Unix(), 10),
+		Count: int64(max(limit, 0)),
+	}).Result()
+}
+
+// ClaimDirty atomically takes ownership of the given dirty entries and reads
+// their documents. Entries that were already claimed by another worker are
+// skipped; claimed entries whose document could not be read are returned
+// separately so the caller can put them back.
+func (s *redisStore) ClaimDirty(ctx context.Context, encodedUUIDs []string) ([]DirtyEntry, []DirtyEntry, error) {
+	type pending struct {
+		since   *redis.FloatCmd
+		fields  *redis.StringSliceCmd
+		removed *redis.IntCmd
+	}
+
+	now := float64(time.Now().Unix())
+
+	cmds := make([]pending, len(encodedUUIDs))
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, encodedUUID := range encodedUUIDs {
+			fieldsKey := dirtyFieldsKeyPrefix + encodedUUID
+			flushingKey := flushingFieldsKeyPrefix + encodedUUID
+
+			cmds[i].since = pipe.ZScore(ctx, dirtyUsersKey, encodedUUID)
+			cmds[i].fields = pipe.SMembers(ctx, fieldsKey)
+
+			// a union, so losing a claim race doesn't clobber the winner's fields
+			pipe.SUnionStore(ctx, flushingKey, flushingKey, fieldsKey)
+			pipe.ZAdd(ctx, flushingUsersKey, redis.Z{Score: now, Member: encodedUUID})
+
+			pipe.Del(ctx, fieldsKey)
+			cmds[i].removed = pipe.ZRem(ctx, dirtyUsersKey, encodedUUID)
+		}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, nil, err
+	}
+
+	var claims []DirtyEntry
+	for i, encodedUUID := range encodedUUIDs {
+		if cmds[i].removed.Val() == 0 {
+			continue
+		}
+
+		uuid, err := base64.StdEncoding.DecodeString(encodedUUID)
+		if err != nil {
+			slog.Warn("dropping malformed dirty entry", "uuid", encodedUUID, "error", err)
+			continue
+		}
+
+		claims = append(claims, DirtyEntry{
+			EncodedUUID: encodedUUID,
+			UUID:        uuid,
+			Since:       time.Unix(int64(cmds[i].since.Val()), 0),
+			Fields:      cmds[i].fields.Val(),
+		})
+	}
+
+	if len(claims) == 0 {
+		return nil, nil, nil
+	}
+
+	// fetch all claimed documents in one round trip
+	docs := make([]*redis.JSONCmd, len(claims))
+	_, err = s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, claim := range claims {
+			docs[i] = pipe.JSONGet(ctx, "session:"+claim.EncodedUUID, "$")
+		}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, claims, err
+	}
+
+	var fetched, failed []DirtyEntry
+	for i, claim := range claims {
+		raw, err := docs[i].Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			failed = append(failed, claim)
+			continue
+		}
+
+		if raw != "" {
+			var doc []defs.UserCacheData
+			err = json.Unmarshal([]byte(raw), &doc)
+			if err != nil || len(doc) == 0 {
+				slog.Error("failed to decode user document", "uuid", claim.EncodedUUID, "error", err)
+				failed = append(failed, claim)
+				continue
+			}
+
+			claim.Doc = &doc[0]
+		}
+
+		fetched = append(fetched, claim)
+	}
+
+	return fetched, failed, nil
+}
+
+// RequeueDirty puts claimed entries back, due again at their RetryAt.
+func (s *redisStore) RequeueDirty(ctx context.Context, entries []DirtyEntry) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, entry := range entries {
+			pipe.Del(ctx, flushingFieldsKeyPrefix+entry.EncodedUUID)
+			pipe.ZRem(ctx, flushingUsersKey, entry.EncodedUUID)
+
+			if len(entry.Fields) > 0 {
+				members := make([]interface{}, len(entry.Fields))
+				for i, field := range entry.Fields {
+					members[i] = field
+				}
+				pipe.SAdd(ctx, dirtyFieldsKeyPrefix+entry.EncodedUUID, members...)
+			}
+			pipe.ZAdd(ctx, dirtyUsersKey, redis.Z{Score: float64(entry.RetryAt.Unix()), Member: entry.EncodedUUID})
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// ReleaseDirty ends claims whose parts were persisted.
+func (s *redisStore) ReleaseDirty(ctx context.Context, encodedUUIDs []string) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, encodedUUID := range encodedUUIDs {
+			pipe.Del(ctx, flushingFieldsKeyPrefix+encodedUUID)
+			pipe.ZRem(ctx, flushingUsersKey, encodedUUID)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// RecoverClaims requeues claims made before until, with the parts they were
+// persisting, and returns how many there were.
+func (s *redisStore) RecoverClaims(ctx context.Context, until time.Time) (int, error) {
+	encodedUUIDs, err := s.client.ZRangeByScore(ctx, flushingUsersKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(until.Unix(), 10),
+	}).Result()
+	if err != nil || len(encodedUUIDs) == 0 {
+		return 0, err
+	}
+
+	now := float64(time.Now().Unix())
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, encodedUUID := range encodedUUIDs {
+			fieldsKey := dirtyFieldsKeyPrefix + encodedUUID
+			flushingKey := flushingFieldsKeyPrefix + encodedUUID
+
+			pipe.SUnionStore(ctx, fieldsKey, fieldsKey, flushingKey)
+			pipe.ZAddNX(ctx, dirtyUsersKey, redis.Z{Score: now, Member: encodedUUID})
+			pipe.Del(ctx, flushingKey)
+			pipe.ZRem(ctx, flushingUsersKey, encodedUUID)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(encodedUUIDs), nil
+}
+
+// StartFlusher starts the background worker that writes dirty user documents back to the database.
+func StartFlusher() {
+	if flusherStop != nil {
+		return
+	}
+
+	flusherStop = make(chan struct{})
+	flusherDone = make(chan struct{})
+
+	go func() {
+		defer close(flusherDone)
+
+		// not cancelled, StopFlusher lets the current batch finish
+		ctx := context.Background()
+
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-flusherStop:
+				return
+			case <-ticker.C:
+				// dirty documents wait in Redis until it is back
+				if !Available() {
+					continue
+				}
+
+				_, err := flushDue(ctx, flushBatchSize)
+				if err != nil {
+					slog.Error("write-back flush failed", "error", err)
+				}
+			}
+		}
+	}()
+
+	slog.Info("write-back flusher started", "interval", flushInterval, "batch", flushBatchSize)
+}
+
+// StopFlusher stops the background worker and waits for the current batch to finish.
+func StopFlusher() {
+	if flusherStop == nil {
+		return
+	}
+
+	close(flusherStop)
+	<-flusherDone
+
+	flusherStop = nil
+	flusherDone = nil
+}
+
+// flushDue persists up to limit users whose dirty entry is due and returns how many were claimed.
+func flushDue(ctx context.Context, limit int) (int, error) {
+	now := time.Now()
+
+	err := updateFlushGauges(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+
+	recovered, err := store.RecoverClaims(ctx, now.Add(-flushClaimTimeout))
+	if err != nil {
+		return 0, err
+	} else if recovered > 0 {
+		slog.Warn("requeued stale write-back claims", "claims", recovered, "timeout", flushClaimTimeout)
+	}
+
+	encodedUUIDs, err := store.DirtyUsers(ctx, now, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(encodedUUIDs) == 0 {
+		return 0, nil
+	}
+
+	claims, err := claimDirty(ctx, encodedUUIDs)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, claim := range claims {
+		err = flushClaim(ctx, claim)
+		if err != nil {
+			slog.Error("failed to write back user document", "uuid", claim.EncodedUUID, "error", err)
+		}
+	}
+
+	return len(claims), nil
+}
+
+func updateFlushGauges(ctx context.Context, now time.Time) error {
+	count, oldest, err := store.DirtyStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	metrics.CacheDirtyUsers.Set(float64(count))
+
+	lag := 0.0
+	if count > 0 {
+		lag = max(now.Sub(oldest).Seconds(), 0)
+	}
+
+	metrics.CacheFlushLag.Set(lag)
+
+	return nil
+}
+
+// claimDirty takes ownership of the given dirty entries and puts back the
+// ones whose documents could not be read.
+func claimDirty(ctx context.Context, encodedUUIDs []string) ([]DirtyEntry, error) {
+	claims, failed, err := store.ClaimDirty(ctx, encodedUUIDs)
+	if len(failed) > 0 {
+		metrics.CacheFlushFailures.Add(float64(len(failed)))
+		requeueClaims(ctx, failed)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// flushClaim persists the claimed parts of a user document. On failure the
+// claim is put back with exponential backoff so no change is ever dropped.
+func flushClaim(ctx context.Context, claim DirtyEntry) error {
+	if claim.Doc == nil {
+		// the document is gone, nothing left to persist
+		releaseClaim(ctx, claim)
+		return nil
+	}
+
+	err := persistUserDocument(ctx, claim.UUID, claim.Doc, claim.Fields)
+	if err != nil {
+		metrics.CacheFlushFailures.Inc()
+		requeueClaims(ctx, []DirtyEntry{claim})
+		return err
+	}
+
+	releaseClaim(ctx, claim)
+
+	flushAttemptsMu.Lock()
+	delete(flushAttempts, claim.EncodedUUID)
+	flushAttemptsMu.Unlock()
+
+	metrics.CacheFlushedUsers.Inc()
+	metrics.CacheFlushDelay.Observe(time.Since(claim.Since).Seconds())
+
+	return nil
+}
+
+func releaseClaim(ctx context.Context, claim DirtyEntry) {
+	err := store.ReleaseDirty(ctx, []string{claim.EncodedUUID})
+	if err != nil {
+		// the claim times out and is flushed again, which is harmless
+		slog.Error("failed to release write-back claim", "uuid", claim.EncodedUUID, "error", err)
+	}
+}
+
+func requeueClaims(ctx context.Context, claims []DirtyEntry) {
+	now := time.Now()
+
+	flushAttemptsMu.Lock()
+	for i := range claims {
+		attempts := flushAttempts[claims[i].EncodedUUID]
+		flushAttempts[claims[i].EncodedUUID] = attempts + 1
+
+		claims[i].RetryAt = now.Add(min(flushBackoff<<attempts, flushMaxBackoff))
+	}
+	flushAttemptsMu.Unlock()
+
+	err := store.RequeueDirty(ctx, claims)
+	if err != nil {
+		slog.Error("failed to requeue dirty users", "users", len(claims), "error", err)
+	}
+}
+
+// persistUserDocument writes the listed parts of a cached user document to the database.
+func persistUserDocument(ctx context.Context, uuid []byte, doc *defs.UserCacheData, fields []string) error {
+	for _, field := range fields {
+		var err error
+
+		switch {
+		case field == dirtySystem:
+			if doc.SystemSaveData == nil {
+				continue
+			}
+
+			if db.UseS3() {
+				err = db.StoreSystemSaveDataS3(ctx, uuid, *doc.SystemSaveData)
+			} else {
+				err = db.StoreSystemSaveData(ctx, uuid, *doc.SystemSaveData)
+			}
+		case field == dirtyStats:
+			if doc.AccountStats == nil {
+				continue
+			}
+
+			stats, voucherCounts := accountStatsToGameStats(*doc.AccountStats)
+			err = db.UpdateAccountStats(ctx, uuid, stats, voucherCounts)
+		case field == dirtyAccount:
+			if doc.Account == nil {
+				continue
+			}
+
+			if doc.Account.TrainerID != nil && doc.Account.SecretID != nil {
+				err = db.UpdateTrainerIds(ctx, int(*doc.Account.TrainerID), int(*doc.Account.SecretID), uuid)
+				if err != nil {
+					break
+				}
+			}
+
+			if doc.Account.LastActivity != nil {
+				err = db.SetAccountLastActivity(ctx, uuid, *doc.Account.LastActivity)
+			}
+		case field == dirtyActiveSession:
+			if doc.ActiveClientSession == "" {
+				continue
+			}
+
+			err = db.UpdateActiveSession(ctx, uuid, doc.ActiveClientSession)
+		case strings.HasPrefix(field, dirtySessionPrefix):
+			slot, convErr := strconv.Atoi(strings.TrimPrefix(field, dirtySessionPrefix))
+			if convErr != nil || slot < 0 || slot >= defs.SessionSlotCount {
+				continue
+			}
+
+			// the current document decides, not the operation that marked the slot
+			session, ok := doc.SessionSaveData[strconv.Itoa(slot)]
+			if ok {
+				err = db.StoreSessionSaveData(ctx, uuid, session, slot)
+			} else {
+				err = db.DeleteSessionSaveData(ctx, uuid, slot)
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to persist %s: %w", field, err)
+		}
+	}
+
+	return nil
+}
+
+// accountStatsToGameStats converts cached stats into the shape db.UpdateAccountStats expects.
+func accountStatsToGameStats(stats defs.AccountStatsRedisData) (defs.GameStats, map[string]int) {
+	gameStats := map[string]interface{}{
+		"playTime":              float64(stats.PlayTime),
+		"battles":               float64(stats.Battles),
+		"classicSessionsPlayed": float64(stats.ClassicSessionsPlayed),
+		"sessionsWon":           float64(stats.SessionsWon),
+		"highestEndlessWave":    float64(stats.HighestEndlessWave),
+		"highestLevel":          float64(stats.HighestLevel),
+		"pokemonSeen":           float64(stats.PokemonSeen),
+		"pokemonDefeated":       float64(stats.PokemonDefeated),
+		"pokemonCaught":         float64(stats.PokemonCaught),
+		"pokemonHatched":        float64(stats.PokemonHatched),
+		"eggsPulled":            float64(stats.EggsPulled),
+	}
+
+	voucherCounts := map[string]int{
+		"0": stats.RegularVouchers,
+		"1": stats.PlusVouchers,
+		"2": stats.PremiumVouchers,
+		"3": stats.GoldenVouchers,
+	}
+
+	return gameStats, voucherCounts
+}
+
+// FlushAll synchronously writes every dirty user document back to the
+// database, ignoring backoff and retrying failures until ctx is done. It
+// returns the base64 uuids of the users that could not be persisted.
+func FlushAll(ctx context.Context) ([]string, error) {
+	_, err := store.RecoverClaims(ctx, time.Now().Add(-flushClaimTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	for ctx.Err() == nil {
+		// requeued entries are never due later than flushMaxBackoff from now
+		encodedUUIDs, err := store.DirtyUsers(ctx, time.Now().Add(flushMaxBackoff), flushBatchSize)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(encodedUUIDs) == 0 {
+			return nil, nil
+		}
+
+		claims, err := claimDirty(ctx, encodedUUIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		failed := len(encodedUUIDs) - len(claims)
+		for _, claim := range claims {
+			err = flushClaim(ctx, claim)
+			if err != nil {
+				slog.Error("failed to write back user document", "uuid", claim.EncodedUUID, "error", err)
+				failed++
+			}
+		}
+
+		if failed > 0 {
+			// give the database a moment before retrying
+			select {
+			case <-ctx.Done():
+			case <-time.After(500 * time.Millisecond):
+			}
+		}
+	}
+
+	remaining, err := store.DirtyUsers(ctx, time.Now().Add(flushMaxBackoff), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return remaining, ctx.Err()
+}
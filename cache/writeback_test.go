@@ -0,0 +1,268 @@
+package cache
+
+import (
+	"context"
+	"encoding/base64"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/defs"
+)
+
+// markTestDirty marks parts of the document of uuid dirty, the way a cache
+// write does.
+func markTestDirty(t *testing.T, ctx context.Context, s Store, uuid []byte, fields ...string) {
+	t.Helper()
+
+	switch s := s.(type) {
+	case *memoryStore:
+		s.mu.Lock()
+		s.markDirty(base64.StdEncoding.EncodeToString(uuid), time.Now(), false, fields...)
+		s.mu.Unlock()
+	case *redisStore:
+		pipe := s.client.TxPipeline()
+		s.markDirty(ctx, pipe, uuid, fields...)
+
+		_, err := pipe.Exec(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// claimTest claims encodedUUIDs and returns the claims, sorted by uuid, with
+// their fields sorted. miniredis has no RedisJSON, so the redis store can't
+// read the documents it claims and hands every claim back as failed, which
+// the flusher requeues like the rest.
+func claimTest(t *testing.T, ctx context.Context, s Store, encodedUUIDs ...string) []DirtyEntry {
+	t.Helper()
+
+	claims, failed, err := s.ClaimDirty(ctx, encodedUUIDs)
+	if err != nil && len(failed) == 0 {
+		t.Fatal(err)
+	}
+
+	claims = append(claims, failed...)
+	for _, claim := range claims {
+		slices.Sort(claim.Fields)
+	}
+
+	slices.SortFunc(claims, func(a, b DirtyEntry) int {
+		return strings.Compare(a.EncodedUUID, b.EncodedUUID)
+	})
+
+	return claims
+}
+
+func dueTest(t *testing.T, ctx context.Context, s Store, until time.Time) []string {
+	t.Helper()
+
+	encodedUUIDs, err := s.DirtyUsers(ctx, until, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slices.Sort(encodedUUIDs)
+
+	return encodedUUIDs
+}
+
+func TestDirtyClaims(t *testing.T) {
+	ctx := context.Background()
+
+	a, b := []byte("aaaaaaaaaaaaaaaa"), []byte("bbbbbbbbbbbbbbbb")
+	encodedA, encodedB := base64.StdEncoding.EncodeToString(a), base64.StdEncoding.EncodeToString(b)
+
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s Store)
+	}{
+		{
+			name: "claims take entries off the queue",
+			run: func(t *testing.T, s Store) {
+				markTestDirty(t, ctx, s, a, dirtySystem, dirtySession(0))
+				markTestDirty(t, ctx, s, a, dirtySystem)
+				markTestDirty(t, ctx, s, b, dirtyStats)
+
+				if due := dueTest(t, ctx, s, time.Now()); !slices.Equal(due, []string{encodedA, encodedB}) {
+					t.Fatalf("due %v", due)
+				}
+
+				claims := claimTest(t, ctx, s, encodedA, encodedB)
+				if len(claims) != 2 || !slices.Equal(claims[0].Fields, []string{dirtySession(0), dirtySystem}) || !slices.Equal(claims[1].Fields, []string{dirtyStats}) {
+					t.Fatalf("claims %+v", claims)
+				}
+
+				if due := dueTest(t, ctx, s, time.Now()); len(due) != 0 {
+					t.Errorf("due after claiming %v", due)
+				}
+
+				// like another flusher racing for the same entries
+				if claims := claimTest(t, ctx, s, encodedA, encodedB); len(claims) != 0 {
+					t.Errorf("claimed twice: %+v", claims)
+				}
+			},
+		},
+		{
+			name: "requeued claims are due at their retry time with new changes",
+			run: func(t *testing.T, s Store) {
+				markTestDirty(t, ctx, s, a, dirtySystem)
+
+				claims := claimTest(t, ctx, s, encodedA)
+				if len(claims) != 1 {
+					t.Fatalf("claims %+v", claims)
+				}
+
+				// written while the claim is being persisted
+				markTestDirty(t, ctx, s, a, dirtyStats)
+
+				retryAt := time.Now().Add(time.Hour)
+				claims[0].RetryAt = retryAt
+
+				err := s.RequeueDirty(ctx, claims)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if due := dueTest(t, ctx, s, time.Now()); len(due) != 0 {
+					t.Errorf("due before the retry time: %v", due)
+				}
+
+				if due := dueTest(t, ctx, s, retryAt); !slices.Equal(due, []string{encodedA}) {
+					t.Fatalf("due at the retry time: %v", due)
+				}
+
+				claims = claimTest(t, ctx, s, encodedA)
+				if len(claims) != 1 || !slices.Equal(claims[0].Fields, []string{dirtyStats, dirtySystem}) {
+					t.Errorf("claims after requeueing %+v", claims)
+				}
+			},
+		},
+		{
+			name: "stale claims are recovered",
+			run: func(t *testing.T, s Store) {
+				markTestDirty(t, ctx, s, a, dirtySystem)
+				markTestDirty(t, ctx, s, b, dirtyStats)
+				claimTest(t, ctx, s, encodedA, encodedB)
+
+				recovered, err := s.RecoverClaims(ctx, time.Now().Add(-time.Hour))
+				if err != nil || recovered != 0 {
+					t.Fatalf("recovered fresh claims: %d %v", recovered, err)
+				}
+
+				// a is persisted, b's flusher is gone
+				err = s.ReleaseDirty(ctx, []string{encodedA})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				recovered, err = s.RecoverClaims(ctx, time.Now().Add(time.Hour))
+				if err != nil || recovered != 1 {
+					t.Fatalf("recovered %d %v, want 1", recovered, err)
+				}
+
+				claims := claimTest(t, ctx, s, encodedA, encodedB)
+				if len(claims) != 1 || claims[0].EncodedUUID != encodedB || !slices.Equal(claims[0].Fields, []string{dirtyStats}) {
+					t.Errorf("claims after recovering %+v", claims)
+				}
+			},
+		},
+	}
+
+	enabled := writeBack
+	writeBack = true
+	t.Cleanup(func() { writeBack = enabled })
+
+	for _, tt := range tests {
+		for backend, s := range testStores(t) {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				tt.run(t, s)
+			})
+		}
+	}
+}
+
+func TestRequeueBackoff(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, flushBackoff},
+		{1, 2 * flushBackoff},
+		{3, 8 * flushBackoff},
+		{10, flushMaxBackoff},
+	}
+
+	previous := store
+	t.Cleanup(func() { store = previous })
+
+	for _, tt := range tests {
+		s := newMemoryStore()
+		store = s
+
+		encodedUUID := base64.StdEncoding.EncodeToString([]byte("aaaaaaaaaaaaaaaa"))
+
+		flushAttemptsMu.Lock()
+		flushAttempts[encodedUUID] = tt.attempts
+		flushAttemptsMu.Unlock()
+
+		before := time.Now()
+		requeueClaims(ctx, []DirtyEntry{{EncodedUUID: encodedUUID, Fields: []string{dirtySystem}}})
+
+		retryAt := s.dirtyAt[encodedUUID]
+		if delay := retryAt.Sub(before); delay < tt.want || delay > tt.want+time.Second {
+			t.Errorf("after %d attempts retried in %s, want %s", tt.attempts, delay, tt.want)
+		}
+
+		flushAttemptsMu.Lock()
+		if flushAttempts[encodedUUID] != tt.attempts+1 {
+			t.Errorf("after %d attempts counted %d", tt.attempts, flushAttempts[encodedUUID])
+		}
+		delete(flushAttempts, encodedUUID)
+		flushAttemptsMu.Unlock()
+	}
+}
+
+func TestFlushDue(t *testing.T) {
+	ctx := context.Background()
+
+	enabled := writeBack
+	writeBack = true
+	previous := store
+	t.Cleanup(func() {
+		writeBack = enabled
+		store = previous
+	})
+
+	s := newMemoryStore()
+	store = s
+
+	gone := []byte("aaaaaaaaaaaaaaaa")
+	markTestDirty(t, ctx, s, gone, dirtySystem)
+
+	// nothing to persist: the document has no system save
+	kept := []byte("bbbbbbbbbbbbbbbb")
+	err := s.save(kept, defs.UserCacheData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	markTestDirty(t, ctx, s, kept, dirtySystem)
+
+	flushed, err := flushDue(ctx, 10)
+	if err != nil || flushed != 2 {
+		t.Fatalf("flushed %d %v, want 2", flushed, err)
+	}
+
+	count, _, err := s.DirtyStatus(ctx)
+	if err != nil || count != 0 {
+		t.Errorf("dirty after flushing: %d %v", count, err)
+	}
+
+	if len(s.flushingAt) != 0 {
+		t.Errorf("claims left after flushing: %v", s.flushingAt)
+	}
+}
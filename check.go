@@ -0,0 +1,103 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"os"
+
+	"github.com/pagefaultgames/rogueserver/cache"
+	"github.com/pagefaultgames/rogueserver/storage"
+)
+
+// runCheck implements `rogueserver check`: it diffs cached user documents
+// against the database and optionally repairs them, printing the reports as
+// JSON. The exit status is 1 when differences are left, 2 on errors.
+func runCheck(args []string, strategy storage.Strategy) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	username := flags.String("username", "", "check the account with this username")
+	sample := flags.Int("sample", 10, "without -username, check this many random cached users")
+	repairFlag := flags.String("repair", "", "repair differences: cache-to-db or db-to-cache")
+	flags.Parse(args)
+
+	repair, err := cache.ParseRepair(*repairFlag)
+	if err != nil {
+		slog.Error("invalid repair mode", "error", err)
+		return 2
+	}
+
+	if !cache.Enabled() {
+		slog.Error("cache strategy uses no cache, nothing to check", "cache_strategy", strategy)
+		return 2
+	}
+
+	if !cache.Available() {
+		slog.Error("cache is unavailable, nothing to check")
+		return 1
+	}
+
+	// decides whether a session slot missing from the cache counts as deleted
+	err = storage.Init(strategy)
+	if err != nil {
+		slog.Error("failed to initialize storage", "error", err)
+		return 2
+	}
+
+	ctx := context.Background()
+
+	uuids, err := cache.ConsistencyTargets(ctx, *username, *sample)
+	if err != nil {
+		slog.Error("failed to find users to check", "error", err)
+		return 2
+	}
+
+	status := 0
+	reports := make([]cache.ConsistencyReport, 0, len(uuids))
+	for _, uuid := range uuids {
+		report, err := cache.CheckConsistency(ctx, uuid, repair)
+		if err != nil {
+			slog.Error("failed to check user", "uuid", base64.StdEncoding.EncodeToString(uuid), "error", err)
+			return 2
+		}
+
+		left := report.Differences
+		if report.Repaired != cache.RepairNone {
+			left = report.Remaining
+		}
+		if len(left) > 0 {
+			status = 1
+		}
+
+		reports = append(reports, report)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	err = encoder.Encode(reports)
+	if err != nil {
+		slog.Error("failed to print reports", "error", err)
+		return 2
+	}
+
+	return status
+}
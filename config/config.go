@@ -0,0 +1,256 @@
+// Package config holds the server settings. They are read from an optional
+// YAML or TOML file, then environment variables, then command-line flags,
+// each overriding the one before.
+//
+// Every setting is a field tagged with its key in the file, its environment
+// variable and its flag. Settings tagged secret can also be read from the
+// file named by the environment variable with _FILE appended, and are masked
+// when the configuration is printed. Environment variables and flags that
+// have been renamed are still read under the name in their oldenv and oldflag
+// tags, with a warning.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+)
+
+type Config struct {
+	Server Server `key:"server"`
+	Log    Log    `key:"log"`
+	DB     DB     `key:"db"`
+	S3     S3     `key:"s3"`
+	Cache  Cache  `key:"cache"`
+	API    API    `key:"api"`
+}
+
+type Server struct {
+	Proto           string        `key:"proto" env:"proto" flag:"proto" usage:"network of the api listener, tcp or unix"`
+	Addr            string        `key:"addr" env:"addr" flag:"addr" usage:"address of the api listener"`
+	TLSCert         string        `key:"tls_cert" env:"tlscert" flag:"tlscert" usage:"TLS certificate file, serves plain http if empty"`
+	TLSKey          string        `key:"tls_key" env:"tlskey" flag:"tlskey" usage:"TLS key file"`
+	Debug           bool          `key:"debug" env:"debug" flag:"debug" usage:"allow requests from any origin"`
+	RequestTimeout  time.Duration `key:"request_timeout" env:"requesttimeout" flag:"requesttimeout" usage:"how long a request may wait for the cache and database before it fails with 504"`
+	ShutdownTimeout time.Duration `key:"shutdown_timeout" env:"shutdowntimeout" flag:"shutdowntimeout" usage:"how long a shutdown may take to drain requests and flush the cache"`
+	MetricsAddr     string        `key:"metrics_addr" env:"metricsaddr" flag:"metricsaddr" usage:"address to serve /metrics on, the api listener if empty"`
+}
+
+type Log struct {
+	Level  string `key:"level" env:"loglevel" flag:"loglevel" usage:"debug, info, warn or error"`
+	Format string `key:"format" env:"logformat" flag:"logformat" usage:"text or json"`
+}
+
+type DB struct {
+	User     string `key:"user" env:"dbuser" flag:"dbuser" usage:"database user"`
+	Password string `key:"password" env:"dbpass" flag:"dbpass" secret:"true" usage:"database password"`
+	Proto    string `key:"proto" env:"dbproto" flag:"dbproto" usage:"network of the database, tcp or unix"`
+	Addr     string `key:"addr" env:"dbaddr" flag:"dbaddr" usage:"database address"`
+	Name     string `key:"name" env:"dbname" flag:"dbname" usage:"database name"`
+	MaxConns int    `key:"max_conns" env:"dbmaxconns" flag:"dbmaxconns" usage:"open and idle database connections"`
+
+	QueryTimeout  time.Duration `key:"query_timeout" env:"dbquerytimeout" flag:"dbquerytimeout" usage:"how long a database call may take before it is abandoned"`
+	ExportTimeout time.Duration `key:"export_timeout" env:"dbexporttimeout" flag:"dbexporttimeout" usage:"how long a streamed export, like /daily/export, may take before it is abandoned"`
+
+	AutoMigrate bool `key:"auto_migrate" env:"dbautomigrate" flag:"dbautomigrate" usage:"apply pending schema migrations on start, otherwise refuse to start until they are"`
+
+	HistoryVersions int `key:"history_versions" env:"dbhistoryversions" flag:"dbhistoryversions" usage:"replaced versions kept of each save"`
+	HistoryDays     int `key:"history_days" env:"dbhistorydays" flag:"dbhistorydays" usage:"days a daily checkpoint of each save is kept for on top of history_versions"`
+}
+
+// S3 moves system saves to a bucket when Bucket is set.
+type S3 struct {
+	Bucket   string `key:"bucket" env:"S3_SYSTEM_BUCKET_NAME" flag:"s3bucket" oldflag:"s3-bucket" usage:"bucket for system saves, the database if empty"`
+	Endpoint string `key:"endpoint" env:"AWS_ENDPOINT_URL_S3" flag:"s3endpoint" oldflag:"s3-endpoint" usage:"S3 endpoint, the AWS default if empty"`
+}
+
+type Cache struct {
+	Backend  string `key:"backend" env:"cachebackend" flag:"cachebackend" usage:"redis or memory"`
+	Strategy string `key:"strategy" env:"cachestrategy" flag:"cachestrategy" oldenv:"cache_strategy" oldflag:"cache_strategy" usage:"none, cache-aside, write-through or write-back"`
+
+	Redis Redis `key:"redis"`
+
+	// write-back
+	FlushInterval time.Duration `key:"flush_interval" env:"cacheflushinterval" flag:"cacheflushinterval" oldenv:"CACHE_FLUSH_INTERVAL" oldflag:"cache-flush-interval" usage:"how often dirty user documents are written back"`
+	FlushBatch    int           `key:"flush_batch" env:"cacheflushbatch" flag:"cacheflushbatch" oldenv:"CACHE_FLUSH_BATCH" oldflag:"cache-flush-batch" usage:"user documents written back per flush"`
+
+	// idle eviction
+	IdleTTL       time.Duration `key:"idle_ttl" env:"cacheidlettl" flag:"cacheidlettl" oldenv:"CACHE_IDLE_TTL" oldflag:"cache-idle-ttl" usage:"how long a user document may go unused before it is evicted"`
+	SweepInterval time.Duration `key:"sweep_interval" env:"cachesweepinterval" flag:"cachesweepinterval" oldenv:"CACHE_SWEEP_INTERVAL" oldflag:"cache-sweep-interval" usage:"how often idle user documents are evicted"`
+
+	// warm-up
+	WarmupAccounts int `key:"warmup_accounts" env:"cachewarmupaccounts" flag:"cachewarmupaccounts" oldenv:"CACHE_WARMUP_ACCOUNTS" oldflag:"cache-warmup-accounts" usage:"recently active accounts to preload at boot, 0 disables it"`
+	WarmupRate     int `key:"warmup_rate" env:"cachewarmuprate" flag:"cachewarmuprate" oldenv:"CACHE_WARMUP_RATE" oldflag:"cache-warmup-rate" usage:"accounts preloaded per second, 0 means unlimited"`
+
+	// circuit breaker
+	BreakerFailures int           `key:"breaker_failures" env:"cachebreakerfailures" flag:"cachebreakerfailures" oldenv:"CACHE_BREAKER_FAILURES" oldflag:"cache-breaker-failures" usage:"consecutive failed calls before the cache is bypassed"`
+	BreakerCooldown time.Duration `key:"breaker_cooldown" env:"cachebreakercooldown" flag:"cachebreakercooldown" oldenv:"CACHE_BREAKER_COOLDOWN" oldflag:"cache-breaker-cooldown" usage:"how often a bypassed cache is checked for recovery"`
+}
+
+type Redis struct {
+	Addr         string        `key:"addr" env:"REDIS_ADDR" flag:"redisaddr" oldflag:"redis-addr" usage:"Redis address"`
+	Password     string        `key:"password" env:"REDIS_PASS" flag:"redispass" oldflag:"redis-pass" secret:"true" usage:"Redis password"`
+	DB           int           `key:"db" env:"REDIS_DB" flag:"redisdb" oldflag:"redis-db" usage:"Redis database number"`
+	Timeout      time.Duration `key:"timeout" env:"redistimeout" flag:"redistimeout" oldenv:"REDIS_TIMEOUT" oldflag:"redis-timeout" usage:"dial, read and write timeout of Redis calls"`
+	PoolSize     int           `key:"pool_size" env:"redispoolsize" flag:"redispoolsize" oldenv:"REDIS_POOL_SIZE" oldflag:"redis-pool-size" usage:"Redis connections"`
+	MinIdleConns int           `key:"min_idle_conns" env:"redisminidleconns" flag:"redisminidleconns" oldenv:"REDIS_MIN_IDLE_CONNS" oldflag:"redis-min-idle-conns" usage:"idle Redis connections kept open"`
+}
+
+type API struct {
+	GameURL     string `key:"game_url" env:"gameurl" flag:"gameurl" usage:"url of the game client, allowed as origin and redirected to after logins"`
+	CallbackURL string `key:"callback_url" env:"callbackurl" flag:"callbackurl" usage:"public url of this server, for OAuth callbacks"`
+
+	Discord Discord `key:"discord"`
+	Google  Google  `key:"google"`
+	Argon2  Argon2  `key:"argon2"`
+
+	// daily runs scoring at least this much ban the account, 0 disables it
+	DailyBanScore int `key:"daily_ban_score" env:"dailybanscore" flag:"dailybanscore" usage:"daily run score that bans an account, 0 disables it"`
+}
+
+type Discord struct {
+	ClientID     string `key:"client_id" env:"discordclientid" flag:"discordclientid" usage:"Discord OAuth client id"`
+	ClientSecret string `key:"client_secret" env:"discordsecretid" flag:"discordsecretid" secret:"true" usage:"Discord OAuth client secret"`
+	BotToken     string `key:"bot_token" env:"discordbottoken" flag:"discordbottoken" secret:"true" usage:"Discord bot token, for admin role checks"`
+	GuildID      string `key:"guild_id" env:"discordguildid" flag:"discordguildid" usage:"Discord guild whose roles grant admin access"`
+}
+
+type Google struct {
+	ClientID     string `key:"client_id" env:"googleclientid" flag:"googleclientid" usage:"Google OAuth client id"`
+	ClientSecret string `key:"client_secret" env:"googlesecretid" flag:"googlesecretid" secret:"true" usage:"Google OAuth client secret"`
+}
+
+// Argon2 are the password hashing parameters. Hashes don't record them, so
+// changing Time, Memory or Threads locks out every existing account.
+type Argon2 struct {
+	Time         int `key:"time" env:"argontime" flag:"argontime" usage:"Argon2 passes"`
+	Memory       int `key:"memory" env:"argonmemory" flag:"argonmemory" usage:"Argon2 memory in KiB"`
+	Threads      int `key:"threads" env:"argonthreads" flag:"argonthreads" usage:"Argon2 threads"`
+	MaxInstances int `key:"max_instances" env:"argonmaxinstances" flag:"argonmaxinstances" usage:"passwords hashed at once, the number of CPUs if 0"`
+}
+
+// Default returns the settings used for everything not configured.
+func Default() Config {
+	return Config{
+		Server: Server{
+			Proto:           "tcp",
+			Addr:            "0.0.0.0:8001",
+			RequestTimeout:  30 * time.Second,
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "text",
+		},
+		DB: DB{
+			User:     "pokerogue",
+			Password: "pokerogue",
+			Proto:    "tcp",
+			Addr:     "localhost",
+			Name:     "pokeroguedb",
+			MaxConns: 64,
+
+			QueryTimeout:  10 * time.Second,
+			ExportTimeout: 5 * time.Minute,
+
+			AutoMigrate: true,
+
+			HistoryVersions: 10,
+			HistoryDays:     7,
+		},
+		Cache: Cache{
+			Backend:  "redis",
+			Strategy: "write-back",
+			Redis: Redis{
+				Addr:         "redis:6379",
+				Timeout:      time.Second,
+				PoolSize:     10,
+				MinIdleConns: 5,
+			},
+			FlushInterval:   10 * time.Second,
+			FlushBatch:      100,
+			IdleTTL:         7 * 24 * time.Hour,
+			SweepInterval:   time.Minute,
+			WarmupRate:      50,
+			BreakerFailures: 5,
+			BreakerCooldown: 5 * time.Second,
+		},
+		API: API{
+			GameURL:     "https://pokerogue.net",
+			CallbackURL: "http://localhost:8001/",
+			Argon2: Argon2{
+				Time:    1,
+				Memory:  256 * 1024,
+				Threads: 4,
+			},
+			DailyBanScore: 20000,
+		},
+	}
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Proto == "tcp" || c.Server.Proto == "unix", "server.proto: want tcp or unix, got %q", c.Server.Proto)
+	check(c.Server.Addr != "", "server.addr: must be set")
+	check((c.Server.TLSCert == "") == (c.Server.TLSKey == ""), "server.tls_cert and server.tls_key: set both or neither")
+	check(c.Server.RequestTimeout > 0, "server.request_timeout: must be positive")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout: must be positive")
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Log.Level)) == nil, "log.level: want debug, info, warn or error, got %q", c.Log.Level)
+	check(c.Log.Format == "text" || c.Log.Format == "json", "log.format: want text or json, got %q", c.Log.Format)
+
+	check(c.DB.User != "", "db.user: must be set")
+	check(c.DB.Proto == "tcp" || c.DB.Proto == "unix", "db.proto: want tcp or unix, got %q", c.DB.Proto)
+	check(c.DB.Addr != "", "db.addr: must be set")
+	check(c.DB.Name != "", "db.name: must be set")
+	check(c.DB.MaxConns > 0, "db.max_conns: must be positive")
+	check(c.DB.QueryTimeout > 0, "db.query_timeout: must be positive")
+	check(c.DB.ExportTimeout > 0, "db.export_timeout: must be positive")
+	check(c.DB.HistoryVersions >= 0, "db.history_versions: must not be negative")
+	check(c.DB.HistoryDays >= 0, "db.history_days: must not be negative")
+
+	check(c.Cache.Backend == "redis" || c.Cache.Backend == "memory", "cache.backend: want redis or memory, got %q", c.Cache.Backend)
+	switch c.Cache.Strategy {
+	case "none", "cache-aside", "write-through", "write-back":
+	default:
+		errs = append(errs, fmt.Errorf("cache.strategy: want none, cache-aside, write-through or write-back, got %q", c.Cache.Strategy))
+	}
+	check(c.Cache.Backend != "redis" || c.Cache.Redis.Addr != "", "cache.redis.addr: must be set for the redis backend")
+	check(c.Cache.Redis.DB >= 0, "cache.redis.db: must not be negative")
+	check(c.Cache.Redis.Timeout > 0, "cache.redis.timeout: must be positive")
+	check(c.Cache.Redis.PoolSize > 0, "cache.redis.pool_size: must be positive")
+	check(c.Cache.Redis.MinIdleConns >= 0, "cache.redis.min_idle_conns: must not be negative")
+	check(c.Cache.FlushInterval > 0, "cache.flush_interval: must be positive")
+	check(c.Cache.FlushBatch > 0, "cache.flush_batch: must be positive")
+	check(c.Cache.IdleTTL > 0, "cache.idle_ttl: must be positive")
+	check(c.Cache.SweepInterval > 0, "cache.sweep_interval: must be positive")
+	check(c.Cache.WarmupAccounts >= 0, "cache.warmup_accounts: must not be negative")
+	check(c.Cache.WarmupRate >= 0, "cache.warmup_rate: must not be negative")
+	check(c.Cache.BreakerFailures > 0, "cache.breaker_failures: must be positive")
+	check(c.Cache.BreakerCooldown > 0, "cache.breaker_cooldown: must be positive")
+
+	check(isURL(c.API.GameURL), "api.game_url: not an absolute url: %q", c.API.GameURL)
+	check(isURL(c.API.CallbackURL), "api.callback_url: not an absolute url: %q", c.API.CallbackURL)
+	check(c.API.Argon2.Time > 0, "api.argon2.time: must be positive")
+	check(c.API.Argon2.Memory > 0, "api.argon2.memory: must be positive")
+	check(c.API.Argon2.Threads > 0 && c.API.Argon2.Threads <= 255, "api.argon2.threads: must be between 1 and 255")
+	check(c.API.Argon2.MaxInstances >= 0, "api.argon2.max_instances: must not be negative")
+	check(c.API.DailyBanScore >= 0, "api.daily_ban_score: must not be negative")
+
+	return errors.Join(errs...)
+}
+
+func isURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
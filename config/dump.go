@@ -0,0 +1,58 @@
+package config
+
+import (
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const maskedValue = "[REDACTED]"
+
+// Dump writes the configuration as a YAML file Load accepts, with secrets
+// masked.
+func (c Config) Dump(w io.Writer) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+
+	for _, s := range settings(&c) {
+		node := root
+		path := strings.Split(s.key, ".")
+		for _, part := range path[:len(path)-1] {
+			node = child(node, part)
+		}
+
+		value := s.String()
+		if s.secret && value != "" {
+			value = maskedValue
+		}
+
+		node.Content = append(node.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: path[len(path)-1]},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: value, LineComment: s.usage},
+		)
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+
+	err := encoder.Encode(root)
+	if err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
+
+// child returns the mapping under key in node, adding it if needed.
+func child(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	mapping := &yaml.Node{Kind: yaml.MappingNode}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, mapping)
+
+	return mapping
+}
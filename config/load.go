@@ -0,0 +1,318 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// setting is one leaf field of Config.
+type setting struct {
+	key    string // dotted path in the file, like db.user
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	value  reflect.Value
+
+	// deprecated names of env and flag, still accepted
+	oldEnv  string
+	oldFlag string
+}
+
+// settings lists the leaf fields of c in declaration order.
+func settings(c *Config) []setting {
+	return collect(reflect.ValueOf(c).Elem(), "")
+}
+
+func collect(v reflect.Value, prefix string) []setting {
+	var list []setting
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		key := prefix + field.Tag.Get("key")
+
+		if field.Type.Kind() == reflect.Struct {
+			list = append(list, collect(v.Field(i), key+".")...)
+			continue
+		}
+
+		list = append(list, setting{
+			key:    key,
+			env:    field.Tag.Get("env"),
+			flag:   field.Tag.Get("flag"),
+			usage:  field.Tag.Get("usage"),
+			secret: field.Tag.Get("secret") == "true",
+			value:  v.Field(i),
+
+			oldEnv:  field.Tag.Get("oldenv"),
+			oldFlag: field.Tag.Get("oldflag"),
+		})
+	}
+
+	return list
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func (s setting) set(raw string) error {
+	switch {
+	case s.value.Type() == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+
+		s.value.SetInt(int64(d))
+	case s.value.Kind() == reflect.String:
+		s.value.SetString(raw)
+	case s.value.Kind() == reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+
+		s.value.SetInt(int64(n))
+	case s.value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+
+		s.value.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported setting type %s", s.value.Type())
+	}
+
+	return nil
+}
+
+func (s setting) String() string {
+	if s.value.Type() == durationType {
+		return time.Duration(s.value.Int()).String()
+	}
+
+	return fmt.Sprint(s.value.Interface())
+}
+
+// flagValue collects a flag for Load to apply after the file and environment.
+type flagValue struct {
+	setting
+	raw *string
+}
+
+func (f flagValue) String() string {
+	if f.raw == nil {
+		return ""
+	}
+
+	return *f.raw
+}
+
+func (f flagValue) Set(raw string) error {
+	*f.raw = raw
+	return nil
+}
+
+func (f flagValue) IsBoolFlag() bool {
+	return f.value.Kind() == reflect.Bool
+}
+
+// Load reads the configuration from the file named by -config or the config
+// environment variable, the environment and args, and validates it. It
+// returns the arguments left after the flags.
+func Load(args []string) (Config, []string, error) {
+	cfg := Default()
+	list := settings(&cfg)
+
+	fs := flag.NewFlagSet("rogueserver", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: rogueserver [flags] [check [flags] | config | leaderboard rebuild [flags] | migrate up|down|status]")
+		fmt.Fprintln(fs.Output(), "       rogueserver healthcheck [flags]")
+		fs.PrintDefaults()
+	}
+
+	path := fs.String("config", os.Getenv("config"), "YAML or TOML configuration file")
+
+	flags := make([]string, len(list))
+	for i, s := range list {
+		def := s.String()
+		if s.secret {
+			def = ""
+		}
+
+		fs.Var(flagValue{s, &flags[i]}, s.flag, fmt.Sprintf("%s (%s, env %s)", s.usage, s.key, s.env))
+		fs.Lookup(s.flag).DefValue = def
+
+		if s.oldFlag != "" {
+			fs.Var(flagValue{s, &flags[i]}, s.oldFlag, fmt.Sprintf("deprecated, use -%s", s.flag))
+		}
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	if *path != "" {
+		err = loadFile(*path, list)
+		if err != nil {
+			return cfg, nil, fmt.Errorf("%s: %w", *path, err)
+		}
+	}
+
+	err = loadEnv(list)
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for i, s := range list {
+		if set[s.oldFlag] {
+			slog.Warn("deprecated flag", "flag", s.oldFlag, "use", s.flag)
+		}
+
+		if !set[s.flag] && !set[s.oldFlag] {
+			continue
+		}
+
+		err = s.set(flags[i])
+		if err != nil {
+			return cfg, nil, fmt.Errorf("invalid value %q for flag -%s: %s", flags[i], s.flag, err)
+		}
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return cfg, nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	return cfg, fs.Args(), nil
+}
+
+// loadFile applies a YAML or TOML file, chosen by its extension. Keys that
+// aren't settings are an error so typos don't go unnoticed.
+func loadFile(path string, list []setting) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	tree := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &tree)
+	case ".toml":
+		_, err = toml.Decode(string(data), &tree)
+	default:
+		return fmt.Errorf("unknown configuration format %q, want .yaml, .yml or .toml", filepath.Ext(path))
+	}
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]string)
+	err = flatten(tree, "", values)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range list {
+		raw, ok := values[s.key]
+		if !ok {
+			continue
+		}
+
+		delete(values, s.key)
+
+		err = s.set(raw)
+		if err != nil {
+			return fmt.Errorf("invalid value %q for %s: %s", raw, s.key, err)
+		}
+	}
+
+	if len(values) > 0 {
+		unknown := make([]string, 0, len(values))
+		for key := range values {
+			unknown = append(unknown, key)
+		}
+		sort.Strings(unknown)
+
+		return fmt.Errorf("unknown settings: %s", strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// flatten turns nested tables into dotted keys with their values as text.
+func flatten(tree map[string]any, prefix string, values map[string]string) error {
+	for key, value := range tree {
+		key = prefix + key
+
+		switch value := value.(type) {
+		case map[string]any:
+			err := flatten(value, key+".", values)
+			if err != nil {
+				return err
+			}
+		case []any:
+			return fmt.Errorf("%s: lists are not supported", key)
+		case nil:
+			values[key] = ""
+		default:
+			values[key] = fmt.Sprint(value)
+		}
+	}
+
+	return nil
+}
+
+// loadEnv applies the environment. A secret can instead be read from the file
+// named by its variable with _FILE appended, like Docker secrets. A deprecated
+// variable is only read if the current one isn't set.
+func loadEnv(list []setting) error {
+	for _, s := range list {
+		raw, ok := os.LookupEnv(s.env)
+		if !ok && s.oldEnv != "" {
+			raw, ok = os.LookupEnv(s.oldEnv)
+			if ok {
+				slog.Warn("deprecated environment variable", "name", s.oldEnv, "use", s.env)
+			}
+		}
+
+		if file := os.Getenv(s.env + "_FILE"); s.secret && file != "" {
+			if ok {
+				return fmt.Errorf("%s and %s_FILE are both set", s.env, s.env)
+			}
+
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return fmt.Errorf("%s_FILE: %w", s.env, err)
+			}
+
+			raw, ok = strings.TrimRight(string(data), "\r\n"), true
+		}
+
+		if !ok {
+			continue
+		}
+
+		err := s.set(raw)
+		if err != nil {
+			return fmt.Errorf("invalid value %q for %s: %s", raw, s.env, err)
+		}
+	}
+
+	return nil
+}
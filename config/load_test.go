@@ -0,0 +1,251 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestFile writes content to name in a temporary directory and returns
+// its path.
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+const testYAML = `
+db:
+  user: file
+  name: file
+  query_timeout: 20s
+cache:
+  redis:
+    pool_size: 20
+`
+
+const testTOML = `
+[db]
+user = "file"
+name = "file"
+query_timeout = "20s"
+
+[cache.redis]
+pool_size = 20
+`
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		file string // name of a file with data, if any
+		data string
+		// names the file with the config variable instead of -config
+		fromEnv bool
+		env     map[string]string
+		args    []string
+		want    func(cfg Config) bool
+	}{
+		{
+			name: "defaults",
+			want: func(cfg Config) bool {
+				return cfg.DB.User == "pokerogue" && cfg.DB.QueryTimeout == 10*time.Second && cfg.Cache.Redis.PoolSize == 10
+			},
+		},
+		{
+			name: "yaml file",
+			file: "config.yaml",
+			data: testYAML,
+			want: func(cfg Config) bool {
+				return cfg.DB.User == "file" && cfg.DB.QueryTimeout == 20*time.Second && cfg.Cache.Redis.PoolSize == 20 && cfg.DB.Addr == "localhost"
+			},
+		},
+		{
+			name: "toml file",
+			file: "config.toml",
+			data: testTOML,
+			want: func(cfg Config) bool {
+				return cfg.DB.User == "file" && cfg.DB.QueryTimeout == 20*time.Second && cfg.Cache.Redis.PoolSize == 20 && cfg.DB.Addr == "localhost"
+			},
+		},
+		{
+			name: "environment over the file",
+			file: "config.yaml",
+			data: testYAML,
+			env:  map[string]string{"dbuser": "env", "redispoolsize": "30"},
+			want: func(cfg Config) bool {
+				return cfg.DB.User == "env" && cfg.DB.Name == "file" && cfg.Cache.Redis.PoolSize == 30
+			},
+		},
+		{
+			name: "flags over the environment",
+			file: "config.toml",
+			data: testTOML,
+			env:  map[string]string{"dbuser": "env", "dbname": "env"},
+			args: []string{"-dbuser", "flag", "-dbquerytimeout", "5s"},
+			want: func(cfg Config) bool {
+				return cfg.DB.User == "flag" && cfg.DB.Name == "env" && cfg.DB.QueryTimeout == 5*time.Second
+			},
+		},
+		{
+			name: "boolean flags",
+			env:  map[string]string{"debug": "false"},
+			args: []string{"-debug"},
+			want: func(cfg Config) bool {
+				return cfg.Server.Debug
+			},
+		},
+		{
+			name: "deprecated names",
+			env:  map[string]string{"cache_strategy": "none", "CACHE_FLUSH_BATCH": "50", "REDIS_TIMEOUT": "2s"},
+			args: []string{"-cache-idle-ttl", "1h"},
+			want: func(cfg Config) bool {
+				return cfg.Cache.Strategy == "none" && cfg.Cache.FlushBatch == 50 && cfg.Cache.Redis.Timeout == 2*time.Second && cfg.Cache.IdleTTL == time.Hour
+			},
+		},
+		{
+			name: "current names over deprecated ones",
+			env:  map[string]string{"CACHE_FLUSH_BATCH": "50", "cacheflushbatch": "60"},
+			args: []string{"-cache-idle-ttl", "1h", "-cacheidlettl", "2h"},
+			want: func(cfg Config) bool {
+				return cfg.Cache.FlushBatch == 60 && cfg.Cache.IdleTTL == 2*time.Hour
+			},
+		},
+		{
+			name:    "file named by the environment",
+			file:    "config.yml",
+			data:    testYAML,
+			fromEnv: true,
+			want: func(cfg Config) bool {
+				return cfg.DB.User == "file"
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("config", "")
+
+			args := tt.args
+			if tt.file != "" {
+				path := writeTestFile(t, tt.file, tt.data)
+				if tt.fromEnv {
+					t.Setenv("config", path)
+				} else {
+					args = append([]string{"-config", path}, args...)
+				}
+			}
+
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			cfg, rest, err := Load(append(args, "migrate", "status"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !tt.want(cfg) {
+				t.Errorf("loaded %+v", cfg)
+			}
+
+			if strings.Join(rest, " ") != "migrate status" {
+				t.Errorf("arguments left %q", rest)
+			}
+		})
+	}
+}
+
+func TestLoadSecretFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		file string // written to a file named by dbpass_FILE
+		want string
+		err  string
+	}{
+		{"read from the file", nil, "hunter2\n", "hunter2", ""},
+		{"only trailing newlines trimmed", nil, " hunter2 \r\n", " hunter2 ", ""},
+		{"both set", map[string]string{"dbpass": "env"}, "hunter2", "", "dbpass and dbpass_FILE are both set"},
+		{"empty variable", map[string]string{"dbpass_FILE": ""}, "", "pokerogue", ""},
+		{"missing file", map[string]string{"dbpass_FILE": "/nonexistent/dbpass"}, "", "", "dbpass_FILE"},
+		{"not a secret", map[string]string{"dbuser_FILE": "/nonexistent/dbuser"}, "", "pokerogue", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("config", "")
+
+			if tt.file != "" {
+				t.Setenv("dbpass_FILE", writeTestFile(t, "dbpass", tt.file))
+			}
+
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			cfg, _, err := Load(nil)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if cfg.DB.Password != tt.want {
+				t.Errorf("password %q, want %q", cfg.DB.Password, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data string
+		env  map[string]string
+		args []string
+		err  string
+	}{
+		{name: "unknown keys", file: "config.yaml", data: "db:\n  usr: x\nredis: x\n", err: "unknown settings: db.usr, redis"},
+		{name: "unknown format", file: "config.json", data: "{}", err: "unknown configuration format"},
+		{name: "lists", file: "config.toml", data: "[db]\naddr = [\"a\", \"b\"]\n", err: "db.addr: lists are not supported"},
+		{name: "invalid file value", file: "config.yaml", data: "db:\n  max_conns: many\n", err: "for db.max_conns"},
+		{name: "invalid environment value", env: map[string]string{"dbquerytimeout": "soon"}, err: "for dbquerytimeout"},
+		{name: "invalid flag value", args: []string{"-redisdb", "one"}, err: "for flag -redisdb"},
+		{name: "invalid configuration", env: map[string]string{"dbexporttimeout": "0s"}, err: "db.export_timeout"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("config", "")
+
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeTestFile(t, tt.file, tt.data)}, args...)
+			}
+
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			_, _, err := Load(args)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
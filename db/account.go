@@ -18,6 +18,7 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"encoding/base64"
 
@@ -27,6 +28,7 @@ import (
 
 	//"log"
 	"slices"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/pagefaultgames/rogueserver/defs"
@@ -35,7 +37,12 @@ import (
 )
 
 // DB에서 uuid로 accounts 정보를 모두 가져오는 함수
-func GetAccountFromDB(uuid []byte) (defs.AccountDBRow, error) {
+func GetAccountFromDB(ctx context.Context, uuid []byte) (defs.AccountDBRow, error) {
+	defer observe("GetAccountFromDB", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var account defs.AccountDBRow
 
 	query := `
@@ -47,7 +54,7 @@ func GetAccountFromDB(uuid []byte) (defs.AccountDBRow, error) {
 	// MariaDB/MySQL 드라이버는 '?'를 파라미터 플레이스홀더로 사용
 	// uuidBytes는 []byte 타입이므로 DB의 binary(16)과 직접 비교 가능
 
-	row := handle.QueryRow(query, uuid)
+	row := handle.QueryRowContext(ctx, query, uuid)
 	err := row.Scan(
 		&account.UUID,
 		&account.Username,
@@ -77,7 +84,12 @@ func GetAccountFromDB(uuid []byte) (defs.AccountDBRow, error) {
 
 // GetAccountStatsFromDB 함수는 DB에서 특정 UUID에 해당하는 accountStats 데이터를 가져옵니다.
 // uuidBytes는 []byte 타입의 UUID입니다.
-func GetAccountStatsFromDB(uuidBytes []byte) (defs.AccountStatsData, error) { // defs.AccountStatsData
+func GetAccountStatsFromDB(ctx context.Context, uuidBytes []byte) (defs.AccountStatsData, error) { // defs.AccountStatsData
+	defer observe("GetAccountStatsFromDB", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var stats defs.AccountStatsData // defs.AccountStatsData
 
 	// uuidBytes가 nil이거나 길이가 맞는지 기본 검사 (선택적)
@@ -97,7 +109,7 @@ func GetAccountStatsFromDB(uuidBytes []byte) (defs.AccountStatsData, error) { //
 	// DB 드라이버는 '?'를 파라미터 플레이스홀더로 사용
 	// uuidBytes는 []byte 타입이므로 DB의 binary(16)과 직접 비교 가능
 
-	row := handle.QueryRow(query, uuidBytes)
+	row := handle.QueryRowContext(ctx, query, uuidBytes)
 	err := row.Scan(
 		&stats.UUID, // []byte로 스캔
 		&stats.PlayTime,
@@ -133,8 +145,13 @@ func GetAccountStatsFromDB(uuidBytes []byte) (defs.AccountStatsData, error) { //
 	return stats, nil
 }
 
-func AddAccountRecord(uuid []byte, username string, key, salt []byte) error {
-	_, err := handle.Exec("INSERT INTO accounts (uuid, username, hash, salt, registered) VALUES (?, ?, ?, ?, UTC_TIMESTAMP())", uuid, username, key, salt)
+func AddAccountRecord(ctx context.Context, uuid []byte, username string, key, salt []byte) error {
+	defer observe("AddAccountRecord", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := handle.ExecContext(ctx, "INSERT INTO accounts (uuid, username, hash, salt, registered) VALUES (?, ?, ?, ?, UTC_TIMESTAMP())", uuid, username, key, salt)
 	if err != nil {
 		return err
 	}
@@ -251,13 +268,18 @@ func AddAccountSession(username string, token []byte) error {
 
 //아래가 원본 함수.
 
-func AddAccountSession(username string, token []byte) error {
-	_, err := handle.Exec("INSERT INTO sessions (uuid, token, expire) SELECT a.uuid, ?, DATE_ADD(UTC_TIMESTAMP(), INTERVAL 1 WEEK) FROM accounts a WHERE a.username = ?", token, username)
+func AddAccountSession(ctx context.Context, username string, token []byte) error {
+	defer observe("AddAccountSession", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := handle.ExecContext(ctx, "INSERT INTO sessions (uuid, token, expire) SELECT a.uuid, ?, DATE_ADD(UTC_TIMESTAMP(), INTERVAL 1 WEEK) FROM accounts a WHERE a.username = ?", token, username)
 	if err != nil {
 		return err
 	}
 
-	_, err = handle.Exec("UPDATE accounts SET lastLoggedIn = UTC_TIMESTAMP() WHERE username = ?", username)
+	_, err = handle.ExecContext(ctx, "UPDATE accounts SET lastLoggedIn = UTC_TIMESTAMP() WHERE username = ?", username)
 	if err != nil {
 		return err
 	}
@@ -265,8 +287,13 @@ func AddAccountSession(username string, token []byte) error {
 	return nil
 }
 
-func AddDiscordIdByUsername(discordId string, username string) error {
-	_, err := handle.Exec("UPDATE accounts SET discordId = ? WHERE username = ?", discordId, username)
+func AddDiscordIdByUsername(ctx context.Context, discordId string, username string) error {
+	defer observe("AddDiscordIdByUsername", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := handle.ExecContext(ctx, "UPDATE accounts SET discordId = ? WHERE username = ?", discordId, username)
 	if err != nil {
 		return err
 	}
@@ -274,8 +301,13 @@ func AddDiscordIdByUsername(discordId string, username string) error {
 	return nil
 }
 
-func AddGoogleIdByUsername(googleId string, username string) error {
-	_, err := handle.Exec("UPDATE accounts SET googleId = ? WHERE username = ?", googleId, username)
+func AddGoogleIdByUsername(ctx context.Context, googleId string, username string) error {
+	defer observe("AddGoogleIdByUsername", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := handle.ExecContext(ctx, "UPDATE accounts SET googleId = ? WHERE username = ?", googleId, username)
 	if err != nil {
 		return err
 	}
@@ -283,8 +315,13 @@ func AddGoogleIdByUsername(googleId string, username string) error {
 	return nil
 }
 
-func AddGoogleIdByUUID(googleId string, uuid []byte) error {
-	_, err := handle.Exec("UPDATE accounts SET googleId = ? WHERE uuid = ?", googleId, uuid)
+func AddGoogleIdByUUID(ctx context.Context, googleId string, uuid []byte) error {
+	defer observe("AddGoogleIdByUUID", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := handle.ExecContext(ctx, "UPDATE accounts SET googleId = ? WHERE uuid = ?", googleId, uuid)
 	if err != nil {
 		return err
 	}
@@ -292,8 +329,13 @@ func AddGoogleIdByUUID(googleId string, uuid []byte) error {
 	return nil
 }
 
-func AddDiscordIdByUUID(discordId string, uuid []byte) error {
-	_, err := handle.Exec("UPDATE accounts SET discordId = ? WHERE uuid = ?", discordId, uuid)
+func AddDiscordIdByUUID(ctx context.Context, discordId string, uuid []byte) error {
+	defer observe("AddDiscordIdByUUID", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := handle.ExecContext(ctx, "UPDATE accounts SET discordId = ? WHERE uuid = ?", discordId, uuid)
 	if err != nil {
 		return err
 	}
@@ -301,9 +343,14 @@ func AddDiscordIdByUUID(discordId string, uuid []byte) error {
 	return nil
 }
 
-func FetchUsernameByDiscordId(discordId string) (string, error) {
+func FetchUsernameByDiscordId(ctx context.Context, discordId string) (string, error) {
+	defer observe("FetchUsernameByDiscordId", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var username string
-	err := handle.QueryRow("SELECT username FROM accounts WHERE discordId = ?", discordId).Scan(&username)
+	err := handle.QueryRowContext(ctx, "SELECT username FROM accounts WHERE discordId = ?", discordId).Scan(&username)
 	if err != nil {
 		return "", err
 	}
@@ -311,9 +358,14 @@ func FetchUsernameByDiscordId(discordId string) (string, error) {
 	return username, nil
 }
 
-func FetchUsernameByGoogleId(googleId string) (string, error) {
+func FetchUsernameByGoogleId(ctx context.Context, googleId string) (string, error) {
+	defer observe("FetchUsernameByGoogleId", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var username string
-	err := handle.QueryRow("SELECT username FROM accounts WHERE googleId = ?", googleId).Scan(&username)
+	err := handle.QueryRowContext(ctx, "SELECT username FROM accounts WHERE googleId = ?", googleId).Scan(&username)
 	if err != nil {
 		return "", err
 	}
@@ -321,9 +373,14 @@ func FetchUsernameByGoogleId(googleId string) (string, error) {
 	return username, nil
 }
 
-func FetchDiscordIdByUsername(username string) (string, error) {
+func FetchDiscordIdByUsername(ctx context.Context, username string) (string, error) {
+	defer observe("FetchDiscordIdByUsername", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var discordId sql.NullString
-	err := handle.QueryRow("SELECT discordId FROM accounts WHERE username = ?", username).Scan(&discordId)
+	err := handle.QueryRowContext(ctx, "SELECT discordId FROM accounts WHERE username = ?", username).Scan(&discordId)
 	if err != nil {
 		return "", err
 	}
@@ -335,9 +392,14 @@ func FetchDiscordIdByUsername(username string) (string, error) {
 	return discordId.String, nil
 }
 
-func FetchGoogleIdByUsername(username string) (string, error) {
+func FetchGoogleIdByUsername(ctx context.Context, username string) (string, error) {
+	defer observe("FetchGoogleIdByUsername", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var googleId sql.NullString
-	err := handle.QueryRow("SELECT googleId FROM accounts WHERE username = ?", username).Scan(&googleId)
+	err := handle.QueryRowContext(ctx, "SELECT googleId FROM accounts WHERE username = ?", username).Scan(&googleId)
 	if err != nil {
 		return "", err
 	}
@@ -349,9 +411,14 @@ func FetchGoogleIdByUsername(username string) (string, error) {
 	return googleId.String, nil
 }
 
-func FetchDiscordIdByUUID(uuid []byte) (string, error) {
+func FetchDiscordIdByUUID(ctx context.Context, uuid []byte) (string, error) {
+	defer observe("FetchDiscordIdByUUID", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var discordId sql.NullString
-	err := handle.QueryRow("SELECT discordId FROM accounts WHERE uuid = ?", uuid).Scan(&discordId)
+	err := handle.QueryRowContext(ctx, "SELECT discordId FROM accounts WHERE uuid = ?", uuid).Scan(&discordId)
 	if err != nil {
 		return "", err
 	}
@@ -363,9 +430,14 @@ func FetchDiscordIdByUUID(uuid []byte) (string, error) {
 	return discordId.String, nil
 }
 
-func FetchGoogleIdByUUID(uuid []byte) (string, error) {
+func FetchGoogleIdByUUID(ctx context.Context, uuid []byte) (string, error) {
+	defer observe("FetchGoogleIdByUUID", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var googleId sql.NullString
-	err := handle.QueryRow("SELECT googleId FROM accounts WHERE uuid = ?", uuid).Scan(&googleId)
+	err := handle.QueryRowContext(ctx, "SELECT googleId FROM accounts WHERE uuid = ?", uuid).Scan(&googleId)
 	if err != nil {
 		return "", err
 	}
@@ -377,9 +449,14 @@ func FetchGoogleIdByUUID(uuid []byte) (string, error) {
 	return googleId.String, nil
 }
 
-func FetchUsernameBySessionToken(token []byte) (string, error) {
+func FetchUsernameBySessionToken(ctx context.Context, token []byte) (string, error) {
+	defer observe("FetchUsernameBySessionToken", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var username string
-	err := handle.QueryRow("SELECT a.username FROM accounts a JOIN sessions s ON a.uuid = s.uuid WHERE s.token = ?", token).Scan(&username)
+	err := handle.QueryRowContext(ctx, "SELECT a.username FROM accounts a JOIN sessions s ON a.uuid = s.uuid WHERE s.token = ?", token).Scan(&username)
 	if err != nil {
 		return "", err
 	}
@@ -387,9 +464,14 @@ func FetchUsernameBySessionToken(token []byte) (string, error) {
 	return username, nil
 }
 
-func CheckUsernameExists(username string) (string, error) {
+func CheckUsernameExists(ctx context.Context, username string) (string, error) {
+	defer observe("CheckUsernameExists", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var dbUsername sql.NullString
-	err := handle.QueryRow("SELECT username FROM accounts WHERE username = ?", username).Scan(&dbUsername)
+	err := handle.QueryRowContext(ctx, "SELECT username FROM accounts WHERE username = ?", username).Scan(&dbUsername)
 	if err != nil {
 		return "", err
 	}
@@ -400,9 +482,14 @@ func CheckUsernameExists(username string) (string, error) {
 	return dbUsername.String, nil
 }
 
-func FetchLastLoggedInDateByUsername(username string) (string, error) {
+func FetchLastLoggedInDateByUsername(ctx context.Context, username string) (string, error) {
+	defer observe("FetchLastLoggedInDateByUsername", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var lastLoggedIn sql.NullString
-	err := handle.QueryRow("SELECT lastLoggedIn FROM accounts WHERE username = ?", username).Scan(&lastLoggedIn)
+	err := handle.QueryRowContext(ctx, "SELECT lastLoggedIn FROM accounts WHERE username = ?", username).Scan(&lastLoggedIn)
 	if err != nil {
 		return "", err
 	}
@@ -421,11 +508,16 @@ type AdminSearchResponse struct {
 	Registered   string `json:"registered"`
 }
 
-func FetchAdminDetailsByUsername(dbUsername string) (AdminSearchResponse, error) {
+func FetchAdminDetailsByUsername(ctx context.Context, dbUsername string) (AdminSearchResponse, error) {
+	defer observe("FetchAdminDetailsByUsername", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var username, discordId, googleId, lastActivity, registered sql.NullString
 	var adminResponse AdminSearchResponse
 
-	err := handle.QueryRow("SELECT username, discordId, googleId, lastActivity, registered from accounts WHERE username = ?", dbUsername).Scan(&username, &discordId, &googleId, &lastActivity, &registered)
+	err := handle.QueryRowContext(ctx, "SELECT username, discordId, googleId, lastActivity, registered from accounts WHERE username = ?", dbUsername).Scan(&username, &discordId, &googleId, &lastActivity, &registered)
 	if err != nil {
 		return adminResponse, err
 	}
@@ -441,8 +533,27 @@ func FetchAdminDetailsByUsername(dbUsername string) (AdminSearchResponse, error)
 	return adminResponse, nil
 }
 
-func UpdateAccountPassword(uuid, key, salt []byte) error {
-	_, err := handle.Exec("UPDATE accounts SET (hash, salt) VALUES (?, ?) WHERE uuid = ?", key, salt, uuid)
+func UpdateAccountPassword(ctx context.Context, uuid, key, salt []byte) error {
+	defer observe("UpdateAccountPassword", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := handle.ExecContext(ctx, "UPDATE accounts SET (hash, salt) VALUES (?, ?) WHERE uuid = ?", key, salt, uuid)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func UpdateAccountLastActivity(ctx context.Context, uuid []byte) error {
+	defer observe("UpdateAccountLastActivity", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := handle.ExecContext(ctx, "UPDATE accounts SET lastActivity = UTC_TIMESTAMP() WHERE uuid = ?", uuid)
 	if err != nil {
 		return err
 	}
@@ -450,8 +561,13 @@ func UpdateAccountPassword(uuid, key, salt []byte) error {
 	return nil
 }
 
-func UpdateAccountLastActivity(uuid []byte) error {
-	_, err := handle.Exec("UPDATE accounts SET lastActivity = UTC_TIMESTAMP() WHERE uuid = ?", uuid)
+func SetAccountLastActivity(ctx context.Context, uuid []byte, lastActivity time.Time) error {
+	defer observe("SetAccountLastActivity", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := handle.ExecContext(ctx, "UPDATE accounts SET lastActivity = ? WHERE uuid = ?", lastActivity.UTC(), uuid)
 	if err != nil {
 		return err
 	}
@@ -459,7 +575,16 @@ func UpdateAccountLastActivity(uuid []byte) error {
 	return nil
 }
 
-func UpdateAccountStats(uuid []byte, stats defs.GameStats, voucherCounts map[string]int) error {
+func UpdateAccountStats(ctx context.Context, uuid []byte, stats defs.GameStats, voucherCounts map[string]int) error {
+	defer observe("UpdateAccountStats", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	return updateAccountStats(ctx, handle, uuid, stats, voucherCounts)
+}
+
+func updateAccountStats(ctx context.Context, q querier, uuid []byte, stats defs.GameStats, voucherCounts map[string]int) error {
 	var columns = []string{"playTime", "battles", "classicSessionsPlayed", "sessionsWon", "highestEndlessWave", "highestLevel", "pokemonSeen", "pokemonDefeated", "pokemonCaught", "pokemonHatched", "eggsPulled", "regularVouchers", "plusVouchers", "premiumVouchers", "goldenVouchers"}
 
 	var statCols []string
@@ -528,7 +653,7 @@ func UpdateAccountStats(uuid []byte, stats defs.GameStats, voucherCounts map[str
 		query += col + " = ?"
 	}
 
-	_, err := handle.Exec(query, statArgs...)
+	_, err := q.ExecContext(ctx, query, statArgs...)
 	if err != nil {
 		return err
 	}
@@ -536,8 +661,13 @@ func UpdateAccountStats(uuid []byte, stats defs.GameStats, voucherCounts map[str
 	return nil
 }
 
-func SetAccountBanned(uuid []byte, banned bool) error {
-	_, err := handle.Exec("UPDATE accounts SET banned = ? WHERE uuid = ?", banned, uuid)
+func SetAccountBanned(ctx context.Context, uuid []byte, banned bool) error {
+	defer observe("SetAccountBanned", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := handle.ExecContext(ctx, "UPDATE accounts SET banned = ? WHERE uuid = ?", banned, uuid)
 	if err != nil {
 		return err
 	}
@@ -545,9 +675,14 @@ func SetAccountBanned(uuid []byte, banned bool) error {
 	return nil
 }
 
-func FetchAccountKeySaltFromUsername(username string) ([]byte, []byte, error) {
+func FetchAccountKeySaltFromUsername(ctx context.Context, username string) ([]byte, []byte, error) {
+	defer observe("FetchAccountKeySaltFromUsername", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var key, salt []byte
-	err := handle.QueryRow("SELECT hash, salt FROM accounts WHERE username = ?", username).Scan(&key, &salt)
+	err := handle.QueryRowContext(ctx, "SELECT hash, salt FROM accounts WHERE username = ?", username).Scan(&key, &salt)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -555,8 +690,13 @@ func FetchAccountKeySaltFromUsername(username string) ([]byte, []byte, error) {
 	return key, salt, nil
 }
 
-func FetchTrainerIds(uuid []byte) (trainerId, secretId int, err error) {
-	err = handle.QueryRow("SELECT trainerId, secretId FROM accounts WHERE uuid = ?", uuid).Scan(&trainerId, &secretId)
+func FetchTrainerIds(ctx context.Context, uuid []byte) (trainerId, secretId int, err error) {
+	defer observe("FetchTrainerIds", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	err = handle.QueryRowContext(ctx, "SELECT trainerId, secretId FROM accounts WHERE uuid = ?", uuid).Scan(&trainerId, &secretId)
 	if err != nil {
 		return 0, 0, err
 	}
@@ -564,8 +704,13 @@ func FetchTrainerIds(uuid []byte) (trainerId, secretId int, err error) {
 	return trainerId, secretId, nil
 }
 
-func UpdateTrainerIds(trainerId, secretId int, uuid []byte) error {
-	_, err := handle.Exec("UPDATE accounts SET trainerId = ?, secretId = ? WHERE uuid = ?", trainerId, secretId, uuid)
+func UpdateTrainerIds(ctx context.Context, trainerId, secretId int, uuid []byte) error {
+	defer observe("UpdateTrainerIds", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := handle.ExecContext(ctx, "UPDATE accounts SET trainerId = ?, secretId = ? WHERE uuid = ?", trainerId, secretId, uuid)
 	if err != nil {
 		return err
 	}
@@ -573,12 +718,17 @@ func UpdateTrainerIds(trainerId, secretId int, uuid []byte) error {
 	return nil
 }
 
-func IsActiveSession(uuid []byte, sessionId string) (bool, error) {
+func IsActiveSession(ctx context.Context, uuid []byte, sessionId string) (bool, error) {
+	defer observe("IsActiveSession", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var id string
-	err := handle.QueryRow("SELECT clientSessionId FROM activeClientSessions WHERE uuid = ?", uuid).Scan(&id)
+	err := handle.QueryRowContext(ctx, "SELECT clientSessionId FROM activeClientSessions WHERE uuid = ?", uuid).Scan(&id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			err = UpdateActiveSession(uuid, sessionId)
+			err = UpdateActiveSession(ctx, uuid, sessionId)
 			if err != nil {
 				return false, err
 			}
@@ -592,8 +742,28 @@ func IsActiveSession(uuid []byte, sessionId string) (bool, error) {
 	return id == "" || id == sessionId, nil
 }
 
-func UpdateActiveSession(uuid []byte, clientSessionId string) error {
-	_, err := handle.Exec("INSERT INTO activeClientSessions (uuid, clientSessionId) VALUES (?, ?) ON DUPLICATE KEY UPDATE clientSessionId = ?", uuid, clientSessionId, clientSessionId)
+func FetchActiveSession(ctx context.Context, uuid []byte) (string, error) {
+	defer observe("FetchActiveSession", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var id string
+	err := handle.QueryRowContext(ctx, "SELECT clientSessionId FROM activeClientSessions WHERE uuid = ?", uuid).Scan(&id)
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+func UpdateActiveSession(ctx context.Context, uuid []byte, clientSessionId string) error {
+	defer observe("UpdateActiveSession", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := handle.ExecContext(ctx, "INSERT INTO activeClientSessions (uuid, clientSessionId) VALUES (?, ?) ON DUPLICATE KEY UPDATE clientSessionId = ?", uuid, clientSessionId, clientSessionId)
 	if err != nil {
 		return err
 	}
@@ -639,10 +809,15 @@ func UpdateActiveSession(uuid []byte, clientSessionId string) error {
 // }
 
 // 위 함수의 기존 함수.
-func FetchUUIDFromToken(token []byte) ([]byte, error) {
+func FetchUUIDFromToken(ctx context.Context, token []byte) ([]byte, error) {
+	defer observe("FetchUUIDFromToken", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var uuid []byte
 	//user info DB에서 조회. 따라서 cache setting 필요.
-	err := handle.QueryRow("SELECT uuid FROM sessions WHERE token = ?", token).Scan(&uuid)
+	err := handle.QueryRowContext(ctx, "SELECT uuid FROM sessions WHERE token = ?", token).Scan(&uuid)
 	if err != nil {
 		return nil, err
 	}
@@ -650,8 +825,42 @@ func FetchUUIDFromToken(token []byte) ([]byte, error) {
 	return uuid, nil
 }
 
-func RemoveSessionFromToken(token []byte) error {
-	_, err := handle.Exec("DELETE FROM sessions WHERE token = ?", token)
+// FetchLiveSessionTokens returns the unexpired login tokens of uuid.
+func FetchLiveSessionTokens(ctx context.Context, uuid []byte) ([]defs.SessionTokenRow, error) {
+	defer observe("FetchLiveSessionTokens", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var tokens []defs.SessionTokenRow
+
+	results, err := handle.QueryContext(ctx, "SELECT token, expire FROM sessions WHERE uuid = ? AND expire > UTC_TIMESTAMP()", uuid)
+	if err != nil {
+		return tokens, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var token defs.SessionTokenRow
+		err = results.Scan(&token.Token, &token.Expire)
+		if err != nil {
+			return tokens, err
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	return tokens, results.Err()
+}
+
+func RemoveSessionFromToken(ctx context.Context, token []byte) error {
+	defer observe("RemoveSessionFromToken", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := handle.ExecContext(ctx, "DELETE FROM sessions WHERE token = ?", token)
 	if err != nil {
 		return err
 	}
@@ -659,9 +868,14 @@ func RemoveSessionFromToken(token []byte) error {
 	return nil
 }
 
-func FetchUsernameFromUUID(uuid []byte) (string, error) {
+func FetchUsernameFromUUID(ctx context.Context, uuid []byte) (string, error) {
+	defer observe("FetchUsernameFromUUID", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var username string
-	err := handle.QueryRow("SELECT username FROM accounts WHERE uuid = ?", uuid).Scan(&username)
+	err := handle.QueryRowContext(ctx, "SELECT username FROM accounts WHERE uuid = ?", uuid).Scan(&username)
 	if err != nil {
 		return "", err
 	}
@@ -669,9 +883,44 @@ func FetchUsernameFromUUID(uuid []byte) (string, error) {
 	return username, nil
 }
 
-func FetchUUIDFromUsername(username string) ([]byte, error) {
+// FetchRecentlyActiveUUIDs returns the uuids of up to limit accounts, most
+// recently active first.
+func FetchRecentlyActiveUUIDs(ctx context.Context, limit int) ([][]byte, error) {
+	defer observe("FetchRecentlyActiveUUIDs", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var uuids [][]byte
+
+	results, err := handle.QueryContext(ctx, "SELECT uuid FROM accounts WHERE lastActivity IS NOT NULL ORDER BY lastActivity DESC LIMIT ?", limit)
+	if err != nil {
+		return uuids, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var uuid []byte
+		err = results.Scan(&uuid)
+		if err != nil {
+			return uuids, err
+		}
+
+		uuids = append(uuids, uuid)
+	}
+
+	return uuids, results.Err()
+}
+
+func FetchUUIDFromUsername(ctx context.Context, username string) ([]byte, error) {
+	defer observe("FetchUUIDFromUsername", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var uuid []byte
-	err := handle.QueryRow("SELECT uuid FROM accounts WHERE username = ?", username).Scan(&uuid)
+	err := handle.QueryRowContext(ctx, "SELECT uuid FROM accounts WHERE username = ?", username).Scan(&uuid)
 	if err != nil {
 		return nil, err
 	}
@@ -679,8 +928,13 @@ func FetchUUIDFromUsername(username string) ([]byte, error) {
 	return uuid, nil
 }
 
-func RemoveDiscordIdByUUID(uuid []byte) error {
-	_, err := handle.Exec("UPDATE accounts SET discordId = NULL WHERE uuid = ?", uuid)
+func RemoveDiscordIdByUUID(ctx context.Context, uuid []byte) error {
+	defer observe("RemoveDiscordIdByUUID", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := handle.ExecContext(ctx, "UPDATE accounts SET discordId = NULL WHERE uuid = ?", uuid)
 	if err != nil {
 		return err
 	}
@@ -688,8 +942,13 @@ func RemoveDiscordIdByUUID(uuid []byte) error {
 	return nil
 }
 
-func RemoveGoogleIdByUUID(uuid []byte) error {
-	_, err := handle.Exec("UPDATE accounts SET googleId = NULL WHERE uuid = ?", uuid)
+func RemoveGoogleIdByUUID(ctx context.Context, uuid []byte) error {
+	defer observe("RemoveGoogleIdByUUID", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := handle.ExecContext(ctx, "UPDATE accounts SET googleId = NULL WHERE uuid = ?", uuid)
 	if err != nil {
 		return err
 	}
@@ -697,8 +956,13 @@ func RemoveGoogleIdByUUID(uuid []byte) error {
 	return nil
 }
 
-func RemoveGoogleIdByUsername(username string) error {
-	_, err := handle.Exec("UPDATE accounts SET googleId = NULL WHERE username = ?", username)
+func RemoveGoogleIdByUsername(ctx context.Context, username string) error {
+	defer observe("RemoveGoogleIdByUsername", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := handle.ExecContext(ctx, "UPDATE accounts SET googleId = NULL WHERE username = ?", username)
 	if err != nil {
 		return err
 	}
@@ -706,8 +970,13 @@ func RemoveGoogleIdByUsername(username string) error {
 	return nil
 }
 
-func RemoveDiscordIdByUsername(username string) error {
-	_, err := handle.Exec("UPDATE accounts SET discordId = NULL WHERE username = ?", username)
+func RemoveDiscordIdByUsername(ctx context.Context, username string) error {
+	defer observe("RemoveDiscordIdByUsername", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := handle.ExecContext(ctx, "UPDATE accounts SET discordId = NULL WHERE username = ?", username)
 	if err != nil {
 		return err
 	}
@@ -715,8 +984,13 @@ func RemoveDiscordIdByUsername(username string) error {
 	return nil
 }
 
-func RemoveDiscordIdByDiscordId(discordId string) error {
-	_, err := handle.Exec("UPDATE accounts SET discordId = NULL WHERE discordId = ?", discordId)
+func RemoveDiscordIdByDiscordId(ctx context.Context, discordId string) error {
+	defer observe("RemoveDiscordIdByDiscordId", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := handle.ExecContext(ctx, "UPDATE accounts SET discordId = NULL WHERE discordId = ?", discordId)
 	if err != nil {
 		return err
 	}
@@ -724,8 +998,13 @@ func RemoveDiscordIdByDiscordId(discordId string) error {
 	return nil
 }
 
-func RemoveGoogleIdByDiscordId(discordId string) error {
-	_, err := handle.Exec("UPDATE accounts SET googleId = NULL WHERE discordId = ?", discordId)
+func RemoveGoogleIdByDiscordId(ctx context.Context, discordId string) error {
+	defer observe("RemoveGoogleIdByDiscordId", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	_, err := handle.ExecContext(ctx, "UPDATE accounts SET googleId = NULL WHERE discordId = ?", discordId)
 	if err != nil {
 		return err
 	}
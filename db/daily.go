@@ -18,14 +18,23 @@
 package db
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
 	"math"
+	"time"
 
 	"github.com/pagefaultgames/rogueserver/defs"
 )
 
-func TryAddDailyRun(seed string) (string, error) {
+func TryAddDailyRun(ctx context.Context, seed string) (string, error) {
+	defer observe("TryAddDailyRun", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var actualSeed string
-	err := handle.QueryRow("INSERT INTO dailyRuns (seed, date) VALUES (?, UTC_DATE()) ON DUPLICATE KEY UPDATE date = date RETURNING seed", seed).Scan(&actualSeed)
+	err := handle.QueryRowContext(ctx, "INSERT INTO dailyRuns (seed, date) VALUES (?, UTC_DATE()) ON DUPLICATE KEY UPDATE date = date RETURNING seed", seed).Scan(&actualSeed)
 	if err != nil {
 		return "", err
 	}
@@ -33,9 +42,14 @@ func TryAddDailyRun(seed string) (string, error) {
 	return actualSeed, nil
 }
 
-func GetDailyRunSeed() (string, error) {
+func GetDailyRunSeed(ctx context.Context) (string, error) {
+	defer observe("GetDailyRunSeed", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var seed string
-	err := handle.QueryRow("SELECT seed FROM dailyRuns WHERE date = UTC_DATE()").Scan(&seed)
+	err := handle.QueryRowContext(ctx, "SELECT seed FROM dailyRuns WHERE date = UTC_DATE()").Scan(&seed)
 	if err != nil {
 		return "", err
 	}
@@ -43,29 +57,120 @@ func GetDailyRunSeed() (string, error) {
 	return seed, nil
 }
 
-func AddOrUpdateAccountDailyRun(uuid []byte, score int, wave int) error {
-	_, err := handle.Exec("INSERT INTO accountDailyRuns (uuid, date, score, wave, timestamp) VALUES (?, UTC_DATE(), ?, ?, UTC_TIMESTAMP()) ON DUPLICATE KEY UPDATE score = GREATEST(score, ?), wave = GREATEST(wave, ?), timestamp = IF(score < ?, UTC_TIMESTAMP(), timestamp)", uuid, score, wave, score, wave, score)
+// HasDailyRun reports whether today's daily run seed has been recorded.
+func HasDailyRun(ctx context.Context) (bool, error) {
+	defer observe("HasDailyRun", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var exists bool
+	err := handle.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM dailyRuns WHERE date = UTC_DATE())").Scan(&exists)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	return nil
+	return exists, nil
 }
 
-func FetchRankings(category int, page int) ([]defs.DailyRanking, error) {
-	var rankings []defs.DailyRanking
+// AddOrUpdateAccountDailyRun records a daily run result, keeping the best
+// score and wave of the day. It returns the date of the daily run.
+func AddOrUpdateAccountDailyRun(ctx context.Context, uuid []byte, score int, wave int) (time.Time, error) {
+	defer observe("AddOrUpdateAccountDailyRun", time.Now())
 
-	offset := (page - 1) * 10
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	// assignments see the ones before them, so timestamp has to compare with
+	// the old score: it is when the best score was reached, which rankings
+	// break ties with and leaderboard rebuilds replay updates by
+	var date time.Time
+	err := handle.QueryRowContext(ctx, "INSERT INTO accountDailyRuns (uuid, date, score, wave, timestamp) VALUES (?, UTC_DATE(), ?, ?, UTC_TIMESTAMP()) ON DUPLICATE KEY UPDATE timestamp = IF(score < ?, UTC_TIMESTAMP(), timestamp), score = GREATEST(score, ?), wave = GREATEST(wave, ?) RETURNING date", uuid, score, wave, score, score, wave).Scan(&date)
+	if err != nil {
+		return date, err
+	}
+
+	return date, nil
+}
+
+// statRankingColumns are the accountStats columns ranked over all time, by
+// ranking category.
+var statRankingColumns = map[int]string{
+	4: "highestEndlessWave",
+	5: "sessionsWon",
+	6: "pokemonHatched",
+	7: "battles",
+}
+
+// Rankings order players the way the cache orders leaderboards, see
+// cache/leaderboard.go, and number them by position, so a page reads the same
+// whichever answers it: by score, then by who reached it first, then by wave
+// and last by username, compared byte by byte.
+const (
+	dailyRankingOrder     = "adr.score DESC, adr.timestamp, adr.wave DESC, CAST(a.username AS BINARY) DESC"
+	aggregateRankingOrder = "SUM(adr.score) DESC, MAX(adr.timestamp), CAST(a.username AS BINARY) DESC"
+)
+
+// rankedQuery returns a query of every player ranked in a category, with the
+// columns n (their place), uuid, username, score and wave. Daily runs are
+// ranked on the day start (0), or summed over the week (1) or month (2) that
+// starts on start or over all time (3); the other categories rank
+// accountStats columns.
+func rankedQuery(category int, start time.Time) (string, []any, error) {
+	day := start.Format(time.DateOnly)
+
+	if category == 0 {
+		return "SELECT ROW_NUMBER() OVER (ORDER BY " + dailyRankingOrder + ") AS n, adr.uuid, a.username, adr.score, adr.wave FROM accountDailyRuns adr JOIN accounts a ON adr.uuid = a.uuid WHERE adr.date = ? AND a.banned = 0", []any{day}, nil
+	}
+
+	if column, ok := statRankingColumns[category]; ok {
+		return fmt.Sprintf("SELECT ROW_NUMBER() OVER (ORDER BY s.%[1]s DESC, CAST(a.username AS BINARY) DESC) AS n, a.uuid, a.username, s.%[1]s AS score, 0 AS wave FROM accountStats s JOIN accounts a ON s.uuid = a.uuid WHERE s.%[1]s > 0 AND a.banned = 0", column), nil, nil
+	}
+
+	period, args, err := rankingPeriod(category, start)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return "SELECT ROW_NUMBER() OVER (ORDER BY " + aggregateRankingOrder + ") AS n, adr.uuid, a.username, SUM(adr.score) AS score, 0 AS wave FROM accountDailyRuns adr JOIN accounts a ON adr.uuid = a.uuid WHERE " + period + "a.banned = 0 GROUP BY adr.uuid, a.username", args, nil
+}
+
+// rankingPeriod returns the conditions, ending in AND, that pick the daily
+// runs summed up by the weekly (1), monthly (2) and all time (3) categories,
+// and their arguments.
+func rankingPeriod(category int, start time.Time) (string, []any, error) {
+	day := start.Format(time.DateOnly)
 
-	var query string
 	switch category {
-	case 0:
-		query = "SELECT RANK() OVER (ORDER BY adr.score DESC, adr.timestamp), a.username, adr.score, adr.wave FROM accountDailyRuns adr JOIN dailyRuns dr ON dr.date = adr.date JOIN accounts a ON adr.uuid = a.uuid WHERE dr.date = UTC_DATE() AND a.banned = 0 LIMIT 10 OFFSET ?"
 	case 1:
-		query = "SELECT RANK() OVER (ORDER BY SUM(adr.score) DESC, adr.timestamp), a.username, SUM(adr.score), 0 FROM accountDailyRuns adr JOIN dailyRuns dr ON dr.date = adr.date JOIN accounts a ON adr.uuid = a.uuid WHERE dr.date >= DATE_SUB(DATE(UTC_TIMESTAMP()), INTERVAL DAYOFWEEK(UTC_TIMESTAMP()) - 1 DAY) AND a.banned = 0 GROUP BY a.username ORDER BY 1 LIMIT 10 OFFSET ?"
+		return "adr.date >= ? AND adr.date < ? + INTERVAL 7 DAY AND ", []any{day, day}, nil
+	case 2:
+		return "adr.date >= ? AND adr.date < ? + INTERVAL 1 MONTH AND ", []any{day, day}, nil
+	case 3:
+		return "", nil, nil
+	}
+
+	return "", nil, fmt.Errorf("unknown ranking category %d", category)
+}
+
+// FetchRankings returns a page of the rankings of a category for the period
+// that starts on start, see rankedQuery.
+func FetchRankings(ctx context.Context, category int, start time.Time, page int) ([]defs.DailyRanking, error) {
+	defer observe("FetchRankings", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var rankings []defs.DailyRanking
+
+	ranked, args, err := rankedQuery(category, start)
+	if err != nil {
+		return rankings, err
 	}
 
-	results, err := handle.Query(query, offset)
+	offset := (page - 1) * 10
+
+	results, err := handle.QueryContext(ctx, "WITH ranked AS ("+ranked+") SELECT n, username, score, wave FROM ranked ORDER BY n LIMIT 10 OFFSET ?", append(args, offset)...)
 	if err != nil {
 		return rankings, err
 	}
@@ -85,20 +190,247 @@ func FetchRankings(category int, page int) ([]defs.DailyRanking, error) {
 	return rankings, nil
 }
 
-func FetchRankingPageCount(category int) (int, error) {
-	var query string
-	switch category {
-	case 0:
-		query = "SELECT COUNT(a.username) FROM accountDailyRuns adr JOIN dailyRuns dr ON dr.date = adr.date JOIN accounts a ON adr.uuid = a.uuid WHERE dr.date = UTC_DATE()"
-	case 1:
-		query = "SELECT COUNT(DISTINCT a.username) FROM accountDailyRuns adr JOIN dailyRuns dr ON dr.date = adr.date JOIN accounts a ON adr.uuid = a.uuid WHERE dr.date >= DATE_SUB(DATE(UTC_TIMESTAMP()), INTERVAL DAYOFWEEK(UTC_TIMESTAMP()) - 1 DAY)"
+// FetchRankingPageCount returns the number of pages of the rankings of a
+// category for the period that starts on start, see rankedQuery.
+func FetchRankingPageCount(ctx context.Context, category int, start time.Time) (int, error) {
+	defer observe("FetchRankingPageCount", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	ranked, args, err := rankedQuery(category, start)
+	if err != nil {
+		return 0, err
 	}
 
 	var recordCount int
-	err := handle.QueryRow(query).Scan(&recordCount)
+	err = handle.QueryRowContext(ctx, "WITH ranked AS ("+ranked+") SELECT COUNT(*) FROM ranked", args...).Scan(&recordCount)
 	if err != nil {
 		return 0, err
 	}
 
 	return int(math.Ceil(float64(recordCount) / 10)), nil
 }
+
+// FetchRankingAround returns the rankings of a category for the period that
+// starts on start, see rankedQuery, from around places above uuid to around
+// places below it. me is the index of uuid in them and players the number of
+// players ranked. A player without a ranking is reported as sql.ErrNoRows.
+func FetchRankingAround(ctx context.Context, category int, start time.Time, uuid []byte, around int) (rankings []defs.DailyRanking, me int, players int, err error) {
+	defer observe("FetchRankingAround", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	ranked, args, err := rankedQuery(category, start)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	args = append(args, uuid, uuid, around, around)
+
+	results, err := handle.QueryContext(ctx, "WITH ranked AS ("+ranked+"), me AS (SELECT n FROM ranked WHERE uuid = ?) SELECT r.n, r.username, r.score, r.wave, r.uuid = ?, (SELECT COUNT(*) FROM ranked) FROM ranked r JOIN me ON r.n BETWEEN me.n - ? AND me.n + ? ORDER BY r.n", args...)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	defer results.Close()
+
+	me = -1
+	for results.Next() {
+		var ranking defs.DailyRanking
+		var isMe bool
+		err = results.Scan(&ranking.Rank, &ranking.Username, &ranking.Score, &ranking.Wave, &isMe, &players)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		if isMe {
+			me = len(rankings)
+		}
+
+		rankings = append(rankings, ranking)
+	}
+
+	err = results.Err()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	if me < 0 {
+		return nil, 0, 0, sql.ErrNoRows
+	}
+
+	return rankings, me, players, nil
+}
+
+// FetchDailyRunHistory returns a page of the daily runs before today, newest
+// first, with their participant counts and winners.
+func FetchDailyRunHistory(ctx context.Context, page int) ([]defs.DailyRunHistory, error) {
+	defer observe("FetchDailyRunHistory", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	history := []defs.DailyRunHistory{}
+
+	offset := (page - 1) * 10
+
+	// only the runs of the days on the page are ranked
+	results, err := handle.QueryContext(ctx, `WITH days AS (SELECT date, seed FROM dailyRuns WHERE date < UTC_DATE() ORDER BY date DESC LIMIT 10 OFFSET ?),
+		runs AS (SELECT adr.date, a.username, adr.score, adr.wave, ROW_NUMBER() OVER (PARTITION BY adr.date ORDER BY `+dailyRankingOrder+`) AS n, COUNT(*) OVER (PARTITION BY adr.date) AS participants FROM days JOIN accountDailyRuns adr ON adr.date = days.date JOIN accounts a ON a.uuid = adr.uuid WHERE a.banned = 0)
+		SELECT days.date, days.seed, COALESCE(runs.participants, 0), runs.username, runs.score, runs.wave FROM days LEFT JOIN runs ON runs.date = days.date AND runs.n = 1 ORDER BY days.date DESC`, offset)
+	if err != nil {
+		return history, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var day defs.DailyRunHistory
+		var date time.Time
+		var username sql.NullString
+		var score, wave sql.NullInt64
+		err = results.Scan(&date, &day.Seed, &day.Participants, &username, &score, &wave)
+		if err != nil {
+			return history, err
+		}
+
+		day.Date = date.Format(time.DateOnly)
+		if username.Valid {
+			day.Winner = &defs.DailyRanking{
+				Rank:     1,
+				Username: username.String,
+				Score:    int(score.Int64),
+				Wave:     int(wave.Int64),
+			}
+		}
+
+		history = append(history, day)
+	}
+
+	return history, results.Err()
+}
+
+// StreamDailyRanking calls fn with every ranking of the daily run on date,
+// best first, along with when the score was reached.
+func StreamDailyRanking(ctx context.Context, date time.Time, fn func(defs.DailyRanking, time.Time) error) error {
+	defer observe("StreamDailyRanking", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, exportTimeout)
+	defer cancel()
+
+	results, err := handle.QueryContext(ctx, "SELECT ROW_NUMBER() OVER (ORDER BY "+dailyRankingOrder+") AS n, a.username, adr.score, adr.wave, adr.timestamp FROM accountDailyRuns adr JOIN accounts a ON adr.uuid = a.uuid WHERE adr.date = ? AND a.banned = 0 ORDER BY n", date.Format(time.DateOnly))
+	if err != nil {
+		return err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var ranking defs.DailyRanking
+		var timestamp time.Time
+		err = results.Scan(&ranking.Rank, &ranking.Username, &ranking.Score, &ranking.Wave, &timestamp)
+		if err != nil {
+			return err
+		}
+
+		err = fn(ranking, timestamp)
+		if err != nil {
+			return err
+		}
+	}
+
+	return results.Err()
+}
+
+// leaderboardQuery returns a query of the leaderboard entries of a category,
+// with the columns username, score, wave and when the score was reached, and
+// its arguments. The players and scores are those of rankedQuery, and a
+// summed up score counts as reached with the last daily run that added to
+// it. The accountStats categories have no such time and get NULL. filter is
+// added to its conditions.
+func leaderboardQuery(category int, start time.Time, filter string) (string, []any, error) {
+	if category == 0 {
+		return "SELECT a.username, adr.score, adr.wave, adr.timestamp FROM accountDailyRuns adr JOIN accounts a ON a.uuid = adr.uuid WHERE adr.date = ? AND a.banned = 0" + filter, []any{start.Format(time.DateOnly)}, nil
+	}
+
+	if column, ok := statRankingColumns[category]; ok {
+		return fmt.Sprintf("SELECT a.username, s.%[1]s, 0, NULL FROM accountStats s JOIN accounts a ON a.uuid = s.uuid WHERE s.%[1]s > 0 AND a.banned = 0", column) + filter, nil, nil
+	}
+
+	period, args, err := rankingPeriod(category, start)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return "SELECT a.username, SUM(adr.score), 0, MAX(adr.timestamp) FROM accountDailyRuns adr JOIN accounts a ON a.uuid = adr.uuid WHERE " + period + "a.banned = 0" + filter + " GROUP BY adr.uuid, a.username", args, nil
+}
+
+// FetchLeaderboard returns the leaderboard entries of a category for the
+// period that starts on start, see leaderboardQuery.
+func FetchLeaderboard(ctx context.Context, category int, start time.Time) ([]defs.LeaderboardEntry, error) {
+	defer observe("FetchLeaderboard", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	query, args, err := leaderboardQuery(category, start, "")
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := handle.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer results.Close()
+
+	var entries []defs.LeaderboardEntry
+	for results.Next() {
+		entry, err := scanLeaderboardEntry(results)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, results.Err()
+}
+
+// FetchLeaderboardEntry returns the leaderboard entry of uuid in a category
+// for the period that starts on start. An account without one is reported as
+// sql.ErrNoRows.
+func FetchLeaderboardEntry(ctx context.Context, category int, start time.Time, uuid []byte) (defs.LeaderboardEntry, error) {
+	defer observe("FetchLeaderboardEntry", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	query, args, err := leaderboardQuery(category, start, " AND a.uuid = ?")
+	if err != nil {
+		return defs.LeaderboardEntry{}, err
+	}
+
+	return scanLeaderboardEntry(handle.QueryRowContext(ctx, query, append(args, uuid)...))
+}
+
+// scanLeaderboardEntry reads a row of leaderboardQuery. Entries without a
+// time count as reached at the unix epoch, so they tie on it.
+func scanLeaderboardEntry(row interface{ Scan(...any) error }) (defs.LeaderboardEntry, error) {
+	var entry defs.LeaderboardEntry
+	var timestamp sql.NullTime
+	err := row.Scan(&entry.Username, &entry.Score, &entry.Wave, &timestamp)
+	if err != nil {
+		return entry, err
+	}
+
+	entry.Timestamp = time.Unix(0, 0).UTC()
+	if timestamp.Valid {
+		entry.Timestamp = timestamp.Time
+	}
+
+	return entry, nil
+}
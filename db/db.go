@@ -18,108 +18,108 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/pagefaultgames/rogueserver/config"
 )
 
 var handle *sql.DB
 
-func Init(username, password, protocol, address, database string) error {
-	var err error
-
-	handle, err = sql.Open("mysql", username+":"+password+"@"+protocol+"("+address+")/"+database+"?parseTime=true")
-	if err != nil {
-		return fmt.Errorf("failed to open database connection: %s", err)
-	}
+// how long a query function may take, on top of the deadline of its context
+var queryTimeout = 10 * time.Second
 
-	conns := 64
+// how long a query streamed out to a client may take, which is read as fast as
+// the client takes it
+var exportTimeout = 5 * time.Minute
 
-	handle.SetMaxOpenConns(conns)
-	handle.SetMaxIdleConns(conns)
+// where system saves go when S3 is in use
+var s3Bucket, s3Endpoint string
 
-	tx, err := handle.Begin()
-	if err != nil {
-		log.Fatal(err)
-	}
+// querier is implemented by both *sql.DB and *sql.Tx, so the same statements
+// can run on their own or as part of a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
 
-	err = setupDb(tx)
+// inTx runs fn in a transaction that is committed if fn returns nil and
+// rolled back otherwise.
+func inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := handle.BeginTx(ctx, nil)
 	if err != nil {
-		tx.Rollback()
-		log.Fatal(err)
+		return err
 	}
+	defer tx.Rollback()
 
-	err = tx.Commit()
+	err = fn(tx)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
-func setupDb(tx *sql.Tx) error {
-	queries := []string{
-		// MIGRATION 000
-
-		`CREATE TABLE IF NOT EXISTS accounts (uuid BINARY(16) NOT NULL PRIMARY KEY, username VARCHAR(16) UNIQUE NOT NULL, hash BINARY(32) NOT NULL, salt BINARY(16) NOT NULL, registered TIMESTAMP NOT NULL, lastLoggedIn TIMESTAMP DEFAULT NULL, lastActivity TIMESTAMP DEFAULT NULL, banned TINYINT(1) NOT NULL DEFAULT 0, trainerId SMALLINT(5) UNSIGNED DEFAULT 0, secretId SMALLINT(5) UNSIGNED DEFAULT 0)`,
-		`CREATE INDEX IF NOT EXISTS accountsByActivity ON accounts (lastActivity)`,
-
-		`CREATE TABLE IF NOT EXISTS sessions (token BINARY(32) NOT NULL PRIMARY KEY, uuid BINARY(16) NOT NULL, active TINYINT(1) NOT NULL DEFAULT 0, expire TIMESTAMP DEFAULT NULL, CONSTRAINT sessions_ibfk_1 FOREIGN KEY (uuid) REFERENCES accounts (uuid) ON DELETE CASCADE ON UPDATE CASCADE)`,
-		`CREATE INDEX IF NOT EXISTS sessionsByUuid ON sessions (uuid)`,
-
-		`CREATE TABLE IF NOT EXISTS accountStats (uuid BINARY(16) NOT NULL PRIMARY KEY, playTime INT(11) NOT NULL DEFAULT 0, battles INT(11) NOT NULL DEFAULT 0, classicSessionsPlayed INT(11) NOT NULL DEFAULT 0, sessionsWon INT(11) NOT NULL DEFAULT 0, highestEndlessWave INT(11) NOT NULL DEFAULT 0, highestLevel INT(11) NOT NULL DEFAULT 0, pokemonSeen INT(11) NOT NULL DEFAULT 0, pokemonDefeated INT(11) NOT NULL DEFAULT 0, pokemonCaught INT(11) NOT NULL DEFAULT 0, pokemonHatched INT(11) NOT NULL DEFAULT 0, eggsPulled INT(11) NOT NULL DEFAULT 0, regularVouchers INT(11) NOT NULL DEFAULT 0, plusVouchers INT(11) NOT NULL DEFAULT 0, premiumVouchers INT(11) NOT NULL DEFAULT 0, goldenVouchers INT(11) NOT NULL DEFAULT 0, CONSTRAINT accountStats_ibfk_1 FOREIGN KEY (uuid) REFERENCES accounts (uuid) ON DELETE CASCADE ON UPDATE CASCADE)`,
-
-		`CREATE TABLE IF NOT EXISTS accountCompensations (id INT(11) NOT NULL AUTO_INCREMENT PRIMARY KEY, uuid BINARY(16) NOT NULL, voucherType INT(11) NOT NULL, count INT(11) NOT NULL DEFAULT 1, claimed BIT(1) NOT NULL DEFAULT b'0', CONSTRAINT accountCompensations_ibfk_1 FOREIGN KEY (uuid) REFERENCES accounts (uuid) ON DELETE CASCADE ON UPDATE CASCADE)`,
-		`CREATE INDEX IF NOT EXISTS accountCompensationsByUuid ON accountCompensations (uuid)`,
-
-		`CREATE TABLE IF NOT EXISTS dailyRuns (date DATE NOT NULL PRIMARY KEY, seed CHAR(24) CHARACTER SET ascii COLLATE ascii_bin NOT NULL)`,
-		`CREATE INDEX IF NOT EXISTS dailyRunsByDateAndSeed ON dailyRuns (date, seed)`,
-
-		`CREATE TABLE IF NOT EXISTS dailyRunCompletions (uuid BINARY(16) NOT NULL, seed CHAR(24) CHARACTER SET ascii COLLATE ascii_bin NOT NULL, mode INT(11) NOT NULL DEFAULT 0, score INT(11) NOT NULL DEFAULT 0, timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (uuid, seed), CONSTRAINT dailyRunCompletions_ibfk_1 FOREIGN KEY (uuid) REFERENCES accounts (uuid) ON DELETE CASCADE ON UPDATE CASCADE)`,
-		`CREATE INDEX IF NOT EXISTS dailyRunCompletionsByUuidAndSeed ON dailyRunCompletions (uuid, seed)`,
-
-		`CREATE TABLE IF NOT EXISTS accountDailyRuns (uuid BINARY(16) NOT NULL, date DATE NOT NULL, score INT(11) NOT NULL DEFAULT 0, wave INT(11) NOT NULL DEFAULT 0, timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (uuid, date), CONSTRAINT accountDailyRuns_ibfk_1 FOREIGN KEY (uuid) REFERENCES accounts (uuid) ON DELETE CASCADE ON UPDATE CASCADE, CONSTRAINT accountDailyRuns_ibfk_2 FOREIGN KEY (date) REFERENCES dailyRuns (date) ON DELETE NO ACTION ON UPDATE NO ACTION)`,
-		`CREATE INDEX IF NOT EXISTS accountDailyRunsByDate ON accountDailyRuns (date)`,
+// Ping checks that the database is reachable.
+func Ping(ctx context.Context) error {
+	return handle.PingContext(ctx)
+}
 
-		`CREATE TABLE IF NOT EXISTS systemSaveData (uuid BINARY(16) PRIMARY KEY, data LONGBLOB, timestamp TIMESTAMP, FOREIGN KEY (uuid) REFERENCES accounts (uuid) ON DELETE CASCADE ON UPDATE CASCADE)`,
+// Use runs the queries of the package on h, a connection opened elsewhere,
+// like a stub database of tests, instead of one opened by Open.
+func Use(h *sql.DB) {
+	handle = h
+}
 
-		`CREATE TABLE IF NOT EXISTS sessionSaveData (uuid BINARY(16), slot TINYINT, data LONGBLOB, timestamp TIMESTAMP, PRIMARY KEY (uuid, slot), FOREIGN KEY (uuid) REFERENCES accounts (uuid) ON DELETE CASCADE ON UPDATE CASCADE)`,
+// Open connects to the database without touching the schema.
+func Open(cfg config.DB, s3 config.S3) error {
+	var err error
 
-		// ----------------------------------
-		// MIGRATION 001
+	handle, err = sql.Open("mysql", cfg.User+":"+cfg.Password+"@"+cfg.Proto+"("+cfg.Addr+")/"+cfg.Name+"?parseTime=true")
+	if err != nil {
+		return fmt.Errorf("failed to open database connection: %s", err)
+	}
 
-		`ALTER TABLE sessions DROP COLUMN IF EXISTS active`,
-		`CREATE TABLE IF NOT EXISTS activeClientSessions (uuid BINARY(16) NOT NULL PRIMARY KEY, clientSessionId VARCHAR(32) NOT NULL, FOREIGN KEY (uuid) REFERENCES accounts (uuid) ON DELETE CASCADE ON UPDATE CASCADE)`,
+	handle.SetMaxOpenConns(cfg.MaxConns)
+	handle.SetMaxIdleConns(cfg.MaxConns)
 
-		// ----------------------------------
-		// MIGRATION 002
+	queryTimeout = cfg.QueryTimeout
+	exportTimeout = cfg.ExportTimeout
 
-		`DROP TABLE accountCompensations`,
+	historyVersions = cfg.HistoryVersions
+	historyDays = cfg.HistoryDays
 
-		// ----------------------------------
-		// MIGRATION 003
+	s3Bucket = s3.Bucket
+	s3Endpoint = s3.Endpoint
 
-		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS discordId VARCHAR(32) UNIQUE DEFAULT NULL`,
-		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS googleId VARCHAR(32) UNIQUE DEFAULT NULL`,
+	return nil
+}
 
-		// ----------------------------------
-		// MIGRATION 004
+// Init connects to the database and brings its schema up to date, or only
+// checks that it is when cfg.AutoMigrate is off.
+func Init(cfg config.DB, s3 config.S3) error {
+	err := Open(cfg, s3)
+	if err != nil {
+		return err
+	}
 
-		`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS isInLocalDb TINYINT(1) NOT NULL DEFAULT 1`,
+	ctx := context.Background()
 
-		// ----------------------------------
-		// MIGRATION 005
+	if cfg.AutoMigrate {
+		_, err = MigrateUp(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to migrate database: %w", err)
+		}
 
-		`ALTER TABLE accounts DROP COLUMN IF EXISTS isInLocalDb`,
+		return nil
 	}
 
-	for _, q := range queries {
-		_, err := tx.Exec(q)
-		if err != nil {
-			return fmt.Errorf("failed to execute query: %w, query: %s", err, q)
-		}
+	err = checkSchema(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check database schema: %w", err)
 	}
 
 	return nil
@@ -17,9 +17,19 @@
 
 package db
 
-func FetchPlayerCount() (int, error) {
+import (
+	"context"
+	"time"
+)
+
+func FetchPlayerCount(ctx context.Context) (int, error) {
+	defer observe("FetchPlayerCount", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var playerCount int
-	err := handle.QueryRow("SELECT COUNT(*) FROM accounts WHERE lastActivity > DATE_SUB(UTC_TIMESTAMP(), INTERVAL 5 MINUTE)").Scan(&playerCount)
+	err := handle.QueryRowContext(ctx, "SELECT COUNT(*) FROM accounts WHERE lastActivity > DATE_SUB(UTC_TIMESTAMP(), INTERVAL 5 MINUTE)").Scan(&playerCount)
 	if err != nil {
 		return 0, err
 	}
@@ -27,9 +37,14 @@ func FetchPlayerCount() (int, error) {
 	return playerCount, nil
 }
 
-func FetchBattleCount() (int, error) {
+func FetchBattleCount(ctx context.Context) (int, error) {
+	defer observe("FetchBattleCount", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var battleCount int
-	err := handle.QueryRow("SELECT COALESCE(SUM(s.battles), 0) FROM accountStats s JOIN accounts a ON a.uuid = s.uuid WHERE a.banned = 0").Scan(&battleCount)
+	err := handle.QueryRowContext(ctx, "SELECT COALESCE(SUM(s.battles), 0) FROM accountStats s JOIN accounts a ON a.uuid = s.uuid WHERE a.banned = 0").Scan(&battleCount)
 	if err != nil {
 		return 0, err
 	}
@@ -37,9 +52,14 @@ func FetchBattleCount() (int, error) {
 	return battleCount, nil
 }
 
-func FetchClassicSessionCount() (int, error) {
+func FetchClassicSessionCount(ctx context.Context) (int, error) {
+	defer observe("FetchClassicSessionCount", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var classicSessionCount int
-	err := handle.QueryRow("SELECT COALESCE(SUM(s.classicSessionsPlayed), 0) FROM accountStats s JOIN accounts a ON a.uuid = s.uuid WHERE a.banned = 0").Scan(&classicSessionCount)
+	err := handle.QueryRowContext(ctx, "SELECT COALESCE(SUM(s.classicSessionsPlayed), 0) FROM accountStats s JOIN accounts a ON a.uuid = s.uuid WHERE a.banned = 0").Scan(&classicSessionCount)
 	if err != nil {
 		return 0, err
 	}
@@ -0,0 +1,215 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/defs"
+)
+
+// Before a save is replaced or deleted it is archived, so a corrupted or
+// malicious upload can be undone. Of each save the historyVersions newest
+// archived versions are kept, plus the last version of each of the past
+// historyDays days, today included, as a daily checkpoint. Archived versions
+// are copied as stored, compressed. System saves kept in S3 have no history
+// here; use bucket versioning for them.
+var (
+	historyVersions = 10
+	historyDays     = 7
+)
+
+// SystemSlot stands for the system save where the history takes a session slot.
+const SystemSlot = -1
+
+// SaveVersion describes an archived version of a save.
+type SaveVersion struct {
+	ID         int64     `json:"id"`
+	Saved      time.Time `json:"saved"`    // when the version was stored
+	Archived   time.Time `json:"archived"` // when it was replaced or deleted
+	Size       int       `json:"size"`     // compressed, in bytes
+	Checkpoint bool      `json:"checkpoint"`
+}
+
+// saveRef locates the save in a slot and its history.
+type saveRef struct {
+	table, history string
+	columns        string // the key columns of both tables
+	where          string
+	args           []any
+}
+
+func saveOf(uuid []byte, slot int) saveRef {
+	if slot == SystemSlot {
+		return saveRef{"systemSaveData", "systemSaveHistory", "uuid", "uuid = ?", []any{uuid}}
+	}
+
+	return saveRef{"sessionSaveData", "sessionSaveHistory", "uuid, slot", "uuid = ? AND slot = ?", []any{uuid, slot}}
+}
+
+// archiveSave copies the save in slot, if there is one, to its history and
+// prunes what the history no longer needs to keep.
+func archiveSave(ctx context.Context, q querier, uuid []byte, slot int) error {
+	if historyVersions == 0 && historyDays == 0 {
+		return nil
+	}
+
+	ref := saveOf(uuid, slot)
+
+	result, err := q.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s (%s, data, saved, archived) SELECT %s, data, COALESCE(timestamp, UTC_TIMESTAMP()), UTC_TIMESTAMP() FROM %s WHERE %s", ref.history, ref.columns, ref.columns, ref.table, ref.where), ref.args...)
+	if err != nil {
+		return fmt.Errorf("failed to archive save: %w", err)
+	}
+
+	archived, err := result.RowsAffected()
+	if err != nil || archived == 0 {
+		return err
+	}
+
+	// the version number n counts from the newest, d within the day the
+	// version was stored; d = 1 is that day's checkpoint. The doubly nested
+	// select is materialized before anything is deleted.
+	_, err = q.ExecContext(ctx, fmt.Sprintf("DELETE FROM %[1]s WHERE id IN (SELECT id FROM (SELECT id, saved, ROW_NUMBER() OVER (ORDER BY id DESC) AS n, ROW_NUMBER() OVER (PARTITION BY DATE(saved) ORDER BY id DESC) AS d FROM %[1]s WHERE %[2]s) AS versions WHERE n > ? AND (d > 1 OR saved < UTC_DATE() - INTERVAL ? DAY))", ref.history, ref.where), append(ref.args, historyVersions, historyDays-1)...)
+	if err != nil {
+		return fmt.Errorf("failed to prune save history: %w", err)
+	}
+
+	return nil
+}
+
+// SaveHistory lists the archived versions of the save in slot, newest first.
+func SaveHistory(ctx context.Context, uuid []byte, slot int) ([]SaveVersion, error) {
+	defer observe("SaveHistory", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	ref := saveOf(uuid, slot)
+
+	rows, err := handle.QueryContext(ctx, fmt.Sprintf("SELECT id, saved, archived, LENGTH(data), ROW_NUMBER() OVER (PARTITION BY DATE(saved) ORDER BY id DESC) = 1 FROM %s WHERE %s ORDER BY id DESC", ref.history, ref.where), ref.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []SaveVersion{}
+	for rows.Next() {
+		var version SaveVersion
+		err = rows.Scan(&version.ID, &version.Saved, &version.Archived, &version.Size, &version.Checkpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		versions = append(versions, version)
+	}
+
+	return versions, rows.Err()
+}
+
+func readSaveVersion(ctx context.Context, q querier, uuid []byte, slot int, id int64) ([]byte, error) {
+	ref := saveOf(uuid, slot)
+
+	var data []byte
+	err := q.QueryRowContext(ctx, fmt.Sprintf("SELECT data FROM %s WHERE id = ? AND %s", ref.history, ref.where), append([]any{id}, ref.args...)...).Scan(&data)
+
+	return data, err
+}
+
+// ReadSystemSaveVersion returns an archived version of the system save. An
+// unknown version is reported as sql.ErrNoRows.
+func ReadSystemSaveVersion(ctx context.Context, uuid []byte, id int64) (defs.SystemSaveData, error) {
+	defer observe("ReadSystemSaveVersion", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var system defs.SystemSaveData
+
+	data, err := readSaveVersion(ctx, handle, uuid, SystemSlot, id)
+	if err != nil {
+		return system, err
+	}
+
+	err = decodeSave(data, &system)
+
+	return system, err
+}
+
+// ReadSessionSaveVersion returns an archived version of the session save in
+// slot. An unknown version is reported as sql.ErrNoRows.
+func ReadSessionSaveVersion(ctx context.Context, uuid []byte, slot int, id int64) (defs.SessionSaveData, error) {
+	defer observe("ReadSessionSaveVersion", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var session defs.SessionSaveData
+
+	data, err := readSaveVersion(ctx, handle, uuid, slot, id)
+	if err != nil {
+		return session, err
+	}
+
+	err = decodeSave(data, &session)
+
+	return session, err
+}
+
+// RestoreSaveVersion makes an archived version the current save in slot. The
+// save it replaces is archived like on any other write, so a restore can be
+// undone the same way. An unknown version is reported as sql.ErrNoRows.
+func RestoreSaveVersion(ctx context.Context, uuid []byte, slot int, id int64) error {
+	defer observe("RestoreSaveVersion", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	return inTx(ctx, func(tx *sql.Tx) error {
+		err := lockAccount(ctx, tx, uuid)
+		if err != nil {
+			return err
+		}
+
+		data, err := readSaveVersion(ctx, tx, uuid, slot, id)
+		if err != nil {
+			return err
+		}
+
+		err = archiveSave(ctx, tx, uuid, slot)
+		if err != nil {
+			return err
+		}
+
+		ref := saveOf(uuid, slot)
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("REPLACE INTO %s (%s, data, timestamp) VALUES (%s, ?, UTC_TIMESTAMP())", ref.table, ref.columns, placeholders(len(ref.args))), append(ref.args, data)...)
+
+		return err
+	})
+}
+
+func placeholders(n int) string {
+	if n == 0 {
+		return ""
+	}
+
+	return "?" + strings.Repeat(", ?", n-1)
+}
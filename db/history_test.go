@@ -0,0 +1,114 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestArchiveSave(t *testing.T) {
+	uuid := []byte("aaaaaaaaaaaaaaaa")
+
+	tests := []struct {
+		name     string
+		slot     int
+		versions int
+		days     int
+		archived int64 // rows copied to the history
+		expect   []string
+		args     [][]driver.Value
+	}{
+		{
+			name:     "system save",
+			slot:     SystemSlot,
+			versions: 10,
+			days:     7,
+			archived: 1,
+			expect: []string{
+				"INSERT INTO systemSaveHistory (uuid, data, saved, archived) SELECT uuid, data, COALESCE(timestamp, UTC_TIMESTAMP()), UTC_TIMESTAMP() FROM systemSaveData WHERE uuid = ?",
+				"DELETE FROM systemSaveHistory WHERE id IN (SELECT id FROM (SELECT id, saved, ROW_NUMBER() OVER (ORDER BY id DESC) AS n, ROW_NUMBER() OVER (PARTITION BY DATE(saved) ORDER BY id DESC) AS d FROM systemSaveHistory WHERE uuid = ?) AS versions WHERE n > ? AND (d > 1 OR saved < UTC_DATE() - INTERVAL ? DAY))",
+			},
+			args: [][]driver.Value{{uuid}, {uuid, 10, 6}},
+		},
+		{
+			name:     "session save",
+			slot:     2,
+			versions: 3,
+			days:     1,
+			archived: 1,
+			expect: []string{
+				"INSERT INTO sessionSaveHistory (uuid, slot, data, saved, archived) SELECT uuid, slot, data, COALESCE(timestamp, UTC_TIMESTAMP()), UTC_TIMESTAMP() FROM sessionSaveData WHERE uuid = ? AND slot = ?",
+				// only today's checkpoint is kept on top of the versions
+				"DELETE FROM sessionSaveHistory WHERE id IN (SELECT id FROM (SELECT id, saved, ROW_NUMBER() OVER (ORDER BY id DESC) AS n, ROW_NUMBER() OVER (PARTITION BY DATE(saved) ORDER BY id DESC) AS d FROM sessionSaveHistory WHERE uuid = ? AND slot = ?) AS versions WHERE n > ? AND (d > 1 OR saved < UTC_DATE() - INTERVAL ? DAY))",
+			},
+			args: [][]driver.Value{{uuid, 2}, {uuid, 2, 3, 0}},
+		},
+		{
+			name:     "no save to archive",
+			slot:     0,
+			versions: 10,
+			days:     7,
+			expect: []string{
+				"INSERT INTO sessionSaveHistory (uuid, slot, data, saved, archived) SELECT uuid, slot, data, COALESCE(timestamp, UTC_TIMESTAMP()), UTC_TIMESTAMP() FROM sessionSaveData WHERE uuid = ? AND slot = ?",
+			},
+			args: [][]driver.Value{{uuid, 0}},
+		},
+		{
+			name: "history disabled",
+			slot: SystemSlot,
+		},
+	}
+
+	versions, days := historyVersions, historyDays
+	t.Cleanup(func() { historyVersions, historyDays = versions, days })
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			historyVersions, historyDays = tt.versions, tt.days
+
+			for i, query := range tt.expect {
+				affected := tt.archived
+				if i > 0 {
+					affected = 0
+				}
+
+				mock.ExpectExec(query).WithArgs(tt.args[i]...).WillReturnResult(sqlmock.NewResult(0, affected))
+			}
+
+			err = archiveSave(context.Background(), conn, uuid, tt.slot)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = mock.ExpectationsWereMet()
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
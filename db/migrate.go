@@ -0,0 +1,362 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A migration changes the schema from version-1 to version. down undoes it
+// and is empty for migrations that can't be reverted.
+type migration struct {
+	version int
+	name    string
+	up      []string
+	down    []string
+}
+
+// checksum identifies the statements of up so changes to an applied
+// migration are noticed.
+func (m migration) checksum() string {
+	sum := sha256.Sum256([]byte(strings.Join(m.up, ";\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// how long to wait for another instance to finish migrating
+const migrationLockTimeout = time.Minute
+
+// ErrSchemaPending is returned by Init when migrations haven't been applied
+// and automatic migration is off.
+var ErrSchemaPending = errors.New("database schema is behind, run rogueserver migrate up")
+
+// Migration states reported by Migrations.
+const (
+	MigrationApplied  = "applied"
+	MigrationPending  = "pending"
+	MigrationDirty    = "dirty"    // failed halfway
+	MigrationModified = "modified" // changed since it was applied
+	MigrationUnknown  = "unknown"  // applied by a newer server
+)
+
+// MigrationStatus is the state of one schema version.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	State     string
+	AppliedAt *time.Time
+}
+
+// appliedMigration is a row of schema_migrations.
+type appliedMigration struct {
+	version   int
+	name      string
+	checksum  string
+	dirty     bool
+	appliedAt time.Time
+}
+
+// migrationConn is a connection holding the migration lock. Migrations run on
+// it and the lock goes away with it, even if the server dies.
+type migrationConn struct {
+	*sql.Conn
+}
+
+func lockMigrations(ctx context.Context) (*migrationConn, error) {
+	conn, err := handle.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connection: %w", err)
+	}
+
+	// named after the database, other databases on the server can migrate
+	var got sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(CONCAT('schema_migrations.', DATABASE()), ?)", int(migrationLockTimeout.Seconds())).Scan(&got)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to lock schema migrations: %w", err)
+	}
+
+	if got.Int64 != 1 {
+		conn.Close()
+		return nil, fmt.Errorf("timed out after %s waiting for another instance to finish migrating", migrationLockTimeout)
+	}
+
+	locked := migrationConn{conn}
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, checksum CHAR(64) NOT NULL, dirty TINYINT(1) NOT NULL DEFAULT 1, appliedAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)`)
+	if err != nil {
+		locked.unlock()
+		return nil, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	return &locked, nil
+}
+
+func (conn migrationConn) unlock() {
+	// a fresh context, the lock must go even if ctx was cancelled
+	conn.ExecContext(context.Background(), "DO RELEASE_LOCK(CONCAT('schema_migrations.', DATABASE()))")
+	conn.Close()
+}
+
+func (conn migrationConn) applied(ctx context.Context) (map[int]appliedMigration, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, name, checksum, dirty, appliedAt FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var m appliedMigration
+		err = rows.Scan(&m.version, &m.name, &m.checksum, &m.dirty, &m.appliedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+		}
+
+		applied[m.version] = m
+	}
+
+	return applied, rows.Err()
+}
+
+// run executes statements for m, with its row marked dirty until they have
+// all succeeded. done finishes the row once they have.
+func (conn migrationConn) run(ctx context.Context, m migration, statements []string, done string) error {
+	for _, statement := range statements {
+		_, err := conn.ExecContext(ctx, statement)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w, query: %s", m.version, m.name, err, statement)
+		}
+	}
+
+	_, err := conn.ExecContext(ctx, done, m.version)
+	if err != nil {
+		return fmt.Errorf("failed to record migration %d (%s): %w", m.version, m.name, err)
+	}
+
+	return nil
+}
+
+// verify refuses to touch a schema this server doesn't fully understand.
+func verify(applied map[int]appliedMigration) error {
+	known := make(map[int]migration, len(migrations))
+	for _, m := range migrations {
+		known[m.version] = m
+	}
+
+	latest := migrations[len(migrations)-1].version
+
+	var errs []error
+	for version, a := range applied {
+		m, ok := known[version]
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Errorf("database schema has migration %d (%s), this server only knows up to %d; upgrade the server", version, a.name, latest))
+		case a.dirty:
+			errs = append(errs, fmt.Errorf("migration %d (%s) failed halfway; repair the schema by hand and delete its row from schema_migrations", version, a.name))
+		case a.checksum != m.checksum():
+			errs = append(errs, fmt.Errorf("migration %d (%s) was changed after it was applied", version, m.name))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// MigrateUp applies all pending migrations in order and returns how many it
+// applied.
+func MigrateUp(ctx context.Context) (int, error) {
+	conn, err := lockMigrations(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.unlock()
+
+	applied, err := conn.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	err = verify(applied)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+
+		// DDL commits on its own, the row tells a failure halfway apart from
+		// a migration that never ran
+		_, err = conn.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, checksum, appliedAt) VALUES (?, ?, ?, UTC_TIMESTAMP())", m.version, m.name, m.checksum())
+		if err != nil {
+			return count, fmt.Errorf("failed to record migration %d (%s): %w", m.version, m.name, err)
+		}
+
+		start := time.Now()
+
+		err = conn.run(ctx, m, m.up, "UPDATE schema_migrations SET dirty = 0, appliedAt = UTC_TIMESTAMP() WHERE version = ?")
+		if err != nil {
+			return count, err
+		}
+
+		slog.Info("applied migration", "version", m.version, "name", m.name, "duration", time.Since(start).Round(time.Millisecond))
+		count++
+	}
+
+	return count, nil
+}
+
+// MigrateDown reverts the latest applied migration and returns its version,
+// 0 if there was none.
+func MigrateDown(ctx context.Context) (int, error) {
+	conn, err := lockMigrations(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.unlock()
+
+	applied, err := conn.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	err = verify(applied)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+
+		if len(m.down) == 0 {
+			return 0, fmt.Errorf("migration %d (%s) can't be reverted", m.version, m.name)
+		}
+
+		_, err = conn.ExecContext(ctx, "UPDATE schema_migrations SET dirty = 1 WHERE version = ?", m.version)
+		if err != nil {
+			return 0, fmt.Errorf("failed to record migration %d (%s): %w", m.version, m.name, err)
+		}
+
+		err = conn.run(ctx, m, m.down, "DELETE FROM schema_migrations WHERE version = ?")
+		if err != nil {
+			return 0, err
+		}
+
+		slog.Info("reverted migration", "version", m.version, "name", m.name)
+
+		return m.version, nil
+	}
+
+	return 0, nil
+}
+
+// Migrations returns the state of every migration this server knows of and
+// of those applied by newer ones, by version.
+func Migrations(ctx context.Context) ([]MigrationStatus, error) {
+	conn, err := lockMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.unlock()
+
+	applied, err := conn.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return migrationStatus(applied), nil
+}
+
+func migrationStatus(applied map[int]appliedMigration) []MigrationStatus {
+	list := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status := MigrationStatus{Version: m.version, Name: m.name, State: MigrationPending}
+
+		if a, ok := applied[m.version]; ok {
+			appliedAt := a.appliedAt
+			status.AppliedAt = &appliedAt
+
+			switch {
+			case a.dirty:
+				status.State = MigrationDirty
+			case a.checksum != m.checksum():
+				status.State = MigrationModified
+			default:
+				status.State = MigrationApplied
+			}
+
+			delete(applied, m.version)
+		}
+
+		list = append(list, status)
+	}
+
+	// applied by newer servers, after the known ones
+	unknown := make([]int, 0, len(applied))
+	for version := range applied {
+		unknown = append(unknown, version)
+	}
+	sort.Ints(unknown)
+
+	for _, version := range unknown {
+		a := applied[version]
+		list = append(list, MigrationStatus{Version: a.version, Name: a.name, State: MigrationUnknown, AppliedAt: &a.appliedAt})
+	}
+
+	return list
+}
+
+// checkSchema fails unless every migration has been applied cleanly.
+func checkSchema(ctx context.Context) error {
+	conn, err := lockMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.unlock()
+
+	applied, err := conn.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = verify(applied)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; !ok {
+			return ErrSchemaPending
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,286 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// testMigrations points the package at a stub database expecting the
+// migration lock and the read of schema_migrations, which returns applied.
+func testMigrations(t *testing.T, applied ...appliedMigration) sqlmock.Sqlmock {
+	t.Helper()
+
+	conn, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := handle
+	handle = conn
+	t.Cleanup(func() {
+		handle = previous
+		conn.Close()
+
+		err := mock.ExpectationsWereMet()
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	mock.ExpectQuery("SELECT GET_LOCK(CONCAT('schema_migrations.', DATABASE()), ?)").
+		WithArgs(int(migrationLockTimeout.Seconds())).
+		WillReturnRows(sqlmock.NewRows([]string{"got"}).AddRow(1))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, checksum CHAR(64) NOT NULL, dirty TINYINT(1) NOT NULL DEFAULT 1, appliedAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	rows := sqlmock.NewRows([]string{"version", "name", "checksum", "dirty", "appliedAt"})
+	for _, a := range applied {
+		rows.AddRow(a.version, a.name, a.checksum, a.dirty, a.appliedAt)
+	}
+
+	mock.ExpectQuery("SELECT version, name, checksum, dirty, appliedAt FROM schema_migrations").WillReturnRows(rows)
+
+	return mock
+}
+
+// appliedUpTo returns clean rows for the known migrations up to version.
+func appliedUpTo(version int) []appliedMigration {
+	var applied []appliedMigration
+	for _, m := range migrations {
+		if m.version > version {
+			break
+		}
+
+		applied = append(applied, appliedMigration{version: m.version, name: m.name, checksum: m.checksum(), appliedAt: time.Now()})
+	}
+
+	return applied
+}
+
+// expectMigration expects m to be recorded and applied.
+func expectMigration(mock sqlmock.Sqlmock, m migration) {
+	mock.ExpectExec("INSERT INTO schema_migrations (version, name, checksum, appliedAt) VALUES (?, ?, ?, UTC_TIMESTAMP())").
+		WithArgs(m.version, m.name, m.checksum()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	for _, statement := range m.up {
+		mock.ExpectExec(statement).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	mock.ExpectExec("UPDATE schema_migrations SET dirty = 0, appliedAt = UTC_TIMESTAMP() WHERE version = ?").
+		WithArgs(m.version).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func expectUnlock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("DO RELEASE_LOCK(CONCAT('schema_migrations.', DATABASE()))").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestMigrateUp(t *testing.T) {
+	latest := migrations[len(migrations)-1]
+
+	dirty := appliedUpTo(latest.version)
+	dirty[1].dirty = true
+
+	modified := appliedUpTo(latest.version)
+	modified[0].checksum = strings.Repeat("0", 64)
+
+	newer := append(appliedUpTo(latest.version), appliedMigration{version: latest.version + 1, name: "future", checksum: strings.Repeat("0", 64), appliedAt: time.Now()})
+
+	tests := []struct {
+		name    string
+		applied []appliedMigration
+		expect  func(mock sqlmock.Sqlmock)
+		count   int
+		err     string
+		cause   error // wrapped by the error, if set
+	}{
+		{
+			name: "new database",
+			expect: func(mock sqlmock.Sqlmock) {
+				for _, m := range migrations {
+					expectMigration(mock, m)
+				}
+			},
+			count: len(migrations),
+		},
+		{
+			name:    "pending migration",
+			applied: appliedUpTo(latest.version - 1),
+			expect: func(mock sqlmock.Sqlmock) {
+				expectMigration(mock, latest)
+			},
+			count: 1,
+		},
+		{
+			name:    "up to date",
+			applied: appliedUpTo(latest.version),
+		},
+		{
+			name:    "dirty migration",
+			applied: dirty,
+			err:     "failed halfway",
+		},
+		{
+			name:    "modified migration",
+			applied: modified,
+			err:     "was changed after it was applied",
+		},
+		{
+			name:    "migration of a newer server",
+			applied: newer,
+			err:     "upgrade the server",
+		},
+		{
+			// the row stays dirty
+			name:    "failure halfway",
+			applied: appliedUpTo(latest.version - 1),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("INSERT INTO schema_migrations (version, name, checksum, appliedAt) VALUES (?, ?, ?, UTC_TIMESTAMP())").
+					WithArgs(latest.version, latest.name, latest.checksum()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(latest.up[0]).WillReturnError(context.DeadlineExceeded)
+			},
+			err:   "deadline exceeded",
+			cause: context.DeadlineExceeded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := testMigrations(t, tt.applied...)
+			if tt.expect != nil {
+				tt.expect(mock)
+			}
+			expectUnlock(mock)
+
+			count, err := MigrateUp(context.Background())
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+
+			if tt.cause != nil && !errors.Is(err, tt.cause) {
+				t.Errorf("error %v doesn't wrap %v", err, tt.cause)
+			}
+
+			if count != tt.count {
+				t.Errorf("applied %d, want %d", count, tt.count)
+			}
+		})
+	}
+}
+
+func TestMigrateDown(t *testing.T) {
+	latest := migrations[len(migrations)-1]
+
+	mock := testMigrations(t, appliedUpTo(latest.version)...)
+	mock.ExpectExec("UPDATE schema_migrations SET dirty = 1 WHERE version = ?").
+		WithArgs(latest.version).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	for _, statement := range latest.down {
+		mock.ExpectExec(statement).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec("DELETE FROM schema_migrations WHERE version = ?").
+		WithArgs(latest.version).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectUnlock(mock)
+
+	version, err := MigrateDown(context.Background())
+	if err != nil || version != latest.version {
+		t.Errorf("reverted %d %v, want %d", version, err, latest.version)
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	latest := migrations[len(migrations)-1]
+
+	dirty := appliedUpTo(latest.version)
+	dirty[len(dirty)-1].dirty = true
+
+	tests := []struct {
+		name    string
+		applied []appliedMigration
+		err     string
+	}{
+		{"up to date", appliedUpTo(latest.version), ""},
+		{"pending migration", appliedUpTo(latest.version - 1), ErrSchemaPending.Error()},
+		{"dirty migration", dirty, "failed halfway"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := testMigrations(t, tt.applied...)
+			expectUnlock(mock)
+
+			err := checkSchema(context.Background())
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMigrationStatus(t *testing.T) {
+	applied := make(map[int]appliedMigration)
+	for _, a := range appliedUpTo(3) {
+		applied[a.version] = a
+	}
+
+	a := applied[2]
+	a.dirty = true
+	applied[2] = a
+
+	a = applied[3]
+	a.checksum = strings.Repeat("0", 64)
+	applied[3] = a
+
+	applied[100] = appliedMigration{version: 100, name: "future", appliedAt: time.Now()}
+	applied[99] = appliedMigration{version: 99, name: "future", appliedAt: time.Now()}
+
+	want := []string{MigrationApplied, MigrationDirty, MigrationModified}
+	for range migrations[3:] {
+		want = append(want, MigrationPending)
+	}
+	want = append(want, MigrationUnknown, MigrationUnknown)
+
+	list := migrationStatus(applied)
+	if len(list) != len(want) {
+		t.Fatalf("%d states, want %d", len(list), len(want))
+	}
+
+	for i, status := range list {
+		if status.State != want[i] {
+			t.Errorf("migration %d is %s, want %s", status.Version, status.State, want[i])
+		}
+
+		if (status.AppliedAt == nil) != (status.State == MigrationPending) {
+			t.Errorf("migration %d applied at %v", status.Version, status.AppliedAt)
+		}
+	}
+
+	if list[len(list)-2].Version != 99 || list[len(list)-1].Version != 100 {
+		t.Errorf("unknown migrations out of order: %+v", list[len(list)-2:])
+	}
+}
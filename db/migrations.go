@@ -0,0 +1,124 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+// migrations is the schema history, oldest first. A migration must never be
+// changed once released: its checksum is recorded when it is applied and a
+// mismatch keeps the server from starting. Add a new version instead.
+//
+// MariaDB commits every DDL statement on its own, so a migration that fails
+// halfway is left dirty and has to be cleaned up by hand, see checkSchema.
+// Keep statements idempotent (IF EXISTS, IF NOT EXISTS) where possible so a
+// rerun after fixing the cause is harmless.
+var migrations = []migration{
+	{
+		// everything before versioned migrations. It brings databases set up
+		// by any earlier release to the same state as a new one.
+		version: 1,
+		name:    "baseline",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS accounts (uuid BINARY(16) NOT NULL PRIMARY KEY, username VARCHAR(16) UNIQUE NOT NULL, hash BINARY(32) NOT NULL, salt BINARY(16) NOT NULL, registered TIMESTAMP NOT NULL, lastLoggedIn TIMESTAMP DEFAULT NULL, lastActivity TIMESTAMP DEFAULT NULL, banned TINYINT(1) NOT NULL DEFAULT 0, trainerId SMALLINT(5) UNSIGNED DEFAULT 0, secretId SMALLINT(5) UNSIGNED DEFAULT 0, discordId VARCHAR(32) UNIQUE DEFAULT NULL, googleId VARCHAR(32) UNIQUE DEFAULT NULL)`,
+			`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS discordId VARCHAR(32) UNIQUE DEFAULT NULL`,
+			`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS googleId VARCHAR(32) UNIQUE DEFAULT NULL`,
+			`ALTER TABLE accounts DROP COLUMN IF EXISTS isInLocalDb`,
+			`CREATE INDEX IF NOT EXISTS accountsByActivity ON accounts (lastActivity)`,
+
+			`CREATE TABLE IF NOT EXISTS sessions (token BINARY(32) NOT NULL PRIMARY KEY, uuid BINARY(16) NOT NULL, expire TIMESTAMP DEFAULT NULL, CONSTRAINT sessions_ibfk_1 FOREIGN KEY (uuid) REFERENCES accounts (uuid) ON DELETE CASCADE ON UPDATE CASCADE)`,
+			`ALTER TABLE sessions DROP COLUMN IF EXISTS active`,
+			`CREATE INDEX IF NOT EXISTS sessionsByUuid ON sessions (uuid)`,
+
+			`CREATE TABLE IF NOT EXISTS accountStats (uuid BINARY(16) NOT NULL PRIMARY KEY, playTime INT(11) NOT NULL DEFAULT 0, battles INT(11) NOT NULL DEFAULT 0, classicSessionsPlayed INT(11) NOT NULL DEFAULT 0, sessionsWon INT(11) NOT NULL DEFAULT 0, highestEndlessWave INT(11) NOT NULL DEFAULT 0, highestLevel INT(11) NOT NULL DEFAULT 0, pokemonSeen INT(11) NOT NULL DEFAULT 0, pokemonDefeated INT(11) NOT NULL DEFAULT 0, pokemonCaught INT(11) NOT NULL DEFAULT 0, pokemonHatched INT(11) NOT NULL DEFAULT 0, eggsPulled INT(11) NOT NULL DEFAULT 0, regularVouchers INT(11) NOT NULL DEFAULT 0, plusVouchers INT(11) NOT NULL DEFAULT 0, premiumVouchers INT(11) NOT NULL DEFAULT 0, goldenVouchers INT(11) NOT NULL DEFAULT 0, CONSTRAINT accountStats_ibfk_1 FOREIGN KEY (uuid) REFERENCES accounts (uuid) ON DELETE CASCADE ON UPDATE CASCADE)`,
+
+			`DROP TABLE IF EXISTS accountCompensations`,
+
+			`CREATE TABLE IF NOT EXISTS dailyRuns (date DATE NOT NULL PRIMARY KEY, seed CHAR(24) CHARACTER SET ascii COLLATE ascii_bin NOT NULL)`,
+			`CREATE INDEX IF NOT EXISTS dailyRunsByDateAndSeed ON dailyRuns (date, seed)`,
+
+			`CREATE TABLE IF NOT EXISTS dailyRunCompletions (uuid BINARY(16) NOT NULL, seed CHAR(24) CHARACTER SET ascii COLLATE ascii_bin NOT NULL, mode INT(11) NOT NULL DEFAULT 0, score INT(11) NOT NULL DEFAULT 0, timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (uuid, seed), CONSTRAINT dailyRunCompletions_ibfk_1 FOREIGN KEY (uuid) REFERENCES accounts (uuid) ON DELETE CASCADE ON UPDATE CASCADE)`,
+			`CREATE INDEX IF NOT EXISTS dailyRunCompletionsByUuidAndSeed ON dailyRunCompletions (uuid, seed)`,
+
+			`CREATE TABLE IF NOT EXISTS accountDailyRuns (uuid BINARY(16) NOT NULL, date DATE NOT NULL, score INT(11) NOT NULL DEFAULT 0, wave INT(11) NOT NULL DEFAULT 0, timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (uuid, date), CONSTRAINT accountDailyRuns_ibfk_1 FOREIGN KEY (uuid) REFERENCES accounts (uuid) ON DELETE CASCADE ON UPDATE CASCADE, CONSTRAINT accountDailyRuns_ibfk_2 FOREIGN KEY (date) REFERENCES dailyRuns (date) ON DELETE NO ACTION ON UPDATE NO ACTION)`,
+			`CREATE INDEX IF NOT EXISTS accountDailyRunsByDate ON accountDailyRuns (date)`,
+
+			`CREATE TABLE IF NOT EXISTS systemSaveData (uuid BINARY(16) PRIMARY KEY, data LONGBLOB, timestamp TIMESTAMP, FOREIGN KEY (uuid) REFERENCES accounts (uuid) ON DELETE CASCADE ON UPDATE CASCADE)`,
+
+			`CREATE TABLE IF NOT EXISTS sessionSaveData (uuid BINARY(16), slot TINYINT, data LONGBLOB, timestamp TIMESTAMP, PRIMARY KEY (uuid, slot), FOREIGN KEY (uuid) REFERENCES accounts (uuid) ON DELETE CASCADE ON UPDATE CASCADE)`,
+
+			`CREATE TABLE IF NOT EXISTS activeClientSessions (uuid BINARY(16) NOT NULL PRIMARY KEY, clientSessionId VARCHAR(32) NOT NULL, FOREIGN KEY (uuid) REFERENCES accounts (uuid) ON DELETE CASCADE ON UPDATE CASCADE)`,
+		},
+		// there is nothing before the baseline to go back to
+		down: nil,
+	},
+	{
+		version: 2,
+		name:    "save_history",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS systemSaveHistory (id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY, uuid BINARY(16) NOT NULL, data LONGBLOB NOT NULL, saved TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, archived TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, FOREIGN KEY (uuid) REFERENCES accounts (uuid) ON DELETE CASCADE ON UPDATE CASCADE)`,
+			`CREATE INDEX IF NOT EXISTS systemSaveHistoryByUuid ON systemSaveHistory (uuid, id)`,
+
+			`CREATE TABLE IF NOT EXISTS sessionSaveHistory (id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY, uuid BINARY(16) NOT NULL, slot TINYINT NOT NULL, data LONGBLOB NOT NULL, saved TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, archived TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, FOREIGN KEY (uuid) REFERENCES accounts (uuid) ON DELETE CASCADE ON UPDATE CASCADE)`,
+			`CREATE INDEX IF NOT EXISTS sessionSaveHistoryByUuidAndSlot ON sessionSaveHistory (uuid, slot, id)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS sessionSaveHistory`,
+			`DROP TABLE IF EXISTS systemSaveHistory`,
+		},
+	},
+	{
+		version: 3,
+		name:    "session_history",
+		up: []string{
+			// saveTimestamp is the client's timestamp of the finished run, so a
+			// retried clear doesn't record it twice
+			`CREATE TABLE IF NOT EXISTS sessionHistory (id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY, uuid BINARY(16) NOT NULL, seed CHAR(24) CHARACTER SET ascii COLLATE ascii_bin NOT NULL, gameMode INT(11) NOT NULL DEFAULT 0, result TINYINT NOT NULL DEFAULT 0, score INT(11) NOT NULL DEFAULT 0, wave INT(11) NOT NULL DEFAULT 0, playTime INT(11) NOT NULL DEFAULT 0, gameVersion VARCHAR(32) NOT NULL DEFAULT '', saveTimestamp BIGINT NOT NULL DEFAULT 0, data LONGBLOB NOT NULL, timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, UNIQUE KEY sessionHistoryByRun (uuid, seed, saveTimestamp), FOREIGN KEY (uuid) REFERENCES accounts (uuid) ON DELETE CASCADE ON UPDATE CASCADE)`,
+			`CREATE INDEX IF NOT EXISTS sessionHistoryByUuid ON sessionHistory (uuid, id)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS sessionHistory`,
+		},
+	},
+	{
+		version: 4,
+		name:    "speedruns",
+		up: []string{
+			// a seed is cleared once per game mode, the first clear is the one that counts
+			`CREATE TABLE IF NOT EXISTS speedruns (id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY, uuid BINARY(16) NOT NULL, seed CHAR(24) CHARACTER SET ascii COLLATE ascii_bin NOT NULL, gameMode INT(11) NOT NULL DEFAULT 0, challenges VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin NOT NULL DEFAULT '', playTime INT(11) NOT NULL, gameVersion VARCHAR(32) NOT NULL DEFAULT '', timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, UNIQUE KEY speedrunsByRun (uuid, seed, gameMode), FOREIGN KEY (uuid) REFERENCES accounts (uuid) ON DELETE CASCADE ON UPDATE CASCADE)`,
+			`CREATE INDEX IF NOT EXISTS speedrunsByTime ON speedruns (gameMode, challenges, playTime)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS speedruns`,
+		},
+	},
+	{
+		version: 5,
+		name:    "stat_rankings",
+		up: []string{
+			// the accountStats columns ranked by statRankingColumns
+			`CREATE INDEX IF NOT EXISTS accountStatsByHighestEndlessWave ON accountStats (highestEndlessWave)`,
+			`CREATE INDEX IF NOT EXISTS accountStatsBySessionsWon ON accountStats (sessionsWon)`,
+			`CREATE INDEX IF NOT EXISTS accountStatsByPokemonHatched ON accountStats (pokemonHatched)`,
+			`CREATE INDEX IF NOT EXISTS accountStatsByBattles ON accountStats (battles)`,
+		},
+		down: []string{
+			`DROP INDEX IF EXISTS accountStatsByBattles ON accountStats`,
+			`DROP INDEX IF EXISTS accountStatsByPokemonHatched ON accountStats`,
+			`DROP INDEX IF EXISTS accountStatsBySessionsWon ON accountStats`,
+			`DROP INDEX IF EXISTS accountStatsByHighestEndlessWave ON accountStats`,
+		},
+	},
+}
@@ -20,11 +20,13 @@ package db
 import (
 	"bytes"
 	"context"
+	"database/sql"
+	"encoding/base64"
 	"encoding/gob"
 	"encoding/json"
-	"fmt"
-	"log"
-	"os"
+	"errors"
+	"log/slog"
+	"time"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/pagefaultgames/rogueserver/defs"
@@ -32,18 +34,24 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-func TryAddSeedCompletion(uuid []byte, seed string, mode int) (bool, error) {
+func TryAddSeedCompletion(ctx context.Context, uuid []byte, seed string, mode int) (bool, error) {
+	defer observe("TryAddSeedCompletion", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var count int
-	err := handle.QueryRow("SELECT COUNT(*) FROM dailyRunCompletions WHERE uuid = ? AND seed = ?", uuid, seed).Scan(&count)
+	err := handle.QueryRowContext(ctx, "SELECT COUNT(*) FROM dailyRunCompletions WHERE uuid = ? AND seed = ?", uuid, seed).Scan(&count)
 	if err != nil {
 		return false, err
 	} else if count > 0 {
 		return false, nil
 	}
 
-	_, err = handle.Exec("INSERT INTO dailyRunCompletions (uuid, seed, mode, timestamp) VALUES (?, ?, ?, UTC_TIMESTAMP())", uuid, seed, mode)
+	_, err = handle.ExecContext(ctx, "INSERT INTO dailyRunCompletions (uuid, seed, mode, timestamp) VALUES (?, ?, ?, UTC_TIMESTAMP())", uuid, seed, mode)
 	if err != nil {
 		return false, err
 	}
@@ -51,9 +59,14 @@ func TryAddSeedCompletion(uuid []byte, seed string, mode int) (bool, error) {
 	return true, nil
 }
 
-func ReadSeedCompleted(uuid []byte, seed string) (bool, error) {
+func ReadSeedCompleted(ctx context.Context, uuid []byte, seed string) (bool, error) {
+	defer observe("ReadSeedCompleted", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var count int
-	err := handle.QueryRow("SELECT COUNT(*) FROM dailyRunCompletions WHERE uuid = ? AND seed = ?", uuid, seed).Scan(&count)
+	err := handle.QueryRowContext(ctx, "SELECT COUNT(*) FROM dailyRunCompletions WHERE uuid = ? AND seed = ?", uuid, seed).Scan(&count)
 	if err != nil {
 		return false, err
 	}
@@ -61,65 +74,98 @@ func ReadSeedCompleted(uuid []byte, seed string) (bool, error) {
 	return count > 0, nil
 }
 
-func ReadSystemSaveData(uuid []byte) (defs.SystemSaveData, error) {
-	//log.Println("ReadSystemSaveData ", uuid);
+func ReadSystemSaveData(ctx context.Context, uuid []byte) (defs.SystemSaveData, error) {
+	defer observe("ReadSystemSaveData", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	system, err := readSystemSaveData(ctx, handle, uuid)
+	if err != nil {
+		slog.Debug("no system save in the database", "uuid", base64.StdEncoding.EncodeToString(uuid), "error", err)
+	}
+
+	return system, err
+}
+
+func readSystemSaveData(ctx context.Context, q querier, uuid []byte) (defs.SystemSaveData, error) {
 	var system defs.SystemSaveData
 
 	var data []byte
-	err := handle.QueryRow("SELECT data FROM systemSaveData WHERE uuid = ?", uuid).Scan(&data)
+	err := q.QueryRowContext(ctx, "SELECT data FROM systemSaveData WHERE uuid = ?", uuid).Scan(&data)
 	if err != nil {
-		log.Println("Not Find Data")
 		return system, err
 	}
 
-	zr, err := zstd.NewReader(bytes.NewReader(data))
+	err = decodeSave(data, &system)
 	if err != nil {
 		return system, err
 	}
 
-	defer zr.Close()
+	return system, nil
+}
 
-	err = gob.NewDecoder(zr).Decode(&system)
+// decodeSave decodes a stored save blob into v.
+func decodeSave(data []byte, v any) error {
+	zr, err := zstd.NewReader(bytes.NewReader(data))
 	if err != nil {
-		return system, err
+		return err
 	}
 
-	return system, nil
-}
+	defer zr.Close()
 
-func StoreSystemSaveData(uuid []byte, data defs.SystemSaveData) error {
-	log.Println("StoreSystemSaveData ", uuid, data)
+	return gob.NewDecoder(zr).Decode(v)
+}
 
+// encodeSave encodes v the way saves are stored: gob, compressed with zstd.
+func encodeSave(v any) ([]byte, error) {
 	buf := new(bytes.Buffer)
 
 	zw, err := zstd.NewWriter(buf)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	//defer zw.Close()
+	err = gob.NewEncoder(zw).Encode(v)
+	if err != nil {
+		zw.Close()
+		return nil, err
+	}
 
-	err = gob.NewEncoder(zw).Encode(data)
+	err = zw.Close()
 	if err != nil {
-		log.Println("Encoding Error:", err)
-		return err
+		return nil, err
 	}
 
-	zw.Flush()
-	log.Println("✅ Data flushed to buffer!")
+	return buf.Bytes(), nil
+}
 
-	err = zw.Close()
+func StoreSystemSaveData(ctx context.Context, uuid []byte, data defs.SystemSaveData) error {
+	defer observe("StoreSystemSaveData", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	return inTx(ctx, func(tx *sql.Tx) error {
+		return storeSystemSaveData(ctx, tx, uuid, data)
+	})
+}
+
+// storeSystemSaveData replaces the system save, archiving the one it replaces.
+func storeSystemSaveData(ctx context.Context, q querier, uuid []byte, data defs.SystemSaveData) error {
+	blob, err := encodeSave(data)
 	if err != nil {
-		log.Println("❌ Failed to close ZSTD writer:", err)
-	} else {
-		log.Println("✅ ZSTD writer closed successfully")
+		return err
 	}
 
-	log.Println("Compressed Data Length:", len(buf.Bytes()))
-	log.Println("Compressed Data Content:", buf.Bytes())
-	fmt.Println("Origin Data:", data)
+	slog.Debug("storing system save", "uuid", base64.StdEncoding.EncodeToString(uuid), "bytes", len(blob))
 
-	_, err = handle.Exec("REPLACE INTO systemSaveData (uuid, data, timestamp) VALUES (?, ?, UTC_TIMESTAMP())", uuid, buf.Bytes())
+	err = archiveSave(ctx, q, uuid, SystemSlot)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.ExecContext(ctx, "REPLACE INTO systemSaveData (uuid, data, timestamp) VALUES (?, ?, UTC_TIMESTAMP())", uuid, blob)
 	if err != nil {
 		return err
 	}
@@ -127,14 +173,18 @@ func StoreSystemSaveData(uuid []byte, data defs.SystemSaveData) error {
 	return nil
 }
 
-func StoreSystemSaveDataS3(uuid []byte, data defs.SystemSaveData) error {
-	cfg, _ := config.LoadDefaultConfig(context.TODO())
+func StoreSystemSaveDataS3(ctx context.Context, uuid []byte, data defs.SystemSaveData) error {
+	defer observe("StoreSystemSaveDataS3", time.Now())
 
-	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
-		o.BaseEndpoint = aws.String(os.Getenv("AWS_ENDPOINT_URL_S3"))
-	})
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
 
-	username, err := FetchUsernameFromUUID(uuid)
+	client, err := newS3Client(ctx)
+	if err != nil {
+		return err
+	}
+
+	username, err := FetchUsernameFromUUID(ctx, uuid)
 	if err != nil {
 		return err
 	}
@@ -146,8 +196,8 @@ func StoreSystemSaveDataS3(uuid []byte, data defs.SystemSaveData) error {
 		return err
 	}
 
-	_, err = client.PutObject(context.Background(), &s3.PutObjectInput{
-		Bucket: aws.String(os.Getenv("S3_SYSTEM_BUCKET_NAME")),
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s3Bucket),
 		Key:    aws.String(username),
 		Body:   buf,
 	})
@@ -158,33 +208,44 @@ func StoreSystemSaveDataS3(uuid []byte, data defs.SystemSaveData) error {
 	return nil
 }
 
-func DeleteSystemSaveData(uuid []byte) error {
-	_, err := handle.Exec("DELETE FROM systemSaveData WHERE uuid = ?", uuid)
-	if err != nil {
+func DeleteSystemSaveData(ctx context.Context, uuid []byte) error {
+	defer observe("DeleteSystemSaveData", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	return inTx(ctx, func(tx *sql.Tx) error {
+		err := archiveSave(ctx, tx, uuid, SystemSlot)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM systemSaveData WHERE uuid = ?", uuid)
 		return err
-	}
+	})
+}
 
-	return nil
+func ReadSessionSaveData(ctx context.Context, uuid []byte, slot int) (defs.SessionSaveData, error) {
+	defer observe("ReadSessionSaveData", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	return readSessionSaveData(ctx, handle, uuid, slot)
 }
 
-func ReadSessionSaveData(uuid []byte, slot int) (defs.SessionSaveData, error) {
-	log.Println("ReadSessionSaveData", uuid, slot)
+func readSessionSaveData(ctx context.Context, q querier, uuid []byte, slot int) (defs.SessionSaveData, error) {
+	slog.Debug("reading session save", "uuid", base64.StdEncoding.EncodeToString(uuid), "slot", slot)
+
 	var session defs.SessionSaveData
 
 	var data []byte
-	err := handle.QueryRow("SELECT data FROM sessionSaveData WHERE uuid = ? AND slot = ?", uuid, slot).Scan(&data)
+	err := q.QueryRowContext(ctx, "SELECT data FROM sessionSaveData WHERE uuid = ? AND slot = ?", uuid, slot).Scan(&data)
 	if err != nil {
 		return session, err
 	}
 
-	zr, err := zstd.NewReader(bytes.NewReader(data))
-	if err != nil {
-		return session, err
-	}
-
-	defer zr.Close()
-
-	err = gob.NewDecoder(zr).Decode(&session)
+	err = decodeSave(data, &session)
 	if err != nil {
 		return session, err
 	}
@@ -192,10 +253,14 @@ func ReadSessionSaveData(uuid []byte, slot int) (defs.SessionSaveData, error) {
 	return session, nil
 }
 
-func GetLatestSessionSaveDataSlot(uuid []byte) (int, error) {
+func GetLatestSessionSaveDataSlot(ctx context.Context, uuid []byte) (int, error) {
+	defer observe("GetLatestSessionSaveDataSlot", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var slot int
-	log.Printf("getlatestsessionsavedataslot")
-	err := handle.QueryRow("SELECT slot FROM sessionSaveData WHERE uuid = ? ORDER BY timestamp DESC, slot ASC LIMIT 1", uuid).Scan(&slot)
+	err := handle.QueryRowContext(ctx, "SELECT slot FROM sessionSaveData WHERE uuid = ? ORDER BY timestamp DESC, slot ASC LIMIT 1", uuid).Scan(&slot)
 	if err != nil {
 		return -1, err
 	}
@@ -203,25 +268,32 @@ func GetLatestSessionSaveDataSlot(uuid []byte) (int, error) {
 	return slot, nil
 }
 
-func StoreSessionSaveData(uuid []byte, data defs.SessionSaveData, slot int) error {
-	log.Println("StoreSessionSaveData", uuid, data, slot)
-	buf := new(bytes.Buffer)
+func StoreSessionSaveData(ctx context.Context, uuid []byte, data defs.SessionSaveData, slot int) error {
+	defer observe("StoreSessionSaveData", time.Now())
 
-	zw, err := zstd.NewWriter(buf)
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	return inTx(ctx, func(tx *sql.Tx) error {
+		return storeSessionSaveData(ctx, tx, uuid, data, slot)
+	})
+}
+
+// storeSessionSaveData replaces the session save in slot, archiving the one it replaces.
+func storeSessionSaveData(ctx context.Context, q querier, uuid []byte, data defs.SessionSaveData, slot int) error {
+	slog.Debug("storing session save", "uuid", base64.StdEncoding.EncodeToString(uuid), "slot", slot)
+
+	blob, err := encodeSave(data)
 	if err != nil {
 		return err
 	}
 
-	//defer zw.Close()
-
-	err = gob.NewEncoder(zw).Encode(data)
+	err = archiveSave(ctx, q, uuid, slot)
 	if err != nil {
 		return err
 	}
 
-	zw.Close()
-
-	_, err = handle.Exec("REPLACE INTO sessionSaveData (uuid, slot, data, timestamp) VALUES (?, ?, ?, UTC_TIMESTAMP())", uuid, slot, buf.Bytes())
+	_, err = q.ExecContext(ctx, "REPLACE INTO sessionSaveData (uuid, slot, data, timestamp) VALUES (?, ?, ?, UTC_TIMESTAMP())", uuid, slot, blob)
 	if err != nil {
 		return err
 	}
@@ -229,18 +301,31 @@ func StoreSessionSaveData(uuid []byte, data defs.SessionSaveData, slot int) erro
 	return nil
 }
 
-func DeleteSessionSaveData(uuid []byte, slot int) error {
-	_, err := handle.Exec("DELETE FROM sessionSaveData WHERE uuid = ? AND slot = ?", uuid, slot)
-	if err != nil {
-		return err
-	}
+func DeleteSessionSaveData(ctx context.Context, uuid []byte, slot int) error {
+	defer observe("DeleteSessionSaveData", time.Now())
 
-	return nil
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	return inTx(ctx, func(tx *sql.Tx) error {
+		err := archiveSave(ctx, tx, uuid, slot)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, "DELETE FROM sessionSaveData WHERE uuid = ? AND slot = ?", uuid, slot)
+		return err
+	})
 }
 
-func RetrievePlaytime(uuid []byte) (int, error) {
+func RetrievePlaytime(ctx context.Context, uuid []byte) (int, error) {
+	defer observe("RetrievePlaytime", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var playtime int
-	err := handle.QueryRow("SELECT playTime FROM accountStats WHERE uuid = ?", uuid).Scan(&playtime)
+	err := handle.QueryRowContext(ctx, "SELECT playTime FROM accountStats WHERE uuid = ?", uuid).Scan(&playtime)
 	if err != nil {
 		return 0, err
 	}
@@ -248,28 +333,36 @@ func RetrievePlaytime(uuid []byte) (int, error) {
 	return playtime, nil
 }
 
-func GetSystemSaveFromS3(uuid []byte) (defs.SystemSaveData, error) {
+// GetSystemSaveFromS3 reads a system save from S3. A user without one is
+// reported as sql.ErrNoRows, like in the database.
+func GetSystemSaveFromS3(ctx context.Context, uuid []byte) (defs.SystemSaveData, error) {
+	defer observe("GetSystemSaveFromS3", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
 	var system defs.SystemSaveData
 
-	username, err := FetchUsernameFromUUID(uuid)
+	username, err := FetchUsernameFromUUID(ctx, uuid)
 	if err != nil {
 		return system, err
 	}
 
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+	client, err := newS3Client(ctx)
 	if err != nil {
 		return system, err
 	}
 
-	client := s3.NewFromConfig(cfg)
-
 	s3Object := s3.GetObjectInput{
-		Bucket: aws.String(os.Getenv("S3_SYSTEM_BUCKET_NAME")),
+		Bucket: aws.String(s3Bucket),
 		Key:    aws.String(username),
 	}
 
-	resp, err := client.GetObject(context.TODO(), &s3Object)
-	if err != nil {
+	resp, err := client.GetObject(ctx, &s3Object)
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return system, sql.ErrNoRows
+	} else if err != nil {
 		return system, err
 	}
 
@@ -280,3 +373,16 @@ func GetSystemSaveFromS3(uuid []byte) (defs.SystemSaveData, error) {
 
 	return system, nil
 }
+
+func newS3Client(ctx context.Context) (*s3.Client, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if s3Endpoint != "" {
+			o.BaseEndpoint = aws.String(s3Endpoint)
+		}
+	}), nil
+}
@@ -0,0 +1,123 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/defs"
+)
+
+// runsPerPage is the page size of a player's run history.
+const runsPerPage = 10
+
+// AddSessionHistory records a finished run. It reports false if the run was
+// already recorded, e.g. by a retried clear.
+func AddSessionHistory(ctx context.Context, uuid []byte, run defs.SessionHistoryData) (bool, error) {
+	defer observe("AddSessionHistory", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	data, err := encodeSave(run)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := handle.ExecContext(ctx, "INSERT IGNORE INTO sessionHistory (uuid, seed, gameMode, result, score, wave, playTime, gameVersion, saveTimestamp, data, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, UTC_TIMESTAMP())", uuid, run.Seed, run.GameMode, run.Result, run.Score, run.WaveIndex, run.PlayTime, run.GameVersion, run.Timestamp, data)
+	if err != nil {
+		return false, err
+	}
+
+	added, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return added > 0, nil
+}
+
+// FetchSessionHistory returns a page of the runs of uuid, newest first.
+func FetchSessionHistory(ctx context.Context, uuid []byte, page int) ([]defs.SessionHistorySummary, error) {
+	defer observe("FetchSessionHistory", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	runs := []defs.SessionHistorySummary{}
+
+	offset := (page - 1) * runsPerPage
+
+	results, err := handle.QueryContext(ctx, "SELECT id, seed, playTime, result, gameMode, score, wave, gameVersion, saveTimestamp FROM sessionHistory WHERE uuid = ? ORDER BY id DESC LIMIT ? OFFSET ?", uuid, runsPerPage, offset)
+	if err != nil {
+		return runs, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var run defs.SessionHistorySummary
+		err = results.Scan(&run.Id, &run.Seed, &run.PlayTime, &run.Result, &run.GameMode, &run.Score, &run.WaveIndex, &run.GameVersion, &run.Timestamp)
+		if err != nil {
+			return runs, err
+		}
+
+		runs = append(runs, run)
+	}
+
+	return runs, results.Err()
+}
+
+// FetchSessionHistoryPageCount returns how many pages of runs uuid has.
+func FetchSessionHistoryPageCount(ctx context.Context, uuid []byte) (int, error) {
+	defer observe("FetchSessionHistoryPageCount", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var runCount int
+	err := handle.QueryRowContext(ctx, "SELECT COUNT(*) FROM sessionHistory WHERE uuid = ?", uuid).Scan(&runCount)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(math.Ceil(float64(runCount) / runsPerPage)), nil
+}
+
+// FetchSessionHistoryRun returns a run of uuid. A run that doesn't exist or
+// belongs to someone else is reported as sql.ErrNoRows.
+func FetchSessionHistoryRun(ctx context.Context, uuid []byte, id int64) (defs.SessionHistoryData, error) {
+	defer observe("FetchSessionHistoryRun", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	var run defs.SessionHistoryData
+
+	var data []byte
+	err := handle.QueryRowContext(ctx, "SELECT data FROM sessionHistory WHERE id = ? AND uuid = ?", id, uuid).Scan(&data)
+	if err != nil {
+		return run, err
+	}
+
+	err = decodeSave(data, &run)
+
+	return run, err
+}
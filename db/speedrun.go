@@ -0,0 +1,152 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/defs"
+)
+
+// speedrunsPerPage is the page size of a speedrun ranking.
+const speedrunsPerPage = 10
+
+// AddSpeedrun records the completion time of a cleared run. It reports false
+// if uuid already cleared the seed in that game mode.
+func AddSpeedrun(ctx context.Context, uuid []byte, run defs.Speedrun) (bool, error) {
+	defer observe("AddSpeedrun", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	result, err := handle.ExecContext(ctx, "INSERT IGNORE INTO speedruns (uuid, seed, gameMode, challenges, playTime, gameVersion, timestamp) VALUES (?, ?, ?, ?, ?, ?, UTC_TIMESTAMP())", uuid, run.Seed, run.GameMode, run.Challenges, run.PlayTime, run.GameVersion)
+	if err != nil {
+		return false, err
+	}
+
+	added, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return added > 0, nil
+}
+
+// speedrunFilter returns the conditions on speedruns s for a game mode,
+// challenge set and, unless empty, game version.
+func speedrunFilter(gameMode defs.GameMode, challenges, version string) (string, []any) {
+	filter := "s.gameMode = ? AND s.challenges = ?"
+	args := []any{gameMode, challenges}
+	if version != "" {
+		filter += " AND s.gameVersion = ?"
+		args = append(args, version)
+	}
+
+	return filter, args
+}
+
+// FetchSpeedruns returns a page of the fastest clears of a game mode and
+// challenge set, one per player: their personal best.
+func FetchSpeedruns(ctx context.Context, gameMode defs.GameMode, challenges, version string, page int) ([]defs.Speedrun, error) {
+	defer observe("FetchSpeedruns", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	runs := []defs.Speedrun{}
+
+	filter, args := speedrunFilter(gameMode, challenges, version)
+	offset := (page - 1) * speedrunsPerPage
+
+	results, err := handle.QueryContext(ctx, "WITH best AS (SELECT a.username, s.gameMode, s.challenges, s.playTime, s.gameVersion, s.seed, s.timestamp, ROW_NUMBER() OVER (PARTITION BY s.uuid ORDER BY s.playTime, s.timestamp) AS n FROM speedruns s JOIN accounts a ON a.uuid = s.uuid WHERE "+filter+" AND a.banned = 0) SELECT RANK() OVER (ORDER BY playTime), username, gameMode, challenges, playTime, gameVersion, seed, timestamp FROM best WHERE n = 1 ORDER BY playTime, timestamp LIMIT ? OFFSET ?", append(args, speedrunsPerPage, offset)...)
+	if err != nil {
+		return runs, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var run defs.Speedrun
+		err = results.Scan(&run.Rank, &run.Username, &run.GameMode, &run.Challenges, &run.PlayTime, &run.GameVersion, &run.Seed, &run.Timestamp)
+		if err != nil {
+			return runs, err
+		}
+
+		runs = append(runs, run)
+	}
+
+	return runs, results.Err()
+}
+
+// FetchSpeedrunPageCount returns how many pages the speedrun ranking of a
+// game mode and challenge set has.
+func FetchSpeedrunPageCount(ctx context.Context, gameMode defs.GameMode, challenges, version string) (int, error) {
+	defer observe("FetchSpeedrunPageCount", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	filter, args := speedrunFilter(gameMode, challenges, version)
+
+	var playerCount int
+	err := handle.QueryRowContext(ctx, "SELECT COUNT(DISTINCT s.uuid) FROM speedruns s JOIN accounts a ON a.uuid = s.uuid WHERE "+filter+" AND a.banned = 0", args...).Scan(&playerCount)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(math.Ceil(float64(playerCount) / speedrunsPerPage)), nil
+}
+
+// FetchPersonalBests returns the fastest clear of uuid in every game mode and
+// challenge set it cleared, on version if it isn't empty.
+func FetchPersonalBests(ctx context.Context, uuid []byte, version string) ([]defs.Speedrun, error) {
+	defer observe("FetchPersonalBests", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	runs := []defs.Speedrun{}
+
+	filter := "s.uuid = ?"
+	args := []any{uuid}
+	if version != "" {
+		filter += " AND s.gameVersion = ?"
+		args = append(args, version)
+	}
+
+	results, err := handle.QueryContext(ctx, "SELECT gameMode, challenges, playTime, gameVersion, seed, timestamp FROM (SELECT s.gameMode, s.challenges, s.playTime, s.gameVersion, s.seed, s.timestamp, ROW_NUMBER() OVER (PARTITION BY s.gameMode, s.challenges ORDER BY s.playTime, s.timestamp) AS n FROM speedruns s WHERE "+filter+") best WHERE n = 1 ORDER BY gameMode, challenges", args...)
+	if err != nil {
+		return runs, err
+	}
+
+	defer results.Close()
+
+	for results.Next() {
+		var run defs.Speedrun
+		err = results.Scan(&run.GameMode, &run.Challenges, &run.PlayTime, &run.GameVersion, &run.Seed, &run.Timestamp)
+		if err != nil {
+			return runs, err
+		}
+
+		runs = append(runs, run)
+	}
+
+	return runs, results.Err()
+}
@@ -0,0 +1,221 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/defs"
+)
+
+// UseS3 reports whether system saves are kept in S3 instead of the database.
+func UseS3() bool {
+	return s3Bucket != ""
+}
+
+// lockAccount locks the account row for the rest of tx. Every validated save
+// update takes this lock first, so they run one after the other per account.
+func lockAccount(ctx context.Context, tx *sql.Tx, uuid []byte) error {
+	var locked int
+	return tx.QueryRowContext(ctx, "SELECT 1 FROM accounts WHERE uuid = ? FOR UPDATE", uuid).Scan(&locked)
+}
+
+// currentSystemSaveData reads the system save an update replaces, from S3 when
+// it is used.
+func currentSystemSaveData(ctx context.Context, tx *sql.Tx, uuid []byte) (defs.SystemSaveData, error) {
+	if UseS3() {
+		return GetSystemSaveFromS3(ctx, uuid)
+	}
+
+	return readSystemSaveData(ctx, tx, uuid)
+}
+
+// storeSystemSave writes the system save as part of tx. S3 uploads can't take
+// part in the transaction; they happen while tx still holds the account lock,
+// and a failed upload rolls the rest back.
+func storeSystemSave(ctx context.Context, tx *sql.Tx, uuid []byte, data defs.SystemSaveData) error {
+	if UseS3() {
+		return StoreSystemSaveDataS3(ctx, uuid, data)
+	}
+
+	return storeSystemSaveData(ctx, tx, uuid, data)
+}
+
+// UpdateSystemSaveData stores a system save if validate accepts the one it
+// replaces (nil if there is none), atomically per account.
+func UpdateSystemSaveData(ctx context.Context, uuid []byte, data defs.SystemSaveData, validate func(current *defs.SystemSaveData) error) error {
+	defer observe("UpdateSystemSaveData", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	tx, err := handle.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = lockAccount(ctx, tx, uuid)
+	if err != nil {
+		return err
+	}
+
+	var current *defs.SystemSaveData
+	system, err := currentSystemSaveData(ctx, tx, uuid)
+	if err == nil {
+		current = &system
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	err = validate(current)
+	if err != nil {
+		return err
+	}
+
+	err = storeSystemSave(ctx, tx, uuid, data)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdateSessionSaveData stores a session save if validate accepts the one it
+// replaces (nil for an empty slot), atomically per account.
+func UpdateSessionSaveData(ctx context.Context, uuid []byte, data defs.SessionSaveData, slot int, validate func(current *defs.SessionSaveData) error) error {
+	defer observe("UpdateSessionSaveData", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	tx, err := handle.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = lockAccount(ctx, tx, uuid)
+	if err != nil {
+		return err
+	}
+
+	var current *defs.SessionSaveData
+	session, err := readSessionSaveData(ctx, tx, uuid, slot)
+	if err == nil {
+		current = &session
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	err = validate(current)
+	if err != nil {
+		return err
+	}
+
+	err = storeSessionSaveData(ctx, tx, uuid, data, slot)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdateAll validates and stores a session and the system save in one
+// transaction. The account row is locked first, so concurrent updates for the
+// same account run one after the other and each validates against the state
+// the previous one left behind.
+func UpdateAll(ctx context.Context, uuid []byte, update defs.SaveUpdate, validate func(defs.SaveSnapshot) error) error {
+	defer observe("UpdateAll", time.Now())
+
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	tx, err := handle.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var snapshot defs.SaveSnapshot
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(trainerId, 0), COALESCE(secretId, 0) FROM accounts WHERE uuid = ? FOR UPDATE", uuid).Scan(&snapshot.TrainerId, &snapshot.SecretId)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, "SELECT clientSessionId FROM activeClientSessions WHERE uuid = ?", uuid).Scan(&snapshot.ActiveClientSession)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	err = tx.QueryRowContext(ctx, "SELECT playTime FROM accountStats WHERE uuid = ?", uuid).Scan(&snapshot.PlayTime)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	session, err := readSessionSaveData(ctx, tx, uuid, update.Slot)
+	if err == nil {
+		snapshot.Session = &session
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	system, err := currentSystemSaveData(ctx, tx, uuid)
+	if err == nil {
+		snapshot.SystemRevision = system.Revision
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if validate != nil {
+		err = validate(snapshot)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO activeClientSessions (uuid, clientSessionId) VALUES (?, ?) ON DUPLICATE KEY UPDATE clientSessionId = ?", uuid, update.ClientSessionId, update.ClientSessionId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE accounts SET trainerId = ?, secretId = ?, lastActivity = UTC_TIMESTAMP() WHERE uuid = ?", update.System.TrainerId, update.System.SecretId, uuid)
+	if err != nil {
+		return err
+	}
+
+	err = updateAccountStats(ctx, tx, uuid, update.System.GameStats, update.System.VoucherCounts)
+	if err != nil {
+		return err
+	}
+
+	err = storeSessionSaveData(ctx, tx, uuid, update.Session, update.Slot)
+	if err != nil {
+		return err
+	}
+
+	err = storeSystemSave(ctx, tx, uuid, update.System)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
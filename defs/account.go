@@ -2,6 +2,7 @@ package defs
 
 import (
 	"database/sql"
+	"log/slog"
 	"time"
 )
 
@@ -21,6 +22,12 @@ type AccountDBRow struct {
 	GoogleID     sql.NullString // varchar(32), NULLable
 }
 
+// SessionTokenRow is a login token from the sessions table.
+type SessionTokenRow struct {
+	Token  []byte    // binary(32)
+	Expire time.Time // timestamp
+}
+
 type AccountStatsData struct {
 	UUID                  []byte `db:"uuid"` // DB에서 읽어올 때 []byte, 실제 사용 시 문자열로 변환 가능
 	PlayTime              int    `db:"playTime"`
@@ -74,3 +81,19 @@ type AccountStatsRedisData struct {
 	PremiumVouchers       int `json:"premiumVouchers"`
 	GoldenVouchers        int `json:"goldenVouchers"`
 }
+
+// LogValue keeps the password hash and salt out of logs.
+func (a AccountDBRow) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("username", a.Username),
+		slog.Bool("banned", a.Banned),
+	)
+}
+
+// LogValue keeps the password hash and salt out of logs.
+func (a AccountRedisData) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("username", a.Username),
+		slog.Bool("banned", a.Banned),
+	)
+}
@@ -17,9 +17,55 @@
 
 package defs
 
+import "time"
+
 type DailyRanking struct {
 	Rank     int    `json:"rank"`
 	Username string `json:"username"`
 	Score    int    `json:"score"`
 	Wave     int    `json:"wave"`
 }
+
+// periods of the rankings of a RankingCategory
+const (
+	RankingPeriodDay   = "day"
+	RankingPeriodWeek  = "week"
+	RankingPeriodMonth = "month"
+)
+
+// RankingCategory is a category of rankings. The date of a request picks the
+// period it is ranked by, if it has one; otherwise it is ranked over all time.
+type RankingCategory struct {
+	Id          int    `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Period      string `json:"period,omitempty"`
+}
+
+// PersonalRanking is where a player stands in a ranking, with the players
+// right above and below them.
+type PersonalRanking struct {
+	DailyRanking
+	Players    int            `json:"players"`
+	Percentile float64        `json:"percentile"` // share of players ranked at or below, 0-100
+	Above      []DailyRanking `json:"above"`      // best first
+	Below      []DailyRanking `json:"below"`      // best first
+}
+
+// DailyRunHistory is a past daily run with how many played it and who won.
+type DailyRunHistory struct {
+	Date         string        `json:"date"`
+	Seed         string        `json:"seed"`
+	Participants int           `json:"participants"`
+	Winner       *DailyRanking `json:"winner"` // nil if nobody played
+}
+
+// LeaderboardEntry is a player's score on a leaderboard, before it is ranked.
+type LeaderboardEntry struct {
+	Username string
+	Score    int
+	Wave     int
+
+	// when the score was reached; on equal scores the earlier one ranks higher
+	Timestamp time.Time
+}
@@ -17,6 +17,8 @@
 
 package defs
 
+import "time"
+
 const SessionSlotCount = 5
 
 type SystemSaveData struct {
@@ -37,6 +39,10 @@ type SystemSaveData struct {
 	UnlockPity         []int              `json:"unlockPity"`
 	GameVersion        string             `json:"gameVersion"`
 	Timestamp          int                `json:"timestamp"`
+
+	// Revision is bumped by the server on every update; clients send back
+	// the revision they last saw
+	Revision int `json:"revision"`
 }
 
 type DexData map[int]DexEntry
@@ -117,6 +123,9 @@ type SessionSaveData struct {
 	Challenges               []ChallengeData          `json:"challenges"`
 	MysteryEncounterType     MysteryEncounterType     `json:"mysteryEncounterType"`
 	MysteryEncounterSaveData MysteryEncounterSaveData `json:"mysteryEncounterSaveData"`
+
+	// Revision counts updates of this slot, see SystemSaveData.Revision
+	Revision int `json:"revision"`
 }
 
 type ChallengeData struct {
@@ -177,3 +186,54 @@ type SessionHistoryData struct {
 }
 
 type SessionHistoryResult int
+
+const (
+	SessionHistoryActive SessionHistoryResult = iota
+	SessionHistoryWin
+	SessionHistoryLoss
+)
+
+// SessionHistorySummary is a run in a page of run history, without the party
+// and modifiers.
+type SessionHistorySummary struct {
+	Id          int64                `json:"id"`
+	Seed        string               `json:"seed"`
+	PlayTime    int                  `json:"playTime"`
+	Result      SessionHistoryResult `json:"sessionHistoryResult"`
+	GameMode    GameMode             `json:"gameMode"`
+	Score       int                  `json:"score"`
+	WaveIndex   int                  `json:"waveIndex"`
+	GameVersion string               `json:"gameVersion"`
+	Timestamp   int                  `json:"timestamp"`
+}
+
+// Speedrun is the completion time of a cleared run, as a place in a speedrun
+// ranking or as a personal best.
+type Speedrun struct {
+	Rank        int       `json:"rank,omitempty"`
+	Username    string    `json:"username,omitempty"`
+	GameMode    GameMode  `json:"gameMode"`
+	Challenges  string    `json:"challenges"` // "<id>:<value>" of each active challenge, by id, comma separated
+	PlayTime    int       `json:"playTime"`
+	GameVersion string    `json:"gameVersion"`
+	Seed        string    `json:"seed"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// SaveSnapshot is the stored state a combined save update is validated against.
+type SaveSnapshot struct {
+	ActiveClientSession string
+	TrainerId           int
+	SecretId            int
+	PlayTime            int
+	SystemRevision      int
+	Session             *SessionSaveData // nil when the slot is empty
+}
+
+// SaveUpdate is a session and a system save written together.
+type SaveUpdate struct {
+	ClientSessionId string
+	Slot            int
+	Session         SessionSaveData
+	System          SystemSaveData
+}
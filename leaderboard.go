@@ -0,0 +1,81 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/api/daily"
+	"github.com/pagefaultgames/rogueserver/cache"
+)
+
+// runLeaderboard implements `rogueserver leaderboard rebuild`: it builds the
+// leaderboards of every category for a day from the database, replacing what
+// the cache has. Failures exit 2.
+func runLeaderboard(args []string) int {
+	flags := flag.NewFlagSet("leaderboard", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: rogueserver [flags] leaderboard rebuild [-date YYYY-MM-DD]")
+		flags.PrintDefaults()
+	}
+	dateFlag := flags.String("date", "", "rebuild the boards of this day, today (UTC) if empty")
+	timeout := flags.Duration("timeout", 10*time.Minute, "give up after this long")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || flags.Arg(0) != "rebuild" {
+		flags.Usage()
+		return 2
+	}
+
+	date := time.Now().UTC()
+	if *dateFlag != "" {
+		var err error
+		date, err = time.Parse(time.DateOnly, *dateFlag)
+		if err != nil {
+			slog.Error("invalid date", "date", *dateFlag, "error", err)
+			return 2
+		}
+	}
+
+	if !cache.Enabled() {
+		slog.Error("leaderboards are kept in the cache, but the cache strategy uses none")
+		return 2
+	}
+
+	if !cache.Available() {
+		slog.Error("cache is unavailable")
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	err := daily.RebuildLeaderboards(ctx, date)
+	if err != nil {
+		slog.Error("failed to rebuild leaderboards", "date", date.Format(time.DateOnly), "error", err)
+		return 2
+	}
+
+	slog.Info("rebuilt leaderboards", "date", date.Format(time.DateOnly))
+
+	return 0
+}
@@ -0,0 +1,185 @@
+package logging
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Init installs the default slog logger. level is debug, info, warn or error
+// and format is text or json. Output of the standard log package goes
+// through the same logger at info level.
+func Init(level, format string) error {
+	var lvl slog.Level
+	err := lvl.UnmarshalText([]byte(level))
+	if err != nil {
+		return fmt.Errorf("invalid log level: %s", level)
+	}
+
+	handler, err := newHandler(os.Stderr, lvl, format)
+	if err != nil {
+		return err
+	}
+
+	slog.SetDefault(slog.New(handler))
+
+	return nil
+}
+
+func newHandler(w io.Writer, level slog.Level, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redact,
+	}
+
+	switch format {
+	case "", "text":
+		return contextHandler{handler: slog.NewTextHandler(w, opts)}, nil
+	case "json":
+		return contextHandler{handler: slog.NewJSONHandler(w, opts)}, nil
+	default:
+		return nil, fmt.Errorf("invalid log format: %s", format)
+	}
+}
+
+// redacted attribute keys, compared in lower case
+var secretKeys = map[string]bool{
+	"token":         true,
+	"authorization": true,
+	"password":      true,
+	"hash":          true,
+	"salt":          true,
+	"secret":        true,
+}
+
+const redactedValue = "[REDACTED]"
+
+// redact blanks attributes whose key names a credential, wherever they appear.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if secretKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redactedValue)
+	}
+
+	return a
+}
+
+// requestInfo is what a request carries into its log records. The uuid is
+// only known once the token has been checked, so it is filled in later.
+type requestInfo struct {
+	mu   sync.Mutex
+	id   string
+	uuid string
+}
+
+type requestInfoKey struct{}
+
+// WithRequest returns a context whose log records carry the request id.
+func WithRequest(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, &requestInfo{id: id})
+}
+
+// SetUUID adds the uuid of the authenticated user to the log records of the
+// request ctx belongs to.
+func SetUUID(ctx context.Context, uuid []byte) {
+	info, ok := ctx.Value(requestInfoKey{}).(*requestInfo)
+	if !ok {
+		return
+	}
+
+	info.mu.Lock()
+	info.uuid = base64.StdEncoding.EncodeToString(uuid)
+	info.mu.Unlock()
+}
+
+// RequestID returns the id of the request ctx belongs to.
+func RequestID(ctx context.Context) string {
+	info, ok := ctx.Value(requestInfoKey{}).(*requestInfo)
+	if !ok {
+		return ""
+	}
+
+	return info.id
+}
+
+// contextHandler adds the request id and uuid of the context to each record,
+// at the top level so they stay easy to search for even in grouped loggers.
+// Groups and the attrs given inside them are therefore applied here, to the
+// attrs of the record only, rather than by the wrapped handler.
+type contextHandler struct {
+	handler slog.Handler
+	groups  []logGroup
+}
+
+// logGroup is a group opened with WithGroup and the attrs added within it.
+type logGroup struct {
+	name  string
+	attrs []slog.Attr
+}
+
+func (h contextHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if len(h.groups) > 0 {
+		r = h.nest(r)
+	}
+
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		info.mu.Lock()
+		id, uuid := info.id, info.uuid
+		info.mu.Unlock()
+
+		r.AddAttrs(slog.String("request_id", id))
+		if uuid != "" {
+			r.AddAttrs(slog.String("uuid", uuid))
+		}
+	}
+
+	return h.handler.Handle(ctx, r)
+}
+
+// nest returns r with its attrs inside the open groups.
+func (h contextHandler) nest(r slog.Record) slog.Record {
+	var attrs []slog.Attr
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+
+	for i := len(h.groups) - 1; i >= 0; i-- {
+		g := h.groups[i]
+		attrs = []slog.Attr{{Key: g.name, Value: slog.GroupValue(append(slices.Clip(g.attrs), attrs...)...)}}
+	}
+
+	nested := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	nested.AddAttrs(attrs...)
+
+	return nested
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(h.groups) == 0 {
+		return contextHandler{handler: h.handler.WithAttrs(attrs)}
+	}
+
+	groups := slices.Clone(h.groups)
+	last := &groups[len(groups)-1]
+	last.attrs = append(slices.Clip(last.attrs), attrs...)
+
+	return contextHandler{h.handler, groups}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	return contextHandler{h.handler, append(slices.Clip(h.groups), logGroup{name: name})}
+}
@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestContextHandlerGroups(t *testing.T) {
+	ctx := WithRequest(context.Background(), "req-1")
+	SetUUID(ctx, []byte{1, 2, 3})
+
+	tests := []struct {
+		name   string
+		logger func(*slog.Logger) *slog.Logger
+		want   string
+	}{
+		{
+			name:   "no group",
+			logger: func(l *slog.Logger) *slog.Logger { return l.With("a", 1) },
+			want:   `{"a":1,"k":"v","request_id":"req-1","uuid":"AQID"}`,
+		},
+		{
+			name:   "group",
+			logger: func(l *slog.Logger) *slog.Logger { return l.WithGroup("g") },
+			want:   `{"g":{"k":"v"},"request_id":"req-1","uuid":"AQID"}`,
+		},
+		{
+			name: "attrs around groups",
+			logger: func(l *slog.Logger) *slog.Logger {
+				return l.With("a", 1).WithGroup("g").With("b", 2).WithGroup("h")
+			},
+			want: `{"a":1,"g":{"b":2,"h":{"k":"v"}},"request_id":"req-1","uuid":"AQID"}`,
+		},
+		{
+			name:   "secrets in groups",
+			logger: func(l *slog.Logger) *slog.Logger { return l.WithGroup("g").With("token", "abc") },
+			want:   `{"g":{"k":"v","token":"[REDACTED]"},"request_id":"req-1","uuid":"AQID"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			handler, err := newHandler(&buf, slog.LevelInfo, "json")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.logger(slog.New(handler)).InfoContext(ctx, "msg", "k", "v")
+
+			var record map[string]any
+			err = json.Unmarshal(buf.Bytes(), &record)
+			if err != nil {
+				t.Fatalf("invalid record %q: %s", buf.String(), err)
+			}
+			delete(record, "time")
+			delete(record, "level")
+			delete(record, "msg")
+
+			got, _ := json.Marshal(record)
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
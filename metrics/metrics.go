@@ -6,21 +6,238 @@ import (
 )
 
 var (
-    CacheHits = prometheus.NewCounter(
+    CacheHits = prometheus.NewCounterVec(
         prometheus.CounterOpts{
             Namespace: "pokerogue",           // 프로젝트명 네임스페이스
             Subsystem: "session_cache",
             Name:      "hits_total",
             Help:      "Number of Redis session cache hits",
         },
+        []string{"backend", "operation"},
     )
-    CacheMisses = prometheus.NewCounter(
+    CacheMisses = prometheus.NewCounterVec(
         prometheus.CounterOpts{
             Namespace: "pokerogue",
             Subsystem: "session_cache",
             Name:      "misses_total",
             Help:      "Number of Redis session cache misses",
         },
+        []string{"backend", "operation"},
+    )
+    CacheErrors = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "pokerogue",
+            Subsystem: "session_cache",
+            Name:      "errors_total",
+            Help:      "Number of failed session cache operations, misses excluded",
+        },
+        []string{"backend", "operation"},
+    )
+    CacheDuration = prometheus.NewHistogramVec(
+        prometheus.HistogramOpts{
+            Namespace: "pokerogue",
+            Subsystem: "session_cache",
+            Name:      "operation_duration_seconds",
+            Help:      "Time spent in session cache operations",
+            Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+        },
+        []string{"backend", "operation"},
+    )
+
+    // http
+    HTTPRequests = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "pokerogue",
+            Subsystem: "http",
+            Name:      "requests_total",
+            Help:      "Number of handled requests by route pattern and status code",
+        },
+        []string{"route", "code"},
+    )
+    HTTPDuration = prometheus.NewHistogramVec(
+        prometheus.HistogramOpts{
+            Namespace: "pokerogue",
+            Subsystem: "http",
+            Name:      "request_duration_seconds",
+            Help:      "Time spent handling requests by route pattern",
+            Buckets:   prometheus.DefBuckets,
+        },
+        []string{"route"},
+    )
+    HTTPResponseSize = prometheus.NewHistogramVec(
+        prometheus.HistogramOpts{
+            Namespace: "pokerogue",
+            Subsystem: "http",
+            Name:      "response_size_bytes",
+            Help:      "Size of response bodies by route pattern",
+            Buckets:   prometheus.ExponentialBuckets(64, 4, 8),
+        },
+        []string{"route"},
+    )
+
+    // database
+    DBQueryDuration = prometheus.NewHistogramVec(
+        prometheus.HistogramOpts{
+            Namespace: "pokerogue",
+            Subsystem: "db",
+            Name:      "query_duration_seconds",
+            Help:      "Time spent in each database query function",
+            Buckets:   prometheus.DefBuckets,
+        },
+        []string{"function"},
+    )
+
+    // caching strategy
+    StorageStrategy = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "pokerogue",
+            Subsystem: "storage",
+            Name:      "strategy",
+            Help:      "Active caching strategy, set to 1 for the strategy in use",
+        },
+        []string{"strategy"},
+    )
+    StorageDuration = prometheus.NewHistogramVec(
+        prometheus.HistogramOpts{
+            Namespace: "pokerogue",
+            Subsystem: "storage",
+            Name:      "operation_duration_seconds",
+            Help:      "Time spent in save, stats, token and active session operations",
+            Buckets:   prometheus.DefBuckets,
+        },
+        []string{"strategy", "operation"},
+    )
+    StorageErrors = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "pokerogue",
+            Subsystem: "storage",
+            Name:      "errors_total",
+            Help:      "Number of failed save, stats, token and active session operations",
+        },
+        []string{"strategy", "operation"},
+    )
+
+    // write-back flusher
+    CacheDirtyUsers = prometheus.NewGauge(
+        prometheus.GaugeOpts{
+            Namespace: "pokerogue",
+            Subsystem: "cache_flush",
+            Name:      "dirty_users",
+            Help:      "Number of user documents waiting to be written back to the database",
+        },
+    )
+    CacheFlushLag = prometheus.NewGauge(
+        prometheus.GaugeOpts{
+            Namespace: "pokerogue",
+            Subsystem: "cache_flush",
+            Name:      "lag_seconds",
+            Help:      "Age of the oldest unflushed user document",
+        },
+    )
+    CacheFlushDelay = prometheus.NewHistogram(
+        prometheus.HistogramOpts{
+            Namespace: "pokerogue",
+            Subsystem: "cache_flush",
+            Name:      "delay_seconds",
+            Help:      "Time between a user document becoming dirty and being persisted",
+            Buckets:   []float64{1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+        },
+    )
+    CacheFlushedUsers = prometheus.NewCounter(
+        prometheus.CounterOpts{
+            Namespace: "pokerogue",
+            Subsystem: "cache_flush",
+            Name:      "flushed_total",
+            Help:      "Number of user documents written back to the database",
+        },
+    )
+    CacheFlushFailures = prometheus.NewCounter(
+        prometheus.CounterOpts{
+            Namespace: "pokerogue",
+            Subsystem: "cache_flush",
+            Name:      "failures_total",
+            Help:      "Number of failed write-back attempts",
+        },
+    )
+
+    // idle eviction
+    CacheEvictedUsers = prometheus.NewCounter(
+        prometheus.CounterOpts{
+            Namespace: "pokerogue",
+            Subsystem: "session_cache",
+            Name:      "evicted_total",
+            Help:      "Number of idle user documents evicted from the cache",
+        },
+    )
+
+    // cache warm-up
+    CacheWarmupRunning = prometheus.NewGauge(
+        prometheus.GaugeOpts{
+            Namespace: "pokerogue",
+            Subsystem: "cache_warmup",
+            Name:      "running",
+            Help:      "Set to 1 while a cache warm-up is in progress",
+        },
+    )
+    CacheWarmupTarget = prometheus.NewGauge(
+        prometheus.GaugeOpts{
+            Namespace: "pokerogue",
+            Subsystem: "cache_warmup",
+            Name:      "target_accounts",
+            Help:      "Number of accounts selected by the current or last warm-up",
+        },
+    )
+    CacheWarmupProcessed = prometheus.NewGauge(
+        prometheus.GaugeOpts{
+            Namespace: "pokerogue",
+            Subsystem: "cache_warmup",
+            Name:      "processed_accounts",
+            Help:      "Number of accounts the current or last warm-up has gone through",
+        },
+    )
+    CacheWarmupAccounts = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+            Namespace: "pokerogue",
+            Subsystem: "cache_warmup",
+            Name:      "accounts_total",
+            Help:      "Number of accounts warmed up, by whether they were loaded, already cached or failed",
+        },
+        []string{"result"},
+    )
+    CacheWarmupTokens = prometheus.NewCounter(
+        prometheus.CounterOpts{
+            Namespace: "pokerogue",
+            Subsystem: "cache_warmup",
+            Name:      "tokens_total",
+            Help:      "Number of live session tokens preloaded into the cache",
+        },
+    )
+
+    // circuit breaker
+    CacheBreakerState = prometheus.NewGaugeVec(
+        prometheus.GaugeOpts{
+            Namespace: "pokerogue",
+            Subsystem: "cache_breaker",
+            Name:      "state",
+            Help:      "Circuit breaker state of the cache, set to 1 for the current state",
+        },
+        []string{"state"},
+    )
+    CacheBreakerTrips = prometheus.NewCounter(
+        prometheus.CounterOpts{
+            Namespace: "pokerogue",
+            Subsystem: "cache_breaker",
+            Name:      "trips_total",
+            Help:      "Number of times the cache was found unavailable and bypassed",
+        },
+    )
+    CacheBreakerStaleUsers = prometheus.NewGauge(
+        prometheus.GaugeOpts{
+            Namespace: "pokerogue",
+            Subsystem: "cache_breaker",
+            Name:      "stale_users",
+            Help:      "Users written to the database while the cache was bypassed, waiting for reconciliation",
+        },
     )
 )
 
@@ -28,5 +245,28 @@ func init() {
     // 애플리케이션 구동 시 자동으로 메트릭을 등록
     prometheus.MustRegister(CacheHits)
     prometheus.MustRegister(CacheMisses)
+    prometheus.MustRegister(CacheErrors)
+    prometheus.MustRegister(CacheDuration)
+    prometheus.MustRegister(DBQueryDuration)
+    prometheus.MustRegister(HTTPRequests)
+    prometheus.MustRegister(HTTPDuration)
+    prometheus.MustRegister(HTTPResponseSize)
+    prometheus.MustRegister(StorageStrategy)
+    prometheus.MustRegister(StorageDuration)
+    prometheus.MustRegister(StorageErrors)
+    prometheus.MustRegister(CacheDirtyUsers)
+    prometheus.MustRegister(CacheFlushLag)
+    prometheus.MustRegister(CacheFlushDelay)
+    prometheus.MustRegister(CacheFlushedUsers)
+    prometheus.MustRegister(CacheFlushFailures)
+    prometheus.MustRegister(CacheEvictedUsers)
+    prometheus.MustRegister(CacheWarmupRunning)
+    prometheus.MustRegister(CacheWarmupTarget)
+    prometheus.MustRegister(CacheWarmupProcessed)
+    prometheus.MustRegister(CacheWarmupAccounts)
+    prometheus.MustRegister(CacheWarmupTokens)
+    prometheus.MustRegister(CacheBreakerState)
+    prometheus.MustRegister(CacheBreakerTrips)
+    prometheus.MustRegister(CacheBreakerStaleUsers)
 }
 
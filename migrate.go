@@ -0,0 +1,112 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/config"
+	"github.com/pagefaultgames/rogueserver/db"
+)
+
+// runMigrate implements `rogueserver migrate up|down|status`: up applies the
+// pending schema migrations, down reverts the latest one and status lists
+// them. The exit status of status is 1 when the schema isn't up to date,
+// other failures exit 2.
+func runMigrate(args []string, cfg config.Config) int {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: rogueserver [flags] migrate up|down|status")
+		flags.PrintDefaults()
+	}
+	timeout := flags.Duration("timeout", 30*time.Minute, "give up after this long")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	err := db.Open(cfg.DB, cfg.S3)
+	if err != nil {
+		slog.Error("failed to open database", "error", err)
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	switch flags.Arg(0) {
+	case "up":
+		count, err := db.MigrateUp(ctx)
+		if err != nil {
+			slog.Error("failed to apply migrations", "error", err)
+			return 2
+		}
+
+		slog.Info("applied migrations", "count", count)
+	case "down":
+		version, err := db.MigrateDown(ctx)
+		if err != nil {
+			slog.Error("failed to revert migration", "error", err)
+			return 2
+		}
+
+		if version == 0 {
+			slog.Info("no migrations to revert")
+		} else {
+			slog.Info("reverted migration", "version", version)
+		}
+	case "status":
+		list, err := db.Migrations(ctx)
+		if err != nil {
+			slog.Error("failed to read migrations", "error", err)
+			return 2
+		}
+
+		status := 0
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATE\tAPPLIED")
+		for _, m := range list {
+			applied := "-"
+			if m.AppliedAt != nil {
+				applied = m.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			if m.State != db.MigrationApplied {
+				status = 1
+			}
+
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", m.Version, m.Name, m.State, applied)
+		}
+		w.Flush()
+
+		return status
+	default:
+		flags.Usage()
+		return 2
+	}
+
+	return 0
+}
@@ -18,103 +18,274 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/bwmarrin/discordgo"
 	"github.com/pagefaultgames/rogueserver/api"
-	"github.com/pagefaultgames/rogueserver/api/account"
-	"github.com/pagefaultgames/rogueserver/db"
 	"github.com/pagefaultgames/rogueserver/cache"
+	"github.com/pagefaultgames/rogueserver/config"
+	"github.com/pagefaultgames/rogueserver/db"
+	"github.com/pagefaultgames/rogueserver/logging"
+	"github.com/pagefaultgames/rogueserver/storage"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
-	// env stuff
-	debug, _ := strconv.ParseBool(os.Getenv("debug"))
-
-	proto := getEnv("proto", "tcp")
-	addr := getEnv("addr", "0.0.0.0:8001")
-	tlscert := getEnv("tlscert", "")
-	tlskey := getEnv("tlskey", "")
-
-	dbuser := getEnv("dbuser", "pokerogue")
-	dbpass := getEnv("dbpass", "pokerogue")
-	dbproto := getEnv("dbproto", "tcp")
-	dbaddr := getEnv("dbaddr", "localhost")
-	dbname := getEnv("dbname", "pokeroguedb")
-
-	discordclientid := getEnv("discordclientid", "")
-	discordsecretid := getEnv("discordsecretid", "")
+	// docker health check, the image has no shell or curl
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(runHealthcheck(os.Args[2:]))
+	}
 
-	googleclientid := getEnv("googleclientid", "")
-	googlesecretid := getEnv("googlesecretid", "")
+	// settings from the config file, env and flags
+	cfg, args, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	callbackurl := getEnv("callbackurl", "http://localhost:8001/")
+	err = logging.Init(cfg.Log.Level, cfg.Log.Format)
+	if err != nil {
+		fatal("failed to set up logging", err)
+	}
 
-	gameurl := getEnv("gameurl", "https://pokerogue.net")
+	// no command serves the api
+	command := ""
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
 
-	discordbottoken := getEnv("discordbottoken", "")
-	discordguildid := getEnv("discordguildid", "")
+	switch command {
+	case "":
+	case "config":
+		// print the effective configuration, secrets masked
+		err = cfg.Dump(os.Stdout)
+		if err != nil {
+			fatal("failed to print configuration", err)
+		}
 
-	account.GameURL = gameurl
+		return
+	case "check", "leaderboard":
+	case "migrate":
+		// schema changes need neither the cache nor a schema check
+		os.Exit(runMigrate(args, cfg))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q, want check, config, leaderboard or migrate\n", command)
+		os.Exit(2)
+	}
 
-	account.DiscordClientID = discordclientid
-	account.DiscordClientSecret = discordsecretid
-	account.DiscordCallbackURL = callbackurl + "/auth/discord/callback"
+	cacheStrategy, err := storage.ParseStrategy(cfg.Cache.Strategy)
+	if err != nil {
+		fatal("invalid cache strategy", err)
+	}
 
-	account.GoogleClientID = googleclientid
-	account.GoogleClientSecret = googlesecretid
-	account.GoogleCallbackURL = callbackurl + "/auth/google/callback"
-	account.DiscordSession, _ = discordgo.New("Bot " + discordbottoken)
-	account.DiscordGuildID = discordguildid
+	shutdownTimeout := cfg.Server.ShutdownTimeout
 
 	// register gob types
 	gob.Register([]interface{}{})
 	gob.Register(map[string]interface{}{})
-	
-	//redis setting
-	if err := cache.Init(); err != nil {
-		log.Fatalf("failed to connect redis: %v", err)
+
+	// cache setting, not needed when everything goes to the database
+	if cacheStrategy != storage.None {
+		if err := cache.Init(cfg.Cache); err != nil {
+			fatal("failed to initialize cache", err, "backend", cfg.Cache.Backend)
+		}
+		slog.Info("cache initialized", "backend", cfg.Cache.Backend, "available", cache.Available())
 	}
-	log.Println("Redis connected")
 
 	// get database connection
-	err := db.Init(dbuser, dbpass, dbproto, dbaddr, dbname)
+	err = db.Init(cfg.DB, cfg.S3)
 	if err != nil {
-		log.Fatalf("failed to initialize database: %s", err)
+		fatal("failed to initialize database", err)
+	}
+
+	if command == "check" {
+		os.Exit(runCheck(args, cacheStrategy))
+	}
+
+	if command == "leaderboard" {
+		os.Exit(runLeaderboard(args))
+	}
+
+	if cacheStrategy == storage.WriteBack {
+		// write dirty cache documents back to the database
+		cache.StartFlusher()
+	} else if cacheStrategy != storage.None {
+		// persist whatever an earlier write-back run left behind before the
+		// cache starts being invalidated under a different strategy
+		drainCache(shutdownTimeout)
+	}
+
+	err = storage.Init(cacheStrategy)
+	if err != nil {
+		fatal("failed to initialize storage", err)
+	}
+	slog.Info("storage initialized", "cache_strategy", cacheStrategy)
+
+	if cache.Enabled() {
+		// evict user documents nobody has used for a while
+		cache.StartSweeper()
+
+		// preload recently active players so they don't all miss after a cache restart
+		if cfg.Cache.WarmupAccounts > 0 {
+			err = cache.StartWarmup(cfg.Cache.WarmupAccounts)
+			if err != nil {
+				slog.Error("failed to start cache warm-up", "error", err)
+			}
+		}
 	}
 
 	// create listener
-	listener, err := createListener(proto, addr)
+	listener, err := createListener(cfg.Server.Proto, cfg.Server.Addr)
 	if err != nil {
-		log.Fatalf("failed to create net listener: %s", err)
+		fatal("failed to create net listener", err)
 	}
 
 	mux := http.NewServeMux()
 
 	// init api
-	if err := api.Init(mux); err != nil {
-		log.Fatal(err)
+	if err := api.Init(mux, cfg.API); err != nil {
+		fatal("failed to initialize api", err)
+	}
+
+	var metricsServer *http.Server
+	if cfg.Server.MetricsAddr == "" {
+		mux.Handle("GET /metrics", promhttp.Handler())
+	} else {
+		metricsServer, err = serveMetrics(cfg.Server.MetricsAddr)
+		if err != nil {
+			fatal("failed to create metrics listener", err)
+		}
 	}
 
 	// start web server
-	handler := prodHandler(mux, gameurl)
-	if debug {
+	handler := prodHandler(mux, cfg.API.GameURL)
+	if cfg.Server.Debug {
 		handler = debugHandler(mux)
 	}
 
-	if tlscert == "" {
-		err = http.Serve(listener, handler)
-	} else {
-		err = http.ServeTLS(listener, handler, tlscert, tlskey)
+	// deadline for the cache and database calls of each request
+	handler = api.Timeout(handler, cfg.Server.RequestTimeout)
+
+	// per-route metrics, access log and request ids
+	handler = api.Instrument(mux, handler)
+
+	server := &http.Server{Handler: handler}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		if cfg.Server.TLSCert == "" {
+			serverErr <- server.Serve(listener)
+		} else {
+			serverErr <- server.ServeTLS(listener, cfg.Server.TLSCert, cfg.Server.TLSKey)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	select {
+	case err = <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("failed to create http server or server errored", "error", err)
+		}
+	case <-ctx.Done():
+		slog.Info("received shutdown signal")
+	}
+
+	shutdown(server, metricsServer, shutdownTimeout)
+}
+
+// shutdown drains the http server, stops background jobs and writes every
+// dirty cache document back to the database before the deadline.
+func shutdown(server, metricsServer *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// keep metrics scrapeable until everything else has stopped
+	if metricsServer != nil {
+		defer metricsServer.Close()
 	}
+
+	slog.Info("shutting down", "deadline", timeout)
+
+	// report not ready while in-flight requests drain
+	api.SetShuttingDown()
+
+	// stop accepting requests and wait for in-flight handlers
+	err := server.Shutdown(ctx)
 	if err != nil {
-		log.Fatalf("failed to create http server or server errored: %s", err)
+		slog.Error("failed to drain http server", "error", err)
 	}
+
+	api.Shutdown(ctx)
+
+	if !cache.Enabled() {
+		return
+	}
+
+	cache.StopWarmup()
+	cache.StopSweeper()
+	cache.StopFlusher()
+	flushCache(ctx)
+}
+
+// drainCache writes back every dirty cache document left over from a
+// previous write-back run.
+func drainCache(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	flushCache(ctx)
+}
+
+func flushCache(ctx context.Context) {
+	unflushed, err := cache.FlushAll(ctx)
+	if err != nil {
+		slog.Error("failed to flush cache", "error", err)
+	}
+
+	if len(unflushed) > 0 {
+		slog.Error("user documents could not be persisted", "users", len(unflushed), "uuids", strings.Join(unflushed, ", "))
+		return
+	}
+
+	slog.Info("all cache documents persisted")
+}
+
+// serveMetrics serves /metrics on a listener of its own at addr.
+func serveMetrics(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+
+	server := &http.Server{Handler: mux}
+	go func() {
+		err := server.Serve(listener)
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics server errored", "error", err)
+		}
+	}()
+
+	slog.Info("serving metrics", "addr", addr)
+
+	return server, nil
 }
 
 func createListener(proto, addr string) (net.Listener, error) {
@@ -167,10 +338,8 @@ func debugHandler(router *http.ServeMux) http.Handler {
 	})
 }
 
-func getEnv(key string, defaultValue string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
-	}
-
-	return defaultValue
+// fatal logs err and exits.
+func fatal(msg string, err error, args ...any) {
+	slog.Error(msg, append(args, "error", err)...)
+	os.Exit(1)
 }
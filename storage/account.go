@@ -0,0 +1,214 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/cache"
+	"github.com/pagefaultgames/rogueserver/db"
+	"github.com/pagefaultgames/rogueserver/defs"
+)
+
+// AddSessionToken records a new login token. Tokens are always written to the
+// sessions table first so a lost cache never logs anyone out.
+func AddSessionToken(ctx context.Context, username string, uuid, token []byte) error {
+	start := time.Now()
+
+	err := addSessionToken(ctx, username, uuid, token)
+	observe("add_token", start, err)
+
+	return err
+}
+
+func addSessionToken(ctx context.Context, username string, uuid, token []byte) error {
+	err := db.AddAccountSession(ctx, username, token)
+	if err != nil {
+		return err
+	}
+
+	if strategy == None || !cache.Available() {
+		return nil
+	}
+
+	err = cache.StoreSessionToken(ctx, uuid, token)
+	if degraded(err) {
+		// the token is read from the database until the cache is back
+		return nil
+	}
+
+	return err
+}
+
+// FetchUUIDFromToken resolves a session token. An unknown token is reported as sql.ErrNoRows.
+func FetchUUIDFromToken(ctx context.Context, token []byte) ([]byte, error) {
+	return read(ctx, "fetch_token",
+		func() ([]byte, error) { return cache.FetchSessionToken(ctx, token) },
+		func() ([]byte, error) { return db.FetchUUIDFromToken(ctx, token) },
+		func(uuid []byte) error { return cache.StoreSessionToken(ctx, uuid, token) },
+	)
+}
+
+// RemoveSessionToken removes a token from the database and the cache. While
+// the cache is unavailable it is removed from the cache once it is back.
+func RemoveSessionToken(ctx context.Context, token []byte) error {
+	start := time.Now()
+
+	err := removeSessionToken(ctx, token)
+	observe("remove_token", start, err)
+
+	return err
+}
+
+func removeSessionToken(ctx context.Context, token []byte) error {
+	if strategy == None {
+		return db.RemoveSessionFromToken(ctx, token)
+	}
+
+	if !cache.Available() {
+		bypassed, err := cache.BypassTokenRemoval(token, func() error { return db.RemoveSessionFromToken(ctx, token) })
+		if bypassed {
+			return err
+		}
+	}
+
+	err := db.RemoveSessionFromToken(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	// the token is gone from the database, don't leave it usable in the cache
+	err = cache.RemoveSessionFromToken(context.WithoutCancel(ctx), token)
+	if degraded(err) {
+		bypassed, _ := cache.BypassTokenRemoval(token, nil)
+		if bypassed {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// IsActiveSession reports whether sessionId is the client session allowed to
+// write saves. If no client session is recorded, sessionId becomes the active one.
+func IsActiveSession(ctx context.Context, uuid []byte, sessionId string) (bool, error) {
+	id, err := read(ctx, "fetch_active_session",
+		func() (string, error) { return cache.FetchActiveSession(ctx, uuid) },
+		func() (string, error) { return db.FetchActiveSession(ctx, uuid) },
+		func(id string) error { return cache.UpdateActiveSession(ctx, uuid, id) },
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = UpdateActiveSession(ctx, uuid, sessionId)
+			if err != nil {
+				return false, err
+			}
+
+			return true, nil
+		}
+
+		return false, err
+	}
+
+	return id == "" || id == sessionId, nil
+}
+
+func UpdateActiveSession(ctx context.Context, uuid []byte, sessionId string) error {
+	return write(ctx, "update_active_session",
+		func() error { return db.UpdateActiveSession(ctx, uuid, sessionId) },
+		func() error { return cache.UpdateActiveSession(ctx, uuid, sessionId) },
+		uuid, cache.PartActiveSession,
+	)
+}
+
+type trainerIds struct {
+	trainerId, secretId int
+}
+
+func FetchTrainerIds(ctx context.Context, uuid []byte) (int, int, error) {
+	ids, err := read(ctx, "fetch_trainer_ids",
+		func() (trainerIds, error) {
+			trainerId, secretId, err := cache.FetchTrainerIds(ctx, uuid)
+			return trainerIds{trainerId, secretId}, err
+		},
+		func() (trainerIds, error) {
+			trainerId, secretId, err := db.FetchTrainerIds(ctx, uuid)
+			return trainerIds{trainerId, secretId}, err
+		},
+		func(trainerIds) error { return fillAccount(ctx, uuid) },
+	)
+
+	return ids.trainerId, ids.secretId, err
+}
+
+func UpdateTrainerIds(ctx context.Context, trainerId, secretId int, uuid []byte) error {
+	return write(ctx, "update_trainer_ids",
+		func() error { return db.UpdateTrainerIds(ctx, trainerId, secretId, uuid) },
+		func() error { return cache.UpdateTrainerIds(ctx, trainerId, secretId, uuid) },
+		uuid, cache.PartAccount,
+	)
+}
+
+func UpdateAccountLastActivity(ctx context.Context, uuid []byte) error {
+	return write(ctx, "update_last_activity",
+		func() error { return db.UpdateAccountLastActivity(ctx, uuid) },
+		func() error { return cache.UpdateAccountLastActivity(ctx, uuid) },
+		uuid, cache.PartAccount,
+	)
+}
+
+func UpdateAccountStats(ctx context.Context, uuid []byte, stats defs.GameStats, voucherCounts map[string]int) error {
+	return write(ctx, "update_stats",
+		func() error { return db.UpdateAccountStats(ctx, uuid, stats, voucherCounts) },
+		func() error { return cache.UpdateAccountStats(ctx, uuid, stats, voucherCounts) },
+		uuid, cache.PartStats,
+	)
+}
+
+// RetrievePlaytime returns the stored play time. A user without stats is reported as sql.ErrNoRows.
+func RetrievePlaytime(ctx context.Context, uuid []byte) (int, error) {
+	return read(ctx, "fetch_playtime",
+		func() (int, error) { return cache.RetrievePlaytime(ctx, uuid) },
+		func() (int, error) { return db.RetrievePlaytime(ctx, uuid) },
+		func(int) error { return fillAccountStats(ctx, uuid) },
+	)
+}
+
+// fillAccount caches the whole account row; the cache has no partial account.
+func fillAccount(ctx context.Context, uuid []byte) error {
+	row, err := db.GetAccountFromDB(ctx, uuid)
+	if err != nil {
+		return fmt.Errorf("failed to read account: %w", err)
+	}
+
+	return cache.CacheAccount(ctx, row)
+}
+
+// fillAccountStats caches the whole stats row; the cache has no partial stats.
+func fillAccountStats(ctx context.Context, uuid []byte) error {
+	stats, err := db.GetAccountStatsFromDB(ctx, uuid)
+	if err != nil {
+		return fmt.Errorf("failed to read account stats: %w", err)
+	}
+
+	return cache.CacheAccountStats(ctx, uuid, stats)
+}
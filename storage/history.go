@@ -0,0 +1,225 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+
+	"github.com/pagefaultgames/rogueserver/cache"
+	"github.com/pagefaultgames/rogueserver/db"
+)
+
+// CurrentVersion stands for the current save where a history version is expected.
+const CurrentVersion = 0
+
+// SaveChange is a single value that differs between two versions of a save.
+type SaveChange struct {
+	Path string `json:"path"`
+	From any    `json:"from"`
+	To   any    `json:"to"`
+}
+
+// SaveHistory lists the archived versions of the save in slot, or of the
+// system save for db.SystemSlot, newest first.
+func SaveHistory(ctx context.Context, uuid []byte, slot int) ([]db.SaveVersion, error) {
+	return db.SaveHistory(ctx, uuid, slot)
+}
+
+// readSaveVersion returns a version of the save in slot as generic JSON. The
+// current version is read like the player would, so it includes changes the
+// flusher hasn't written back yet.
+func readSaveVersion(ctx context.Context, uuid []byte, slot int, id int64) (any, error) {
+	var save any
+	var err error
+
+	switch {
+	case slot == db.SystemSlot && id == CurrentVersion:
+		save, err = ReadSystemSaveData(ctx, uuid)
+	case slot == db.SystemSlot:
+		save, err = db.ReadSystemSaveVersion(ctx, uuid, id)
+	case id == CurrentVersion:
+		save, err = ReadSessionSaveData(ctx, uuid, slot)
+	default:
+		save, err = db.ReadSessionSaveVersion(ctx, uuid, slot, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := json.Marshal(save)
+	if err != nil {
+		return nil, err
+	}
+
+	var generic any
+	err = json.Unmarshal(raw, &generic)
+
+	return generic, err
+}
+
+// DiffSaveVersions lists what changed in the save in slot from one version to
+// another. Either may be CurrentVersion. A missing version, or a missing
+// current save, is reported as sql.ErrNoRows.
+func DiffSaveVersions(ctx context.Context, uuid []byte, slot int, from, to int64) ([]SaveChange, error) {
+	a, err := readSaveVersion(ctx, uuid, slot, from)
+	if err != nil {
+		return nil, fmt.Errorf("version %d: %w", from, err)
+	}
+
+	b, err := readSaveVersion(ctx, uuid, slot, to)
+	if err != nil {
+		return nil, fmt.Errorf("version %d: %w", to, err)
+	}
+
+	changes := []SaveChange{}
+	diffSaves("$", a, b, &changes)
+
+	return changes, nil
+}
+
+// diffSaves appends a SaveChange for every leaf that differs between two
+// generic JSON values.
+func diffSaves(path string, from, to any, out *[]SaveChange) {
+	switch f := from.(type) {
+	case map[string]any:
+		t, ok := to.(map[string]any)
+		if !ok {
+			break
+		}
+
+		keys := make([]string, 0, len(f)+len(t))
+		for key := range f {
+			keys = append(keys, key)
+		}
+		for key := range t {
+			if _, ok := f[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			diffSaves(path+"."+key, f[key], t[key], out)
+		}
+		return
+	case []any:
+		t, ok := to.([]any)
+		if !ok {
+			break
+		}
+
+		for i := range max(len(f), len(t)) {
+			var fi, ti any
+			if i < len(f) {
+				fi = f[i]
+			}
+			if i < len(t) {
+				ti = t[i]
+			}
+
+			diffSaves(fmt.Sprintf("%s[%d]", path, i), fi, ti, out)
+		}
+		return
+	}
+
+	rawFrom, errFrom := json.Marshal(from)
+	rawTo, errTo := json.Marshal(to)
+	if errFrom != nil || errTo != nil || string(rawFrom) != string(rawTo) {
+		*out = append(*out, SaveChange{Path: path, From: from, To: to})
+	}
+}
+
+// RestoreSaveVersion makes an archived version the current save in slot, in
+// the database and the cached user document. The save it replaces is archived
+// first, including changes the flusher hadn't written back, which are dropped
+// from the cache. An unknown version is reported as sql.ErrNoRows.
+func RestoreSaveVersion(ctx context.Context, uuid []byte, slot int, id int64) error {
+	part := cache.PartSystem
+	if slot != db.SystemSlot {
+		part = cache.PartSession(slot)
+	}
+
+	if strategy == WriteBack && cache.Available() {
+		err := persistPending(ctx, uuid, slot, part)
+		if err != nil {
+			return fmt.Errorf("failed to archive the current save: %w", err)
+		}
+	}
+
+	err := write(ctx, "restore_save",
+		func() error { return db.RestoreSaveVersion(ctx, uuid, slot, id) },
+		nil,
+		uuid, part,
+	)
+	if err != nil {
+		return err
+	}
+
+	if strategy == None || !cache.Available() {
+		return nil
+	}
+
+	// load the restored save into the cached document now rather than on the
+	// next read
+	if slot == db.SystemSlot {
+		_, err = ReadSystemSaveData(ctx, uuid)
+	} else {
+		_, err = ReadSessionSaveData(ctx, uuid, slot)
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "failed to cache restored save", "slot", slot, "error", err)
+	}
+
+	return nil
+}
+
+// persistPending writes a cached save with changes the flusher hasn't written
+// back to the database, which archives the version it replaces there.
+func persistPending(ctx context.Context, uuid []byte, slot int, part string) error {
+	pending, err := cache.PendingParts(ctx, uuid)
+	if err != nil || !slices.Contains(pending, part) {
+		return err
+	}
+
+	if slot == db.SystemSlot {
+		system, err := cache.ReadSystemSaveData(ctx, uuid)
+		if errors.Is(err, cache.ErrMiss) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		return db.StoreSystemSaveData(ctx, uuid, system)
+	}
+
+	session, err := cache.ReadSessionSaveData(ctx, uuid, slot)
+	if errors.Is(err, cache.ErrMiss) || errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return db.StoreSessionSaveData(ctx, uuid, session, slot)
+}
@@ -0,0 +1,105 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDiffSaves(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		want     []SaveChange
+	}{
+		{
+			name: "equal",
+			from: `{"a":1,"b":[1,2],"c":{"d":"x"}}`,
+			to:   `{"c":{"d":"x"},"b":[1,2],"a":1}`,
+			want: []SaveChange{},
+		},
+		{
+			name: "nested maps",
+			from: `{"gameStats":{"playTime":10,"battles":{"won":1,"lost":2}}}`,
+			to:   `{"gameStats":{"playTime":20,"battles":{"won":1,"lost":3}}}`,
+			want: []SaveChange{
+				{Path: "$.gameStats.battles.lost", From: 2.0, To: 3.0},
+				{Path: "$.gameStats.playTime", From: 10.0, To: 20.0},
+			},
+		},
+		{
+			name: "added and removed keys",
+			from: `{"a":1,"b":{"c":true}}`,
+			to:   `{"b":{"d":"x"},"e":null}`,
+			want: []SaveChange{
+				{Path: "$.a", From: 1.0, To: nil},
+				{Path: "$.b.c", From: true, To: nil},
+				{Path: "$.b.d", From: nil, To: "x"},
+			},
+		},
+		{
+			// an added element is one change, not one per leaf
+			name: "longer array",
+			from: `{"party":[{"id":1}]}`,
+			to:   `{"party":[{"id":1},{"id":2}]}`,
+			want: []SaveChange{
+				{Path: "$.party[1]", From: nil, To: map[string]any{"id": 2.0}},
+			},
+		},
+		{
+			name: "shorter array",
+			from: `{"party":[1,2,3]}`,
+			to:   `{"party":[1]}`,
+			want: []SaveChange{
+				{Path: "$.party[1]", From: 2.0, To: nil},
+				{Path: "$.party[2]", From: 3.0, To: nil},
+			},
+		},
+		{
+			name: "different types",
+			from: `{"a":{"b":1},"c":[1],"d":"1"}`,
+			to:   `{"a":[1],"c":{"b":1},"d":1}`,
+			want: []SaveChange{
+				{Path: "$.a", From: map[string]any{"b": 1.0}, To: []any{1.0}},
+				{Path: "$.c", From: []any{1.0}, To: map[string]any{"b": 1.0}},
+				{Path: "$.d", From: "1", To: 1.0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var from, to any
+			if err := json.Unmarshal([]byte(tt.from), &from); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.to), &to); err != nil {
+				t.Fatal(err)
+			}
+
+			changes := []SaveChange{}
+			diffSaves("$", from, to, &changes)
+
+			if !reflect.DeepEqual(changes, tt.want) {
+				t.Errorf("changes %+v, want %+v", changes, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/pagefaultgames/rogueserver/cache"
+	"github.com/pagefaultgames/rogueserver/db"
+	"github.com/pagefaultgames/rogueserver/defs"
+)
+
+// ReadSessionSaveData returns the session save in slot. An empty slot is reported as sql.ErrNoRows.
+func ReadSessionSaveData(ctx context.Context, uuid []byte, slot int) (defs.SessionSaveData, error) {
+	return read(ctx, "read_session",
+		func() (defs.SessionSaveData, error) { return cache.ReadSessionSaveData(ctx, uuid, slot) },
+		func() (defs.SessionSaveData, error) { return db.ReadSessionSaveData(ctx, uuid, slot) },
+		func(session defs.SessionSaveData) error { return cache.StoreSessionSaveData(ctx, uuid, session, slot) },
+	)
+}
+
+func StoreSessionSaveData(ctx context.Context, uuid []byte, data defs.SessionSaveData, slot int) error {
+	return write(ctx, "store_session",
+		func() error { return db.StoreSessionSaveData(ctx, uuid, data, slot) },
+		func() error { return cache.StoreSessionSaveData(ctx, uuid, data, slot) },
+		uuid, cache.PartSession(slot),
+	)
+}
+
+// UpdateSessionSaveData stores a session save if validate accepts the one it
+// replaces (nil for an empty slot). The check and the write are atomic per
+// account: in the cache for write-back, in a database transaction otherwise.
+func UpdateSessionSaveData(ctx context.Context, uuid []byte, data defs.SessionSaveData, slot int, validate func(current *defs.SessionSaveData) error) error {
+	return write(ctx, "update_session",
+		func() error { return db.UpdateSessionSaveData(ctx, uuid, data, slot, validate) },
+		func() error {
+			if strategy != WriteBack {
+				// already validated by the database transaction
+				return cache.StoreSessionSaveData(ctx, uuid, data, slot)
+			}
+
+			err := prime(func() error { _, err := ReadSessionSaveData(ctx, uuid, slot); return err })
+			if err != nil {
+				return err
+			}
+
+			return cache.UpdateSessionSaveData(ctx, uuid, data, slot, validate)
+		},
+		uuid, cache.PartSession(slot),
+	)
+}
+
+func DeleteSessionSaveData(ctx context.Context, uuid []byte, slot int) error {
+	return write(ctx, "delete_session",
+		func() error { return db.DeleteSessionSaveData(ctx, uuid, slot) },
+		func() error { return cache.DeleteSessionSaveData(ctx, uuid, slot) },
+		uuid, cache.PartSession(slot),
+	)
+}
+
+// ReadSystemSaveData returns the system save. A user without one is reported
+// as sql.ErrNoRows.
+func ReadSystemSaveData(ctx context.Context, uuid []byte) (defs.SystemSaveData, error) {
+	return read(ctx, "read_system",
+		func() (defs.SystemSaveData, error) { return cache.ReadSystemSaveData(ctx, uuid) },
+		func() (defs.SystemSaveData, error) {
+			if db.UseS3() {
+				return db.GetSystemSaveFromS3(ctx, uuid)
+			}
+
+			return db.ReadSystemSaveData(ctx, uuid)
+		},
+		func(system defs.SystemSaveData) error { return cache.StoreSystemSaveData(ctx, uuid, system) },
+	)
+}
+
+func StoreSystemSaveData(ctx context.Context, uuid []byte, data defs.SystemSaveData) error {
+	return write(ctx, "store_system",
+		func() error {
+			if db.UseS3() {
+				return db.StoreSystemSaveDataS3(ctx, uuid, data)
+			}
+
+			return db.StoreSystemSaveData(ctx, uuid, data)
+		},
+		func() error { return cache.StoreSystemSaveData(ctx, uuid, data) },
+		uuid, cache.PartSystem,
+	)
+}
+
+// UpdateSystemSaveData stores a system save if validate accepts the one it
+// replaces (nil if there is none), atomically per account like UpdateSessionSaveData.
+func UpdateSystemSaveData(ctx context.Context, uuid []byte, data defs.SystemSaveData, validate func(current *defs.SystemSaveData) error) error {
+	return write(ctx, "update_system",
+		func() error { return db.UpdateSystemSaveData(ctx, uuid, data, validate) },
+		func() error {
+			if strategy != WriteBack {
+				// already validated by the database transaction
+				return cache.StoreSystemSaveData(ctx, uuid, data)
+			}
+
+			err := prime(func() error { _, err := ReadSystemSaveData(ctx, uuid); return err })
+			if err != nil {
+				return err
+			}
+
+			return cache.UpdateSystemSaveData(ctx, uuid, data, validate)
+		},
+		uuid, cache.PartSystem,
+	)
+}
+
+// DeleteSystemSaveData deletes the system save from the database and drops
+// it from the cache. The write-back flusher has no way to express a deleted
+// system save, so this is never deferred.
+func DeleteSystemSaveData(ctx context.Context, uuid []byte) error {
+	return write(ctx, "delete_system",
+		func() error { return db.DeleteSystemSaveData(ctx, uuid) },
+		nil,
+		uuid, cache.PartSystem,
+	)
+}
+
+// UpdateAll validates a combined session and system save against the stored
+// state and writes both, atomically per account: in the cache for write-back,
+// in one database transaction otherwise. validate sees the state the update
+// is applied to, so two concurrent updates can never both pass on stale data.
+func UpdateAll(ctx context.Context, uuid []byte, update defs.SaveUpdate, validate func(defs.SaveSnapshot) error) error {
+	return write(ctx, "update_all",
+		func() error { return db.UpdateAll(ctx, uuid, update, validate) },
+		func() error {
+			if strategy != WriteBack {
+				// already validated by the database transaction
+				return cache.UpdateAll(ctx, uuid, update, nil)
+			}
+
+			err := prime(
+				func() error { _, err := ReadSessionSaveData(ctx, uuid, update.Slot); return err },
+				func() error { _, err := ReadSystemSaveData(ctx, uuid); return err },
+			)
+			if err != nil {
+				return err
+			}
+
+			return cache.UpdateAll(ctx, uuid, update, validate)
+		},
+		uuid, cache.PartActiveSession, cache.PartAccount, cache.PartStats, cache.PartSystem, cache.PartSession(update.Slot),
+	)
+}
+
+// prime runs reads that fill parts of the cached user document a validated
+// write-back update is about to check, so it doesn't validate against a part
+// that simply wasn't cached yet. Parts that don't exist anywhere are fine.
+func prime(reads ...func() error) error {
+	for _, read := range reads {
+		err := read()
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+/*
+	Copyright (C) 2024  Pagefault Games
+
+	This program is free software: you can redistribute it and/or modify
+	it under the terms of the GNU Affero General Public License as published by
+	the Free Software Foundation, either version 3 of the License, or
+	(at your option) any later version.
+
+	This program is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU Affero General Public License for more details.
+
+	You should have received a copy of the GNU Affero General Public License
+	along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package storage routes save, stats, token and active session operations
+// between the cache and the database according to the caching strategy.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/pagefaultgames/rogueserver/cache"
+	"github.com/pagefaultgames/rogueserver/metrics"
+)
+
+type Strategy string
+
+const (
+	// None reads and writes the database only.
+	None Strategy = "none"
+	// CacheAside reads the cache first and fills it on a miss; writes go to
+	// the database and invalidate the cached copy.
+	CacheAside Strategy = "cache-aside"
+	// WriteThrough reads like CacheAside; writes go to the database, then the cache.
+	WriteThrough Strategy = "write-through"
+	// WriteBack reads and writes the cache; the flusher persists changes later.
+	WriteBack Strategy = "write-back"
+)
+
+var strategy = WriteBack
+
+// ErrConflict is returned when an atomic update kept losing to concurrent
+// updates of the same account.
+var ErrConflict = cache.ErrConflict
+
+// ParseStrategy validates a cachestrategy setting.
+func ParseStrategy(s string) (Strategy, error) {
+	switch Strategy(s) {
+	case None, CacheAside, WriteThrough, WriteBack:
+		return Strategy(s), nil
+	}
+
+	return "", fmt.Errorf("unknown cache strategy %q (want none, cache-aside, write-through or write-back)", s)
+}
+
+// Init selects the caching strategy. Every strategy but None needs cache.Init first.
+func Init(s Strategy) error {
+	if s != None && !cache.Enabled() {
+		return fmt.Errorf("cache strategy %s needs a cache backend", s)
+	}
+
+	strategy = s
+
+	if cache.Enabled() {
+		cache.SetWriteBack(s == WriteBack)
+	}
+
+	metrics.StorageStrategy.Reset()
+	metrics.StorageStrategy.WithLabelValues(string(s)).Set(1)
+
+	return nil
+}
+
+// Current returns the active caching strategy.
+func Current() Strategy {
+	return strategy
+}
+
+func observe(operation string, start time.Time, err error) {
+	metrics.StorageDuration.WithLabelValues(string(strategy), operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.StorageErrors.WithLabelValues(string(strategy), operation).Inc()
+	}
+}
+
+// read looks in the cache first and falls back to the database on a miss,
+// filling the cache with what it found. fill may be nil.
+func read[T any](ctx context.Context, operation string, fromCache func() (T, error), fromDB func() (T, error), fill func(T) error) (T, error) {
+	start := time.Now()
+
+	v, err := readThrough(ctx, operation, fromCache, fromDB, fill)
+	observe(operation, start, err)
+
+	return v, err
+}
+
+func readThrough[T any](ctx context.Context, operation string, fromCache func() (T, error), fromDB func() (T, error), fill func(T) error) (T, error) {
+	if strategy == None || !cache.Available() {
+		return fromDB()
+	}
+
+	v, err := fromCache()
+	if err == nil {
+		return v, nil
+	}
+
+	// the caller gave up, don't bother the database
+	if ctx.Err() != nil {
+		return v, err
+	}
+
+	if !errors.Is(err, cache.ErrMiss) {
+		// with write-back the database may be behind the cache, so only a
+		// miss or an outage that tripped the breaker can fall back
+		if strategy == WriteBack && !degraded(err) {
+			return v, err
+		}
+
+		slog.Warn("cache read failed, using database", "operation", operation, "error", err)
+	}
+
+	v, err = fromDB()
+	if err != nil {
+		return v, err
+	}
+
+	if fill != nil && cache.Available() {
+		err = fill(v)
+		if err != nil {
+			slog.Warn("failed to fill cache", "operation", operation, "error", err)
+		}
+	}
+
+	return v, nil
+}
+
+// write applies a change according to the strategy. parts name what the
+// change touches in the cached user document, for invalidation. A nil toCache
+// means the change has no cache-side equivalent and is always written to the
+// database, then invalidated.
+func write(ctx context.Context, operation string, toDB func() error, toCache func() error, uuid []byte, parts ...string) error {
+	start := time.Now()
+
+	err := writeThrough(ctx, toDB, toCache, uuid, parts...)
+	observe(operation, start, err)
+
+	return err
+}
+
+// While the cache is unavailable every strategy writes the database only and
+// the touched parts are invalidated once the cache is back. Under write-back
+// that means changes the flusher hadn't persisted before the outage are lost
+// for those parts: the database copy, which the player was served in the
+// meantime, wins.
+func writeThrough(ctx context.Context, toDB func() error, toCache func() error, uuid []byte, parts ...string) error {
+	s := strategy
+	if toCache == nil && s != None {
+		s = CacheAside
+	}
+
+	if s == None {
+		return toDB()
+	}
+
+	if !cache.Available() {
+		bypassed, err := cache.Bypass(toDB, uuid, parts...)
+		if bypassed {
+			return err
+		}
+	}
+
+	switch s {
+	case CacheAside:
+		err := toDB()
+		if err != nil {
+			return err
+		}
+
+		return invalidate(ctx, uuid, parts...)
+	case WriteThrough:
+		err := toDB()
+		if err != nil {
+			return err
+		}
+
+		err = toCache()
+		if err != nil {
+			// the database has the change, make sure the cache doesn't serve the old value
+			slog.Warn("failed to write through to cache, invalidating", "error", err)
+			return invalidate(ctx, uuid, parts...)
+		}
+
+		return nil
+	default:
+		err := toCache()
+		if degraded(err) {
+			bypassed, dbErr := cache.Bypass(toDB, uuid, parts...)
+			if bypassed {
+				return dbErr
+			}
+		}
+
+		return err
+	}
+}
+
+// invalidate drops parts the database has a newer version of from the cache,
+// or has them dropped once the cache is back if it just went away.
+func invalidate(ctx context.Context, uuid []byte, parts ...string) error {
+	// the database already has the change, the caller giving up now must not
+	// leave the old value cached
+	err := cache.Invalidate(context.WithoutCancel(ctx), uuid, parts...)
+	if degraded(err) {
+		bypassed, _ := cache.Bypass(nil, uuid, parts...)
+		if bypassed {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// degraded reports whether a cache call failed because the cache became
+// unavailable, as opposed to a single failed call.
+func degraded(err error) bool {
+	return cache.IsUnavailable(err) && !cache.Available()
+}
+
+// EnsureCached makes sure the user document for uuid is cached before
+// handlers use it. It does nothing without a cache or while the cache is
+// unavailable.
+func EnsureCached(ctx context.Context, uuid []byte) error {
+	if strategy == None || !cache.Available() {
+		return nil
+	}
+
+	start := time.Now()
+
+	err := cache.EnsureCacheData(ctx, uuid)
+	if degraded(err) {
+		err = nil
+	}
+	observe("ensure_cached", start, err)
+
+	return err
+}